@@ -3,16 +3,24 @@ module github.com/rchapin/go-in-mem-datastore
 go 1.18
 
 require (
-	github.com/linkedin/goavro v2.1.0+incompatible
+	github.com/golang/snappy v0.0.3
+	github.com/linkedin/goavro/v2 v2.12.0
 	github.com/rchapin/rlog v1.0.0
 	github.com/stretchr/testify v1.7.5
-	github.com/linkedin/goavro/v2 v2.12.0
+	github.com/vmihailenco/msgpack/v5 v5.3.5
+	github.com/xitongsys/parquet-go v1.6.2
+	github.com/xitongsys/parquet-go-source v0.0.0-20200817004010-026bad9b25d0
+	google.golang.org/protobuf v1.31.0
 )
 
 require (
+	github.com/apache/arrow/go/arrow v0.0.0-20200730104253-651201b0f516 // indirect
+	github.com/apache/thrift v0.14.2 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/golang/snappy v0.0.1 // indirect
+	github.com/klauspost/compress v1.13.1 // indirect
+	github.com/pierrec/lz4/v4 v4.1.8 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	gopkg.in/linkedin/goavro.v1 v1.0.5 // indirect
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+	golang.org/x/xerrors v0.0.0-20191204190536-9bdfabe68543 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
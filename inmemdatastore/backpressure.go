@@ -0,0 +1,449 @@
+package inmemdatastore
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/rchapin/rlog"
+)
+
+const (
+	// The name of the file in the OverflowDir to which entries are spilled with BackpressureSpill.
+	OverflowFileName = "persistence-overflow.log"
+	// The name to which the overflow file is renamed while its entries are being drained back onto
+	// the PersistenceChan.
+	OverflowDrainingFileName = "persistence-overflow.draining.log"
+	// The default amount of time that Put will wait for space on the PersistenceChan with
+	// BackpressureBlockWithTimeout.
+	DefaultBackpressureTimeout = time.Second
+	// How often spilled entries are checked for and drained back onto the PersistenceChan.
+	overflowDrainInterval = 100 * time.Millisecond
+)
+
+var (
+	// ErrPersistenceBackpressure is returned when an entry could not be handed off to the
+	// Persisters before the BackpressureTimeout passed.
+	ErrPersistenceBackpressure = errors.New("persistence channel is full")
+)
+
+// BackpressurePolicy determines what happens to an entry for the Persisters when the
+// PersistenceChan is full.
+type BackpressurePolicy int
+
+const (
+	// Put blocks until there is space on the PersistenceChan.
+	BackpressureBlock BackpressurePolicy = iota
+	// Put blocks until there is space on the PersistenceChan or the BackpressureTimeout passes, in
+	// which case ErrPersistenceBackpressure is returned and the entry is not persisted.
+	BackpressureBlockWithTimeout
+	// The oldest entry on the PersistenceChan is dropped to make space for the new one.  A caller
+	// waiting on the durable write of a dropped entry gets ErrPersistenceBackpressure.
+	BackpressureDropOldest
+	// The entry is appended to an overflow file in the OverflowDir and is put back onto the
+	// PersistenceChan once there is space for it.  Durable writes, which wait on a Persister, block
+	// instead of being spilled.
+	BackpressureSpill
+)
+
+// PersistenceStats are the counters for the handing off of entries to the Persisters.
+type PersistenceStats struct {
+	// The number of entries currently waiting on the PersistenceChan.
+	QueueDepth    int
+	QueueCapacity int
+	Enqueued      int64
+	// The number of entries for which the PersistenceChan was full when they were enqueued.
+	QueueFull     int64
+	TimedOut      int64
+	DroppedOldest int64
+	Spilled       int64
+	SpillErrors   int64
+	// The number of spilled entries that have been put back onto the PersistenceChan.
+	Drained int64
+	// The number of entries that the Persisters failed to persist and dropped, either with
+	// FailurePolicyDrop or because they could not be written to the DeadLetterWriter.
+	Dropped int64
+}
+
+type persistenceCounters struct {
+	enqueued      int64
+	queueFull     int64
+	timedOut      int64
+	droppedOldest int64
+	spilled       int64
+	spillErrors   int64
+	drained       int64
+}
+
+// PersistenceStats returns a snapshot of the counters for the handing off of entries to the
+// Persisters.
+func (ds *InMemDataStore) PersistenceStats() PersistenceStats {
+	var dropped int64
+	for _, persister := range ds.persisters {
+		dropped += atomic.LoadInt64(&persister.dropped)
+	}
+	return PersistenceStats{
+		QueueDepth:    len(ds.persistenceChan),
+		QueueCapacity: cap(ds.persistenceChan),
+		Enqueued:      atomic.LoadInt64(&ds.counters.enqueued),
+		QueueFull:     atomic.LoadInt64(&ds.counters.queueFull),
+		TimedOut:      atomic.LoadInt64(&ds.counters.timedOut),
+		DroppedOldest: atomic.LoadInt64(&ds.counters.droppedOldest),
+		Spilled:       atomic.LoadInt64(&ds.counters.spilled),
+		SpillErrors:   atomic.LoadInt64(&ds.counters.spillErrors),
+		Drained:       atomic.LoadInt64(&ds.counters.drained),
+		Dropped:       dropped,
+	}
+}
+
+// enqueue hands the entry off to the Persisters, applying the BackpressurePolicy if the
+// PersistenceChan is full.  Regardless of the policy, it returns the error of the context if it is
+// done before the entry has been handed off.
+func (ds *InMemDataStore) enqueue(ctx context.Context, entry *PersistenceEntry) error {
+	select {
+	case ds.persistenceChan <- entry:
+		atomic.AddInt64(&ds.counters.enqueued, 1)
+		return nil
+	default:
+	}
+	atomic.AddInt64(&ds.counters.queueFull, 1)
+
+	switch ds.backpressurePolicy {
+	case BackpressureBlockWithTimeout:
+		timer := time.NewTimer(ds.backpressureTimeout)
+		defer timer.Stop()
+		select {
+		case ds.persistenceChan <- entry:
+			atomic.AddInt64(&ds.counters.enqueued, 1)
+			return nil
+		case <-timer.C:
+			atomic.AddInt64(&ds.counters.timedOut, 1)
+			return fmt.Errorf("%w; key=%s, timeout=%s", ErrPersistenceBackpressure, entry.Key, ds.backpressureTimeout)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	case BackpressureDropOldest:
+		if ds.dropOldest(entry) {
+			atomic.AddInt64(&ds.counters.enqueued, 1)
+			return nil
+		}
+	case BackpressureSpill:
+		if entry.done == nil {
+			err := ds.overflow.spill(entry)
+			if err == nil {
+				atomic.AddInt64(&ds.counters.spilled, 1)
+				// The entry is drained from the overflow file, which the write-ahead log checkpoints
+				// sync, rather than from the log.
+				entry.walSegment.release()
+				return nil
+			}
+			// Blocking is the only way left to avoid losing the entry.
+			atomic.AddInt64(&ds.counters.spillErrors, 1)
+			log.Errorf("IMDS unable to spill entry, blocking instead; key=%s, err=%s", entry.Key, err)
+		}
+	}
+
+	select {
+	case ds.persistenceChan <- entry:
+		atomic.AddInt64(&ds.counters.enqueued, 1)
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// dropOldest drops entries from the head of the PersistenceChan until there is space for the
+// entry.  Returns false if nothing could be dropped, which is always the case for an unbuffered
+// channel, in which case the caller must block.
+func (ds *InMemDataStore) dropOldest(entry *PersistenceEntry) bool {
+	for {
+		select {
+		case ds.persistenceChan <- entry:
+			return true
+		default:
+		}
+		select {
+		case oldest := <-ds.persistenceChan:
+			atomic.AddInt64(&ds.counters.droppedOldest, 1)
+			log.Debugf("IMDS dropped oldest persistence entry; key=%s", oldest.Key)
+			oldest.walSegment.release()
+			if oldest.done != nil {
+				oldest.done <- fmt.Errorf("%w; key=%s, dropped as oldest entry", ErrPersistenceBackpressure, oldest.Key)
+			}
+		default:
+			return false
+		}
+	}
+}
+
+// overflowFile is the file to which entries are spilled with BackpressureSpill.  Entries are
+// appended to the OverflowFileName file, framed and encoded as they are in the write-ahead log, so
+// that the types of the values in the records are kept.  To drain them, it is renamed to OverflowDrainingFileName,
+// so that new entries are spilled to a new file, and its entries are put back onto the
+// PersistenceChan.
+type overflowFile struct {
+	dir string
+	fh  *os.File
+	// The number of entries spilled to the current file.
+	pending int64
+	mux     *sync.Mutex
+	// Tracks the entries drained from the draining file that have not yet been released by the
+	// Persisters, once all of them have been put back onto the PersistenceChan.  Only used by the
+	// drainer.
+	drained *walSegment
+}
+
+func newOverflowFile(dir string) *overflowFile {
+	return &overflowFile{dir: dir, mux: &sync.Mutex{}}
+}
+
+// spill appends the entry to the file.  The entries of a batch are spilled, and later drained, one
+// at a time.
+func (o *overflowFile) spill(entry *PersistenceEntry) error {
+	entries := entry.Batch
+	if entries == nil {
+		entries = []*PersistenceEntry{entry}
+	}
+	data := []byte{}
+	for _, e := range entries {
+		body, err := encodeWALEntry(e)
+		if err != nil {
+			return err
+		}
+		data = appendFrame(data, body)
+	}
+	var err error
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	if o.fh == nil {
+		o.fh, err = os.OpenFile(filepath.Join(o.dir, OverflowFileName), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			o.fh = nil
+			return err
+		}
+	}
+	// The entries on the PersistenceChan are not durable either, so the file is not synced here.  It
+	// is only synced by the checkpoints of the write-ahead log, if there is one, before they remove
+	// the entries from the log.
+	_, err = o.fh.Write(data)
+	if err != nil {
+		return err
+	}
+	o.pending++
+	return nil
+}
+
+// rotate closes the current file and renames it to OverflowDrainingFileName, so that it can be
+// drained.  Returns false if there is nothing to drain.
+func (o *overflowFile) rotate() (bool, error) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	if o.fh != nil {
+		err := syncAndClose(o.fh)
+		o.fh = nil
+		if err != nil {
+			return false, err
+		}
+	}
+	path := filepath.Join(o.dir, OverflowFileName)
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	o.pending = 0
+	return true, os.Rename(path, filepath.Join(o.dir, OverflowDrainingFileName))
+}
+
+func (o *overflowFile) hasPending() bool {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	return o.pending > 0
+}
+
+// sync syncs the current file.  The entries on the PersistenceChan are not durable either, so it is
+// only needed once the entries are no longer in the write-ahead log.
+func (o *overflowFile) sync() error {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	if o.fh == nil {
+		return nil
+	}
+	return o.fh.Sync()
+}
+
+func (o *overflowFile) close() error {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	if o.fh == nil {
+		return nil
+	}
+	err := syncAndClose(o.fh)
+	o.fh = nil
+	return err
+}
+
+// readOverflowEntries reads each of the entries from an overflow file and passes them to fn.  A
+// missing file is not an error.
+func readOverflowEntries(path string, fn func(*PersistenceEntry) error) error {
+	fh, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	r := bufio.NewReader(fh)
+	for {
+		body, err := readFrame(r)
+		if err == io.EOF {
+			return nil
+		}
+		var entry *PersistenceEntry
+		if err == nil {
+			entry, err = decodeWALEntry(body)
+		}
+		if err != nil {
+			// The tail of the file may not have been completely written if the process crashed.
+			log.Warnf("IMDS unable to read overflow entry, skipping the rest of the file; path=%s, err=%s", path, err)
+			return nil
+		}
+		err = fn(entry)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// recoverOverflow writes the entries that were spilled, but not yet persisted, before the last
+// shutdown back to the datastore.  They are persisted once the drainer is running.
+func (ds *InMemDataStore) recoverOverflow() error {
+	for _, name := range []string{OverflowDrainingFileName, OverflowFileName} {
+		path := filepath.Join(ds.overflowDir, name)
+		err := readOverflowEntries(path, func(entry *PersistenceEntry) error {
+			datastore, err := ds.getDatastoreShard(entry.Key)
+			if err != nil {
+				return err
+			}
+			datastore.mux.Lock()
+			defer datastore.mux.Unlock()
+			if entry.Tombstone {
+				ds.tombstone(datastore, entry.Key, entry.Timestamp)
+			} else {
+				_, err := ds.cache(datastore, entry.Key, entry.Record, entry.deadline)
+				if err != nil {
+					log.Warnf("IMDS unable to recover overflow entry; key=%s, err=%s", entry.Key, err)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runOverflowDrainer starts a go routine that puts the spilled entries back onto the
+// PersistenceChan once it is at most half full.  Entries that have not been drained when the IMDS
+// is shutdown are left in the overflow files and are drained after the next Start.
+func (ds *InMemDataStore) runOverflowDrainer() {
+	log.Infof("IMDS starting overflow drainer, overflowDir=%s", ds.overflowDir)
+	ds.bgWg.Add(1)
+	ticker := time.NewTicker(overflowDrainInterval)
+	go func() {
+		defer ds.bgWg.Done()
+		defer ticker.Stop()
+		// Drain anything left over from before the last shutdown.
+		pending := true
+		for {
+			select {
+			case <-ticker.C:
+				if !pending && !ds.overflow.hasPending() {
+					continue
+				}
+				if len(ds.persistenceChan) > cap(ds.persistenceChan)/2 {
+					continue
+				}
+				var err error
+				pending, err = ds.drainOverflow()
+				if err != nil {
+					log.Errorf("IMDS unable to drain overflow file; overflowDir=%s, err=%s", ds.overflowDir, err)
+				}
+			case <-ds.bgCtx.Done():
+				log.Info("IMDS overflow drainer exiting on context done")
+				if err := ds.overflow.close(); err != nil {
+					log.Errorf("IMDS unable to close overflow file; overflowDir=%s, err=%s", ds.overflowDir, err)
+				}
+				return
+			}
+		}
+	}()
+}
+
+// drainOverflow puts all of the entries in the draining file, rotating the current overflow file
+// to it if it does not already exist, back onto the PersistenceChan.  Each of the drained entries
+// holds a reference to the file, in the same way as the entries of the write-ahead log hold one to
+// their segment, and the file is only removed once the Persisters have released all of them.
+// Returns true if the draining was interrupted, or failed, or the file has not yet been removed,
+// and it should be retried.
+func (ds *InMemDataStore) drainOverflow() (bool, error) {
+	if ds.overflow.drained != nil {
+		return ds.removeDrained()
+	}
+	path := filepath.Join(ds.overflowDir, OverflowDrainingFileName)
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		ok, err := ds.overflow.rotate()
+		if err != nil || !ok {
+			return err != nil, err
+		}
+	}
+	drained := &walSegment{path: path}
+	err := readOverflowEntries(path, func(entry *PersistenceEntry) error {
+		atomic.AddInt64(&drained.outstanding, 1)
+		entry.walSegment = drained
+		select {
+		case ds.persistenceChan <- entry:
+			atomic.AddInt64(&ds.counters.drained, 1)
+			return nil
+		case <-ds.bgCtx.Done():
+			drained.release()
+			return ds.bgCtx.Err()
+		}
+	})
+	if errors.Is(err, context.Canceled) {
+		// The whole file is drained again after the next Start, which only results in some of the
+		// entries being persisted twice.
+		return true, nil
+	}
+	if err != nil {
+		return true, err
+	}
+	ds.overflow.drained = drained
+	return ds.removeDrained()
+}
+
+// removeDrained removes the draining file once all of the entries drained from it have been
+// released by the Persisters, and the Writers have been synced so that the entries that were
+// persisted are durable.  Returns true if the file has not yet been removed.
+func (ds *InMemDataStore) removeDrained() (bool, error) {
+	drained := ds.overflow.drained
+	if !drained.done() {
+		return true, nil
+	}
+	for _, persister := range ds.persisters {
+		err := persister.sync()
+		// Without a Syncer nothing is durable until the Writer is shutdown, with or without the file.
+		if err != nil && !errors.Is(err, ErrSyncNotSupported) {
+			return true, err
+		}
+	}
+	ds.overflow.drained = nil
+	return false, os.Remove(drained.path)
+}
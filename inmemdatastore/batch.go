@@ -0,0 +1,111 @@
+package inmemdatastore
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// KeyedRecord is a record along with the key under which it is stored.
+type KeyedRecord struct {
+	Key    string
+	Record map[string]interface{}
+}
+
+// BatchPutResult is the result of a single record of a PutBatch.
+type BatchPutResult struct {
+	Key    string
+	Result PutResult
+	// Set if the record was invalid for the ConflictResolver, in which case it was neither written
+	// to the datastore nor persisted.
+	Err error
+}
+
+// PutBatch writes each of the records to the datastore, as with Put, taking the lock for each shard
+// only once for all of the records that belong to it.  All of the valid records are then handed off
+// to the Persisters as a single entry, which a BatchWriter writes as a single unit.  Returns the
+// result for each record, in the same order as the records.  The error is from handing the batch
+// off to the Persisters, or with DurabilitySync from persisting it, and as with Put it may be
+// returned even though the records have been written to the datastore.
+func (ds *InMemDataStore) PutBatch(records []KeyedRecord) ([]BatchPutResult, error) {
+	retval := make([]BatchPutResult, len(records))
+	err := ds.retention.reject(fmt.Sprintf("batch[%d]", len(records)), ds.dataDir)
+	if err != nil {
+		for i, record := range records {
+			retval[i].Key = record.Key
+		}
+		return retval, err
+	}
+	deadlines := make([]int64, len(records))
+	byShard := make(map[uint64][]int, ds.numShards)
+	for i, record := range records {
+		retval[i].Key = record.Key
+		shardId := GetDatastoreShardId(record.Key, ds.numShards)
+		byShard[shardId] = append(byShard[shardId], i)
+	}
+
+	for shardId, indices := range byShard {
+		datastore, ok := ds.datastores[shardId]
+		if !ok {
+			for _, i := range indices {
+				retval[i].Err = fmt.Errorf("unable to resolve datastore; key=%s, shardId=%d", records[i].Key, shardId)
+			}
+			continue
+		}
+		datastore.mux.Lock()
+		for _, i := range indices {
+			record := records[i]
+			_, existed := datastore.Data[record.Key]
+			deadlines[i] = ds.expiryDeadline(record.Record, ds.ttl)
+			resolution, err := ds.cache(datastore, record.Key, record.Record, deadlines[i])
+			if err != nil {
+				retval[i].Err = fmt.Errorf("unable to put record; key=%s, err=%w", record.Key, err)
+				continue
+			}
+			retval[i].Result = PutResult{Outcome: putOutcome(resolution, existed), Resolution: resolution}
+			datastore.countOutcome(retval[i].Result.Outcome)
+			datastore.NumWrites++
+		}
+		datastore.mux.Unlock()
+	}
+
+	batch := make([]*PersistenceEntry, 0, len(records))
+	for i, record := range records {
+		if retval[i].Err == nil {
+			batch = append(batch, &PersistenceEntry{Key: record.Key, Record: record.Record, deadline: deadlines[i]})
+		}
+	}
+	if len(batch) == 0 {
+		return retval, nil
+	}
+	ctx, cancel := ds.syncContext()
+	defer cancel()
+	return retval, ds.logAndHandOff(ctx, &PersistenceEntry{Batch: batch}, ds.durability == DurabilitySync)
+}
+
+// GetMany returns the records for each of the keys that are in the datastore, taking the read lock
+// for each shard only once for all of the keys that belong to it.  Keys that are not in the
+// datastore, or whose records have expired, are not included.
+func (ds *InMemDataStore) GetMany(keys []string) (map[string]interface{}, error) {
+	byShard := make(map[uint64][]string, ds.numShards)
+	for _, key := range keys {
+		shardId := GetDatastoreShardId(key, ds.numShards)
+		byShard[shardId] = append(byShard[shardId], key)
+	}
+	retval := make(map[string]interface{}, len(keys))
+	for shardId, shardKeys := range byShard {
+		datastore, ok := ds.datastores[shardId]
+		if !ok {
+			return nil, fmt.Errorf("unable to resolve datastore; key=%s, shardId=%d", shardKeys[0], shardId)
+		}
+		datastore.mux.RLock()
+		for _, key := range shardKeys {
+			rec, ok := datastore.Data[key]
+			if ok && !ds.expired(datastore, key) {
+				retval[key] = rec
+			}
+		}
+		atomic.AddInt64(&datastore.NumReads, int64(len(shardKeys)))
+		datastore.mux.RUnlock()
+	}
+	return retval, nil
+}
@@ -0,0 +1,124 @@
+package inmemdatastore
+
+import (
+	"io"
+	"time"
+
+	log "github.com/rchapin/rlog"
+)
+
+const (
+	// The default interval at which buffered records are flushed when a BlockPolicy is set.
+	DefaultBlockFlushInterval = time.Second
+)
+
+// BlockPolicy defines how many records a writer buffers before it appends them to its data file as
+// a single OCF block.  Larger blocks mean fewer writes to the file and better compression, at the
+// cost of the buffered records being lost if the process crashes before they are flushed.  A zero
+// value for both of the limits disables buffering, and each record is appended as its own block.
+type BlockPolicy struct {
+	// The maximum number of records in a block.
+	MaxRecords int
+	// The maximum size, in bytes, of the Avro binary encoding of the records in a block.  The limit
+	// is checked after each record is buffered so a block will exceed it by at most one record.
+	MaxBytes int64
+	// The maximum amount of time that a record will be buffered before it is flushed.  Defaults to
+	// DefaultBlockFlushInterval.
+	FlushInterval time.Duration
+}
+
+func (b BlockPolicy) enabled() bool {
+	return b.MaxRecords > 0 || b.MaxBytes > 0
+}
+
+func (b BlockPolicy) withDefaults() BlockPolicy {
+	if b.enabled() && b.FlushInterval == 0 {
+		b.FlushInterval = DefaultBlockFlushInterval
+	}
+	return b
+}
+
+func (b BlockPolicy) full(numRecords int, numBytes int64) bool {
+	if b.MaxRecords > 0 && numRecords >= b.MaxRecords {
+		return true
+	}
+	if b.MaxBytes > 0 && numBytes >= b.MaxBytes {
+		return true
+	}
+	return false
+}
+
+// buffer adds the records to the current block, flushing it if it is full.  Each record is encoded,
+// if the Serializer has not already done so, as it is buffered, both to measure the size of the
+// block and so that an invalid record is rejected by the write that added it, rather than failing
+// the whole block when it is flushed.  If the flush fails, the records are removed from the block
+// and the records buffered by earlier writes are kept to be retried by the next flush.  The caller
+// must hold the mux.
+func (a *AvroFileWriter) buffer(records []*SerializedRecord) error {
+	prevLen := len(a.pending)
+	var err error
+	a.pending, err = a.encode(a.pending, records)
+	if err != nil {
+		a.pending = a.pending[:prevLen]
+		return err
+	}
+	a.pendingRecords += len(records)
+	if !a.block.full(a.pendingRecords, int64(len(a.pending))) {
+		return nil
+	}
+	err = a.flush()
+	if err != nil {
+		a.pending = a.pending[:prevLen]
+		a.pendingRecords -= len(records)
+		return err
+	}
+	return a.rotateIfNeeded()
+}
+
+// flush appends all of the buffered records to the current data file as a single block.  The
+// caller must hold the mux.
+func (a *AvroFileWriter) flush() error {
+	if a.pendingRecords == 0 {
+		return nil
+	}
+	err := a.ocfw.appendEncoded(int64(a.pendingRecords), a.pending)
+	if err != nil {
+		return err
+	}
+	a.fileRecords += int64(a.pendingRecords)
+	a.pending = a.pending[:0]
+	a.pendingRecords = 0
+	a.fileBytes, err = a.fh.Seek(0, io.SeekCurrent)
+	return err
+}
+
+// runFlusher starts a go routine that flushes the buffered records every FlushInterval, so that
+// records are not held in memory indefinitely when they are written slowly.
+func (a *AvroFileWriter) runFlusher() {
+	a.wg.Add(1)
+	ticker := time.NewTicker(a.block.FlushInterval)
+	go func() {
+		defer a.wg.Done()
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				a.mux.Lock()
+				if !a.closed {
+					err := a.flush()
+					if err == nil {
+						err = a.rotateIfNeeded()
+					}
+					if err != nil {
+						log.Errorf("Unable to flush block; id=%d, records=%d, err=%s", a.id, a.pendingRecords, err)
+					}
+				}
+				a.mux.Unlock()
+			case <-a.stop:
+				return
+			case <-a.ctx.Done():
+				return
+			}
+		}
+	}()
+}
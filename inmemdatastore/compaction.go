@@ -0,0 +1,593 @@
+package inmemdatastore
+
+import (
+	"bufio"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/linkedin/goavro/v2"
+	log "github.com/rchapin/rlog"
+)
+
+const (
+	// The prefix of the names of the files written by Compact, which is followed by a sequence
+	// number and the extension of the files that they replace, eg. "compacted-0000000003.avro".
+	// They are not segments, so they are always read on start-up regardless of any snapshot.
+	CompactedFilePrefix = "compacted-"
+	// The default minimum number of closed data files for Compact to compact.
+	DefaultCompactionMinFiles = 2
+	// The suffix of a compacted file while it is being written.  Unlike files with the
+	// TmpFileSuffix, they are not read on start-up, and they are removed by the next Compact.
+	compactingFileSuffix = ".compacting"
+	// The number of records written to each block of a compacted file.
+	compactionBlockSize = 1024
+)
+
+// CompactionStats describes what was done by a single Compact.
+type CompactionStats struct {
+	// The number of data and tombstone files that were replaced.
+	FilesCompacted int
+	RecordsRead    int64
+	RecordsWritten int64
+	TombstonesRead int64
+	// The tombstones are compacted down to the most recent for each key, and those whose
+	// TombstoneTTL has passed are dropped.
+	TombstonesWritten int64
+	// The total size of the files that were replaced and of those that replaced them.
+	BytesBefore int64
+	BytesAfter  int64
+	// The paths of the compacted data and tombstone files.  Empty if there was nothing to write.
+	Path          string
+	TombstonePath string
+}
+
+// compactor holds the configuration for compacting the data files in the DataDir.
+type compactor struct {
+	interval       time.Duration
+	minFiles       int
+	retainVersions int
+	retainDuration time.Duration
+	// Serializes the compactions.
+	mux *sync.Mutex
+}
+
+func newCompactor(cfg Config) *compactor {
+	minFiles := cfg.CompactionMinFiles
+	if minFiles <= 0 {
+		minFiles = DefaultCompactionMinFiles
+	}
+	retainVersions := cfg.CompactionRetainVersions
+	if retainVersions <= 0 {
+		retainVersions = 1
+	}
+	return &compactor{
+		interval:       cfg.CompactionInterval,
+		minFiles:       minFiles,
+		retainVersions: retainVersions,
+		retainDuration: cfg.CompactionRetainDuration,
+		mux:            &sync.Mutex{},
+	}
+}
+
+// compactable returns whether all of the data written to the Writer can be compacted, which for a
+// MultiWriter means that all of its Writers are AvroFileWriters.
+func compactable(w Writer) bool {
+	if multiWriter, ok := w.(*MultiWriter); ok {
+		for _, child := range multiWriter.writers {
+			if !compactable(child) {
+				return false
+			}
+		}
+		return true
+	}
+	_, ok := w.(*AvroFileWriter)
+	return ok
+}
+
+// compactionInputs are the files to be replaced by a single compaction.
+type compactionInputs struct {
+	data       []string
+	tombstones []string
+	// The most recent tombstone file of each writer, which may still be being written.
+	liveTombstones []string
+	// The sequence number of the next compacted files.
+	seq uint64
+}
+
+// Compact replaces the closed Avro data files and tombstone files in the DataDir, along with the
+// files written by any previous Compact, with a single data file that only holds the most recent
+// CompactionRetainVersions records for each key, plus any records within the
+// CompactionRetainDuration of now, and a single tombstone file that only holds the most recent
+// tombstone for each key.  Records that are older than the tombstone for their key are dropped.
+// Records are ordered by the RecordTimestampKey, so with a ConflictResolver that orders them in
+// some other way the records that are kept may not be those that the datastore holds.  The data
+// files are read twice, first to find the versions of each key to keep and then to write them in
+// the order in which they are read, so only the timestamps of those versions are held in memory.
+//
+// A data file is closed once its writer has moved on to a later one, so the most recent file of
+// each writer is never compacted.  That keeps the sequence numbers of the writers, and the
+// markers of any snapshots, valid.  Compact only ever reads those closed files, so it runs
+// alongside the Persisters without blocking them, or any Puts.  Nothing is done if there are fewer
+// than CompactionMinFiles closed data files, counting a previously compacted file as one.
+//
+// The compacted files are written under temporary names, synced, and only then renamed and the
+// files that they replace removed.  If the process dies before all of those files are removed the
+// records in them are read twice on start-up, which only results in duplicates, and they are
+// compacted again by the next Compact.
+//
+// Only the Avro data files are read, so the files of any other Writer are never compacted.  That
+// is why Start rejects a CompactionInterval unless all of the Writers are AvroFileWriters.
+func (ds *InMemDataStore) Compact() (CompactionStats, error) {
+	stats := CompactionStats{}
+	if ds.dataDir == "" {
+		return stats, errors.New("a DataDir is required for compaction")
+	}
+	c := ds.compactor
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	inputs, err := ds.compactionInputs()
+	if err != nil {
+		return stats, err
+	}
+	if len(inputs.data) < c.minFiles {
+		return stats, nil
+	}
+
+	codec, compression, err := compactionCodec(inputs.data)
+	if err != nil {
+		return stats, err
+	}
+	tombstones := map[string]int64{}
+	readTombstone := func(datum interface{}) error {
+		record, ok := datum.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		key, keyOk := record[TombstoneFieldKey].(string)
+		timestamp, timestampOk := record[TombstoneFieldTimestamp].(int64)
+		if keyOk && timestampOk {
+			if existing, ok := tombstones[key]; !ok || timestamp > existing {
+				tombstones[key] = timestamp
+			}
+		}
+		return nil
+	}
+	for _, path := range inputs.tombstones {
+		err := readCompactionFile(path, func(datum interface{}) error {
+			stats.TombstonesRead++
+			return readTombstone(datum)
+		})
+		if err != nil {
+			return stats, err
+		}
+	}
+	// The tombstones in the files that are still open are only used to drop the records that they
+	// delete, the files themselves are left as they are and are read on start-up.  Any that have not
+	// been completely written yet only result in records that are kept until the next Compact.
+	compactedTombstones := make(map[string]int64, len(tombstones))
+	nowNanos := time.Now().UnixNano()
+	for key, timestamp := range tombstones {
+		if ds.tombstoneTTL > 0 && ds.tombstoneDeadline(timestamp) <= nowNanos {
+			continue
+		}
+		compactedTombstones[key] = timestamp
+	}
+	for _, path := range inputs.liveTombstones {
+		err := readCompactionFile(path, readTombstone)
+		if err != nil {
+			log.Debugf("IMDS unable to read all of the tombstones in open file during compaction; path=%s, err=%s", path, err)
+		}
+	}
+	// The first pass only keeps the order and timestamp of the most recent CompactionRetainVersions
+	// of each key, so that the second pass can write the records that are to be kept as it reads
+	// them, without holding any of them in memory.
+	kept := map[string][]compactionVersion{}
+	stats.RecordsRead, err = ds.readCompactionVersions(inputs.data,
+		func(path string, record map[string]interface{}, key string, keyed bool, version compactionVersion) error {
+			if record == nil {
+				log.Warnf("IMDS dropping record that is not a map during compaction; path=%s", path)
+				return nil
+			}
+			if keyed && compactionLive(version, tombstones, key) {
+				kept[key] = retainVersion(kept[key], version, c.retainVersions)
+			}
+			return nil
+		})
+	if err != nil {
+		return stats, err
+	}
+	var cutoff int64
+	if c.retainDuration > 0 {
+		cutoff = time.Now().Add(-c.retainDuration).UnixNano() / int64(ds.recordTimestampUnit)
+	}
+	writeRecords := func(appendRecord func(map[string]interface{}) error) error {
+		numRead, err := ds.readCompactionVersions(inputs.data,
+			func(path string, record map[string]interface{}, key string, keyed bool, version compactionVersion) error {
+				if record == nil {
+					return nil
+				}
+				// Records without a key cannot be compacted, so they are all kept.
+				if keyed && !c.retained(version, kept[key], tombstones, key, cutoff) {
+					return nil
+				}
+				stats.RecordsWritten++
+				return appendRecord(record)
+			})
+		if err == nil && numRead != stats.RecordsRead {
+			err = fmt.Errorf(
+				"data files changed during compaction; recordsRead=%d, recordsReread=%d", stats.RecordsRead, numRead)
+		}
+		return err
+	}
+
+	tombstoneKeys := make([]string, 0, len(compactedTombstones))
+	for key := range compactedTombstones {
+		tombstoneKeys = append(tombstoneKeys, key)
+	}
+	sort.Strings(tombstoneKeys)
+	writeTombstones := func(appendRecord func(map[string]interface{}) error) error {
+		for _, key := range tombstoneKeys {
+			err := appendRecord(map[string]interface{}{
+				TombstoneFieldKey:       key,
+				TombstoneFieldTimestamp: compactedTombstones[key],
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Write both of the compacted files before either is renamed, so that a failure part way
+	// through leaves nothing behind but the temporary files.
+	seqName := CompactedFilePrefix + fmt.Sprintf("%010d", inputs.seq)
+	outputs := []compactedFile{
+		{path: filepath.Join(ds.dataDir, seqName+AvroFileExtension), codec: codec, write: writeRecords},
+	}
+	if len(tombstoneKeys) > 0 {
+		tombstoneCodec, err := goavro.NewCodec(TombstoneSchema)
+		if err != nil {
+			return stats, err
+		}
+		outputs = append(outputs, compactedFile{
+			path:  filepath.Join(ds.dataDir, seqName+TombstoneFileExtension),
+			codec: tombstoneCodec,
+			write: writeTombstones,
+		})
+	}
+	for _, output := range outputs {
+		size, err := writeCompactedFile(output.path+compactingFileSuffix, output.codec, compression, output.write)
+		if err != nil {
+			for _, o := range outputs {
+				os.Remove(o.path + compactingFileSuffix)
+			}
+			return stats, fmt.Errorf("unable to write compacted file; path=%s, err=%w", output.path, err)
+		}
+		stats.BytesAfter += size
+	}
+	for _, output := range outputs {
+		err := renameNoReplace(output.path+compactingFileSuffix, output.path)
+		if err != nil {
+			return stats, err
+		}
+	}
+	err = syncDir(ds.dataDir)
+	if err != nil {
+		return stats, err
+	}
+	stats.Path = outputs[0].path
+	if len(outputs) > 1 {
+		stats.TombstonePath = outputs[1].path
+		stats.TombstonesWritten = int64(len(tombstoneKeys))
+	}
+
+	for _, path := range append(inputs.data, inputs.tombstones...) {
+		fi, err := os.Stat(path)
+		if err == nil {
+			stats.BytesBefore += fi.Size()
+		}
+		err = os.Remove(path)
+		if err != nil {
+			return stats, fmt.Errorf("unable to remove compacted file; path=%s, err=%w", path, err)
+		}
+		stats.FilesCompacted++
+	}
+	log.Infof(
+		"IMDS compaction complete, filesCompacted=%d, recordsRead=%d, recordsWritten=%d, bytesBefore=%d, bytesAfter=%d",
+		stats.FilesCompacted, stats.RecordsRead, stats.RecordsWritten, stats.BytesBefore, stats.BytesAfter)
+	return stats, syncDir(ds.dataDir)
+}
+
+// compactionInputs lists the closed data and tombstone files, and the previously compacted files,
+// in the DataDir, and removes any temporary files left behind by a compaction that failed.
+func (ds *InMemDataStore) compactionInputs() (compactionInputs, error) {
+	retval := compactionInputs{}
+	for _, ext := range []string{AvroFileExtension, TombstoneFileExtension} {
+		compacted, err := filepath.Glob(filepath.Join(ds.dataDir, CompactedFilePrefix+"*"+ext))
+		if err != nil {
+			return retval, err
+		}
+		leftovers, err := filepath.Glob(filepath.Join(ds.dataDir, CompactedFilePrefix+"*"+ext+compactingFileSuffix))
+		if err != nil {
+			return retval, err
+		}
+		for _, path := range leftovers {
+			log.Infof("Removing file left behind by a failed compaction; path=%s", path)
+			err := os.Remove(path)
+			if err != nil {
+				return retval, err
+			}
+		}
+		for _, path := range compacted {
+			seq, err := strconv.ParseUint(
+				strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), CompactedFilePrefix), ext), 10, 64)
+			if err != nil {
+				continue
+			}
+			if seq >= retval.seq {
+				retval.seq = seq + 1
+			}
+		}
+
+		segments, open, err := closedSegments(ds.dataDir, ext)
+		if err != nil {
+			return retval, err
+		}
+		closed := compacted
+		for _, segment := range segments {
+			if ds.shipper.pending(segment.Path) {
+				// Left as it is until it has been shipped, which for its tombstones is the same as
+				// a file that is still open.
+				open = append(open, segment)
+				continue
+			}
+			closed = append(closed, segment.Path)
+		}
+		if ext == TombstoneFileExtension {
+			for _, segment := range open {
+				retval.liveTombstones = append(retval.liveTombstones, segment.Path)
+			}
+		}
+		if ext == AvroFileExtension {
+			retval.data = closed
+		} else {
+			retval.tombstones = closed
+		}
+	}
+	return retval, nil
+}
+
+// compactedFile is a file to be written by a compaction, whose records are passed to appendRecord
+// by write.
+type compactedFile struct {
+	path  string
+	codec *goavro.Codec
+	write func(appendRecord func(map[string]interface{}) error) error
+}
+
+// compactionVersion identifies a single version of the record for a key.
+type compactionVersion struct {
+	timestamp    int64
+	hasTimestamp bool
+	// The order in which the version was read, which breaks ties between the timestamps.
+	order int64
+}
+
+func (v compactionVersion) newerThan(o compactionVersion) bool {
+	if v.timestamp != o.timestamp {
+		return v.timestamp > o.timestamp
+	}
+	return v.order > o.order
+}
+
+// readCompactionVersions reads each of the records in the data files, in order, and passes them to
+// fn along with their version, and their key if they have one.  The record is nil if it is not a
+// map.  Returns the number of records read.
+func (ds *InMemDataStore) readCompactionVersions(
+	paths []string,
+	fn func(path string, record map[string]interface{}, key string, keyed bool, version compactionVersion) error,
+) (int64, error) {
+	var order int64
+	for _, path := range paths {
+		err := readCompactionFile(path, func(datum interface{}) error {
+			order++
+			version := compactionVersion{order: order}
+			record, ok := datum.(map[string]interface{})
+			if !ok {
+				return fn(path, nil, "", false, version)
+			}
+			key, keyed := record[ds.recordIdKey].(string)
+			version.timestamp, version.hasTimestamp = ds.recordTimestamp(record)
+			return fn(path, record, key, keyed, version)
+		})
+		if err != nil {
+			return order, err
+		}
+	}
+	return order, nil
+}
+
+// compactionLive returns whether the version of the record for the key has not been deleted.  As
+// on start-up, a tombstone removes any record that is not newer than it, or that has no timestamp.
+func compactionLive(version compactionVersion, tombstones map[string]int64, key string) bool {
+	deleted, ok := tombstones[key]
+	return !ok || (version.hasTimestamp && version.timestamp > deleted)
+}
+
+// retainVersion adds the version to the most recent versions of a key, which are kept oldest first,
+// and drops the oldest of them if there are then more than n.
+func retainVersion(kept []compactionVersion, version compactionVersion, n int) []compactionVersion {
+	if len(kept) == n {
+		if !version.newerThan(kept[0]) {
+			return kept
+		}
+		copy(kept, kept[1:])
+		kept = kept[:n-1]
+	}
+	i := sort.Search(len(kept), func(i int) bool { return kept[i].newerThan(version) })
+	kept = append(kept, compactionVersion{})
+	copy(kept[i+1:], kept[i:])
+	kept[i] = version
+	return kept
+}
+
+// retained returns whether the version of the record for the key is to be kept, either because it
+// is one of the most recent versions that were kept by retainVersion, or because it is within the
+// retainDuration, whose cutoff is in the units of the RecordTimestampKey.
+func (c *compactor) retained(
+	version compactionVersion,
+	kept []compactionVersion,
+	tombstones map[string]int64,
+	key string,
+	cutoff int64,
+) bool {
+	if !compactionLive(version, tombstones, key) {
+		return false
+	}
+	if len(kept) < c.retainVersions || !kept[0].newerThan(version) {
+		return true
+	}
+	return c.retainDuration > 0 && version.hasTimestamp && version.timestamp >= cutoff
+}
+
+// compactionCodec returns the codec of the schema, and the compression, of the data files, all of
+// which must have been written with the same schema.
+func compactionCodec(paths []string) (*goavro.Codec, Compression, error) {
+	var codec *goavro.Codec
+	compression := CompressionNull
+	for _, path := range paths {
+		fh, err := os.Open(path)
+		if err != nil {
+			return nil, compression, err
+		}
+		ocfr, err := goavro.NewOCFReader(bufio.NewReader(fh))
+		fh.Close()
+		if err != nil {
+			return nil, compression, fmt.Errorf("unable to read avro data file; path=%s, err=%w", path, err)
+		}
+		if codec == nil {
+			codec = ocfr.Codec()
+			compression, err = parseCompression(ocfr.CompressionName())
+			if err != nil {
+				return nil, compression, err
+			}
+			continue
+		}
+		if ocfr.Codec().CanonicalSchema() != codec.CanonicalSchema() {
+			return nil, compression, fmt.Errorf("%w; path=%s", ErrIncompatibleSchema, path)
+		}
+	}
+	return codec, compression, nil
+}
+
+// readCompactionFile reads each of the records from the Avro OCF file and passes them to fn, stopping
+// at the first error that it returns.  Unlike on start-up, a file that cannot be completely read is
+// an error, since it would otherwise be replaced by a compacted file without the records that could
+// not be read.
+func readCompactionFile(path string, fn func(interface{}) error) error {
+	fh, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	fi, err := fh.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() == 0 {
+		return nil
+	}
+	ocfr, err := goavro.NewOCFReader(bufio.NewReader(fh))
+	if err != nil {
+		return fmt.Errorf("unable to read avro file; path=%s, err=%w", path, err)
+	}
+	for ocfr.Scan() {
+		datum, err := ocfr.Read()
+		if err != nil {
+			return fmt.Errorf("unable to read avro record; path=%s, err=%w", path, err)
+		}
+		err = fn(datum)
+		if err != nil {
+			return err
+		}
+	}
+	if err := ocfr.Err(); err != nil {
+		return fmt.Errorf("unable to read avro file; path=%s, err=%w", path, err)
+	}
+	return nil
+}
+
+// writeCompactedFile writes the records passed to appendRecord by write to a new Avro OCF file, in
+// blocks of compactionBlockSize, syncs it and returns its size.
+func writeCompactedFile(
+	path string,
+	codec *goavro.Codec,
+	compression Compression,
+	write func(appendRecord func(map[string]interface{}) error) error,
+) (int64, error) {
+	fh, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	ocfw, err := newOCFWriter(fh, codec, compression, flate.DefaultCompression)
+	if err != nil {
+		fh.Close()
+		return 0, err
+	}
+	block := make([]map[string]interface{}, 0, compactionBlockSize)
+	err = write(func(record map[string]interface{}) error {
+		block = append(block, record)
+		if len(block) < compactionBlockSize {
+			return nil
+		}
+		err := ocfw.Append(block)
+		block = block[:0]
+		return err
+	})
+	if err == nil && len(block) > 0 {
+		err = ocfw.Append(block)
+	}
+	if err != nil {
+		fh.Close()
+		return 0, err
+	}
+	size, err := fh.Seek(0, io.SeekEnd)
+	if err != nil {
+		fh.Close()
+		return 0, err
+	}
+	return size, syncAndClose(fh)
+}
+
+// runCompactor starts a go routine that compacts the data files every CompactionInterval.
+func (ds *InMemDataStore) runCompactor() {
+	log.Infof("IMDS starting compactor, interval=%s", ds.compactor.interval)
+	ds.bgWg.Add(1)
+	ticker := time.NewTicker(ds.compactor.interval)
+	go func() {
+		defer ds.bgWg.Done()
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				_, err := ds.Compact()
+				if err != nil {
+					log.Errorf("IMDS unable to compact data files; dataDir=%s, err=%s", ds.dataDir, err)
+				}
+			case <-ds.bgCtx.Done():
+				log.Info("IMDS compactor exiting on context done")
+				return
+			}
+		}
+	}()
+}
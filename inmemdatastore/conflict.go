@@ -0,0 +1,310 @@
+package inmemdatastore
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrConflictField is returned when a record does not contain a value, of a supported type, for
+	// the field that a ConflictResolver orders records by.
+	ErrConflictField = errors.New("invalid conflict resolution field")
+)
+
+// Resolution is the result of resolving the conflict between an incoming record and the existing
+// record for the same key.
+type Resolution int
+
+const (
+	// The incoming record replaced the existing one, or there was no existing record.
+	ResolutionApplied Resolution = iota
+	// The existing record is newer than the incoming one, which was not written to the datastore.
+	ResolutionStale
+	// The existing and incoming records are equally new.  The existing record is kept.
+	ResolutionTie
+	// The existing record could not be ordered against the incoming one, for example because it
+	// does not have a timestamp, so the incoming record replaced it.
+	ResolutionUnordered
+)
+
+func (r Resolution) String() string {
+	switch r {
+	case ResolutionApplied:
+		return "applied"
+	case ResolutionStale:
+		return "stale"
+	case ResolutionTie:
+		return "tie"
+	case ResolutionUnordered:
+		return "unordered"
+	default:
+		return fmt.Sprintf("Resolution(%d)", int(r))
+	}
+}
+
+// Applied returns true if the incoming record was written to the datastore.
+func (r Resolution) Applied() bool {
+	return r == ResolutionApplied || r == ResolutionUnordered
+}
+
+// ConflictResolver decides whether an incoming record should replace the existing record for the
+// same key in the datastore.  It is called with the write lock for the shard held, so it must not
+// call back into the InMemDataStore.
+type ConflictResolver interface {
+	// Resolve compares the incoming record to the existing one.  The existing record is nil if
+	// there is no record for the key, in which case the incoming record should be validated and
+	// ResolutionApplied returned.  An error means that the incoming record is invalid and it is
+	// neither written to the datastore nor persisted.
+	Resolve(existing, incoming map[string]interface{}) (Resolution, error)
+}
+
+// ResolverFunc adapts a function to a ConflictResolver.
+type ResolverFunc func(existing, incoming map[string]interface{}) (Resolution, error)
+
+func (f ResolverFunc) Resolve(existing, incoming map[string]interface{}) (Resolution, error) {
+	return f(existing, incoming)
+}
+
+// LWWResolver is a last-writer-wins ConflictResolver that keeps the record with the greatest value
+// for its field.  The values may be of any numeric type, or time.Time.  If the existing record does
+// not have a valid value for the field it is always replaced, with ResolutionUnordered.
+type LWWResolver struct {
+	field string
+}
+
+func NewLWWResolver(field string) *LWWResolver {
+	return &LWWResolver{field: field}
+}
+
+func (r *LWWResolver) Resolve(existing, incoming map[string]interface{}) (Resolution, error) {
+	return resolveByField(r.field, existing, incoming, compareOrdered)
+}
+
+// VersionResolver is a ConflictResolver that keeps the record with the highest version, an
+// integer counter that is incremented for each change to a record.  If the existing record does not
+// have a valid version it is always replaced, with ResolutionUnordered.
+type VersionResolver struct {
+	field string
+}
+
+func NewVersionResolver(field string) *VersionResolver {
+	return &VersionResolver{field: field}
+}
+
+func (r *VersionResolver) Resolve(existing, incoming map[string]interface{}) (Resolution, error) {
+	return resolveByField(r.field, existing, incoming, compareVersions)
+}
+
+// HLCResolver is a ConflictResolver that keeps the record with the greatest hybrid logical clock
+// timestamp, as generated by an HLClock.  The values of its field may be an HLC, or a
+// map[string]interface{} with the HLCFieldWallTime and HLCFieldLogical keys as decoded from an Avro
+// record.  If the existing record does not have a valid HLC it is always replaced, with
+// ResolutionUnordered.
+type HLCResolver struct {
+	field string
+}
+
+func NewHLCResolver(field string) *HLCResolver {
+	return &HLCResolver{field: field}
+}
+
+func (r *HLCResolver) Resolve(existing, incoming map[string]interface{}) (Resolution, error) {
+	return resolveByField(r.field, existing, incoming, func(a, b interface{}) (int, bool) {
+		hlcA, ok := toHLC(a)
+		if !ok {
+			return 0, false
+		}
+		hlcB, ok := toHLC(b)
+		if !ok {
+			return 0, false
+		}
+		return hlcA.Compare(hlcB), true
+	})
+}
+
+// resolveByField resolves the conflict between the records by comparing the values of the field
+// with cmp, which returns false if either of the values is not of a supported type.
+func resolveByField(
+	field string,
+	existing, incoming map[string]interface{},
+	cmp func(a, b interface{}) (int, bool),
+) (Resolution, error) {
+	incomingVal, ok := incoming[field]
+	if !ok {
+		return ResolutionApplied, fmt.Errorf("%w; field=%s, missing from record", ErrConflictField, field)
+	}
+	// Compare the incoming value to itself to validate its type.
+	if _, ok := cmp(incomingVal, incomingVal); !ok {
+		return ResolutionApplied, fmt.Errorf("%w; field=%s, type=%T", ErrConflictField, field, incomingVal)
+	}
+	if existing == nil {
+		return ResolutionApplied, nil
+	}
+	result, ok := cmp(existing[field], incomingVal)
+	if !ok {
+		// There is nothing in the existing record to which we can compare, we will just replace it.
+		return ResolutionUnordered, nil
+	}
+	switch {
+	case result < 0:
+		return ResolutionApplied, nil
+	case result > 0:
+		return ResolutionStale, nil
+	default:
+		return ResolutionTie, nil
+	}
+}
+
+// compareOrdered compares two numeric or time.Time values.  Signed and unsigned integers are
+// compared exactly and any comparison involving a float is done as float64.
+func compareOrdered(a, b interface{}) (int, bool) {
+	if timeA, ok := a.(time.Time); ok {
+		timeB, ok := b.(time.Time)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case timeA.Before(timeB):
+			return -1, true
+		case timeA.After(timeB):
+			return 1, true
+		default:
+			return 0, true
+		}
+	}
+	numA, ok := toNumber(a)
+	if !ok {
+		return 0, false
+	}
+	numB, ok := toNumber(b)
+	if !ok {
+		return 0, false
+	}
+	return numA.compare(numB), true
+}
+
+func compareVersions(a, b interface{}) (int, bool) {
+	numA, ok := toNumber(a)
+	if !ok || numA.kind == numberFloat {
+		return 0, false
+	}
+	numB, ok := toNumber(b)
+	if !ok || numB.kind == numberFloat {
+		return 0, false
+	}
+	return numA.compare(numB), true
+}
+
+type numberKind int
+
+const (
+	numberInt numberKind = iota
+	numberUint
+	numberFloat
+)
+
+// number holds any of the Go numeric types without losing precision.
+type number struct {
+	kind numberKind
+	i    int64
+	u    uint64
+	f    float64
+}
+
+func toNumber(val interface{}) (number, bool) {
+	switch v := val.(type) {
+	case int:
+		return number{kind: numberInt, i: int64(v)}, true
+	case int8:
+		return number{kind: numberInt, i: int64(v)}, true
+	case int16:
+		return number{kind: numberInt, i: int64(v)}, true
+	case int32:
+		return number{kind: numberInt, i: int64(v)}, true
+	case int64:
+		return number{kind: numberInt, i: v}, true
+	case uint:
+		return number{kind: numberUint, u: uint64(v)}, true
+	case uint8:
+		return number{kind: numberUint, u: uint64(v)}, true
+	case uint16:
+		return number{kind: numberUint, u: uint64(v)}, true
+	case uint32:
+		return number{kind: numberUint, u: uint64(v)}, true
+	case uint64:
+		return number{kind: numberUint, u: v}, true
+	case float32:
+		return number{kind: numberFloat, f: float64(v)}, true
+	case float64:
+		return number{kind: numberFloat, f: v}, true
+	default:
+		return number{}, false
+	}
+}
+
+func (n number) float() float64 {
+	switch n.kind {
+	case numberInt:
+		return float64(n.i)
+	case numberUint:
+		return float64(n.u)
+	default:
+		return n.f
+	}
+}
+
+func (n number) compare(o number) int {
+	switch {
+	case n.kind == numberFloat || o.kind == numberFloat:
+		return compareValues(n.float(), o.float())
+	case n.kind == numberInt && o.kind == numberInt:
+		return compareValues(n.i, o.i)
+	case n.kind == numberUint && o.kind == numberUint:
+		return compareValues(n.u, o.u)
+	case n.kind == numberInt:
+		// A negative int is less than any uint.
+		if n.i < 0 {
+			return -1
+		}
+		return compareValues(uint64(n.i), o.u)
+	default:
+		if o.i < 0 {
+			return 1
+		}
+		return compareValues(n.u, uint64(o.i))
+	}
+}
+
+func compareValues[T int64 | uint64 | float64](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// recordTimestamp returns the value of the RecordTimestampKey of the record in units of the
+// RecordTimestampUnit, which is what the timestamps of deletes are compared to.  Returns false if
+// the record does not have a numeric or time.Time timestamp.
+func (ds *InMemDataStore) recordTimestamp(record map[string]interface{}) (int64, bool) {
+	val := record[ds.recordTimestampKey]
+	if t, ok := val.(time.Time); ok {
+		return t.UnixNano() / int64(ds.recordTimestampUnit), true
+	}
+	num, ok := toNumber(val)
+	if !ok {
+		return 0, false
+	}
+	switch num.kind {
+	case numberInt:
+		return num.i, true
+	case numberUint:
+		return int64(num.u), true
+	default:
+		return int64(num.f), true
+	}
+}
@@ -0,0 +1,260 @@
+package inmemdatastore
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/xitongsys/parquet-go/parquet"
+)
+
+const CSVFileExtension = ".csv"
+
+// CSVNestedMode defines how the CSVFileWriter writes the fields of nested Avro records.
+type CSVNestedMode int
+
+const (
+	// Each field of a nested record is written to a column of its own, named with the path to the
+	// field joined with ".", eg. "location.lat".
+	CSVNestedFlatten CSVNestedMode = iota
+	// A nested record is written as JSON to a single column.
+	CSVNestedJSON
+)
+
+func (c CSVNestedMode) String() string {
+	switch c {
+	case CSVNestedFlatten:
+		return "flatten"
+	case CSVNestedJSON:
+		return "json"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(c))
+	}
+}
+
+// CSVFileWriter is a Writer that writes each record as a row to a sequence of CSV files named
+// "<id>-<seq>.csv".  The columns are the fields of the Avro schema, in the order in which they are
+// defined, with the nested records written according to the CSVNestedMode.  The nullable unions,
+// ["null", T], are written as their value, and arrays, maps and any other unions are written as
+// JSON.  Null values, including the fields that are missing from a record, are written as the
+// NullValue.  It writes the Record of each SerializedRecord, so it can be paired with any
+// Serializer.  The files are rotated and closed in the same way as those of the AvroFileWriter, and
+// each file begins with its own header row.
+//
+// As well as by a Persister, it can be used with InMemDataStore.Export to write the current contents
+// of the data store to CSV in one shot.
+type CSVFileWriter struct {
+	id        int
+	columns   []*parquetNode
+	nested    CSVNestedMode
+	nullValue string
+	delimiter rune
+	segments  *segmentWriter
+	// Reused for assembling rows.  Only used while holding the mux of the segmentWriter.
+	buf *bytes.Buffer
+}
+
+type CSVFileWriterConfig struct {
+	Id         int
+	AvroSchema string
+	OutputDir  string
+	// Defines when the writer closes the file to which it is currently writing and opens a new
+	// one.  By default files are never rotated.
+	Rotation RotationPolicy
+	// The delimiter between the fields of a row.  Defaults to ','.
+	Delimiter rune
+	// Whether to omit the header row with the names of the columns.
+	OmitHeader bool
+	Nested     CSVNestedMode
+	// What is written for null values.  Defaults to the empty string.
+	NullValue string
+}
+
+func NewCSVFileWriter(ctx context.Context, wg *sync.WaitGroup, cfg CSVFileWriterConfig) (*CSVFileWriter, error) {
+	delimiter := cfg.Delimiter
+	if delimiter == 0 {
+		delimiter = ','
+	}
+	if delimiter == '"' || delimiter == '\r' || delimiter == '\n' || !utf8.ValidRune(delimiter) ||
+		delimiter == utf8.RuneError {
+		return nil, fmt.Errorf("invalid delimiter; delimiter=%q", delimiter)
+	}
+	if cfg.Nested != CSVNestedFlatten && cfg.Nested != CSVNestedJSON {
+		return nil, fmt.Errorf("unsupported nested mode; nested=%s", cfg.Nested)
+	}
+	// The columns are the leaves of the same schema as is derived for Parquet, or with
+	// CSVNestedJSON the top level fields.
+	schema, err := newParquetSchema(cfg.AvroSchema)
+	if err != nil {
+		return nil, err
+	}
+	columns := schema.leaves
+	if cfg.Nested == CSVNestedJSON {
+		columns = schema.root.children
+	}
+	retval := &CSVFileWriter{
+		id:        cfg.Id,
+		columns:   columns,
+		nested:    cfg.Nested,
+		nullValue: cfg.NullValue,
+		delimiter: delimiter,
+		buf:       &bytes.Buffer{},
+	}
+
+	header := []string{}
+	for _, column := range columns {
+		header = append(header, strings.Join(column.path, "."))
+	}
+	segments, err := newSegmentWriter(ctx, wg, segmentWriterConfig{
+		Id:        cfg.Id,
+		OutputDir: cfg.OutputDir,
+		Ext:       CSVFileExtension,
+		Rotation:  cfg.Rotation,
+		NewEncoder: func(w io.Writer) (segmentEncoder, error) {
+			if !cfg.OmitHeader {
+				err := retval.writeRows(w, [][]string{header})
+				if err != nil {
+					return nil, err
+				}
+			}
+			return plainEncoder{w}, nil
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	retval.segments = segments
+	return retval, nil
+}
+
+func (c *CSVFileWriter) Write(record *SerializedRecord) error {
+	return c.WriteBatch([]*SerializedRecord{record})
+}
+
+// WriteBatch appends the rows of all of the records to the current file with a single write.
+func (c *CSVFileWriter) WriteBatch(records []*SerializedRecord) error {
+	rows := make([][]string, len(records))
+	for i, record := range records {
+		if record.Record == nil {
+			return fmt.Errorf("%w: no record to write; index=%d, key=%s", ErrInvalidRecord, i, record.Key)
+		}
+		row := make([]string, 0, len(c.columns))
+		var err error
+		if c.nested == CSVNestedJSON {
+			for _, column := range c.columns {
+				row, err = c.appendFields(row, column, record.Record[column.name])
+				if err != nil {
+					break
+				}
+			}
+		} else {
+			row, err = c.appendRecordFields(row, record.Record)
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %s; index=%d, key=%s", ErrInvalidRecord, err, i, record.Key)
+		}
+		rows[i] = row
+	}
+	return c.segments.write(len(records), func(enc segmentEncoder) error {
+		return c.writeRows(enc, rows)
+	})
+}
+
+// appendRecordFields appends the fields of the record for each of the leaf columns.
+func (c *CSVFileWriter) appendRecordFields(row []string, record map[string]interface{}) ([]string, error) {
+	for _, column := range c.columns {
+		var val interface{} = record
+		for i, name := range column.path {
+			m, ok := unwrapUnion(val).(map[string]interface{})
+			if !ok {
+				if val != nil {
+					return nil, fmt.Errorf("unsupported type for record; field=%s, type=%T",
+						strings.Join(column.path[:i], "."), val)
+				}
+				break
+			}
+			val = m[name]
+		}
+		var err error
+		row, err = c.appendFields(row, column, val)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return row, nil
+}
+
+func (c *CSVFileWriter) appendFields(row []string, column *parquetNode, val interface{}) ([]string, error) {
+	if column.union {
+		val = unwrapUnion(val)
+	}
+	if val == nil {
+		return append(row, c.nullValue), nil
+	}
+	if column.children != nil || column.convertedIs(parquet.ConvertedType_JSON) {
+		data, err := json.Marshal(val)
+		if err != nil {
+			return nil, fmt.Errorf("%s; field=%s", err, strings.Join(column.path, "."))
+		}
+		return append(row, string(data)), nil
+	}
+	return append(row, formatCSVValue(val)), nil
+}
+
+// formatCSVValue formats a scalar value.  Bytes are written as base64 and times as RFC 3339.
+func formatCSVValue(val interface{}) string {
+	switch v := val.(type) {
+	case string:
+		return v
+	case []byte:
+		return base64.StdEncoding.EncodeToString(v)
+	case bool:
+		return strconv.FormatBool(v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case time.Duration:
+		return v.String()
+	}
+	num, ok := toNumber(val)
+	if !ok {
+		return fmt.Sprint(val)
+	}
+	switch num.kind {
+	case numberInt:
+		return strconv.FormatInt(num.i, 10)
+	case numberUint:
+		return strconv.FormatUint(num.u, 10)
+	default:
+		return strconv.FormatFloat(num.f, 'g', -1, 64)
+	}
+}
+
+// writeRows encodes the rows and writes them with a single write.
+func (c *CSVFileWriter) writeRows(w io.Writer, rows [][]string) error {
+	c.buf.Reset()
+	cw := csv.NewWriter(c.buf)
+	cw.Comma = c.delimiter
+	err := cw.WriteAll(rows)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(c.buf.Bytes())
+	return err
+}
+
+func (c *CSVFileWriter) Sync() error {
+	return c.segments.sync()
+}
+
+func (c *CSVFileWriter) Shutdown() error {
+	return c.segments.shutdown()
+}
@@ -0,0 +1,124 @@
+package inmemdatastore
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "github.com/rchapin/rlog"
+)
+
+const (
+	DeadLetterFileExtension = ".deadletters.jsonl"
+)
+
+// JSONLinesDeadLetterWriter is a DeadLetterWriter that appends each DeadLetter, as a single line of
+// JSON, to a file named "<id>.deadletters.jsonl" in its output dir.  Because the records are not
+// encoded with the schema any record can be written, regardless of its shape.  Existing files are
+// appended to and never truncated.
+type JSONLinesDeadLetterWriter struct {
+	id         int
+	outputPath string
+	fh         *os.File
+	mux        *sync.Mutex
+}
+
+type JSONLinesDeadLetterWriterConfig struct {
+	Id int
+	// The directory to which the dead letter file is written.  It should be separate from the
+	// output dir of the data files.
+	OutputDir string
+}
+
+func NewJSONLinesDeadLetterWriter(cfg JSONLinesDeadLetterWriterConfig) (*JSONLinesDeadLetterWriter, error) {
+	outputPath := filepath.Join(cfg.OutputDir, fmt.Sprintf("%d%s", cfg.Id, DeadLetterFileExtension))
+	fh, err := os.OpenFile(outputPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONLinesDeadLetterWriter{
+		id:         cfg.Id,
+		outputPath: outputPath,
+		fh:         fh,
+		mux:        &sync.Mutex{},
+	}, nil
+}
+
+// WriteDeadLetter appends the DeadLetter to the file and syncs it to disk.
+func (j *JSONLinesDeadLetterWriter) WriteDeadLetter(deadLetter *DeadLetter) error {
+	data, err := json.Marshal(deadLetter)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	j.mux.Lock()
+	defer j.mux.Unlock()
+	_, err = j.fh.Write(data)
+	if err != nil {
+		return err
+	}
+	// Dead letters should be rare, and are the only copy of the record, so we sync each one.
+	return j.fh.Sync()
+}
+
+func (j *JSONLinesDeadLetterWriter) Shutdown() error {
+	log.Infof("Dead letter writer shutting down; id=%d", j.id)
+	j.mux.Lock()
+	defer j.mux.Unlock()
+	return j.fh.Close()
+}
+
+// ReadDeadLetters reads each of the DeadLetters from a file written by a JSONLinesDeadLetterWriter
+// and passes them to fn.  Integer values in the records are decoded as int64 and all other numbers
+// as float64.
+func ReadDeadLetters(path string, fn func(*DeadLetter) error) error {
+	fh, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	decoder := json.NewDecoder(bufio.NewReader(fh))
+	decoder.UseNumber()
+	for {
+		deadLetter := &DeadLetter{}
+		err := decoder.Decode(deadLetter)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("unable to read dead letter; path=%s, err=%w", path, err)
+		}
+		if deadLetter.Record != nil {
+			normalizeJSONNumbers(deadLetter.Record)
+		}
+		err = fn(deadLetter)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// ReplayDeadLetters writes each of the DeadLetters in the file back to the datastore, with Put for
+// records and Delete for tombstones, once the problem that caused them to fail has been fixed.
+// Returns the number of DeadLetters replayed.
+func (ds *InMemDataStore) ReplayDeadLetters(path string) (int, error) {
+	count := 0
+	err := ReadDeadLetters(path, func(deadLetter *DeadLetter) error {
+		var err error
+		if deadLetter.Tombstone {
+			err = ds.Delete(deadLetter.Key, deadLetter.Timestamp)
+		} else {
+			_, err = ds.Put(deadLetter.Key, deadLetter.Record)
+		}
+		if err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	return count, err
+}
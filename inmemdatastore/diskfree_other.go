@@ -0,0 +1,8 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly && !windows
+
+package inmemdatastore
+
+// diskFree is not supported on this platform, so RetentionMinFreeBytes is never enforced.
+func diskFree(path string) (int64, error) {
+	return 0, errDiskFreeUnsupported
+}
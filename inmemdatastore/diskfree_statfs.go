@@ -0,0 +1,16 @@
+//go:build linux || darwin || freebsd || dragonfly
+
+package inmemdatastore
+
+import "syscall"
+
+// diskFree returns the number of bytes available to an unprivileged user on the file system that
+// holds the path.
+func diskFree(path string) (int64, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(path, &stat)
+	if err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
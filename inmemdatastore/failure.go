@@ -0,0 +1,118 @@
+package inmemdatastore
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrInvalidRecord indicates that a record could not be persisted because of its contents, for
+	// example because it does not match the schema.  Persisting it again will fail in the same way,
+	// so such records are never retried.
+	ErrInvalidRecord = errors.New("invalid record")
+)
+
+const (
+	DefaultRetryMaxAttempts    = 3
+	DefaultRetryInitialBackoff = 100 * time.Millisecond
+	DefaultRetryMaxBackoff     = 5 * time.Second
+)
+
+// FailurePolicy determines what a Persister does with an entry that it fails to persist.
+// Regardless of the policy, each failure is reported as a PersisterError.
+type FailurePolicy int
+
+const (
+	// The entry is dropped.
+	FailurePolicyDrop FailurePolicy = iota
+	// Persisting the entry is retried, with an exponential backoff between attempts, as defined
+	// by the RetryPolicy.  If all of the attempts fail, or the error is an ErrInvalidRecord, the
+	// entry is routed to the DeadLetterWriter, if one is configured, otherwise it is dropped.
+	FailurePolicyRetry
+	// The entry is routed to the DeadLetterWriter.
+	FailurePolicyDeadLetter
+)
+
+// RetryPolicy defines how a Persister retries an entry that it failed to persist with
+// FailurePolicyRetry.  Zero values are replaced with the defaults.
+type RetryPolicy struct {
+	// The total number of attempts, including the first, to persist the entry.
+	MaxAttempts int
+	// The amount of time to wait before the first retry.  It is doubled for each subsequent retry.
+	InitialBackoff time.Duration
+	// The maximum amount of time to wait between retries.
+	MaxBackoff time.Duration
+}
+
+func (r RetryPolicy) withDefaults() RetryPolicy {
+	if r.MaxAttempts == 0 {
+		r.MaxAttempts = DefaultRetryMaxAttempts
+	}
+	if r.InitialBackoff == 0 {
+		r.InitialBackoff = DefaultRetryInitialBackoff
+	}
+	if r.MaxBackoff == 0 {
+		r.MaxBackoff = DefaultRetryMaxBackoff
+	}
+	return r
+}
+
+// PersisterError describes a failure of a Persister.
+type PersisterError struct {
+	PersisterId int
+	// The key of the entry that failed to be persisted.  Empty if the failure was not for a
+	// specific entry, for example when shutting down the Writer.
+	Key string
+	// The entry that failed to be persisted, if any.
+	Entry *PersistenceEntry
+	// The number of attempts that were made to persist the entry.
+	Attempts int
+	Err      error
+	Time     time.Time
+}
+
+func (e *PersisterError) Error() string {
+	return fmt.Sprintf(
+		"persister failure; persisterId=%d, key=%s, attempts=%d, err=%s",
+		e.PersisterId, e.Key, e.Attempts, e.Err)
+}
+
+func (e *PersisterError) Unwrap() error {
+	return e.Err
+}
+
+type PersisterErrorChan chan *PersisterError
+
+// DeadLetter is an entry that a Persister failed to persist along with the details of the failure.
+type DeadLetter struct {
+	Key         string                 `json:"key"`
+	Record      map[string]interface{} `json:"record,omitempty"`
+	Tombstone   bool                   `json:"tombstone,omitempty"`
+	Timestamp   int64                  `json:"timestamp,omitempty"`
+	PersisterId int                    `json:"persister_id"`
+	Error       string                 `json:"error"`
+	Time        time.Time              `json:"time"`
+}
+
+// NewDeadLetter creates a DeadLetter from the PersisterError for a failed entry.
+func NewDeadLetter(perr *PersisterError) *DeadLetter {
+	retval := &DeadLetter{
+		Key:         perr.Key,
+		PersisterId: perr.PersisterId,
+		Error:       perr.Err.Error(),
+		Time:        perr.Time,
+	}
+	if perr.Entry != nil {
+		retval.Record = perr.Entry.Record
+		retval.Tombstone = perr.Entry.Tombstone
+		retval.Timestamp = perr.Entry.Timestamp
+	}
+	return retval
+}
+
+// DeadLetterWriter persists the entries that a Persister failed to persist with its Writer.
+type DeadLetterWriter interface {
+	WriteDeadLetter(*DeadLetter) error
+	Shutdown() error
+}
@@ -0,0 +1,108 @@
+package inmemdatastore
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// The keys of the map[string]interface{} representation of an HLC.
+	HLCFieldWallTime = "wall_time"
+	HLCFieldLogical  = "logical"
+)
+
+// HLC is a hybrid logical clock timestamp.  It orders events by wall clock time, in unix nanos,
+// and by a logical counter for events with the same wall clock time, so that causally related
+// events are ordered correctly even if the wall clocks of the nodes that generated them are skewed.
+type HLC struct {
+	WallTime int64
+	Logical  int64
+}
+
+// Compare returns -1, 0 or 1 if h is before, the same as, or after o.
+func (h HLC) Compare(o HLC) int {
+	if h.WallTime != o.WallTime {
+		return compareValues(h.WallTime, o.WallTime)
+	}
+	return compareValues(h.Logical, o.Logical)
+}
+
+// Map returns the HLC as a map[string]interface{}, suitable for a field of a record that is
+// persisted with an Avro record schema with long HLCFieldWallTime and HLCFieldLogical fields.
+func (h HLC) Map() map[string]interface{} {
+	return map[string]interface{}{HLCFieldWallTime: h.WallTime, HLCFieldLogical: h.Logical}
+}
+
+func toHLC(val interface{}) (HLC, bool) {
+	switch v := val.(type) {
+	case HLC:
+		return v, true
+	case *HLC:
+		if v == nil {
+			return HLC{}, false
+		}
+		return *v, true
+	case map[string]interface{}:
+		wallTime, ok := v[HLCFieldWallTime].(int64)
+		if !ok {
+			return HLC{}, false
+		}
+		logical, ok := v[HLCFieldLogical].(int64)
+		if !ok {
+			return HLC{}, false
+		}
+		return HLC{WallTime: wallTime, Logical: logical}, true
+	default:
+		return HLC{}, false
+	}
+}
+
+// HLClock generates HLC timestamps for the records written by a single node.
+type HLClock struct {
+	last HLC
+	now  func() int64
+	mux  *sync.Mutex
+}
+
+func NewHLClock() *HLClock {
+	return &HLClock{
+		now: func() int64 { return time.Now().UnixNano() },
+		mux: &sync.Mutex{},
+	}
+}
+
+// Now returns a timestamp for a local event that is after all of the timestamps previously
+// returned by, or passed to Update on, the clock.
+func (c *HLClock) Now() HLC {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	wallTime := c.now()
+	if wallTime > c.last.WallTime {
+		c.last = HLC{WallTime: wallTime}
+	} else {
+		c.last.Logical++
+	}
+	return c.last
+}
+
+// Update advances the clock past a timestamp received from another node and returns a timestamp
+// for the receipt of it.
+func (c *HLClock) Update(remote HLC) HLC {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	wallTime := c.now()
+	switch {
+	case wallTime > c.last.WallTime && wallTime > remote.WallTime:
+		c.last = HLC{WallTime: wallTime}
+	case remote.WallTime > c.last.WallTime:
+		c.last = HLC{WallTime: remote.WallTime, Logical: remote.Logical + 1}
+	case c.last.WallTime > remote.WallTime:
+		c.last.Logical++
+	default:
+		if remote.Logical > c.last.Logical {
+			c.last.Logical = remote.Logical
+		}
+		c.last.Logical++
+	}
+	return c.last
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"hash/fnv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/rchapin/rlog"
@@ -14,8 +15,42 @@ const (
 	RecFieldId = "id"
 )
 
+// PersistenceEntry is a single unit of work handed to the Persisters via the PersistenceChan.
+type PersistenceEntry struct {
+	// The key under which the record is stored in the datastore.
+	Key string
+	// The record to be persisted.  Nil for a tombstone.
+	Record map[string]interface{}
+	// Whether this entry is a tombstone that records the deletion of the Key.
+	Tombstone bool
+	// For a tombstone, the timestamp of the deletion.
+	Timestamp int64
+	// If set, this entry is a batch of records, put with PutBatch, that are persisted as a single
+	// unit and the other fields are not used.
+	Batch []*PersistenceEntry
+	// The deadline, in unix nanos, at which the record expires, or zero if it does not.  It is kept
+	// in the write-ahead log and snapshots so that a replayed record expires when it would have.
+	deadline int64
+	// If set, the Persister sends the result of durably writing the entry on this channel.
+	done chan error
+	// The write-ahead log segment to which the entry was written, or the overflow file from which
+	// it was drained, if any, which is released once the Persister is done with the entry.
+	walSegment *walSegment
+}
+
+// Durability determines when a Put returns relative to when its record is persisted.
+type Durability int
+
+const (
+	// Put returns as soon as the record has been handed off to the Persisters.
+	DurabilityAsync Durability = iota
+	// Put blocks until a Persister has written the record and synced it to disk, or until the
+	// SyncTimeout passes.
+	DurabilitySync
+)
+
 type (
-	PersistenceChan chan map[string]interface{}
+	PersistenceChan chan *PersistenceEntry
 	Persisters      map[int]*Persister
 	Datastores      map[uint64]*Datastore
 	Config          struct {
@@ -24,41 +59,223 @@ type (
 		PersistanceChanBuffSize int
 		Persisters              Persisters
 		// The top-level key in the map[string]interface{} records that will be stored in the
-		// InMemoryDataStore.  This is required for the Put method to process a new record.
+		// InMemoryDataStore.  Records are ordered by it unless a ConflictResolver is provided, and
+		// deletes are always ordered by it.
 		RecordTimestampKey string
+		// Decides whether a record replaces the existing record for the same key.  Defaults to an
+		// LWWResolver on the RecordTimestampKey.
+		ConflictResolver ConflictResolver
+		// The top-level key in the map[string]interface{} records that contains the key under which
+		// the record is stored.  It is used to re-populate the InMemoryDataStore from persisted
+		// records on start-up.  Defaults to RecFieldId.
+		RecordIdKey string
+		// The directory into which the Persisters write their data files.  If set, Start will
+		// pre-populate the InMemoryDataStore with the most recent record for each key found in the
+		// files in this directory.
+		DataDir string
+		// Used to decode the records in the files written to the DataDir by RawFileWriters, by the
+		// Encoding of each record, when re-populating the InMemoryDataStore.  The records with an
+		// Encoding that none of them decode are counted as invalid.
+		Deserializers []Deserializer
+		// The amount of time after which a record expires and is evicted from the
+		// InMemoryDataStore.  Zero disables expiry.  It can be overridden for a single record with
+		// PutWithTTL.  The records recovered from the data files, which do not hold their
+		// deadlines, are given this TTL again, which with TTLModeWallClock restarts their expiry.
+		TTL time.Duration
+		// What the TTL of a record is measured against.  Defaults to TTLModeWallClock.
+		TTLMode TTLMode
+		// The unit of the int64 values of the RecordTimestampKey, used to measure TTLs when the
+		// TTLMode is TTLModeRecordTimestamp.  Defaults to time.Nanosecond.
+		RecordTimestampUnit time.Duration
+		// How often the expired records and tombstones are evicted.  Defaults to
+		// DefaultTTLSweepInterval.  The sweeper only runs if either the TTL, the TombstoneTTL or
+		// the TTLSweepInterval is set.
+		TTLSweepInterval time.Duration
+		// How long the tombstone of a deleted key is kept, measured from the timestamp of the
+		// delete in the RecordTimestampUnit.  Once it has passed, the tombstone is evicted by the
+		// sweeper and is dropped when the data files are compacted, after which a Put of a record
+		// that is older than the delete, or that has no timestamp, is written again.  It should be
+		// longer than any record is expected to be delayed by.  Zero keeps each tombstone until
+		// the key is written again.
+		TombstoneTTL time.Duration
+		// An optional channel on which an ExpiryEvent is sent for each record that is evicted.
+		ExpiryChan ExpiryChan
+		// When Put returns relative to when its record is persisted.  Defaults to DurabilityAsync.
+		Durability Durability
+		// With DurabilitySync, the maximum amount of time that Put will wait for its record to be
+		// persisted.  Zero means that it will wait indefinitely.
+		SyncTimeout time.Duration
+		// An optional channel on which the Persisters report their failures.  The Persisters never
+		// block on the channel, if it is full the error is logged and dropped.
+		ErrorChan PersisterErrorChan
+		// What happens to an entry for the Persisters when the PersistenceChan is full.  Defaults
+		// to BackpressureBlock.
+		BackpressurePolicy BackpressurePolicy
+		// With BackpressureBlockWithTimeout, the maximum amount of time to wait for space on the
+		// PersistenceChan.  Defaults to DefaultBackpressureTimeout.
+		BackpressureTimeout time.Duration
+		// The directory to which entries are spilled with BackpressureSpill.  Required for
+		// BackpressureSpill.  It should be separate from the DataDir.
+		OverflowDir string
+		// If set, each Put, PutBatch and Delete is appended to a write-ahead log in this directory
+		// before it returns, and on start-up the log is replayed before the DataDir is read.  It
+		// should be separate from the DataDir.  The Writers of the Persisters, and all of the
+		// Writers of a MultiWriter, must be Syncers.
+		WALDir string
+		// When the write-ahead log is synced to disk.  Defaults to WALSyncAlways.
+		WALSyncPolicy WALSyncPolicy
+		// With WALSyncInterval, how often the write-ahead log is synced.  Defaults to
+		// DefaultWALSyncInterval.
+		WALSyncInterval time.Duration
+		// The size at which a write-ahead log segment is rotated.  Defaults to
+		// DefaultWALSegmentMaxBytes.
+		WALSegmentMaxBytes int64
+		// How often the write-ahead log segments whose entries have been durably persisted by the
+		// Persisters are removed.  Defaults to DefaultWALCheckpointInterval.
+		WALCheckpointInterval time.Duration
+		// If set, a snapshot of the datastore is written to this directory every SnapshotInterval,
+		// and on start-up the datastore is re-populated from the most recent snapshot and only the
+		// data files written after it.  It should be separate from the DataDir.
+		SnapshotDir string
+		// How often a snapshot is written.  Defaults to DefaultSnapshotInterval.
+		SnapshotInterval time.Duration
+		// The number of snapshot files that are kept.  Defaults to DefaultSnapshotRetain.
+		SnapshotRetain int
+		// How often the closed data files in the DataDir are compacted.  Zero disables the
+		// background compaction, in which case Compact can still be called directly.  Only the
+		// files written by an AvroFileWriter are compacted, so it requires that all of the Writers
+		// are AvroFileWriters.
+		CompactionInterval time.Duration
+		// The minimum number of closed data files that are compacted.  Defaults to
+		// DefaultCompactionMinFiles.
+		CompactionMinFiles int
+		// The number of the most recent records for each key that compaction keeps.  Defaults to
+		// one.
+		CompactionRetainVersions int
+		// If set, compaction also keeps all of the records whose RecordTimestampKey is within this
+		// duration of the current time.
+		CompactionRetainDuration time.Duration
+		// How often the retention limits on the DataDir are enforced.  Defaults to
+		// DefaultRetentionInterval.  Retention only runs if at least one of the limits is set.
+		RetentionInterval time.Duration
+		// The maximum total size, in bytes, of the files in the DataDir.
+		RetentionMaxBytes int64
+		// The maximum age of a closed data file in the DataDir, measured from when it was last
+		// written.
+		RetentionMaxAge time.Duration
+		// The minimum number of bytes that are to be kept free on the file system of the DataDir.
+		// If it cannot be met by removing closed data files the IMDS rejects Puts, PutBatches and
+		// Deletes with ErrInsufficientDiskSpace until it can.
+		RetentionMinFreeBytes int64
+		// If set, the data files removed to enforce the retention limits are moved to this directory
+		// instead of being deleted.  It should be on a different file system from the DataDir.
+		RetentionArchiveDir string
+		// If set, the closed data files in the DataDir are uploaded to this object store.
+		ShipperStore ObjectStore
+		// How often the closed data files are shipped.  Defaults to DefaultShipperInterval.
+		ShipperInterval time.Duration
+		// The size of each part of the multipart uploads.  Defaults to DefaultShipperPartSize, and
+		// must be at least MinShipperPartSize.
+		ShipperPartSize int64
+		// Prepended to the name of each data file to form the key of its object.
+		ShipperKeyPrefix string
+		// What happens to a data file once it has been shipped.  Defaults to ShipMark.
+		ShipperPolicy ShipPolicy
+		// How each request to the ShipperStore is retried.  Zero values are replaced with the
+		// defaults.
+		ShipperRetry RetryPolicy
+		// The file in which the progress of the uploads is tracked.  Defaults to the
+		// ShipperManifestFileName in the DataDir.
+		ShipperManifestPath string
 	}
 )
 
 type Datastore struct {
-	Id        uint64
-	Data      map[string]interface{}
-	NumReads  int64
-	NumWrites int64
-	mux       *sync.RWMutex
+	Id   uint64
+	Data map[string]interface{}
+	// The timestamps of the most recent deletes of keys that are not currently in the Data map.
+	// Used to reject any Put of a record older than the delete.  Evicting one only affects the
+	// datastore, the tombstone has already been handed off to the Persisters.
+	Tombstones map[string]int64
+	// The deadlines, in unix nanos, at which the records for the keys expire.
+	Expiries map[string]int64
+	// Updated atomically, since it is incremented while only holding the read lock.
+	NumReads   int64
+	NumWrites  int64
+	NumDeletes int64
+	NumExpired int64
+	// The number of tombstones evicted once their TombstoneTTL passed.
+	NumTombstonesEvicted int64
+	// The number of Puts with each PutOutcome.
+	NumInserted              int64
+	NumReplaced              int64
+	NumStaleSkipped          int64
+	NumNoTimestampOverwrites int64
+	expiryQueue              expiryQueue
+	tombstoneQueue           expiryQueue
+	mux                      *sync.RWMutex
 }
 
 func NewDatastore(id uint64) *Datastore {
 	return &Datastore{
-		Id:        id,
-		Data:      make(map[string]interface{}),
-		NumReads:  0,
-		NumWrites: 0,
-		mux:       &sync.RWMutex{},
+		Id:         id,
+		Data:       make(map[string]interface{}),
+		Tombstones: make(map[string]int64),
+		Expiries:   make(map[string]int64),
+		NumReads:   0,
+		NumWrites:  0,
+		NumDeletes: 0,
+		NumExpired: 0,
+		mux:        &sync.RWMutex{},
 	}
 }
 
 type InMemDataStore struct {
-	ctx                context.Context
-	cancel             context.CancelFunc
-	wg                 *sync.WaitGroup
-	datastores         Datastores
-	numShards          int
-	recordTimestampKey string
-	persisters         Persisters
-	startTime          int64
-	persisterCtx       context.Context
-	persisterCancel    context.CancelFunc
-	persistenceChan    PersistenceChan
+	ctx                   context.Context
+	cancel                context.CancelFunc
+	wg                    *sync.WaitGroup
+	datastores            Datastores
+	numShards             int
+	recordTimestampKey    string
+	recordIdKey           string
+	resolver              ConflictResolver
+	dataDir               string
+	deserializers         map[Encoding]Deserializer
+	recoveryStats         RecoveryStats
+	persisters            Persisters
+	startTime             int64
+	persisterCtx          context.Context
+	persisterCancel       context.CancelFunc
+	persistenceChan       PersistenceChan
+	ttl                   time.Duration
+	ttlMode               TTLMode
+	ttlSweepInterval      time.Duration
+	tombstoneTTL          time.Duration
+	recordTimestampUnit   time.Duration
+	expiryChan            ExpiryChan
+	durability            Durability
+	syncTimeout           time.Duration
+	errorChan             PersisterErrorChan
+	backpressurePolicy    BackpressurePolicy
+	backpressureTimeout   time.Duration
+	overflowDir           string
+	overflow              *overflowFile
+	counters              persistenceCounters
+	wal                   *writeAheadLog
+	walSyncInterval       time.Duration
+	walCheckpointInterval time.Duration
+	// The entries replayed from the write-ahead log during Start, which are handed off to the
+	// Persisters once they are running.
+	walReplayed []*PersistenceEntry
+	snapshotter *snapshotter
+	compactor   *compactor
+	retention   *retention
+	shipper     *shipper
+	// Used to manage the go routines, other than the Persisters, that the IMDS runs in the
+	// background.
+	bgCtx    context.Context
+	bgCancel context.CancelFunc
+	bgWg     *sync.WaitGroup
 }
 
 func NewInMemDatastore(ctx context.Context, cancel context.CancelFunc, wg *sync.WaitGroup, cfg Config) *InMemDataStore {
@@ -68,24 +285,97 @@ func NewInMemDatastore(ctx context.Context, cancel context.CancelFunc, wg *sync.
 	// close before exiting.
 	persisterCtx, persisterCancel := context.WithCancel(context.Background())
 
+	bgCtx, bgCancel := context.WithCancel(context.Background())
+
+	recordIdKey := cfg.RecordIdKey
+	if recordIdKey == "" {
+		recordIdKey = RecFieldId
+	}
+	resolver := cfg.ConflictResolver
+	if resolver == nil {
+		resolver = NewLWWResolver(cfg.RecordTimestampKey)
+	}
+	recordTimestampUnit := cfg.RecordTimestampUnit
+	if recordTimestampUnit == 0 {
+		recordTimestampUnit = time.Nanosecond
+	}
+	backpressureTimeout := cfg.BackpressureTimeout
+	if backpressureTimeout == 0 {
+		backpressureTimeout = DefaultBackpressureTimeout
+	}
+	ttlSweepInterval := cfg.TTLSweepInterval
+	if ttlSweepInterval == 0 && (cfg.TTL > 0 || cfg.TombstoneTTL > 0) {
+		ttlSweepInterval = DefaultTTLSweepInterval
+	}
+
+	walSyncInterval := cfg.WALSyncInterval
+	if walSyncInterval == 0 {
+		walSyncInterval = DefaultWALSyncInterval
+	}
+	walCheckpointInterval := cfg.WALCheckpointInterval
+	if walCheckpointInterval == 0 {
+		walCheckpointInterval = DefaultWALCheckpointInterval
+	}
+
+	deserializers := make(map[Encoding]Deserializer, len(cfg.Deserializers))
+	for _, deserializer := range cfg.Deserializers {
+		deserializers[deserializer.Encoding()] = deserializer
+	}
+
 	retval := &InMemDataStore{
-		ctx:                ctx,
-		cancel:             cancel,
-		wg:                 wg,
-		datastores:         make(Datastores, cfg.NumDatastoreShards),
-		numShards:          cfg.NumDatastoreShards,
-		recordTimestampKey: cfg.RecordTimestampKey,
-		persisters:         cfg.Persisters,
-		persistenceChan:    cfg.PersistenceChan,
-		persisterCtx:       persisterCtx,
-		persisterCancel:    persisterCancel,
+		ctx:                   ctx,
+		cancel:                cancel,
+		wg:                    wg,
+		datastores:            make(Datastores, cfg.NumDatastoreShards),
+		numShards:             cfg.NumDatastoreShards,
+		recordTimestampKey:    cfg.RecordTimestampKey,
+		recordIdKey:           recordIdKey,
+		resolver:              resolver,
+		dataDir:               cfg.DataDir,
+		deserializers:         deserializers,
+		persisters:            cfg.Persisters,
+		persistenceChan:       cfg.PersistenceChan,
+		persisterCtx:          persisterCtx,
+		persisterCancel:       persisterCancel,
+		ttl:                   cfg.TTL,
+		ttlMode:               cfg.TTLMode,
+		ttlSweepInterval:      ttlSweepInterval,
+		tombstoneTTL:          cfg.TombstoneTTL,
+		recordTimestampUnit:   recordTimestampUnit,
+		expiryChan:            cfg.ExpiryChan,
+		durability:            cfg.Durability,
+		syncTimeout:           cfg.SyncTimeout,
+		errorChan:             cfg.ErrorChan,
+		backpressurePolicy:    cfg.BackpressurePolicy,
+		backpressureTimeout:   backpressureTimeout,
+		overflowDir:           cfg.OverflowDir,
+		overflow:              newOverflowFile(cfg.OverflowDir),
+		wal:                   newWriteAheadLog(cfg.WALDir, cfg.WALSyncPolicy, cfg.WALSegmentMaxBytes),
+		walSyncInterval:       walSyncInterval,
+		walCheckpointInterval: walCheckpointInterval,
+		snapshotter:           newSnapshotter(cfg.SnapshotDir, cfg.SnapshotInterval, cfg.SnapshotRetain),
+		compactor:             newCompactor(cfg),
+		retention:             newRetention(cfg),
+		shipper:               newShipper(cfg),
+		bgCtx:                 bgCtx,
+		bgCancel:              bgCancel,
+		bgWg:                  &sync.WaitGroup{},
 	}
 	for i := uint64(0); i < uint64(retval.numShards); i++ {
 		retval.datastores[i] = NewDatastore(i)
 	}
+	for _, persister := range retval.persisters {
+		persister.errorChan = cfg.ErrorChan
+	}
 	return retval
 }
 
+// Errors returns the channel on which the Persisters report their failures, as provided in the
+// Config.
+func (ds *InMemDataStore) Errors() PersisterErrorChan {
+	return ds.errorChan
+}
+
 func (ds *InMemDataStore) Get(key string) (interface{}, error) {
 	datastore, err := ds.getDatastoreShard(key)
 	if err != nil {
@@ -93,20 +383,20 @@ func (ds *InMemDataStore) Get(key string) (interface{}, error) {
 	}
 	datastore.mux.RLock()
 	rec := datastore.Data[key]
-	datastore.NumReads++
+	if rec != nil && ds.expired(datastore, key) {
+		// The record has expired but the sweeper has not yet evicted it.
+		rec = nil
+	}
+	atomic.AddInt64(&datastore.NumReads, 1)
 	datastore.mux.RUnlock()
 	return rec, nil
 }
 
-// GetAll will return the entire in memory data store.  For a production grade piece of software we
-// would have to do something other than just returning a reference to the private map, such as a
-// deep copy.  For now, this is just here to facilitate testing.
+// GetAll returns a copy of all of the records in the datastore, as with Snapshot(false).
 func (ds *InMemDataStore) GetAll() map[string]interface{} {
 	retval := make(map[string]interface{})
-	for _, datastore := range ds.datastores {
-		for k, v := range datastore.Data {
-			retval[k] = v
-		}
+	for k, v := range ds.Snapshot(false) {
+		retval[k] = v
 	}
 	return retval
 }
@@ -115,44 +405,78 @@ func (ds *InMemDataStore) GetDatastores() Datastores {
 	return ds.datastores
 }
 
-func (ds *InMemDataStore) Put(key string, val map[string]interface{}) error {
+// PutResult describes what a Put did with its record.
+type PutResult struct {
+	// What happened to the record in the datastore.  It is persisted regardless.
+	Outcome PutOutcome
+	// How the ConflictResolver resolved the conflict with the existing record.
+	Resolution Resolution
+}
+
+// Applied returns true if the record was written to the datastore.
+func (r PutResult) Applied() bool {
+	return r.Resolution.Applied()
+}
+
+// Put writes the record to the datastore, unless the ConflictResolver decides that the existing
+// record for the key is newer, appends it to the write-ahead log, if there is one, and hands it off
+// to the Persisters.  If the record is invalid for the ConflictResolver an error is returned and the
+// record is neither written nor persisted.  If the PersistenceChan is full the BackpressurePolicy
+// applies, and an error may be returned even though the record has been written to the datastore.
+func (ds *InMemDataStore) Put(key string, val map[string]interface{}) (PutResult, error) {
+	return ds.PutWithTTL(key, val, ds.ttl)
+}
+
+// PutWithTTL is the same as Put, but overrides the TTL configured for the datastore with the
+// given ttl for this record.  A ttl of zero means that the record does not expire.
+func (ds *InMemDataStore) PutWithTTL(key string, val map[string]interface{}, ttl time.Duration) (PutResult, error) {
+	ctx, cancel := ds.syncContext()
+	defer cancel()
+	return ds.put(ctx, key, val, ttl, ds.durability == DurabilitySync)
+}
+
+// syncContext returns the context with which a Put waits for its record to be persisted with
+// DurabilitySync.
+func (ds *InMemDataStore) syncContext() (context.Context, context.CancelFunc) {
+	if ds.durability == DurabilitySync && ds.syncTimeout > 0 {
+		return context.WithTimeout(context.Background(), ds.syncTimeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// PutSync is the same as Put, but blocks until a Persister has written the record and synced it to
+// disk, or until the context is done.  Any error encountered while persisting the record is
+// returned, in which case the record has still been written to the datastore.  If the context is
+// done first its error is returned and the record may yet be persisted.
+func (ds *InMemDataStore) PutSync(ctx context.Context, key string, val map[string]interface{}) (PutResult, error) {
+	return ds.put(ctx, key, val, ds.ttl, true)
+}
+
+func (ds *InMemDataStore) put(
+	ctx context.Context,
+	key string,
+	val map[string]interface{},
+	ttl time.Duration,
+	durable bool,
+) (PutResult, error) {
 	datastore, err := ds.getDatastoreShard(key)
 	if err != nil {
-		return err
+		return PutResult{}, err
+	}
+	err = ds.retention.reject(key, ds.dataDir)
+	if err != nil {
+		return PutResult{}, err
 	}
+	deadline := ds.expiryDeadline(val, ttl)
 	datastore.mux.Lock()
-
-	// Here we validate that we do not yet have a record in the datastore that is newer than this
-	// one.  It is entirely possible, given multiple concurrent writes that a record was put into
-	// the datastore that is newer than the current one that we are trying to write.  In that case,
-	// we need to verify that there isn't a record that is newer.  Otherwise, we will not be
-	// reflecting the current state of the system.  Regardless, we still want to persist this record
-	// to disk.k
-	//
-	// First, attempt to get this record from the datastore
-	data := datastore.Data
-	rec, ok := data[key]
-	if !ok {
-		// We don't yet have a record for this key in the datastore at all, just write it and continue
-		data[key] = val
-	} else {
-		// Get the collection_time from the existing record and ensure that it is older
-		recMap := rec.(map[string]interface{})
-		existingTimestamp, ok := recMap[ds.recordTimestampKey].(int64)
-		if !ok {
-			// There is no top-level key in the recMap pulled from the cache to which we can compare
-			// timestamps, we will just write it.
-			// TODO: add some sort of stat that we can return to the caller
-			data[key] = val
-		} else {
-			if existingTimestamp < val[ds.recordTimestampKey].(int64) {
-				// The incoming record is newer than what we currently have in the cache, we should
-				// persist this in the cache.
-				data[key] = val
-			}
-		}
+	_, existed := datastore.Data[key]
+	resolution, err := ds.cache(datastore, key, val, deadline)
+	if err != nil {
+		datastore.mux.Unlock()
+		return PutResult{}, fmt.Errorf("unable to put record; key=%s, err=%w", key, err)
 	}
-
+	result := PutResult{Outcome: putOutcome(resolution, existed), Resolution: resolution}
+	datastore.countOutcome(result.Outcome)
 	datastore.NumWrites++
 	numWrites := datastore.NumWrites
 	datastore.mux.Unlock()
@@ -160,27 +484,257 @@ func (ds *InMemDataStore) Put(key string, val map[string]interface{}) error {
 		log.Infof("IMDS Datastore writes, id=%d, numWrites=%d", datastore.Id, numWrites)
 	}
 
-	ds.persistenceChan <- val
-	return nil
+	return result, ds.logAndHandOff(ctx, &PersistenceEntry{Key: key, Record: val, deadline: deadline}, durable)
+}
+
+// logAndHandOff appends the entry to the write-ahead log and then hands it off to the Persisters.
+// The entry has already been applied to the datastore, so if it cannot be appended to the log the
+// error is only logged, and it is still handed off to be persisted.
+func (ds *InMemDataStore) logAndHandOff(
+	ctx context.Context,
+	entry *PersistenceEntry,
+	durable bool,
+) error {
+	err := ds.wal.appendEntry(entry)
+	if err != nil {
+		log.Errorf("IMDS unable to append to write-ahead log, handing off entry without it; key=%s, err=%s", entry.Key, err)
+	}
+	return ds.handOff(ctx, entry, durable)
+}
+
+// handOff enqueues the entry for the Persisters and, if durable, waits until a Persister has written
+// it and synced it to disk, or until the context is done.
+func (ds *InMemDataStore) handOff(ctx context.Context, entry *PersistenceEntry, durable bool) error {
+	if !durable {
+		err := ds.enqueue(ctx, entry)
+		if err != nil {
+			entry.walSegment.release()
+		}
+		return err
+	}
+	entry.done = make(chan error, 1)
+	err := ds.enqueue(ctx, entry)
+	if err != nil {
+		entry.walSegment.release()
+		return err
+	}
+	select {
+	case err := <-entry.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Delete removes the record for the key from the datastore, unless the datastore contains a record
+// for the key that is newer than the timestamp.  A tombstone with the timestamp is kept for the key
+// so that any Put of a record that is older than the delete, or that has no timestamp, will not be
+// written to the datastore.
+// As with Put, the tombstone is persisted regardless of whether it was applied to the datastore.
+func (ds *InMemDataStore) Delete(key string, timestamp int64) error {
+	datastore, err := ds.getDatastoreShard(key)
+	if err != nil {
+		return err
+	}
+	err = ds.retention.reject(key, ds.dataDir)
+	if err != nil {
+		return err
+	}
+	datastore.mux.Lock()
+	ds.tombstone(datastore, key, timestamp)
+	datastore.NumDeletes++
+	datastore.mux.Unlock()
+
+	entry := &PersistenceEntry{Key: key, Tombstone: true, Timestamp: timestamp}
+	return ds.logAndHandOff(context.Background(), entry, false)
 }
 
-// Start will spin up the Persisters and when it returns will be ready for reads and writes.
-func (ds *InMemDataStore) Start() {
+// GetRecoveryStats returns the stats gathered while re-populating the datastore from the DataDir
+// during Start.
+func (ds *InMemDataStore) GetRecoveryStats() RecoveryStats {
+	return ds.recoveryStats
+}
+
+// Start will re-populate the datastore from any data previously persisted to the DataDir, spin up
+// the Persisters and when it returns will be ready for reads and writes.
+func (ds *InMemDataStore) Start() error {
 	ds.startTime = time.Now().UTC().UnixMilli()
+	if ds.backpressurePolicy == BackpressureSpill && ds.overflowDir == "" {
+		return fmt.Errorf("an OverflowDir is required for BackpressureSpill")
+	}
+	if ds.shipper != nil && ds.dataDir == "" {
+		return fmt.Errorf("a DataDir is required for a ShipperStore")
+	}
+	if ds.shipper != nil && ds.shipper.partSize < MinShipperPartSize {
+		return fmt.Errorf("a ShipperPartSize of at least %d is required; partSize=%d", MinShipperPartSize, ds.shipper.partSize)
+	}
+	// The write-ahead log is truncated once the Writers have been synced, so an entry that is only
+	// buffered by a Writer that cannot be synced would be lost from both.
+	for _, persister := range ds.persisters {
+		if ds.wal != nil && !syncable(persister.Writer) {
+			return fmt.Errorf(
+				"%w: the Writers must be Syncers with a WALDir; persisterId=%d", ErrSyncNotSupported, persister.id)
+		}
+		// Compaction only reads the Avro data files, so the files of any other Writer would grow
+		// without ever being compacted.
+		if ds.dataDir != "" && ds.compactor.interval > 0 && !compactable(persister.Writer) {
+			return fmt.Errorf(
+				"the Writers must be AvroFileWriters with a CompactionInterval; persisterId=%d", persister.id)
+		}
+	}
+	if ds.dataDir != "" || ds.wal != nil || ds.snapshotter != nil {
+		stats, err := ds.recover()
+		if err != nil {
+			return err
+		}
+		ds.recoveryStats = stats
+		log.Infof(
+			"IMDS recovery complete, snapshotPath=%s, snapshotRecords=%d, walSegmentsRead=%d, walEntriesReplayed=%d, "+
+				"filesRead=%d, filesSkipped=%d, recordsRead=%d, recordsSkipped=%d, recordsInvalid=%d, tombstonesRead=%d",
+			stats.SnapshotPath, stats.SnapshotRecords, stats.WALSegmentsRead, stats.WALEntriesReplayed,
+			stats.FilesRead, stats.FilesSkipped, stats.RecordsRead, stats.RecordsSkipped, stats.RecordsInvalid,
+			stats.TombstonesRead)
+	}
+	if ds.overflowDir != "" {
+		err := ds.recoverOverflow()
+		if err != nil {
+			return err
+		}
+		ds.runOverflowDrainer()
+	}
 	for _, persister := range ds.persisters {
 		persister.Run()
 	}
+	if ds.wal != nil {
+		ds.handOffReplayed()
+		if ds.wal.policy == WALSyncInterval {
+			ds.runWALSyncer()
+		}
+		ds.runWALCheckpointer()
+	}
+	// The sweeper is only started once everything has been recovered, so that it does not contend
+	// with the recovery for the shards, and it evicts the recovered records that have expired on
+	// its first run.
+	if ds.ttlSweepInterval > 0 {
+		ds.runSweeper()
+	}
+	if ds.snapshotter != nil {
+		ds.runSnapshotter()
+	}
+	if ds.dataDir != "" && ds.compactor.interval > 0 {
+		ds.runCompactor()
+	}
+	if ds.dataDir != "" && ds.retention != nil {
+		ds.runRetention()
+	}
+	if ds.shipper != nil {
+		err := ds.shipper.loadManifest()
+		if err != nil {
+			return err
+		}
+		ds.runShipper()
+	}
+	return nil
 }
 
 // Shutdown will signal the Serializers to close their open file handles and shutdown the IMDS.
 func (ds *InMemDataStore) Shutdown() {
 	log.Info("Shutdown command received, shutting down serializers")
+	ds.bgCancel()
+	ds.bgWg.Wait()
 	ds.persisterCancel()
 	log.Info("Waiting for serializers to finish shutting down")
 	ds.wg.Wait()
+	if ds.wal != nil {
+		ds.closeWAL()
+	}
 	log.Info("Shutdown complete")
 }
 
+// cache writes the record to the given Datastore shard for the key, to expire at the given
+// deadline, unless the shard already contains a newer record for it.  The caller must hold the
+// write lock for the shard.
+func (ds *InMemDataStore) cache(
+	datastore *Datastore,
+	key string,
+	val map[string]interface{},
+	deadline int64,
+) (Resolution, error) {
+	resolution, err := ds.write(datastore, key, val)
+	if err != nil || !resolution.Applied() {
+		return resolution, err
+	}
+	ds.setExpiry(datastore, key, deadline)
+	return resolution, nil
+}
+
+func (ds *InMemDataStore) write(datastore *Datastore, key string, val map[string]interface{}) (Resolution, error) {
+	// Here we validate that we do not yet have a record in the datastore that is newer than this
+	// one.  It is entirely possible, given multiple concurrent writes that a record was put into
+	// the datastore that is newer than the current one that we are trying to write.  In that case,
+	// we need to verify that there isn't a record that is newer.  Otherwise, we will not be
+	// reflecting the current state of the system.  Regardless, we still want to persist this record
+	// to disk.
+	//
+	// First, attempt to get this record from the datastore
+	data := datastore.Data
+	var existing map[string]interface{}
+	if rec, ok := data[key]; ok {
+		existing = rec.(map[string]interface{})
+	}
+	resolution, err := ds.resolver.Resolve(existing, val)
+	if err != nil || !resolution.Applied() {
+		return resolution, err
+	}
+	if existing == nil {
+		// If the key was deleted, only write the record if it is newer than the delete.  A record
+		// without a timestamp cannot be ordered against the delete, so the delete wins, as it does
+		// when the tombstones are applied on recovery and when the data files are compacted.
+		deletedTimestamp, deleted := datastore.Tombstones[key]
+		if deleted {
+			timestamp, ok := ds.recordTimestamp(val)
+			if !ok || deletedTimestamp > timestamp {
+				return ResolutionStale, nil
+			}
+			if deletedTimestamp == timestamp {
+				// Deletes win ties.
+				return ResolutionTie, nil
+			}
+			delete(datastore.Tombstones, key)
+		}
+	}
+	data[key] = val
+	return resolution, nil
+}
+
+// tombstone removes the record for the key from the given Datastore shard and records the
+// timestamp of the delete, unless the shard contains a record or a tombstone for the key that is
+// newer.  The caller must hold the write lock for the shard.  Returns true if the tombstone was
+// applied.
+func (ds *InMemDataStore) tombstone(datastore *Datastore, key string, timestamp int64) bool {
+	if deletedTimestamp, ok := datastore.Tombstones[key]; ok && deletedTimestamp >= timestamp {
+		return false
+	}
+	if rec, ok := datastore.Data[key]; ok {
+		existingTimestamp, ok := ds.recordTimestamp(rec.(map[string]interface{}))
+		if ok && existingTimestamp > timestamp {
+			return false
+		}
+		delete(datastore.Data, key)
+		delete(datastore.Expiries, key)
+	}
+	datastore.Tombstones[key] = timestamp
+	if ds.tombstoneTTL > 0 {
+		pushExpiry(
+			&datastore.tombstoneQueue,
+			expiry{key: key, deadline: ds.tombstoneDeadline(timestamp)},
+			datastore.Tombstones,
+			ds.tombstoneDeadline,
+		)
+	}
+	return true
+}
+
 func (ds *InMemDataStore) getDatastoreShard(key string) (*Datastore, error) {
 	shardId := GetDatastoreShardId(key, ds.numShards)
 	datastore, ok := ds.datastores[shardId]
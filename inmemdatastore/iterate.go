@@ -0,0 +1,135 @@
+package inmemdatastore
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Range calls fn with a copy of each of the records in the datastore, until fn returns false.  Each
+// shard is copied under its read lock, which is released before fn is called, so fn may safely
+// read from or write to the datastore.  Because the shards are copied one at a time, the records
+// from different shards may reflect different points in time.  Expired records that have not yet
+// been evicted are skipped.
+func (ds *InMemDataStore) Range(fn func(key string, record map[string]interface{}) bool) {
+	for i := uint64(0); i < uint64(ds.numShards); i++ {
+		datastore := ds.datastores[i]
+		datastore.mux.RLock()
+		records := ds.copyShard(datastore)
+		datastore.mux.RUnlock()
+		for key, record := range records {
+			if !fn(key, record) {
+				return
+			}
+		}
+	}
+}
+
+// Snapshot returns a copy of all of the records in the datastore.  If consistent is true the read
+// locks for all of the shards are held while they are copied, blocking all writes for the duration,
+// so that the snapshot reflects a single point in time.  Otherwise, each shard is copied under its
+// own read lock in turn, as with Range.
+func (ds *InMemDataStore) Snapshot(consistent bool) map[string]map[string]interface{} {
+	retval := make(map[string]map[string]interface{})
+	if !consistent {
+		ds.Range(func(key string, record map[string]interface{}) bool {
+			retval[key] = record
+			return true
+		})
+		return retval
+	}
+
+	// Writers only ever hold the lock for a single shard, and we always acquire them in the same
+	// order, so this cannot deadlock.
+	for i := uint64(0); i < uint64(ds.numShards); i++ {
+		ds.datastores[i].mux.RLock()
+	}
+	defer func() {
+		for i := uint64(0); i < uint64(ds.numShards); i++ {
+			ds.datastores[i].mux.RUnlock()
+		}
+	}()
+	for i := uint64(0); i < uint64(ds.numShards); i++ {
+		for key, record := range ds.copyShard(ds.datastores[i]) {
+			retval[key] = record
+		}
+	}
+	return retval
+}
+
+// copyShard returns a deep copy of each of the unexpired records in the shard.  The caller must
+// hold at least the read lock for the shard.
+func (ds *InMemDataStore) copyShard(datastore *Datastore) map[string]map[string]interface{} {
+	retval := make(map[string]map[string]interface{}, len(datastore.Data))
+	for key, rec := range datastore.Data {
+		if ds.expired(datastore, key) {
+			continue
+		}
+		retval[key] = CopyRecord(rec.(map[string]interface{}))
+	}
+	return retval
+}
+
+// CopyRecord returns a deep copy of the record, copying any nested maps and slices, so that the
+// copy can be modified without affecting the original.
+func CopyRecord(record map[string]interface{}) map[string]interface{} {
+	if record == nil {
+		return nil
+	}
+	return copyValue(record).(map[string]interface{})
+}
+
+func copyValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		retval := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			retval[k] = copyValue(e)
+		}
+		return retval
+	case []interface{}:
+		retval := make([]interface{}, len(v))
+		for i, e := range v {
+			retval[i] = copyValue(e)
+		}
+		return retval
+	case []byte:
+		retval := make([]byte, len(v))
+		copy(retval, v)
+		return retval
+	case []string:
+		retval := make([]string, len(v))
+		copy(retval, v)
+		return retval
+	case []int64:
+		retval := make([]int64, len(v))
+		copy(retval, v)
+		return retval
+	case []float64:
+		retval := make([]float64, len(v))
+		copy(retval, v)
+		return retval
+	default:
+		// Scalars are copied by value.
+		return v
+	}
+}
+
+// Export writes a copy of each of the records in the datastore to the Writer, as unencoded records
+// ordered by key, and returns the number of records written.  The records are taken from a
+// Snapshot, with consistent passed through.  It is meant for one-shot exports, eg. with a
+// CSVFileWriter, and it is up to the caller to Shutdown the Writer once it is done with it.
+func (ds *InMemDataStore) Export(w Writer, consistent bool) (int, error) {
+	snapshot := ds.Snapshot(consistent)
+	keys := make([]string, 0, len(snapshot))
+	for key := range snapshot {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for i, key := range keys {
+		err := w.Write(&SerializedRecord{Key: key, Encoding: EncodingNone, Record: snapshot[key]})
+		if err != nil {
+			return i, fmt.Errorf("unable to export record; key=%s, err=%w", key, err)
+		}
+	}
+	return len(keys), nil
+}
@@ -0,0 +1,198 @@
+package inmemdatastore
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	JSONLinesFileExtension     = ".jsonl"
+	JSONLinesGzipFileExtension = ".jsonl.gz"
+)
+
+// JSONSerializer encodes the records as JSON objects, with EncodingJSON.
+type JSONSerializer struct{}
+
+func NewJSONSerializer() Serializer {
+	return &JSONSerializer{}
+}
+
+func (j *JSONSerializer) Serialize(key string, record map[string]interface{}) (*SerializedRecord, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	return &SerializedRecord{Key: key, Encoding: EncodingJSON, Data: data, Record: record}, nil
+}
+
+// JSONDeserializer decodes records with EncodingJSON.  As with ReadJSONLinesFile, integer values are
+// decoded as int64 and all other numbers as float64.
+type JSONDeserializer struct{}
+
+func NewJSONDeserializer() Deserializer {
+	return &JSONDeserializer{}
+}
+
+func (j *JSONDeserializer) Encoding() Encoding {
+	return EncodingJSON
+}
+
+func (j *JSONDeserializer) Deserialize(record *SerializedRecord) (map[string]interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(record.Data))
+	decoder.UseNumber()
+	retval := map[string]interface{}{}
+	err := decoder.Decode(&retval)
+	if err != nil {
+		return nil, err
+	}
+	normalizeJSONNumbers(retval)
+	return retval, nil
+}
+
+// JSONLinesFileWriter is a Writer that appends each record, as a single line of JSON, to a sequence
+// of segments named "<id>-<seq>.jsonl", or "<id>-<seq>.jsonl.gz" if they are compressed.  Records
+// with EncodingJSON are written as-is and records with EncodingNone are encoded by the writer, so it
+// can be paired with either the JSONSerializer or the NoopSerializer.  The segments are rotated and
+// closed in the same way as those of the AvroFileWriter.  The files are read back with
+// ReadJSONLinesFile.
+type JSONLinesFileWriter struct {
+	id       int
+	segments *segmentWriter
+	// Reused for assembling lines.  Only used while holding the mux of the segmentWriter.
+	buf []byte
+}
+
+type JSONLinesFileWriterConfig struct {
+	Id        int
+	OutputDir string
+	// Defines when the writer closes the file to which it is currently writing and opens a new
+	// one.  By default files are never rotated.  With Gzip the MaxBytes is measured against the
+	// compressed data that has been flushed to the file.
+	Rotation RotationPolicy
+	// Whether each segment is compressed as a gzip stream.
+	Gzip bool
+	// The compress/gzip level.  Zero selects gzip.DefaultCompression.
+	GzipLevel int
+}
+
+func NewJSONLinesFileWriter(
+	ctx context.Context,
+	wg *sync.WaitGroup,
+	cfg JSONLinesFileWriterConfig,
+) (*JSONLinesFileWriter, error) {
+	ext := JSONLinesFileExtension
+	newEncoder := func(w io.Writer) (segmentEncoder, error) {
+		return plainEncoder{w}, nil
+	}
+	if cfg.Gzip {
+		level := cfg.GzipLevel
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+			return nil, fmt.Errorf("invalid gzip level; level=%d", level)
+		}
+		ext = JSONLinesGzipFileExtension
+		newEncoder = func(w io.Writer) (segmentEncoder, error) {
+			return gzip.NewWriterLevel(w, level)
+		}
+	}
+	segments, err := newSegmentWriter(ctx, wg, segmentWriterConfig{
+		Id:         cfg.Id,
+		OutputDir:  cfg.OutputDir,
+		Ext:        ext,
+		Rotation:   cfg.Rotation,
+		NewEncoder: newEncoder,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &JSONLinesFileWriter{id: cfg.Id, segments: segments}, nil
+}
+
+func (j *JSONLinesFileWriter) Write(record *SerializedRecord) error {
+	return j.WriteBatch([]*SerializedRecord{record})
+}
+
+// WriteBatch appends the lines of all of the records to the current file with a single write.
+func (j *JSONLinesFileWriter) WriteBatch(records []*SerializedRecord) error {
+	lines := make([][]byte, len(records))
+	for i, record := range records {
+		switch record.Encoding {
+		case EncodingJSON:
+			lines[i] = record.Data
+		case EncodingNone:
+			data, err := json.Marshal(record.Record)
+			if err != nil {
+				return fmt.Errorf("%w: %s; index=%d, key=%s", ErrInvalidRecord, err, i, record.Key)
+			}
+			lines[i] = data
+		default:
+			return fmt.Errorf(
+				"%w: unsupported encoding; index=%d, key=%s, encoding=%s", ErrInvalidRecord, i, record.Key, record.Encoding)
+		}
+	}
+	return j.segments.write(len(records), func(enc segmentEncoder) error {
+		buf := j.buf[:0]
+		for _, line := range lines {
+			buf = append(buf, line...)
+			buf = append(buf, '\n')
+		}
+		j.buf = buf
+		_, err := enc.Write(buf)
+		return err
+	})
+}
+
+func (j *JSONLinesFileWriter) Sync() error {
+	return j.segments.sync()
+}
+
+func (j *JSONLinesFileWriter) Shutdown() error {
+	return j.segments.shutdown()
+}
+
+// ReadJSONLinesFile reads each of the records from a file written by a JSONLinesFileWriter and
+// passes them to fn.  Files with the JSONLinesGzipFileExtension are decompressed.  Integer values
+// are decoded as int64 and all other numbers as float64.
+func ReadJSONLinesFile(path string, fn func(map[string]interface{}) error) error {
+	fh, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	var r io.Reader = bufio.NewReader(fh)
+	if strings.HasSuffix(strings.TrimSuffix(path, TmpFileSuffix), JSONLinesGzipFileExtension) {
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("unable to read gzip header; path=%s, err=%w", path, err)
+		}
+		defer gr.Close()
+		r = gr
+	}
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	for {
+		record := map[string]interface{}{}
+		err := decoder.Decode(&record)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("unable to read record; path=%s, err=%w", path, err)
+		}
+		normalizeJSONNumbers(record)
+		err = fn(record)
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package inmemdatastore
+
+import (
+	"encoding/json"
+)
+
+// normalizeJSONNumbers walks a value decoded with json.Decoder.UseNumber and replaces each
+// json.Number with an int64, if it is an integer, or a float64.  Decoding every number as a float64
+// would lose the precision of int64 values such as unix nano timestamps.
+func normalizeJSONNumbers(val interface{}) interface{} {
+	switch v := val.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+		return v.String()
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = normalizeJSONNumbers(e)
+		}
+		return v
+	case []interface{}:
+		for i, e := range v {
+			v[i] = normalizeJSONNumbers(e)
+		}
+		return v
+	default:
+		return v
+	}
+}
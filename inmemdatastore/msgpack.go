@@ -0,0 +1,51 @@
+package inmemdatastore
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// MsgPackSerializer encodes the records as MessagePack maps, with EncodingMsgPack.  It does not need
+// a schema.  Integers and floats are written with the size of their Go type, rather than the
+// smallest size that fits their value, so that they are decoded by the MsgPackDeserializer as the
+// same types, eg. an int64 is always decoded as an int64.
+type MsgPackSerializer struct{}
+
+func NewMsgPackSerializer() Serializer {
+	return &MsgPackSerializer{}
+}
+
+func (m *MsgPackSerializer) Serialize(key string, record map[string]interface{}) (*SerializedRecord, error) {
+	data, err := msgpack.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	return &SerializedRecord{Key: key, Encoding: EncodingMsgPack, Data: data, Record: record}, nil
+}
+
+// MsgPackDeserializer decodes records with EncodingMsgPack.  Nested maps are decoded as
+// map[string]interface{}, arrays as []interface{} and timestamps as time.Time.
+type MsgPackDeserializer struct{}
+
+func NewMsgPackDeserializer() Deserializer {
+	return &MsgPackDeserializer{}
+}
+
+func (m *MsgPackDeserializer) Encoding() Encoding {
+	return EncodingMsgPack
+}
+
+func (m *MsgPackDeserializer) Deserialize(record *SerializedRecord) (map[string]interface{}, error) {
+	decoder := msgpack.NewDecoder(bytes.NewReader(record.Data))
+	val, err := decoder.DecodeInterface()
+	if err != nil {
+		return nil, err
+	}
+	retval, ok := val.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("msgpack value is not a map; key=%s, type=%T", record.Key, val)
+	}
+	return retval, nil
+}
@@ -0,0 +1,105 @@
+package inmemdatastore
+
+import (
+	"fmt"
+)
+
+// MultiWriter is a Writer that writes each record to all of its Writers, so that a single Persister
+// can persist the same records in more than one format, eg. to an AvroFileWriter and to a
+// JSONLinesFileWriter side by side.  Because the Writers share the output of one Serializer, it is
+// usually paired with the NoopSerializer and each Writer encodes the records itself.
+//
+// Each record is written to all of the Writers, even if one of them fails, and the first error is
+// returned.  A record that is retried is written again to all of the Writers, so the Writers that
+// did not fail will contain it more than once.  Batches are written as a unit to the Writers that
+// are BatchWriters and one record at a time to the others.  Tombstones are only written to the
+// Writers that are TombstoneWriters, and Sync only syncs the Writers that are Syncers.  A MultiWriter
+// with a Writer that is not a Syncer cannot be used with a WALDir.
+type MultiWriter struct {
+	writers []Writer
+}
+
+func NewMultiWriter(writers ...Writer) *MultiWriter {
+	return &MultiWriter{writers: writers}
+}
+
+func (m *MultiWriter) Write(record *SerializedRecord) error {
+	var retval error
+	for i, w := range m.writers {
+		err := w.Write(record)
+		if err != nil && retval == nil {
+			retval = fmt.Errorf("%w; writer=%d", err, i)
+		}
+	}
+	return retval
+}
+
+func (m *MultiWriter) WriteBatch(records []*SerializedRecord) error {
+	var retval error
+	for i, w := range m.writers {
+		var err error
+		if batchWriter, ok := w.(BatchWriter); ok {
+			err = batchWriter.WriteBatch(records)
+		} else {
+			for _, record := range records {
+				err = w.Write(record)
+				if err != nil {
+					break
+				}
+			}
+		}
+		if err != nil && retval == nil {
+			retval = fmt.Errorf("%w; writer=%d", err, i)
+		}
+	}
+	return retval
+}
+
+// WriteTombstone writes the tombstone to each of the Writers that are TombstoneWriters.  Returns an
+// error if none of them are.
+func (m *MultiWriter) WriteTombstone(key string, timestamp int64) error {
+	var retval error
+	written := false
+	for i, w := range m.writers {
+		tombstoneWriter, ok := w.(TombstoneWriter)
+		if !ok {
+			continue
+		}
+		written = true
+		err := tombstoneWriter.WriteTombstone(key, timestamp)
+		if err != nil && retval == nil {
+			retval = fmt.Errorf("%w; writer=%d", err, i)
+		}
+	}
+	if !written {
+		return fmt.Errorf("none of the writers support tombstones; key=%s", key)
+	}
+	return retval
+}
+
+func (m *MultiWriter) Sync() error {
+	var retval error
+	for i, w := range m.writers {
+		syncer, ok := w.(Syncer)
+		if !ok {
+			continue
+		}
+		err := syncer.Sync()
+		if err != nil && retval == nil {
+			retval = fmt.Errorf("%w; writer=%d", err, i)
+		}
+	}
+	return retval
+}
+
+// Shutdown shuts down all of the Writers and returns the first error.
+func (m *MultiWriter) Shutdown() error {
+	var retval error
+	for i, w := range m.writers {
+		err := w.Shutdown()
+		if err != nil && retval == nil {
+			retval = fmt.Errorf("%w; writer=%d", err, i)
+		}
+	}
+	return retval
+}
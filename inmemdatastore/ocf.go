@@ -0,0 +1,287 @@
+package inmemdatastore
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/golang/snappy"
+	"github.com/linkedin/goavro/v2"
+)
+
+const (
+	ocfMagic         = "Obj\x01"
+	ocfSyncLength    = 16
+	ocfMetaSchema    = "avro.schema"
+	ocfMetaCodec     = "avro.codec"
+	ocfCodecNull     = "null"
+	ocfCodecDeflate  = "deflate"
+	ocfCodecSnappy   = "snappy"
+	ocfMaxHeaderSize = 1 << 20
+)
+
+// Compression is the codec with which the blocks of an OCF are compressed.  Any reader of Avro
+// OCFs, including goavro.OCFReader and the recovery of the datastore, reads all of them.
+type Compression int
+
+const (
+	// The blocks are not compressed.
+	CompressionNull Compression = iota
+	// The blocks are compressed with DEFLATE, at the level set by the CompressionLevel.
+	CompressionDeflate
+	// The blocks are compressed with Snappy, each followed by the CRC32 checksum of its
+	// uncompressed data.
+	CompressionSnappy
+)
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNull:
+		return ocfCodecNull
+	case CompressionDeflate:
+		return ocfCodecDeflate
+	case CompressionSnappy:
+		return ocfCodecSnappy
+	default:
+		return fmt.Sprintf("Compression(%d)", int(c))
+	}
+}
+
+func parseCompression(label string) (Compression, error) {
+	switch label {
+	case "", ocfCodecNull:
+		return CompressionNull, nil
+	case ocfCodecDeflate:
+		return CompressionDeflate, nil
+	case ocfCodecSnappy:
+		return CompressionSnappy, nil
+	default:
+		return CompressionNull, fmt.Errorf("unsupported compression codec; codec=%s", label)
+	}
+}
+
+// ocfWriter writes Avro Object Container Files.  Unlike goavro.OCFWriter it can append a block of
+// records that have already been encoded, so that a writer that encodes its records as they are
+// buffered does not have to encode them a second time when the block is written.
+type ocfWriter struct {
+	w           io.Writer
+	codec       *goavro.Codec
+	compression Compression
+	sync        []byte
+	// Reused for encoding records and assembling blocks.
+	data       []byte
+	block      []byte
+	compressed *bytes.Buffer
+	flate      *flate.Writer
+	snappy     []byte
+}
+
+// newOCFWriter returns an ocfWriter for the file.  If the file is empty the header, with the
+// compression codec, is written to it.  Otherwise the header is read from it and the file is
+// positioned to append to it, as with goavro.OCFWriter, and its blocks are compressed with the
+// codec already in the header of the file.  The level is only used for CompressionDeflate.
+func newOCFWriter(fh *os.File, codec *goavro.Codec, compression Compression, level int) (*ocfWriter, error) {
+	retval := &ocfWriter{w: fh, codec: codec, compression: compression, compressed: &bytes.Buffer{}}
+	size, err := fh.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if size > 0 {
+		err = retval.readHeader(fh)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if retval.compression == CompressionDeflate {
+		retval.flate, err = flate.NewWriter(retval.compressed, level)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if size == 0 {
+		retval.sync = make([]byte, ocfSyncLength)
+		_, err = rand.Read(retval.sync)
+		if err != nil {
+			return nil, err
+		}
+		_, err = fh.Write(retval.header())
+		if err != nil {
+			return nil, err
+		}
+	}
+	return retval, nil
+}
+
+// readHeader reads the sync marker and the compression codec from the header of the existing file
+// and then seeks to the end of it.
+func (o *ocfWriter) readHeader(fh *os.File) error {
+	_, err := fh.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	meta, sync, err := readOCFHeader(bufio.NewReader(io.LimitReader(fh, ocfMaxHeaderSize)))
+	if err != nil {
+		return fmt.Errorf("unable to read header; path=%s, err=%w", fh.Name(), err)
+	}
+	compression, err := parseCompression(string(meta[ocfMetaCodec]))
+	if err != nil {
+		return fmt.Errorf("%s; path=%s", err, fh.Name())
+	}
+	o.compression = compression
+	o.sync = sync
+	_, err = fh.Seek(0, io.SeekEnd)
+	return err
+}
+
+func (o *ocfWriter) header() []byte {
+	retval := []byte(ocfMagic)
+	retval = appendLong(retval, 2)
+	retval = appendBytes(retval, []byte(ocfMetaSchema))
+	retval = appendBytes(retval, []byte(o.codec.Schema()))
+	retval = appendBytes(retval, []byte(ocfMetaCodec))
+	retval = appendBytes(retval, []byte(o.compression.String()))
+	retval = appendLong(retval, 0)
+	return append(retval, o.sync...)
+}
+
+// Append encodes the records and writes them as a single block.  Nothing is written if any of the
+// records cannot be encoded.
+func (o *ocfWriter) Append(records []map[string]interface{}) error {
+	data := o.data[:0]
+	for i, record := range records {
+		var err error
+		data, err = o.codec.BinaryFromNative(data, record)
+		if err != nil {
+			return fmt.Errorf("cannot translate datum to binary; index=%d, err=%w", i, err)
+		}
+	}
+	o.data = data
+	return o.appendEncoded(int64(len(records)), data)
+}
+
+// appendEncoded compresses and writes a block of count records from their concatenated Avro binary
+// encodings.
+func (o *ocfWriter) appendEncoded(count int64, data []byte) error {
+	data, err := o.compress(data)
+	if err != nil {
+		return err
+	}
+	block := o.block[:0]
+	block = appendLong(block, count)
+	block = appendLong(block, int64(len(data)))
+	block = append(block, data...)
+	block = append(block, o.sync...)
+	o.block = block
+	// A single write so that a failure never leaves a partial block followed by a complete one.
+	_, err = o.w.Write(block)
+	return err
+}
+
+// compress returns the data compressed with the codec of the file.  The returned slice is only
+// valid until the next call.
+func (o *ocfWriter) compress(data []byte) ([]byte, error) {
+	switch o.compression {
+	case CompressionDeflate:
+		o.compressed.Reset()
+		o.flate.Reset(o.compressed)
+		_, err := o.flate.Write(data)
+		if err != nil {
+			return nil, err
+		}
+		err = o.flate.Close()
+		if err != nil {
+			return nil, err
+		}
+		return o.compressed.Bytes(), nil
+	case CompressionSnappy:
+		if n := snappy.MaxEncodedLen(len(data)) + crc32.Size; cap(o.snappy) < n {
+			o.snappy = make([]byte, n)
+		}
+		encoded := snappy.Encode(o.snappy[:cap(o.snappy)], data)
+		var checksum [crc32.Size]byte
+		binary.BigEndian.PutUint32(checksum[:], crc32.ChecksumIEEE(data))
+		return append(encoded, checksum[:]...), nil
+	default:
+		return data, nil
+	}
+}
+
+// readOCFHeader reads the metadata and the sync marker from the header of an OCF.
+func readOCFHeader(r *bufio.Reader) (map[string][]byte, []byte, error) {
+	magic := make([]byte, len(ocfMagic))
+	_, err := io.ReadFull(r, magic)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(magic, []byte(ocfMagic)) {
+		return nil, nil, errors.New("invalid magic bytes")
+	}
+	meta := make(map[string][]byte)
+	for {
+		count, err := binary.ReadVarint(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		if count == 0 {
+			break
+		}
+		if count < 0 {
+			// A negative count is followed by the size of the block, which we do not need.
+			count = -count
+			_, err = binary.ReadVarint(r)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		for i := int64(0); i < count; i++ {
+			key, err := readBytes(r)
+			if err != nil {
+				return nil, nil, err
+			}
+			val, err := readBytes(r)
+			if err != nil {
+				return nil, nil, err
+			}
+			meta[string(key)] = val
+		}
+	}
+	sync := make([]byte, ocfSyncLength)
+	_, err = io.ReadFull(r, sync)
+	if err != nil {
+		return nil, nil, err
+	}
+	return meta, sync, nil
+}
+
+func readBytes(r *bufio.Reader) ([]byte, error) {
+	size, err := binary.ReadVarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if size < 0 || size > ocfMaxHeaderSize {
+		return nil, fmt.Errorf("invalid size; size=%d", size)
+	}
+	retval := make([]byte, size)
+	_, err = io.ReadFull(r, retval)
+	return retval, err
+}
+
+// appendLong appends the Avro encoding of a long, which is the same zig-zag varint encoding used by
+// encoding/binary.
+func appendLong(buf []byte, val int64) []byte {
+	var scratch [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(scratch[:], val)
+	return append(buf, scratch[:n]...)
+}
+
+func appendBytes(buf []byte, val []byte) []byte {
+	buf = appendLong(buf, int64(len(val)))
+	return append(buf, val...)
+}
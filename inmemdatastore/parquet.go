@@ -0,0 +1,406 @@
+package inmemdatastore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xitongsys/parquet-go-source/writerfile"
+	"github.com/xitongsys/parquet-go/common"
+	"github.com/xitongsys/parquet-go/layout"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/schema"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+const (
+	ParquetFileExtension = ".parquet"
+	// The default size of a row group when neither of the limits of the RowGroupPolicy is set.
+	DefaultRowGroupMaxBytes = 8 << 20
+	// The key of the metadata in the footer of each file that holds the Avro schema from which the
+	// Parquet schema was derived, as used by parquet-avro.
+	parquetMetaAvroSchema = "parquet.avro.schema"
+	parquetCreatedBy      = "go-in-mem-datastore"
+)
+
+// RowGroupPolicy defines how many rows the ParquetFileWriter buffers in memory before it writes
+// them to the current file as a row group.  A zero value for both of the limits uses a MaxBytes of
+// DefaultRowGroupMaxBytes.
+type RowGroupPolicy struct {
+	// The maximum number of rows in a row group.
+	MaxRows int
+	// The maximum size, in bytes, of the uncompressed data of the columns of a row group.  The limit
+	// is checked after each write so a row group will exceed it by at most the size of one write.
+	MaxBytes int64
+}
+
+func (r RowGroupPolicy) withDefaults() RowGroupPolicy {
+	if r.MaxRows == 0 && r.MaxBytes == 0 {
+		r.MaxBytes = DefaultRowGroupMaxBytes
+	}
+	return r
+}
+
+func (r RowGroupPolicy) full(numRows int, numBytes int64) bool {
+	if r.MaxRows > 0 && numRows >= r.MaxRows {
+		return true
+	}
+	if r.MaxBytes > 0 && numBytes >= r.MaxBytes {
+		return true
+	}
+	return false
+}
+
+// ParquetFileWriter is a Writer that writes the records to a sequence of Parquet files named
+// "<id>-<seq>.parquet", with a Parquet schema derived from the same Avro schema as is passed to the
+// AvroFileWriter.  The files are encoded with github.com/xitongsys/parquet-go.  It writes the
+// Record of each SerializedRecord, so it can be paired with any Serializer.  The rows are buffered
+// in memory and written as a row group according to the RowGroupPolicy, and the files are rotated
+// and closed in the same way as those of the AvroFileWriter.
+//
+// A Parquet file can only be read once its footer has been written when it is closed, so the
+// ParquetFileWriter does not implement Syncer and the rows buffered, or written to a file that has
+// not yet been closed, are lost if the process crashes.  It is meant for exporting the records for
+// analytics alongside a writer that can be recovered from, with a MultiWriter, and cannot be used
+// with a WALDir.
+type ParquetFileWriter struct {
+	id       int
+	schema   *parquetSchema
+	segments *segmentWriter
+}
+
+type ParquetFileWriterConfig struct {
+	Id         int
+	AvroSchema string
+	OutputDir  string
+	// Defines when the writer closes the file to which it is currently writing and opens a new
+	// one.  By default files are never rotated.  The MaxBytes is measured against the row groups
+	// that have been written to the file.
+	Rotation RotationPolicy
+	RowGroup RowGroupPolicy
+	// The codec with which the pages of the columns are compressed.  CompressionDeflate writes
+	// GZIP pages.  Defaults to CompressionNull.
+	Compression Compression
+}
+
+func NewParquetFileWriter(ctx context.Context, wg *sync.WaitGroup, cfg ParquetFileWriterConfig) (*ParquetFileWriter, error) {
+	if cfg.Compression < CompressionNull || cfg.Compression > CompressionSnappy {
+		return nil, fmt.Errorf("unsupported compression codec; codec=%s", cfg.Compression)
+	}
+	schema, err := newParquetSchema(cfg.AvroSchema)
+	if err != nil {
+		return nil, err
+	}
+	rowGroup := cfg.RowGroup.withDefaults()
+	segments, err := newSegmentWriter(ctx, wg, segmentWriterConfig{
+		Id:        cfg.Id,
+		OutputDir: cfg.OutputDir,
+		Ext:       ParquetFileExtension,
+		Rotation:  cfg.Rotation,
+		NewEncoder: func(w io.Writer) (segmentEncoder, error) {
+			return newParquetEncoder(w, schema, cfg.AvroSchema, rowGroup, cfg.Compression)
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ParquetFileWriter{id: cfg.Id, schema: schema, segments: segments}, nil
+}
+
+func (p *ParquetFileWriter) Write(record *SerializedRecord) error {
+	return p.WriteBatch([]*SerializedRecord{record})
+}
+
+// WriteBatch adds the records to the current row group.  If any of them cannot be converted to the
+// schema none of them are added.  If parquet-go fails to write one of them, those before it, and
+// possibly the one that failed, have already been added.
+func (p *ParquetFileWriter) WriteBatch(records []*SerializedRecord) error {
+	return p.segments.write(len(records), func(enc segmentEncoder) error {
+		return enc.(*parquetEncoder).writeRows(records)
+	})
+}
+
+func (p *ParquetFileWriter) Shutdown() error {
+	return p.segments.shutdown()
+}
+
+// parquetCell is the value of a single column of a row, converted to the Go type with which
+// parquet-go encodes the physical type of the column, along with its definition level.
+type parquetCell struct {
+	value interface{}
+	def   int32
+}
+
+// parquetEncoder is the segmentEncoder for a single Parquet file.  Rows are shredded into a
+// parquetCell for each column as they are written, so that a record that does not match the schema
+// is rejected before anything is added to the parquet-go writer, and the writer's MarshalFunc then
+// only has to gather the cells into its tables.
+type parquetEncoder struct {
+	pw     *writer.ParquetWriter
+	schema *parquetSchema
+	policy RowGroupPolicy
+	// The number of rows, and the size of their values, written since the last row group.
+	numRows int
+	size    int64
+}
+
+func newParquetEncoder(
+	w io.Writer,
+	schema *parquetSchema,
+	avroSchema string,
+	policy RowGroupPolicy,
+	compression Compression,
+) (*parquetEncoder, error) {
+	pw, err := writer.NewParquetWriter(writerfile.NewWriterFile(w), schema.elements, 1)
+	if err != nil {
+		return nil, err
+	}
+	switch compression {
+	case CompressionSnappy:
+		pw.CompressionType = parquet.CompressionCodec_SNAPPY
+	case CompressionDeflate:
+		pw.CompressionType = parquet.CompressionCodec_GZIP
+	default:
+		pw.CompressionType = parquet.CompressionCodec_UNCOMPRESSED
+	}
+	// Row groups are only written when the RowGroupPolicy says so.
+	pw.RowGroupSize = math.MaxInt64
+	pw.MarshalFunc = schema.marshal
+	createdBy := parquetCreatedBy
+	pw.Footer.CreatedBy = &createdBy
+	pw.Footer.KeyValueMetadata = append(
+		pw.Footer.KeyValueMetadata,
+		&parquet.KeyValue{Key: parquetMetaAvroSchema, Value: &avroSchema},
+	)
+	return &parquetEncoder{pw: pw, schema: schema, policy: policy}, nil
+}
+
+// Write is not used, the rows are added with writeRows.
+func (p *parquetEncoder) Write(data []byte) (int, error) {
+	return 0, errors.New("parquetEncoder does not support Write")
+}
+
+// Flush does nothing, the rows are only written once there are enough of them for a row group,
+// and a Parquet file cannot be read until it has been closed.
+func (p *parquetEncoder) Flush() error {
+	return nil
+}
+
+// Close writes any buffered rows as a final row group, and then the footer.
+func (p *parquetEncoder) Close() error {
+	return p.pw.WriteStop()
+}
+
+// writeRows adds the records to the current row group, writing the row group once it is full.  If
+// any of the records cannot be converted to the schema, none of them are added.  The rows are added
+// to the parquet-go writer one at a time, so if it fails to write one of them those before it have
+// already been added.  The writer buffers each row before it tries to write out any pages, so the
+// row that failed is counted as added too.
+func (p *parquetEncoder) writeRows(records []*SerializedRecord) error {
+	rows := make([][]parquetCell, len(records))
+	sizes := make([]int64, len(records))
+	for i, record := range records {
+		if record.Record == nil {
+			return fmt.Errorf("%w: no record to write; index=%d, key=%s", ErrInvalidRecord, i, record.Key)
+		}
+		rows[i] = make([]parquetCell, len(p.schema.leaves))
+		n, err := p.schema.shred(rows[i], p.schema.root, record.Record, 0)
+		if err != nil {
+			return fmt.Errorf("%w: %s; index=%d, key=%s", ErrInvalidRecord, err, i, record.Key)
+		}
+		sizes[i] = n
+	}
+	for i, row := range rows {
+		err := p.pw.Write(row)
+		p.numRows++
+		p.size += sizes[i]
+		if err != nil {
+			return fmt.Errorf("%w; index=%d, key=%s", err, i, records[i].Key)
+		}
+	}
+	if !p.policy.full(p.numRows, p.size) {
+		return nil
+	}
+	p.numRows = 0
+	p.size = 0
+	return p.pw.Flush(true)
+}
+
+// shred sets the cells of the row for the node, and for all of its descendants, and returns the size
+// of their values.  The def is the definition level of the parent of the node.
+func (s *parquetSchema) shred(row []parquetCell, node *parquetNode, val interface{}, def int32) (int64, error) {
+	if node.union {
+		val = unwrapUnion(val)
+	}
+	if val == nil {
+		if node.repetition != parquet.FieldRepetitionType_OPTIONAL {
+			return 0, fmt.Errorf("missing value for required field; field=%s", strings.Join(node.path, "."))
+		}
+		s.setNulls(row, node, def)
+		return 0, nil
+	}
+	if node.repetition == parquet.FieldRepetitionType_OPTIONAL {
+		def++
+	}
+	if node.children == nil {
+		value, size, err := parquetValue(node, val)
+		if err != nil {
+			return 0, fmt.Errorf("%s; field=%s", err, strings.Join(node.path, "."))
+		}
+		row[node.column] = parquetCell{value: value, def: def}
+		return size, nil
+	}
+	record, ok := val.(map[string]interface{})
+	if !ok {
+		return 0, fmt.Errorf("unsupported type for record; field=%s, type=%T", strings.Join(node.path, "."), val)
+	}
+	retval := int64(0)
+	for _, child := range node.children {
+		size, err := s.shred(row, child, record[child.name], def)
+		if err != nil {
+			return 0, err
+		}
+		retval += size
+	}
+	return retval, nil
+}
+
+func (s *parquetSchema) setNulls(row []parquetCell, node *parquetNode, def int32) {
+	if node.children == nil {
+		row[node.column] = parquetCell{def: def}
+		return
+	}
+	for _, child := range node.children {
+		s.setNulls(row, child, def)
+	}
+}
+
+// marshal is the MarshalFunc of the parquet-go writer, which gathers the cells of the rows that
+// have been written into a table for each column.
+func (s *parquetSchema) marshal(rows []interface{}, handler *schema.SchemaHandler) (*map[string]*layout.Table, error) {
+	retval := map[string]*layout.Table{}
+	for _, leaf := range s.leaves {
+		path := handler.IndexMap[leaf.element]
+		table := layout.NewEmptyTable()
+		table.Path = common.StrToPath(path)
+		table.Schema = handler.SchemaElements[leaf.element]
+		table.Info = handler.Infos[leaf.element]
+		table.RepetitionType = leaf.repetition
+		table.MaxDefinitionLevel = leaf.maxDef
+		table.Values = make([]interface{}, len(rows))
+		table.DefinitionLevels = make([]int32, len(rows))
+		table.RepetitionLevels = make([]int32, len(rows))
+		for i, row := range rows {
+			cell := row.([]parquetCell)[leaf.column]
+			table.Values[i] = cell.value
+			table.DefinitionLevels[i] = cell.def
+		}
+		retval[path] = table
+	}
+	return &retval, nil
+}
+
+// parquetValue converts a value to the Go type with which parquet-go encodes the physical type of
+// the leaf, and returns it along with the size of its PLAIN encoding.
+func parquetValue(node *parquetNode, val interface{}) (interface{}, int64, error) {
+	switch node.physical {
+	case parquet.Type_BOOLEAN:
+		b, ok := val.(bool)
+		if !ok {
+			return nil, 0, fmt.Errorf("unsupported type; type=%T", val)
+		}
+		return b, 1, nil
+	case parquet.Type_INT32:
+		i, err := parquetInteger(val, node)
+		if err == nil && (i < math.MinInt32 || i > math.MaxInt32) {
+			err = fmt.Errorf("value out of range for int; value=%d", i)
+		}
+		return int32(i), 4, err
+	case parquet.Type_INT64:
+		i, err := parquetInteger(val, node)
+		return i, 8, err
+	case parquet.Type_FLOAT, parquet.Type_DOUBLE:
+		num, ok := toNumber(val)
+		if !ok {
+			return nil, 0, fmt.Errorf("unsupported type; type=%T", val)
+		}
+		if node.physical == parquet.Type_FLOAT {
+			return float32(num.float()), 4, nil
+		}
+		return num.float(), 8, nil
+	case parquet.Type_FIXED_LEN_BYTE_ARRAY:
+		data, err := parquetBytes(val, node)
+		if err == nil && len(data) != int(node.typeLength) {
+			err = fmt.Errorf("invalid size for fixed; size=%d, expected=%d", len(data), node.typeLength)
+		}
+		return string(data), int64(len(data)), err
+	default:
+		data, err := parquetBytes(val, node)
+		return string(data), int64(4 + len(data)), err
+	}
+}
+
+// parquetInteger converts a value to an integer in the units of the converted type of the column,
+// accepting the native Go types that goavro uses for the Avro logical types.
+func parquetInteger(val interface{}, node *parquetNode) (int64, error) {
+	switch v := val.(type) {
+	case time.Time:
+		switch {
+		case node.convertedIs(parquet.ConvertedType_DATE):
+			return int64(math.Floor(float64(v.Unix()) / 86400)), nil
+		case node.convertedIs(parquet.ConvertedType_TIMESTAMP_MILLIS):
+			return v.UnixNano() / int64(time.Millisecond), nil
+		case node.convertedIs(parquet.ConvertedType_TIMESTAMP_MICROS):
+			return v.UnixNano() / int64(time.Microsecond), nil
+		}
+	case time.Duration:
+		switch {
+		case node.convertedIs(parquet.ConvertedType_TIME_MILLIS):
+			return int64(v / time.Millisecond), nil
+		case node.convertedIs(parquet.ConvertedType_TIME_MICROS):
+			return int64(v / time.Microsecond), nil
+		}
+	default:
+		num, ok := toNumber(val)
+		if ok && num.kind == numberInt {
+			return num.i, nil
+		}
+		if ok && num.kind == numberUint && num.u <= math.MaxInt64 {
+			return int64(num.u), nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported type; type=%T", val)
+}
+
+func parquetBytes(val interface{}, node *parquetNode) ([]byte, error) {
+	if node.convertedIs(parquet.ConvertedType_JSON) {
+		return json.Marshal(val)
+	}
+	switch v := val.(type) {
+	case string:
+		return []byte(v), nil
+	case []byte:
+		return v, nil
+	default:
+		return nil, fmt.Errorf("unsupported type; type=%T", val)
+	}
+}
+
+// unwrapUnion returns the value of a union that goavro has wrapped in a map from the name of its
+// branch to its value.
+func unwrapUnion(val interface{}) interface{} {
+	m, ok := val.(map[string]interface{})
+	if !ok || len(m) != 1 {
+		return val
+	}
+	for _, v := range m {
+		return v
+	}
+	return val
+}
@@ -0,0 +1,280 @@
+package inmemdatastore
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/xitongsys/parquet-go/parquet"
+)
+
+// parquetNode is a field of the Parquet schema derived from an Avro schema.  A node with children is
+// a group, derived from an Avro record, and any other node is a leaf with a column of its own.
+type parquetNode struct {
+	name       string
+	path       []string
+	repetition parquet.FieldRepetitionType
+	// Whether the Avro type was a union, in which case its values may be wrapped in a map from the
+	// name of the branch to the value, as goavro does.
+	union bool
+	// The following are only set for leaves.  A nil converted means that the column has no
+	// converted type.
+	physical   parquet.Type
+	converted  *parquet.ConvertedType
+	typeLength int32
+	// The index of the column of the leaf.
+	column int
+	// The index of the SchemaElement of the node.
+	element int32
+	// The number of optional nodes on the path to the node, including itself.
+	maxDef   int32
+	children []*parquetNode
+}
+
+// parquetSchema is the Parquet schema derived from an Avro record schema.  Avro records are written
+// as Parquet groups and the nullable unions, ["null", T], as optional fields.  Avro arrays, maps
+// and any other unions are written as JSON in UTF8 columns, with the JSON converted type.
+type parquetSchema struct {
+	root     *parquetNode
+	leaves   []*parquetNode
+	elements []*parquet.SchemaElement
+}
+
+func newParquetSchema(avroSchema string) (*parquetSchema, error) {
+	var parsed interface{}
+	err := json.Unmarshal([]byte(avroSchema), &parsed)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse avro schema; err=%w", err)
+	}
+	retval := &parquetSchema{}
+	b := &parquetSchemaBuilder{schema: retval, names: map[string]interface{}{}}
+	root, err := b.node("root", nil, parsed, "")
+	if err != nil {
+		return nil, err
+	}
+	if root.children == nil {
+		return nil, fmt.Errorf("avro schema must be a record; schema=%s", avroSchema)
+	}
+	if m, ok := parsed.(map[string]interface{}); ok {
+		if name, ok := m["name"].(string); ok {
+			root.name = name
+		}
+	}
+	root.setMaxDef(0)
+	retval.root = root
+	root.appendSchemaElements(retval, true)
+	return retval, nil
+}
+
+type parquetSchemaBuilder struct {
+	schema *parquetSchema
+	// The named Avro types, by their full names, so that they can be referenced by later fields.
+	names map[string]interface{}
+}
+
+func (b *parquetSchemaBuilder) node(name string, path []string, avroType interface{}, namespace string) (*parquetNode, error) {
+	switch t := avroType.(type) {
+	case string:
+		if leaf, ok := parquetPrimitive(t, ""); ok {
+			return b.leaf(name, path, leaf), nil
+		}
+		named, ok := b.names[t]
+		if !ok && namespace != "" {
+			named, ok = b.names[namespace+"."+t]
+		}
+		if !ok {
+			return nil, fmt.Errorf("unknown avro type; field=%s, type=%s", strings.Join(path, "."), t)
+		}
+		return b.node(name, path, named, namespace)
+	case []interface{}:
+		return b.union(name, path, t, namespace)
+	case map[string]interface{}:
+		return b.complex(name, path, t, namespace)
+	default:
+		return nil, fmt.Errorf("invalid avro type; field=%s, type=%v", strings.Join(path, "."), avroType)
+	}
+}
+
+func (b *parquetSchemaBuilder) union(name string, path []string, branches []interface{}, namespace string) (*parquetNode, error) {
+	nonNull := []interface{}{}
+	for _, branch := range branches {
+		if branch != "null" {
+			nonNull = append(nonNull, branch)
+		}
+	}
+	var retval *parquetNode
+	if len(nonNull) == 1 {
+		var err error
+		retval, err = b.node(name, path, nonNull[0], namespace)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		retval = b.leaf(name, path, parquetJSONLeaf())
+	}
+	if len(nonNull) < len(branches) {
+		retval.repetition = parquet.FieldRepetitionType_OPTIONAL
+	}
+	retval.union = true
+	return retval, nil
+}
+
+func (b *parquetSchemaBuilder) complex(
+	name string,
+	path []string,
+	avroType map[string]interface{},
+	namespace string,
+) (*parquetNode, error) {
+	typeName, _ := avroType["type"].(string)
+	// Named types are registered by their full name so that later fields can refer to them.
+	if typeName == "record" || typeName == "enum" || typeName == "fixed" {
+		fullName, _ := avroType["name"].(string)
+		if ns, ok := avroType["namespace"].(string); ok && ns != "" {
+			namespace = ns
+		}
+		if !strings.Contains(fullName, ".") && namespace != "" {
+			fullName = namespace + "." + fullName
+		}
+		b.names[fullName] = avroType
+	}
+	switch typeName {
+	case "record":
+		fields, _ := avroType["fields"].([]interface{})
+		retval := &parquetNode{
+			name:       name,
+			path:       path,
+			repetition: parquet.FieldRepetitionType_REQUIRED,
+			children:   []*parquetNode{},
+		}
+		for _, f := range fields {
+			field, _ := f.(map[string]interface{})
+			fieldName, _ := field["name"].(string)
+			child, err := b.node(fieldName, append(append([]string{}, path...), fieldName), field["type"], namespace)
+			if err != nil {
+				return nil, err
+			}
+			retval.children = append(retval.children, child)
+		}
+		return retval, nil
+	case "enum":
+		return b.leaf(name, path, &parquetNode{
+			physical:  parquet.Type_BYTE_ARRAY,
+			converted: parquetConverted(parquet.ConvertedType_ENUM),
+		}), nil
+	case "fixed":
+		size, _ := avroType["size"].(float64)
+		return b.leaf(name, path, &parquetNode{
+			physical:   parquet.Type_FIXED_LEN_BYTE_ARRAY,
+			typeLength: int32(size),
+		}), nil
+	case "array", "map":
+		return b.leaf(name, path, parquetJSONLeaf()), nil
+	default:
+		logicalType, _ := avroType["logicalType"].(string)
+		if leaf, ok := parquetPrimitive(typeName, logicalType); ok {
+			return b.leaf(name, path, leaf), nil
+		}
+		return b.node(name, path, avroType["type"], namespace)
+	}
+}
+
+// leaf adds the node as the next column of the schema.
+func (b *parquetSchemaBuilder) leaf(name string, path []string, node *parquetNode) *parquetNode {
+	node.name = name
+	node.path = path
+	node.column = len(b.schema.leaves)
+	b.schema.leaves = append(b.schema.leaves, node)
+	return node
+}
+
+// parquetPrimitive returns the leaf for the Avro primitive type, with its logical type if it has
+// one.  Returns false if the type is not a primitive.
+func parquetPrimitive(avroType, logicalType string) (*parquetNode, bool) {
+	retval := &parquetNode{}
+	switch avroType {
+	case "boolean":
+		retval.physical = parquet.Type_BOOLEAN
+	case "int":
+		retval.physical = parquet.Type_INT32
+		switch logicalType {
+		case "date":
+			retval.converted = parquetConverted(parquet.ConvertedType_DATE)
+		case "time-millis":
+			retval.converted = parquetConverted(parquet.ConvertedType_TIME_MILLIS)
+		}
+	case "long":
+		retval.physical = parquet.Type_INT64
+		switch logicalType {
+		case "time-micros":
+			retval.converted = parquetConverted(parquet.ConvertedType_TIME_MICROS)
+		case "timestamp-millis":
+			retval.converted = parquetConverted(parquet.ConvertedType_TIMESTAMP_MILLIS)
+		case "timestamp-micros":
+			retval.converted = parquetConverted(parquet.ConvertedType_TIMESTAMP_MICROS)
+		}
+	case "float":
+		retval.physical = parquet.Type_FLOAT
+	case "double":
+		retval.physical = parquet.Type_DOUBLE
+	case "bytes":
+		retval.physical = parquet.Type_BYTE_ARRAY
+	case "string":
+		retval.physical = parquet.Type_BYTE_ARRAY
+		retval.converted = parquetConverted(parquet.ConvertedType_UTF8)
+	default:
+		return nil, false
+	}
+	return retval, true
+}
+
+// parquetJSONLeaf returns the leaf for an Avro type that is written as JSON.
+func parquetJSONLeaf() *parquetNode {
+	return &parquetNode{physical: parquet.Type_BYTE_ARRAY, converted: parquetConverted(parquet.ConvertedType_JSON)}
+}
+
+func parquetConverted(converted parquet.ConvertedType) *parquet.ConvertedType {
+	return &converted
+}
+
+// convertedIs returns whether the leaf has the converted type.
+func (n *parquetNode) convertedIs(converted parquet.ConvertedType) bool {
+	return n.converted != nil && *n.converted == converted
+}
+
+// appendSchemaElements appends the SchemaElements of the node, and all of its descendants in depth
+// first order, to the schema.
+func (n *parquetNode) appendSchemaElements(schema *parquetSchema, root bool) {
+	element := parquet.NewSchemaElement()
+	element.Name = n.name
+	if !root {
+		repetition := n.repetition
+		element.RepetitionType = &repetition
+	}
+	if n.children == nil {
+		physical := n.physical
+		element.Type = &physical
+		element.ConvertedType = n.converted
+		if n.physical == parquet.Type_FIXED_LEN_BYTE_ARRAY {
+			typeLength := n.typeLength
+			element.TypeLength = &typeLength
+		}
+	} else {
+		numChildren := int32(len(n.children))
+		element.NumChildren = &numChildren
+	}
+	n.element = int32(len(schema.elements))
+	schema.elements = append(schema.elements, element)
+	for _, child := range n.children {
+		child.appendSchemaElements(schema, false)
+	}
+}
+
+func (n *parquetNode) setMaxDef(def int32) {
+	if n.repetition == parquet.FieldRepetitionType_OPTIONAL {
+		def++
+	}
+	n.maxDef = def
+	for _, child := range n.children {
+		child.setMaxDef(def)
+	}
+}
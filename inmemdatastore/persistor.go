@@ -2,36 +2,75 @@ package inmemdatastore
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	log "github.com/rchapin/rlog"
 )
 
+var (
+	// ErrSyncNotSupported is returned for a durable write when the Writer of the Persister does not
+	// implement Syncer.
+	ErrSyncNotSupported = errors.New("writer does not support sync")
+)
+
+// Syncer is implemented by Writers that are able to flush all of the data written to them to
+// durable storage.
+type Syncer interface {
+	Sync() error
+}
+
 type PersisterConfig struct {
 	Id         int
 	Serializer Serializer
 	Writer     Writer
 	InputChan  PersistenceChan
+	// What to do with an entry that fails to be persisted.  Defaults to FailurePolicyDrop.
+	FailurePolicy FailurePolicy
+	// How entries are retried with FailurePolicyRetry.
+	Retry RetryPolicy
+	// Where failed entries are routed with FailurePolicyDeadLetter, or with FailurePolicyRetry
+	// once all of the attempts have failed.  Required for FailurePolicyDeadLetter.  It is shutdown
+	// along with the Writer.
+	DeadLetterWriter DeadLetterWriter
 }
 
 type Persister struct {
-	ctx       context.Context
-	wg        *sync.WaitGroup
-	id        int
-	inputChan PersistenceChan
+	ctx              context.Context
+	wg               *sync.WaitGroup
+	id               int
+	inputChan        PersistenceChan
+	failurePolicy    FailurePolicy
+	retry            RetryPolicy
+	deadLetterWriter DeadLetterWriter
+	// Set by the InMemDataStore to the ErrorChan in its Config.
+	errorChan PersisterErrorChan
+	// Set if the Writer failed to shutdown, in which case the write-ahead log is not truncated.
+	shutdownErr error
+	// The number of entries that failed to be persisted and were dropped.  Updated atomically.
+	dropped int64
 	Serializer
 	Writer
 }
 
-func NewPersister(ctx context.Context, wg *sync.WaitGroup, cfg PersisterConfig) *Persister {
-	return &Persister{
-		ctx:        ctx,
-		wg:         wg,
-		id:         cfg.Id,
-		Serializer: cfg.Serializer,
-		Writer:     cfg.Writer,
-		inputChan:  cfg.InputChan,
+func NewPersister(ctx context.Context, wg *sync.WaitGroup, cfg PersisterConfig) (*Persister, error) {
+	if cfg.FailurePolicy == FailurePolicyDeadLetter && cfg.DeadLetterWriter == nil {
+		return nil, fmt.Errorf("a DeadLetterWriter is required for FailurePolicyDeadLetter; persisterId=%d", cfg.Id)
 	}
+	return &Persister{
+		ctx:              ctx,
+		wg:               wg,
+		id:               cfg.Id,
+		Serializer:       cfg.Serializer,
+		Writer:           cfg.Writer,
+		inputChan:        cfg.InputChan,
+		failurePolicy:    cfg.FailurePolicy,
+		retry:            cfg.Retry.withDefaults(),
+		deadLetterWriter: cfg.DeadLetterWriter,
+	}, nil
 }
 
 func (p *Persister) Run() {
@@ -41,39 +80,287 @@ func (p *Persister) Run() {
 		defer p.wg.Done()
 		for {
 			select {
-			case record := <-p.inputChan:
-				err := p.persist(record)
-				if err != nil {
-					// FIXME: Do something other than panicking here
-					panic(err)
-				}
+			case entry := <-p.inputChan:
+				p.process(entry)
 			case <-p.ctx.Done():
 				log.Infof("Persister exiting Run loop on context done; id=%d ", p.id)
 				// We must ensure that the channel is empty before we shutdown or we can leave data
 				// on it that never gets persisted to disk
 				for {
 					if len(p.inputChan) > 0 {
-						record := <-p.inputChan
-						err := p.persist(record)
-						if err != nil {
-							// FIXME: Do something other than panicking here
-							panic(err)
-						}
+						entry := <-p.inputChan
+						p.process(entry)
 					} else {
 						break
 					}
 				}
-				p.Shutdown()
+				p.shutdown()
 				return
 			}
 		}
 	}()
 }
 
-func (p *Persister) persist(record map[string]interface{}) error {
-	data, err := p.Serialize(record)
-	if err != nil {
+// process persists the entry, applying the FailurePolicy if it cannot be persisted.  If the caller
+// is waiting for the entry to be durably written, the Writer is synced and the result is sent back
+// to the caller.  The entry is then released from the write-ahead log, or the overflow file from
+// which it was drained, once it has been persisted, written to the DeadLetterWriter or dropped.  It is only kept, and replayed on the next start,
+// if the Persister shut down while it was still being retried.
+func (p *Persister) process(entry *PersistenceEntry) {
+	keep := entry.walSegment != nil
+	var pending bool
+	var err error
+	if entry.Batch != nil {
+		pending, err = p.processBatch(entry, keep)
+	} else {
+		pending, err = p.processEntry(entry, entry.done != nil, keep)
+	}
+	if !pending {
+		entry.walSegment.release()
+	}
+	if entry.done != nil {
+		entry.done <- err
+	}
+}
+
+// processEntry persists the entry and returns whether a retry is still pending, along with the
+// error with which it failed to be persisted.  A retry is only left pending if keep is set,
+// otherwise the FailurePolicy is applied to the entry.
+func (p *Persister) processEntry(entry *PersistenceEntry, durable, keep bool) (bool, error) {
+	attempts, err := p.attemptWithRetry(entry.Key, func() error {
+		err := p.persist(entry)
+		if err == nil && durable {
+			err = p.sync()
+		}
 		return err
+	})
+	if err != nil {
+		if keep && p.retryPending(attempts, err) {
+			p.keep(entry, err, attempts)
+			return true, err
+		}
+		p.fail(entry, err, attempts)
+		return false, err
+	}
+	return false, nil
+}
+
+// processBatch persists all of the entries in the batch as a single unit if the Writer is a
+// BatchWriter.  If the batch contains an invalid record, or the Writer is not a BatchWriter, the
+// entries are persisted one at a time so that only the invalid ones fail.  Returns whether a retry
+// is still pending for any of the entries, and the first error of any of the entries.
+func (p *Persister) processBatch(entry *PersistenceEntry, keep bool) (bool, error) {
+	durable := entry.done != nil
+	if batchWriter, ok := p.Writer.(BatchWriter); ok {
+		attempts, err := p.attemptWithRetry(fmt.Sprintf("batch[%d]", len(entry.Batch)), func() error {
+			err := p.persistBatch(batchWriter, entry.Batch)
+			if err == nil && durable {
+				err = p.sync()
+			}
+			return err
+		})
+		if err == nil {
+			return false, nil
+		}
+		if !errors.Is(err, ErrInvalidRecord) {
+			if keep && p.retryPending(attempts, err) {
+				p.keep(entry, err, attempts)
+				return true, err
+			}
+			for _, e := range entry.Batch {
+				p.fail(e, err, attempts)
+			}
+			return false, err
+		}
+		log.Warnf(
+			"Persister batch contains an invalid record, persisting its records one at a time; id=%d, size=%d, err=%s",
+			p.id, len(entry.Batch), err)
+	}
+
+	pending := false
+	var retval error
+	for _, e := range entry.Batch {
+		ok, err := p.processEntry(e, false, keep)
+		if ok {
+			pending = true
+		}
+		if err != nil && retval == nil {
+			retval = err
+		}
+	}
+	if durable {
+		err := p.sync()
+		if err != nil && retval == nil {
+			retval = err
+		}
+	}
+	return pending, retval
+}
+
+// attemptWithRetry calls fn and, with FailurePolicyRetry, retries it with an exponential backoff
+// until it succeeds, the RetryPolicy is exhausted, or it fails with an ErrInvalidRecord.  Returns
+// the number of attempts and the last error.
+func (p *Persister) attemptWithRetry(key string, fn func() error) (int, error) {
+	err := fn()
+	attempts := 1
+	if err != nil && p.failurePolicy == FailurePolicyRetry {
+		backoff := p.retry.InitialBackoff
+		for attempts < p.retry.MaxAttempts && err != nil && !errors.Is(err, ErrInvalidRecord) {
+			log.Warnf("Persister retrying entry; id=%d, key=%s, attempts=%d, err=%s", p.id, key, attempts, err)
+			if !p.wait(backoff) {
+				break
+			}
+			backoff *= 2
+			if backoff > p.retry.MaxBackoff {
+				backoff = p.retry.MaxBackoff
+			}
+			err = fn()
+			attempts++
+		}
+	}
+	return attempts, err
+}
+
+// wait blocks for the backoff between retries.  Returns false, without waiting, if the Persister is
+// shutting down.
+func (p *Persister) wait(backoff time.Duration) bool {
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-p.ctx.Done():
+		return false
+	}
+}
+
+// retryPending returns whether the attempts to persist an entry that failed with the error were
+// cut short by the Persister shutting down, rather than exhausted.
+func (p *Persister) retryPending(attempts int, err error) bool {
+	return p.failurePolicy == FailurePolicyRetry && attempts < p.retry.MaxAttempts && !errors.Is(err, ErrInvalidRecord)
+}
+
+// keep reports the failure to persist the entry, which is left in the write-ahead log, or the
+// overflow file from which it was drained, to be retried on the next start.
+func (p *Persister) keep(entry *PersistenceEntry, err error, attempts int) {
+	p.reportError(&PersisterError{
+		PersisterId: p.id,
+		Key:         entry.Key,
+		Entry:       entry,
+		Attempts:    attempts,
+		Err:         err,
+		Time:        time.Now().UTC(),
+	})
+	log.Warnf("Persister keeping entry to retry on the next start; id=%d, key=%s", p.id, entry.Key)
+}
+
+// fail reports the failure to persist the entry and, unless the FailurePolicy is to drop it,
+// routes it to the DeadLetterWriter.  The entry is dropped if it cannot be written to the
+// DeadLetterWriter.
+func (p *Persister) fail(entry *PersistenceEntry, err error, attempts int) {
+	perr := &PersisterError{
+		PersisterId: p.id,
+		Key:         entry.Key,
+		Entry:       entry,
+		Attempts:    attempts,
+		Err:         err,
+		Time:        time.Now().UTC(),
+	}
+	p.reportError(perr)
+	if p.deadLetterWriter == nil || p.failurePolicy == FailurePolicyDrop {
+		log.Warnf("Persister dropping entry; id=%d, key=%s", p.id, entry.Key)
+		atomic.AddInt64(&p.dropped, 1)
+		return
+	}
+	err = p.deadLetterWriter.WriteDeadLetter(NewDeadLetter(perr))
+	if err != nil {
+		p.reportError(&PersisterError{
+			PersisterId: p.id,
+			Key:         entry.Key,
+			Entry:       entry,
+			Attempts:    attempts,
+			Err:         fmt.Errorf("unable to write dead letter: %w", err),
+			Time:        time.Now().UTC(),
+		})
+		log.Warnf("Persister dropping entry; id=%d, key=%s", p.id, entry.Key)
+		atomic.AddInt64(&p.dropped, 1)
+	}
+}
+
+// reportError logs the error and sends it on the errorChan, if there is one.  The Persister never
+// blocks on the errorChan, if it is full the error is dropped.
+func (p *Persister) reportError(perr *PersisterError) {
+	log.Error(perr)
+	if p.errorChan == nil {
+		return
+	}
+	select {
+	case p.errorChan <- perr:
+	default:
+		log.Warnf("Persister ErrorChan is full, dropping error; id=%d, key=%s", p.id, perr.Key)
+	}
+}
+
+func (p *Persister) shutdown() {
+	err := p.Writer.Shutdown()
+	if err != nil {
+		p.shutdownErr = err
+		p.reportError(&PersisterError{PersisterId: p.id, Err: err, Time: time.Now().UTC()})
+	}
+	if p.deadLetterWriter != nil {
+		err := p.deadLetterWriter.Shutdown()
+		if err != nil {
+			p.reportError(&PersisterError{PersisterId: p.id, Err: err, Time: time.Now().UTC()})
+		}
+	}
+}
+
+func (p *Persister) sync() error {
+	syncer, ok := p.Writer.(Syncer)
+	if !ok {
+		return fmt.Errorf("%w; persisterId=%d", ErrSyncNotSupported, p.id)
+	}
+	return syncer.Sync()
+}
+
+// syncable returns whether all of the data written to the Writer can be synced, which for a
+// MultiWriter means that all of its Writers are Syncers.
+func syncable(w Writer) bool {
+	if multiWriter, ok := w.(*MultiWriter); ok {
+		for _, child := range multiWriter.writers {
+			if !syncable(child) {
+				return false
+			}
+		}
+		return true
+	}
+	_, ok := w.(Syncer)
+	return ok
+}
+
+func (p *Persister) persistBatch(batchWriter BatchWriter, batch []*PersistenceEntry) error {
+	data := make([]*SerializedRecord, 0, len(batch))
+	for _, entry := range batch {
+		d, err := p.Serialize(entry.Key, entry.Record)
+		if err != nil {
+			return fmt.Errorf("%w: %s; key=%s", ErrInvalidRecord, err, entry.Key)
+		}
+		data = append(data, d)
+	}
+	return batchWriter.WriteBatch(data)
+}
+
+func (p *Persister) persist(entry *PersistenceEntry) error {
+	if entry.Tombstone {
+		tombstoneWriter, ok := p.Writer.(TombstoneWriter)
+		if !ok {
+			return fmt.Errorf("writer does not support tombstones; persisterId=%d, key=%s", p.id, entry.Key)
+		}
+		return tombstoneWriter.WriteTombstone(entry.Key, entry.Timestamp)
+	}
+	data, err := p.Serialize(entry.Key, entry.Record)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidRecord, err)
 	}
 	err = p.Write(data)
 	if err != nil {
@@ -0,0 +1,421 @@
+package inmemdatastore
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"os"
+	"strconv"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// ProtobufSerializer encodes the records as Protobuf messages, with EncodingProtobuf.  The message
+// type is read from a descriptor set file, as written by "protoc --include_imports -o", and each
+// record is mapped to a dynamic message of that type by the names of its fields:
+//
+//   - Scalar fields accept any Go numeric type that fits, bools, strings and []byte.
+//   - Enum fields accept the name of a value, as a string, or its number.
+//   - Message fields accept a map[string]interface{}.
+//   - Repeated fields accept a []interface{}, or a slice of a scalar type.
+//   - Map fields accept a map[string]interface{}, with keys that are parsed for integer and bool
+//     key types.
+//
+// A nil value leaves the field unset.  A record with a key that is not a field of the message, or
+// with a value that cannot be converted to the type of its field, is rejected.
+type ProtobufSerializer struct {
+	descriptor  protoreflect.MessageDescriptor
+	fingerprint uint64
+}
+
+// ProtobufDeserializer decodes records with EncodingProtobuf into maps with the types described for
+// the ProtobufSerializer, so that a record round-trips with the same types as it was written with
+// for the int32, int64, uint32, uint64, float32, float64, bool, string and []byte values.  Enums are
+// decoded as the names of their values.  Fields without presence, which proto3 scalars do not have,
+// are always included, with their zero value if they were not set, while unset fields with presence
+// are omitted.
+type ProtobufDeserializer struct {
+	descriptor  protoreflect.MessageDescriptor
+	fingerprint uint64
+}
+
+func NewProtobufSerializer(descriptorSetPath, messageName string) (Serializer, error) {
+	descriptor, fingerprint, err := loadProtobufDescriptor(descriptorSetPath, messageName)
+	if err != nil {
+		return nil, err
+	}
+	return &ProtobufSerializer{descriptor: descriptor, fingerprint: fingerprint}, nil
+}
+
+func NewProtobufDeserializer(descriptorSetPath, messageName string) (Deserializer, error) {
+	descriptor, fingerprint, err := loadProtobufDescriptor(descriptorSetPath, messageName)
+	if err != nil {
+		return nil, err
+	}
+	return &ProtobufDeserializer{descriptor: descriptor, fingerprint: fingerprint}, nil
+}
+
+// loadProtobufDescriptor returns the descriptor of the named message from the descriptor set file,
+// and its fingerprint, which is the FNV-1a hash of the deterministic encoding of the message's
+// DescriptorProto.
+func loadProtobufDescriptor(path, messageName string) (protoreflect.MessageDescriptor, uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	set := &descriptorpb.FileDescriptorSet{}
+	err = proto.Unmarshal(data, set)
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to parse descriptor set; path=%s, err=%w", path, err)
+	}
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid descriptor set; path=%s, err=%w", path, err)
+	}
+	desc, err := files.FindDescriptorByName(protoreflect.FullName(messageName))
+	if err == protoregistry.NotFound {
+		return nil, 0, fmt.Errorf("message not found in descriptor set; path=%s, message=%s", path, messageName)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	retval, ok := desc.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, 0, fmt.Errorf("descriptor is not a message; path=%s, message=%s", path, messageName)
+	}
+	descriptorProto, err := proto.MarshalOptions{Deterministic: true}.Marshal(protodesc.ToDescriptorProto(retval))
+	if err != nil {
+		return nil, 0, err
+	}
+	h := fnv.New64a()
+	h.Write(descriptorProto)
+	return retval, h.Sum64(), nil
+}
+
+func (p *ProtobufSerializer) Serialize(key string, record map[string]interface{}) (*SerializedRecord, error) {
+	msg := dynamicpb.NewMessage(p.descriptor)
+	err := protobufFromNative(msg, record)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s; key=%s", ErrInvalidRecord, err, key)
+	}
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	return &SerializedRecord{
+		Key:               key,
+		Encoding:          EncodingProtobuf,
+		Data:              data,
+		SchemaFingerprint: p.fingerprint,
+		Record:            record,
+	}, nil
+}
+
+func (p *ProtobufDeserializer) Encoding() Encoding {
+	return EncodingProtobuf
+}
+
+func (p *ProtobufDeserializer) Deserialize(record *SerializedRecord) (map[string]interface{}, error) {
+	if record.SchemaFingerprint != p.fingerprint {
+		return nil, fmt.Errorf(
+			"schema fingerprint mismatch; key=%s, fingerprint=%d, expected=%d", record.Key, record.SchemaFingerprint, p.fingerprint)
+	}
+	msg := dynamicpb.NewMessage(p.descriptor)
+	err := proto.Unmarshal(record.Data, msg)
+	if err != nil {
+		return nil, err
+	}
+	return protobufToNative(msg), nil
+}
+
+func protobufFromNative(msg protoreflect.Message, record map[string]interface{}) error {
+	fields := msg.Descriptor().Fields()
+	for name, val := range record {
+		fd := fields.ByName(protoreflect.Name(name))
+		if fd == nil {
+			return fmt.Errorf("unknown field; message=%s, field=%s", msg.Descriptor().FullName(), name)
+		}
+		if val == nil {
+			continue
+		}
+		var err error
+		switch {
+		case fd.IsMap():
+			err = protobufMapFromNative(msg.Mutable(fd).Map(), fd, val)
+		case fd.IsList():
+			err = protobufListFromNative(msg.Mutable(fd).List(), fd, val)
+		case fd.Kind() == protoreflect.MessageKind || fd.Kind() == protoreflect.GroupKind:
+			m, ok := val.(map[string]interface{})
+			if !ok {
+				err = fmt.Errorf("unsupported type; type=%T", val)
+				break
+			}
+			err = protobufFromNative(msg.Mutable(fd).Message(), m)
+		default:
+			var v protoreflect.Value
+			v, err = protobufScalarFromNative(fd, val)
+			if err == nil {
+				msg.Set(fd, v)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%s; field=%s", err, fd.FullName())
+		}
+	}
+	return nil
+}
+
+func protobufListFromNative(list protoreflect.List, fd protoreflect.FieldDescriptor, val interface{}) error {
+	vals, ok := toInterfaceSlice(val)
+	if !ok {
+		return fmt.Errorf("unsupported type for repeated field; type=%T", val)
+	}
+	for i, elem := range vals {
+		if fd.Kind() == protoreflect.MessageKind || fd.Kind() == protoreflect.GroupKind {
+			m, ok := elem.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("unsupported type; index=%d, type=%T", i, elem)
+			}
+			v := list.NewElement()
+			err := protobufFromNative(v.Message(), m)
+			if err != nil {
+				return err
+			}
+			list.Append(v)
+			continue
+		}
+		v, err := protobufScalarFromNative(fd, elem)
+		if err != nil {
+			return fmt.Errorf("%s; index=%d", err, i)
+		}
+		list.Append(v)
+	}
+	return nil
+}
+
+func protobufMapFromNative(m protoreflect.Map, fd protoreflect.FieldDescriptor, val interface{}) error {
+	entries, ok := val.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("unsupported type for map field; type=%T", val)
+	}
+	for k, elem := range entries {
+		var key interface{} = k
+		switch fd.MapKey().Kind() {
+		case protoreflect.BoolKind:
+			b, err := strconv.ParseBool(k)
+			if err != nil {
+				return fmt.Errorf("invalid map key; key=%s", k)
+			}
+			key = b
+		case protoreflect.StringKind:
+		default:
+			i, err := strconv.ParseInt(k, 10, 64)
+			if err != nil {
+				u, uerr := strconv.ParseUint(k, 10, 64)
+				if uerr != nil {
+					return fmt.Errorf("invalid map key; key=%s", k)
+				}
+				key = u
+			} else {
+				key = i
+			}
+		}
+		mapKey, err := protobufScalarFromNative(fd.MapKey(), key)
+		if err != nil {
+			return fmt.Errorf("%s; key=%s", err, k)
+		}
+		valueFd := fd.MapValue()
+		if valueFd.Kind() == protoreflect.MessageKind {
+			mv, ok := elem.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("unsupported type; key=%s, type=%T", k, elem)
+			}
+			v := m.NewValue()
+			err := protobufFromNative(v.Message(), mv)
+			if err != nil {
+				return err
+			}
+			m.Set(mapKey.MapKey(), v)
+			continue
+		}
+		v, err := protobufScalarFromNative(valueFd, elem)
+		if err != nil {
+			return fmt.Errorf("%s; key=%s", err, k)
+		}
+		m.Set(mapKey.MapKey(), v)
+	}
+	return nil
+}
+
+func protobufScalarFromNative(fd protoreflect.FieldDescriptor, val interface{}) (protoreflect.Value, error) {
+	switch fd.Kind() {
+	case protoreflect.BoolKind:
+		if b, ok := val.(bool); ok {
+			return protoreflect.ValueOfBool(b), nil
+		}
+	case protoreflect.StringKind:
+		if s, ok := val.(string); ok {
+			return protoreflect.ValueOfString(s), nil
+		}
+	case protoreflect.BytesKind:
+		switch v := val.(type) {
+		case []byte:
+			return protoreflect.ValueOfBytes(v), nil
+		case string:
+			return protoreflect.ValueOfBytes([]byte(v)), nil
+		}
+	case protoreflect.EnumKind:
+		if s, ok := val.(string); ok {
+			ev := fd.Enum().Values().ByName(protoreflect.Name(s))
+			if ev == nil {
+				return protoreflect.Value{}, fmt.Errorf("unknown enum value; value=%s", s)
+			}
+			return protoreflect.ValueOfEnum(ev.Number()), nil
+		}
+		if i, ok := protobufInteger(val, math.MinInt32, math.MaxInt32); ok {
+			return protoreflect.ValueOfEnum(protoreflect.EnumNumber(i)), nil
+		}
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		if i, ok := protobufInteger(val, math.MinInt32, math.MaxInt32); ok {
+			return protoreflect.ValueOfInt32(int32(i)), nil
+		}
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		if i, ok := protobufInteger(val, math.MinInt64, math.MaxInt64); ok {
+			return protoreflect.ValueOfInt64(i), nil
+		}
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		if u, ok := protobufUnsigned(val, math.MaxUint32); ok {
+			return protoreflect.ValueOfUint32(uint32(u)), nil
+		}
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		if u, ok := protobufUnsigned(val, math.MaxUint64); ok {
+			return protoreflect.ValueOfUint64(u), nil
+		}
+	case protoreflect.FloatKind:
+		if num, ok := toNumber(val); ok {
+			return protoreflect.ValueOfFloat32(float32(num.float())), nil
+		}
+	case protoreflect.DoubleKind:
+		if num, ok := toNumber(val); ok {
+			return protoreflect.ValueOfFloat64(num.float()), nil
+		}
+	}
+	return protoreflect.Value{}, fmt.Errorf("unsupported type; kind=%s, type=%T", fd.Kind(), val)
+}
+
+// protobufInteger returns the value as an int64 if it is an integer within the range.
+func protobufInteger(val interface{}, min, max int64) (int64, bool) {
+	num, ok := toNumber(val)
+	if !ok {
+		return 0, false
+	}
+	switch num.kind {
+	case numberInt:
+		return num.i, num.i >= min && num.i <= max
+	case numberUint:
+		return int64(num.u), num.u <= uint64(max)
+	default:
+		return 0, false
+	}
+}
+
+// protobufUnsigned returns the value as a uint64 if it is a non-negative integer up to the max.
+func protobufUnsigned(val interface{}, max uint64) (uint64, bool) {
+	num, ok := toNumber(val)
+	if !ok {
+		return 0, false
+	}
+	switch num.kind {
+	case numberInt:
+		return uint64(num.i), num.i >= 0 && uint64(num.i) <= max
+	case numberUint:
+		return num.u, num.u <= max
+	default:
+		return 0, false
+	}
+}
+
+// toInterfaceSlice returns the elements of a []interface{} or of a slice of one of the scalar types
+// that CopyRecord copies.
+func toInterfaceSlice(val interface{}) ([]interface{}, bool) {
+	switch v := val.(type) {
+	case []interface{}:
+		return v, true
+	case []string:
+		retval := make([]interface{}, len(v))
+		for i, e := range v {
+			retval[i] = e
+		}
+		return retval, true
+	case []int64:
+		retval := make([]interface{}, len(v))
+		for i, e := range v {
+			retval[i] = e
+		}
+		return retval, true
+	case []float64:
+		retval := make([]interface{}, len(v))
+		for i, e := range v {
+			retval[i] = e
+		}
+		return retval, true
+	default:
+		return nil, false
+	}
+}
+
+func protobufToNative(msg protoreflect.Message) map[string]interface{} {
+	retval := map[string]interface{}{}
+	fields := msg.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		if fd.HasPresence() && !msg.Has(fd) {
+			continue
+		}
+		retval[string(fd.Name())] = protobufValueToNative(fd, msg.Get(fd))
+	}
+	return retval
+}
+
+func protobufValueToNative(fd protoreflect.FieldDescriptor, v protoreflect.Value) interface{} {
+	switch {
+	case fd.IsMap():
+		retval := map[string]interface{}{}
+		v.Map().Range(func(k protoreflect.MapKey, mv protoreflect.Value) bool {
+			retval[k.String()] = protobufSingularToNative(fd.MapValue(), mv)
+			return true
+		})
+		return retval
+	case fd.IsList():
+		list := v.List()
+		retval := make([]interface{}, list.Len())
+		for i := 0; i < list.Len(); i++ {
+			retval[i] = protobufSingularToNative(fd, list.Get(i))
+		}
+		return retval
+	default:
+		return protobufSingularToNative(fd, v)
+	}
+}
+
+func protobufSingularToNative(fd protoreflect.FieldDescriptor, v protoreflect.Value) interface{} {
+	switch fd.Kind() {
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return protobufToNative(v.Message())
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByNumber(v.Enum()); ev != nil {
+			return string(ev.Name())
+		}
+		return int32(v.Enum())
+	case protoreflect.BytesKind:
+		return append([]byte{}, v.Bytes()...)
+	default:
+		// The remaining kinds are already the native Go types, eg. int32 for Int32Kind.
+		return v.Interface()
+	}
+}
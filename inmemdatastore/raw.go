@@ -0,0 +1,216 @@
+package inmemdatastore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+)
+
+const (
+	RawFileExtension = ".raw"
+	// Written at the start of each raw file.
+	rawFileMagic = "IMDSRAW\x01"
+	// The maximum size of a single frame that ReadRawFile will read.
+	rawMaxFrameSize = 1 << 30
+)
+
+// RawFileWriter is a Writer that appends the Data of each SerializedRecord, as a length-prefixed
+// frame along with its key and Encoding, to a sequence of segments named "<id>-<seq>.raw".  It does
+// no encoding of its own, so it must be paired with a Serializer that encodes the records, such as
+// the AvroSerializer, and returns an error wrapping ErrInvalidRecord for a record with
+// EncodingNone.  The files are read back with ReadRawFile.
+//
+// Each frame is the length of its body as a uvarint, the body, and the CRC32 of the body.  The body
+// is the Encoding as a uvarint, the SchemaFingerprint as a big-endian uint64, the length of the key
+// as a uvarint, the key, and the Data.
+type RawFileWriter struct {
+	id       int
+	segments *segmentWriter
+	// Reused for assembling frames.  Only used while holding the mux of the segmentWriter.
+	buf []byte
+}
+
+type RawFileWriterConfig struct {
+	Id        int
+	OutputDir string
+	// Defines when the writer closes the file to which it is currently writing and opens a new
+	// one.  By default files are never rotated.
+	Rotation RotationPolicy
+}
+
+func NewRawFileWriter(ctx context.Context, wg *sync.WaitGroup, cfg RawFileWriterConfig) (*RawFileWriter, error) {
+	segments, err := newSegmentWriter(ctx, wg, segmentWriterConfig{
+		Id:        cfg.Id,
+		OutputDir: cfg.OutputDir,
+		Ext:       RawFileExtension,
+		Rotation:  cfg.Rotation,
+		NewEncoder: func(w io.Writer) (segmentEncoder, error) {
+			_, err := w.Write([]byte(rawFileMagic))
+			return plainEncoder{w}, err
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &RawFileWriter{id: cfg.Id, segments: segments}, nil
+}
+
+func (r *RawFileWriter) Write(record *SerializedRecord) error {
+	return r.WriteBatch([]*SerializedRecord{record})
+}
+
+// WriteBatch appends the frames of all of the records to the current file with a single write.
+func (r *RawFileWriter) WriteBatch(records []*SerializedRecord) error {
+	for i, record := range records {
+		if record.Encoding == EncodingNone {
+			return fmt.Errorf(
+				"%w: unsupported encoding; index=%d, key=%s, encoding=%s", ErrInvalidRecord, i, record.Key, record.Encoding)
+		}
+	}
+	return r.segments.write(len(records), func(enc segmentEncoder) error {
+		buf := r.buf[:0]
+		for _, record := range records {
+			buf = appendRawFrame(buf, record)
+		}
+		r.buf = buf
+		_, err := enc.Write(buf)
+		return err
+	})
+}
+
+func (r *RawFileWriter) Sync() error {
+	return r.segments.sync()
+}
+
+func (r *RawFileWriter) Shutdown() error {
+	return r.segments.shutdown()
+}
+
+func appendRawFrame(buf []byte, record *SerializedRecord) []byte {
+	bodyLen := uvarintLen(uint64(record.Encoding)) + 8 +
+		uvarintLen(uint64(len(record.Key))) + len(record.Key) + len(record.Data)
+	buf = appendUvarint(buf, uint64(bodyLen))
+	start := len(buf)
+	buf = appendUvarint(buf, uint64(record.Encoding))
+	var fingerprint [8]byte
+	binary.BigEndian.PutUint64(fingerprint[:], record.SchemaFingerprint)
+	buf = append(buf, fingerprint[:]...)
+	buf = appendUvarint(buf, uint64(len(record.Key)))
+	buf = append(buf, record.Key...)
+	buf = append(buf, record.Data...)
+	var checksum [crc32.Size]byte
+	binary.BigEndian.PutUint32(checksum[:], crc32.ChecksumIEEE(buf[start:]))
+	return append(buf, checksum[:]...)
+}
+
+// ReadRawFile reads each of the records from a file written by a RawFileWriter and passes them to
+// fn.  The Record of each SerializedRecord is nil; its Data is as it was output by the Serializer.
+// A file that ends with a partially written frame, as can be left by a crash, returns an error
+// wrapping io.ErrUnexpectedEOF after all of the complete frames have been read.
+func ReadRawFile(path string, fn func(*SerializedRecord) error) error {
+	fh, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	r := bufio.NewReader(fh)
+	magic := make([]byte, len(rawFileMagic))
+	_, err = io.ReadFull(r, magic)
+	if err != nil {
+		return fmt.Errorf("unable to read raw file header; path=%s, err=%w", path, err)
+	}
+	if !bytes.Equal(magic, []byte(rawFileMagic)) {
+		return fmt.Errorf("invalid raw file header; path=%s", path)
+	}
+	for {
+		record, err := readRawFrame(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("unable to read raw frame; path=%s, err=%w", path, err)
+		}
+		err = fn(record)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func readRawFrame(r *bufio.Reader) (*SerializedRecord, error) {
+	body, err := readFrame(r)
+	if err != nil {
+		return nil, err
+	}
+
+	encoding, n := binary.Uvarint(body)
+	if n <= 0 || len(body) < n+8 {
+		return nil, errors.New("invalid frame")
+	}
+	body = body[n:]
+	retval := &SerializedRecord{
+		Encoding:          Encoding(encoding),
+		SchemaFingerprint: binary.BigEndian.Uint64(body),
+	}
+	body = body[8:]
+	keyLen, n := binary.Uvarint(body)
+	if n <= 0 || uint64(len(body)-n) < keyLen {
+		return nil, errors.New("invalid frame")
+	}
+	body = body[n:]
+	retval.Key = string(body[:keyLen])
+	retval.Data = body[keyLen:]
+	return retval, nil
+}
+
+// appendFrame appends the body as a frame: its length as a uvarint, the body, and its CRC32.
+func appendFrame(buf []byte, body []byte) []byte {
+	buf = appendUvarint(buf, uint64(len(body)))
+	buf = append(buf, body...)
+	var checksum [crc32.Size]byte
+	binary.BigEndian.PutUint32(checksum[:], crc32.ChecksumIEEE(body))
+	return append(buf, checksum[:]...)
+}
+
+// readFrame reads a frame written by appendFrame and returns its body.  It returns io.EOF if there
+// are no more frames, and io.ErrUnexpectedEOF if the reader ends part way through a frame.
+func readFrame(r *bufio.Reader) ([]byte, error) {
+	bodyLen, err := binary.ReadUvarint(r)
+	if err != nil {
+		if err == io.EOF {
+			return nil, err
+		}
+		return nil, io.ErrUnexpectedEOF
+	}
+	if bodyLen > rawMaxFrameSize {
+		return nil, fmt.Errorf("invalid frame size; size=%d", bodyLen)
+	}
+	frame := make([]byte, bodyLen+crc32.Size)
+	_, err = io.ReadFull(r, frame)
+	if err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	body := frame[:bodyLen]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(frame[bodyLen:]) {
+		return nil, errors.New("checksum mismatch")
+	}
+	return body, nil
+}
+
+func appendUvarint(buf []byte, val uint64) []byte {
+	var scratch [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(scratch[:], val)
+	return append(buf, scratch[:n]...)
+}
+
+func uvarintLen(val uint64) int {
+	var scratch [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(scratch[:], val)
+}
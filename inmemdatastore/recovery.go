@@ -0,0 +1,280 @@
+package inmemdatastore
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/linkedin/goavro/v2"
+	log "github.com/rchapin/rlog"
+)
+
+const (
+	AvroFileExtension = ".avro"
+)
+
+// RecoveryStats summarizes the data read from the SnapshotDir, the WALDir and the DataDir when
+// re-populating the datastore on start-up.
+type RecoveryStats struct {
+	// The path of the snapshot that was loaded, if any.
+	SnapshotPath string
+	// The number of records and tombstones loaded from the snapshot.
+	SnapshotRecords    int64
+	SnapshotTombstones int64
+	// The number of write-ahead log segments that were read.
+	WALSegmentsRead int
+	// The number of entries replayed from the write-ahead log, counting a batch as a single entry.
+	WALEntriesReplayed int64
+	// The number of data files that were read.
+	FilesRead int
+	// The number of data files that were not read because their records are all in the snapshot.
+	FilesSkipped int
+	// The total number of records read from all of the data files.
+	RecordsRead int64
+	// The number of records that were not loaded because the datastore already contained a newer
+	// record for the same key.
+	RecordsSkipped int64
+	// The number of records that were not loaded because they did not contain a string value for
+	// the RecordIdKey, or were rejected by the ConflictResolver.
+	RecordsInvalid int64
+	// The total number of tombstones read from all of the tombstone files.
+	TombstonesRead int64
+}
+
+// recover loads the most recent snapshot, if there is one, replays the write-ahead log, if there
+// is one, and then reads every Avro OCF file, and every raw file, in the DataDir that was written
+// after the snapshot and loads the most recent record for each key into the datastore shards, and
+// then applies the tombstones from all of the tombstone files written after the snapshot.  The
+// records are not re-persisted, other than those replayed from the write-ahead log.  Files that
+// still have the TmpFileSuffix, left behind by a writer that did not shutdown cleanly, are read as
+// well.
+//
+// Because both records and tombstones are only applied if they are newer than what is already in
+// the datastore the order in which the files are read does not change the end result.
+func (ds *InMemDataStore) recover() (RecoveryStats, error) {
+	stats := RecoveryStats{}
+	var markers []SnapshotMarker
+	if ds.snapshotter != nil {
+		var err error
+		markers, err = ds.loadSnapshot(&stats)
+		if err != nil {
+			return stats, err
+		}
+	}
+	if ds.wal != nil {
+		err := ds.replayWAL(&stats)
+		if err != nil {
+			return stats, err
+		}
+	}
+	if ds.dataDir == "" {
+		return stats, nil
+	}
+	files, err := ds.dataFiles(AvroFileExtension, markers, &stats)
+	if err != nil {
+		return stats, err
+	}
+	for _, file := range files {
+		err := readAvroFile(file, &stats, ds.recoverRecord)
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	rawFiles, err := ds.dataFiles(RawFileExtension, markers, &stats)
+	if err != nil {
+		return stats, err
+	}
+	for _, file := range rawFiles {
+		err := ds.readRawDataFile(file, &stats)
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	tombstoneFiles, err := ds.dataFiles(TombstoneFileExtension, markers, &stats)
+	if err != nil {
+		return stats, err
+	}
+	for _, file := range tombstoneFiles {
+		err := readAvroFile(file, &stats, ds.recoverTombstone)
+		if err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+func (ds *InMemDataStore) recoverRecord(datum interface{}, stats *RecoveryStats) {
+	stats.RecordsRead++
+	record, ok := datum.(map[string]interface{})
+	if !ok {
+		stats.RecordsInvalid++
+		return
+	}
+	key, ok := record[ds.recordIdKey].(string)
+	if !ok {
+		stats.RecordsInvalid++
+		return
+	}
+	// The data files do not hold the deadline of the record, so it is derived from the TTL of the
+	// datastore, which with TTLModeWallClock restarts the expiry from now.
+	resolution, err := ds.load(key, record, ds.expiryDeadline(record, ds.ttl))
+	if err != nil {
+		log.Debugf("IMDS unable to recover record; key=%s, err=%s", key, err)
+		stats.RecordsInvalid++
+		return
+	}
+	if !resolution.Applied() {
+		stats.RecordsSkipped++
+	}
+}
+
+func (ds *InMemDataStore) recoverTombstone(datum interface{}, stats *RecoveryStats) {
+	stats.TombstonesRead++
+	record, ok := datum.(map[string]interface{})
+	if !ok {
+		return
+	}
+	key, ok := record[TombstoneFieldKey].(string)
+	if !ok {
+		return
+	}
+	timestamp, ok := record[TombstoneFieldTimestamp].(int64)
+	if !ok {
+		return
+	}
+	datastore, err := ds.getDatastoreShard(key)
+	if err != nil {
+		return
+	}
+	datastore.mux.Lock()
+	ds.tombstone(datastore, key, timestamp)
+	datastore.mux.Unlock()
+}
+
+// globDataFiles returns the paths of all of the files in the dir with the given extension, with or
+// without the TmpFileSuffix, sorted so that they are read in a deterministic order and the stats
+// are repeatable for a given dir.
+func globDataFiles(dir, ext string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+ext))
+	if err != nil {
+		return nil, err
+	}
+	tmpFiles, err := filepath.Glob(filepath.Join(dir, "*"+ext+TmpFileSuffix))
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, tmpFiles...)
+	sort.Strings(files)
+	return files, nil
+}
+
+// dataFiles returns the paths of the files in the DataDir with the given extension, as with
+// globDataFiles, less those that are covered by the snapshot with the given markers.
+func (ds *InMemDataStore) dataFiles(ext string, markers []SnapshotMarker, stats *RecoveryStats) ([]string, error) {
+	files, err := globDataFiles(ds.dataDir, ext)
+	if err != nil {
+		return nil, err
+	}
+	retval := make([]string, 0, len(files))
+	for _, file := range files {
+		if coveredBySnapshot(markers, file, ext) {
+			stats.FilesSkipped++
+			continue
+		}
+		retval = append(retval, file)
+	}
+	return retval, nil
+}
+
+// readAvroFile reads each of the records from the Avro OCF file and passes them to fn.
+func readAvroFile(path string, stats *RecoveryStats, fn func(interface{}, *RecoveryStats)) error {
+	fh, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	fi, err := fh.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() == 0 {
+		// A file that was created but never had its header written to it, there is nothing to
+		// load.
+		log.Warnf("Skipping empty data file during recovery; path=%s", path)
+		return nil
+	}
+
+	ocfr, err := goavro.NewOCFReader(bufio.NewReader(fh))
+	if err != nil {
+		return fmt.Errorf("unable to read avro data file; path=%s, err=%w", path, err)
+	}
+	stats.FilesRead++
+	for ocfr.Scan() {
+		datum, err := ocfr.Read()
+		if err != nil {
+			return fmt.Errorf("unable to read avro record; path=%s, err=%w", path, err)
+		}
+		fn(datum, stats)
+	}
+	if err := ocfr.Err(); err != nil {
+		// The most likely cause is a partially written block at the end of a file that was being
+		// written when the process died.  Everything up to that point has been loaded, so we log it
+		// and carry on with the rest of the files.
+		log.Warnf("Unable to read all of the blocks in data file during recovery; path=%s, err=%s", path, err)
+	}
+	return nil
+}
+
+// readRawDataFile decodes each of the records in the raw file with the Deserializer for its
+// Encoding and loads them.  As with an Avro file, a partially written frame at the end of the file
+// is logged and the records before it are kept.
+func (ds *InMemDataStore) readRawDataFile(path string, stats *RecoveryStats) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if fi.Size() == 0 {
+		log.Warnf("Skipping empty data file during recovery; path=%s", path)
+		return nil
+	}
+	stats.FilesRead++
+	err = ReadRawFile(path, func(record *SerializedRecord) error {
+		deserializer, ok := ds.deserializers[record.Encoding]
+		if !ok {
+			log.Debugf("IMDS unable to recover record, no deserializer; key=%s, encoding=%s", record.Key, record.Encoding)
+			stats.RecordsRead++
+			stats.RecordsInvalid++
+			return nil
+		}
+		datum, err := deserializer.Deserialize(record)
+		if err != nil {
+			log.Debugf("IMDS unable to deserialize record; key=%s, err=%s", record.Key, err)
+			stats.RecordsRead++
+			stats.RecordsInvalid++
+			return nil
+		}
+		ds.recoverRecord(datum, stats)
+		return nil
+	})
+	if err != nil {
+		log.Warnf("Unable to read all of the frames in data file during recovery; path=%s, err=%s", path, err)
+	}
+	return nil
+}
+
+// load writes the record to its Datastore shard, to expire at the given deadline, subject to the
+// same check for a newer record as Put, without handing it off to the Persisters.
+func (ds *InMemDataStore) load(key string, record map[string]interface{}, deadline int64) (Resolution, error) {
+	datastore, err := ds.getDatastoreShard(key)
+	if err != nil {
+		return ResolutionStale, err
+	}
+	datastore.mux.Lock()
+	defer datastore.mux.Unlock()
+	return ds.cache(datastore, key, record, deadline)
+}
@@ -0,0 +1,412 @@
+package inmemdatastore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/rchapin/rlog"
+)
+
+const (
+	// How often the retention limits are enforced if no RetentionInterval is set.
+	DefaultRetentionInterval = 10 * time.Second
+)
+
+var (
+	// ErrInsufficientDiskSpace is returned by Put, PutBatch and Delete while the free space on the
+	// file system of the DataDir is below RetentionMinFreeBytes and there are no more closed data
+	// files that can be removed to free it.  The write is rejected before it is applied to the
+	// datastore or appended to the write-ahead log, so it has no effect.
+	ErrInsufficientDiskSpace = errors.New("insufficient disk space")
+	// errDiskFreeUnsupported is returned by diskFree on platforms on which the free space of a
+	// file system cannot be determined.
+	errDiskFreeUnsupported = errors.New("unable to determine free disk space on this platform")
+)
+
+// retentionReason is the limit for which a data file was removed.
+type retentionReason int
+
+const (
+	retentionMaxAge retentionReason = iota
+	retentionMaxBytes
+	retentionMinFreeBytes
+)
+
+func (r retentionReason) String() string {
+	switch r {
+	case retentionMaxAge:
+		return "max-age"
+	case retentionMaxBytes:
+		return "max-bytes"
+	case retentionMinFreeBytes:
+		return "min-free-bytes"
+	default:
+		return fmt.Sprintf("retentionReason(%d)", int(r))
+	}
+}
+
+// RetentionStats are the counters for the enforcement of the retention limits on the DataDir.
+type RetentionStats struct {
+	// The number of times that the limits have been enforced.
+	Runs int64
+	// The number of closed data files that were deleted, or moved to the RetentionArchiveDir, and
+	// their total size.
+	FilesDeleted  int64
+	FilesArchived int64
+	BytesRemoved  int64
+	// The number of files removed for each of the limits.
+	RemovedMaxAge       int64
+	RemovedMaxBytes     int64
+	RemovedMinFreeBytes int64
+	// The total size of the files in the DataDir, and the free space on its file system, after the
+	// most recent run.  FreeBytes is -1 if the free space could not be determined.
+	BytesUsed int64
+	FreeBytes int64
+	LastRun   time.Time
+	// Whether the IMDS is currently rejecting Puts, PutBatches and Deletes with
+	// ErrInsufficientDiskSpace, and the number of writes that it has rejected.
+	Degraded bool
+	Rejected int64
+}
+
+// retention holds the configuration, and the counters, for the enforcement of the retention limits
+// on the DataDir.
+type retention struct {
+	interval     time.Duration
+	maxBytes     int64
+	maxAge       time.Duration
+	minFreeBytes int64
+	archiveDir   string
+	// Set to 1 while the free space is below the minFreeBytes.  Accessed atomically.
+	degraded int32
+	// Accessed atomically.
+	rejected int64
+	// Guards the stats.
+	mux   *sync.Mutex
+	stats RetentionStats
+}
+
+// newRetention returns nil if none of the retention limits are set.
+func newRetention(cfg Config) *retention {
+	if cfg.RetentionMaxBytes <= 0 && cfg.RetentionMaxAge <= 0 && cfg.RetentionMinFreeBytes <= 0 {
+		return nil
+	}
+	interval := cfg.RetentionInterval
+	if interval == 0 {
+		interval = DefaultRetentionInterval
+	}
+	return &retention{
+		interval:     interval,
+		maxBytes:     cfg.RetentionMaxBytes,
+		maxAge:       cfg.RetentionMaxAge,
+		minFreeBytes: cfg.RetentionMinFreeBytes,
+		archiveDir:   cfg.RetentionArchiveDir,
+		mux:          &sync.Mutex{},
+		stats:        RetentionStats{FreeBytes: -1},
+	}
+}
+
+// isDegraded is safe to call on a nil retention, which is never degraded.
+func (r *retention) isDegraded() bool {
+	return r != nil && atomic.LoadInt32(&r.degraded) == 1
+}
+
+// reject returns ErrInsufficientDiskSpace, and counts the rejected write, if the IMDS is degraded.
+// It is safe to call on a nil retention.
+func (r *retention) reject(key, dataDir string) error {
+	if !r.isDegraded() {
+		return nil
+	}
+	atomic.AddInt64(&r.rejected, 1)
+	return fmt.Errorf("%w; key=%s, dataDir=%s", ErrInsufficientDiskSpace, key, dataDir)
+}
+
+// reason returns the limit, if any, that the data file exceeds given the current total size of the
+// files in the DataDir and the free space on its file system.
+func (r *retention) reason(file retentionFile, now time.Time, used, free int64, freeOk bool) (retentionReason, bool) {
+	switch {
+	case r.maxAge > 0 && now.Sub(file.modTime) > r.maxAge:
+		return retentionMaxAge, true
+	case r.maxBytes > 0 && used > r.maxBytes:
+		return retentionMaxBytes, true
+	case r.minFreeBytes > 0 && freeOk && free < r.minFreeBytes:
+		return retentionMinFreeBytes, true
+	default:
+		return 0, false
+	}
+}
+
+// retentionFile is a closed data file that can be removed to enforce the retention limits.
+type retentionFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// RetentionStats returns a snapshot of the counters for the enforcement of the retention limits.
+// They are all zero if none of the limits are set.
+func (ds *InMemDataStore) RetentionStats() RetentionStats {
+	r := ds.retention
+	if r == nil {
+		return RetentionStats{}
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	retval := r.stats
+	retval.Degraded = r.isDegraded()
+	retval.Rejected = atomic.LoadInt64(&r.rejected)
+	return retval
+}
+
+// EnforceRetention removes the oldest closed data files in the DataDir, those that their writers
+// have moved on from along with any written by Compact, until none of them are older than the
+// RetentionMaxAge, the total size of the files in the DataDir is no more than the
+// RetentionMaxBytes, and there are at least RetentionMinFreeBytes free on its file system.  The
+// files are deleted, or moved to the RetentionArchiveDir if one is set.  As with compaction, the
+// most recent file of each writer is never removed.
+//
+// If there is still less than RetentionMinFreeBytes free once all of the closed files have been
+// removed, the IMDS is degraded until a later run finds enough free space.  While it is degraded,
+// Put, PutBatch and Delete are rejected with ErrInsufficientDiskSpace without updating the
+// datastore.
+//
+// Returns the counters as of the end of the run.
+func (ds *InMemDataStore) EnforceRetention() (RetentionStats, error) {
+	r := ds.retention
+	if ds.dataDir == "" || r == nil {
+		return RetentionStats{}, errors.New("a DataDir and at least one retention limit are required for retention")
+	}
+	// Compaction also reads and removes the closed data files, so the two never run at the same
+	// time.
+	ds.compactor.mux.Lock()
+	defer ds.compactor.mux.Unlock()
+
+	files, used, err := ds.retentionFiles()
+	if err != nil {
+		return ds.RetentionStats(), err
+	}
+	free, err := diskFree(ds.dataDir)
+	freeOk := err == nil
+	if err != nil && !errors.Is(err, errDiskFreeUnsupported) {
+		return ds.RetentionStats(), err
+	}
+
+	now := time.Now()
+	removed := map[retentionReason]int64{}
+	var deleted, archived, bytesRemoved int64
+	for _, file := range files {
+		reason, ok := r.reason(file, now, used, free, freeOk)
+		if !ok {
+			// The files are ordered oldest first, and the rest are no older and removing them would
+			// not free any more space than is needed.
+			break
+		}
+		wasArchived, err := ds.removeRetentionFile(file.path)
+		if err != nil {
+			return ds.RetentionStats(), err
+		}
+		log.Infof(
+			"IMDS retention removed data file, path=%s, reason=%s, size=%d, modTime=%s, archived=%t",
+			file.path, reason, file.size, file.modTime.Format(time.RFC3339), wasArchived)
+		removed[reason]++
+		if wasArchived {
+			archived++
+		} else {
+			deleted++
+		}
+		bytesRemoved += file.size
+		used -= file.size
+		if freeOk && r.minFreeBytes > 0 {
+			// An archived file only frees any space if the RetentionArchiveDir is on a different
+			// file system, so the free space is checked again rather than estimated.
+			free, err = diskFree(ds.dataDir)
+			if err != nil {
+				return ds.RetentionStats(), err
+			}
+		}
+	}
+	if deleted+archived > 0 {
+		err := syncDir(ds.dataDir)
+		if err != nil {
+			return ds.RetentionStats(), err
+		}
+	}
+
+	short := freeOk && r.minFreeBytes > 0 && free < r.minFreeBytes
+	if short && atomic.CompareAndSwapInt32(&r.degraded, 0, 1) {
+		log.Errorf(
+			"IMDS degraded, rejecting entries for the persisters until there is enough free disk space; "+
+				"dataDir=%s, freeBytes=%d, minFreeBytes=%d",
+			ds.dataDir, free, r.minFreeBytes)
+	} else if !short && atomic.CompareAndSwapInt32(&r.degraded, 1, 0) {
+		log.Infof("IMDS no longer degraded, dataDir=%s, freeBytes=%d, minFreeBytes=%d", ds.dataDir, free, r.minFreeBytes)
+	}
+
+	r.mux.Lock()
+	r.stats.Runs++
+	r.stats.FilesDeleted += deleted
+	r.stats.FilesArchived += archived
+	r.stats.BytesRemoved += bytesRemoved
+	r.stats.RemovedMaxAge += removed[retentionMaxAge]
+	r.stats.RemovedMaxBytes += removed[retentionMaxBytes]
+	r.stats.RemovedMinFreeBytes += removed[retentionMinFreeBytes]
+	r.stats.BytesUsed = used
+	r.stats.FreeBytes = -1
+	if freeOk {
+		r.stats.FreeBytes = free
+	}
+	r.stats.LastRun = now
+	r.mux.Unlock()
+	log.Debugf(
+		"IMDS retention enforced, filesDeleted=%d, filesArchived=%d, bytesRemoved=%d, bytesUsed=%d, freeBytes=%d",
+		deleted, archived, bytesRemoved, used, free)
+	return ds.RetentionStats(), nil
+}
+
+// retentionFiles returns the closed data files in the DataDir, oldest first, along with the total
+// size of all of the files in the DataDir.
+func (ds *InMemDataStore) retentionFiles() ([]retentionFile, int64, error) {
+	entries, err := os.ReadDir(ds.dataDir)
+	if err != nil {
+		return nil, 0, err
+	}
+	var used int64
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			// Renamed, or removed, since the directory was read.
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		used += info.Size()
+	}
+
+	paths := []string{}
+	for _, ext := range dataFileExtensions {
+		closed, _, err := closedSegments(ds.dataDir, ext)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, segment := range closed {
+			// A data file that has not been shipped yet is kept, even if that leaves the IMDS
+			// degraded.
+			if !ds.shipper.pending(segment.Path) {
+				paths = append(paths, segment.Path)
+			}
+		}
+	}
+	for _, ext := range []string{AvroFileExtension, TombstoneFileExtension} {
+		compacted, err := filepath.Glob(filepath.Join(ds.dataDir, CompactedFilePrefix+"*"+ext))
+		if err != nil {
+			return nil, 0, err
+		}
+		paths = append(paths, compacted...)
+	}
+
+	retval := make([]retentionFile, 0, len(paths))
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, 0, err
+		}
+		retval = append(retval, retentionFile{path: path, size: info.Size(), modTime: info.ModTime()})
+	}
+	// A tombstone file is written to alongside the data files, so ordering by the paths when the
+	// times are the same removes the data files of a writer before its tombstone files.
+	sort.Slice(retval, func(i, j int) bool {
+		if !retval[i].modTime.Equal(retval[j].modTime) {
+			return retval[i].modTime.Before(retval[j].modTime)
+		}
+		return retval[i].path < retval[j].path
+	})
+	return retval, used, nil
+}
+
+// removeRetentionFile deletes the file, or moves it to the RetentionArchiveDir if one is set, in
+// which case it returns true.
+func (ds *InMemDataStore) removeRetentionFile(path string) (bool, error) {
+	archiveDir := ds.retention.archiveDir
+	if archiveDir == "" {
+		return false, os.Remove(path)
+	}
+	dst := filepath.Join(archiveDir, filepath.Base(path))
+	err := renameNoReplace(path, dst)
+	var linkErr *os.LinkError
+	if errors.As(err, &linkErr) {
+		// The RetentionArchiveDir is on a different file system, which is the only way that
+		// archiving frees any space.
+		err = copyFile(path, dst)
+		if err == nil {
+			err = os.Remove(path)
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, syncDir(archiveDir)
+}
+
+// copyFile copies the file at src to dst, which must not already exist, by way of a temporary file
+// that is synced before it is renamed to dst.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := dst + TmpFileSuffix
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	err = syncAndClose(out)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return renameNoReplace(tmp, dst)
+}
+
+// runRetention starts a go routine that enforces the retention limits every RetentionInterval.
+func (ds *InMemDataStore) runRetention() {
+	log.Infof(
+		"IMDS starting retention, interval=%s, maxBytes=%d, maxAge=%s, minFreeBytes=%d, archiveDir=%s",
+		ds.retention.interval, ds.retention.maxBytes, ds.retention.maxAge, ds.retention.minFreeBytes,
+		ds.retention.archiveDir)
+	ds.bgWg.Add(1)
+	ticker := time.NewTicker(ds.retention.interval)
+	go func() {
+		defer ds.bgWg.Done()
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				_, err := ds.EnforceRetention()
+				if err != nil {
+					log.Errorf("IMDS unable to enforce retention; dataDir=%s, err=%s", ds.dataDir, err)
+				}
+			case <-ds.bgCtx.Done():
+				log.Info("IMDS retention exiting on context done")
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,331 @@
+package inmemdatastore
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// The region used to sign the requests if no S3Config.Region is set.  Most S3-compatible
+	// stores other than AWS accept any region.
+	DefaultS3Region = "us-east-1"
+	s3TimeFormat    = "20060102T150405Z"
+	s3DateFormat    = "20060102"
+)
+
+// S3Config configures an S3ObjectStore.
+type S3Config struct {
+	// The URL of the S3-compatible endpoint, eg. "https://s3.eu-west-1.amazonaws.com" or
+	// "http://localhost:9000".  The objects are addressed path-style, as Endpoint/Bucket/key.
+	Endpoint string
+	// Defaults to DefaultS3Region.
+	Region string
+	Bucket string
+	// The credentials with which the requests are signed.
+	AccessKeyId     string
+	SecretAccessKey string
+	// Only needed for temporary credentials.
+	SessionToken string
+	// Defaults to http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+// S3Error is the error returned by an S3-compatible store for a failed request.
+type S3Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+	RequestId  string
+}
+
+func (e *S3Error) Error() string {
+	return fmt.Sprintf(
+		"s3 request failed; status=%d, code=%s, message=%s, requestId=%s", e.StatusCode, e.Code, e.Message, e.RequestId)
+}
+
+// Is makes a NoSuchUpload error match ErrUploadNotFound.
+func (e *S3Error) Is(target error) bool {
+	return target == ErrUploadNotFound && e.Code == "NoSuchUpload"
+}
+
+// S3ObjectStore is an ObjectStore for Amazon S3, or any store that implements its multipart upload
+// API such as MinIO, that signs its requests with AWS Signature Version 4.
+type S3ObjectStore struct {
+	cfg      S3Config
+	endpoint *url.URL
+	client   *http.Client
+}
+
+func NewS3ObjectStore(cfg S3Config) (*S3ObjectStore, error) {
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3 endpoint; endpoint=%s, err=%w", cfg.Endpoint, err)
+	}
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint, a scheme and host are required; endpoint=%s", cfg.Endpoint)
+	}
+	if cfg.Bucket == "" {
+		return nil, errors.New("an s3 bucket is required")
+	}
+	if cfg.Region == "" {
+		cfg.Region = DefaultS3Region
+	}
+	client := cfg.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &S3ObjectStore{cfg: cfg, endpoint: endpoint, client: client}, nil
+}
+
+type s3InitiateMultipartUploadResult struct {
+	UploadId string `xml:"UploadId"`
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name         `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletePart `xml:"Part"`
+}
+
+type s3CompletePart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3ErrorResponse struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string   `xml:"Code"`
+	Message   string   `xml:"Message"`
+	RequestId string   `xml:"RequestId"`
+}
+
+func (s *S3ObjectStore) CreateMultipartUpload(ctx context.Context, key string) (string, error) {
+	body, _, err := s.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return "", err
+	}
+	result := &s3InitiateMultipartUploadResult{}
+	err = xml.Unmarshal(body, result)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse s3 response; key=%s, err=%w", key, err)
+	}
+	if result.UploadId == "" {
+		return "", fmt.Errorf("s3 response did not contain an upload id; key=%s", key)
+	}
+	return result.UploadId, nil
+}
+
+func (s *S3ObjectStore) UploadPart(
+	ctx context.Context,
+	key, uploadId string,
+	partNumber int,
+	data []byte,
+) (string, error) {
+	query := url.Values{"partNumber": {strconv.Itoa(partNumber)}, "uploadId": {uploadId}}
+	_, header, err := s.do(ctx, http.MethodPut, key, query, data)
+	if err != nil {
+		return "", err
+	}
+	etag := header.Get("ETag")
+	if etag == "" {
+		return "", fmt.Errorf("s3 response did not contain an etag; key=%s, partNumber=%d", key, partNumber)
+	}
+	return etag, nil
+}
+
+func (s *S3ObjectStore) CompleteMultipartUpload(ctx context.Context, key, uploadId string, parts []CompletedPart) error {
+	complete := s3CompleteMultipartUpload{Parts: make([]s3CompletePart, len(parts))}
+	for i, part := range parts {
+		complete.Parts[i] = s3CompletePart{PartNumber: part.PartNumber, ETag: part.ETag}
+	}
+	data, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	body, _, err := s.do(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadId}}, data)
+	if err != nil {
+		return err
+	}
+	// The request can fail after the status has been sent, in which case the error is in the body.
+	return parseS3Error(http.StatusOK, body)
+}
+
+func (s *S3ObjectStore) AbortMultipartUpload(ctx context.Context, key, uploadId string) error {
+	_, _, err := s.do(ctx, http.MethodDelete, key, url.Values{"uploadId": {uploadId}}, nil)
+	return err
+}
+
+// do sends the signed request for the object with the key and returns the body and headers of the
+// response, or an S3Error if the request failed.
+func (s *S3ObjectStore) do(
+	ctx context.Context,
+	method, key string,
+	query url.Values,
+	body []byte,
+) ([]byte, http.Header, error) {
+	req, err := s.newRequest(ctx, method, key, query, body, time.Now().UTC())
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		err := parseS3Error(resp.StatusCode, respBody)
+		if err == nil {
+			err = &S3Error{StatusCode: resp.StatusCode, Message: http.StatusText(resp.StatusCode)}
+		}
+		return nil, nil, err
+	}
+	return respBody, resp.Header, nil
+}
+
+// newRequest returns the request for the object with the key, signed at now.
+func (s *S3ObjectStore) newRequest(
+	ctx context.Context,
+	method, key string,
+	query url.Values,
+	body []byte,
+	now time.Time,
+) (*http.Request, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.cfg.Bucket + "/" + key
+	u.RawPath = s3Encode(u.Path, false)
+	u.RawQuery = s3CanonicalQuery(query)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, body, now)
+	return req, nil
+}
+
+// parseS3Error returns the S3Error in the body, if it holds one.
+func parseS3Error(statusCode int, body []byte) error {
+	if !bytes.Contains(body, []byte("<Error>")) {
+		return nil
+	}
+	errResp := &s3ErrorResponse{}
+	if xml.Unmarshal(body, errResp) != nil {
+		return nil
+	}
+	return &S3Error{StatusCode: statusCode, Code: errResp.Code, Message: errResp.Message, RequestId: errResp.RequestId}
+}
+
+// sign adds the headers for AWS Signature Version 4 to the request.
+func (s *S3ObjectStore) sign(req *http.Request, body []byte, now time.Time) {
+	payloadHash := sha256.Sum256(body)
+	payloadHashHex := hex.EncodeToString(payloadHash[:])
+	amzDate := now.Format(s3TimeFormat)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHashHex)
+	if s.cfg.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.cfg.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := &strings.Builder{}
+	for _, name := range names {
+		fmt.Fprintf(canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHashHex,
+	}, "\n")
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := strings.Join([]string{now.Format(s3DateFormat), s.cfg.Region, "s3", "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(canonicalRequestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretAccessKey), now.Format(s3DateFormat))
+	key = hmacSHA256(key, s.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.cfg.AccessKeyId, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Encode percent-encodes every byte of s other than the unreserved characters, and the slashes
+// unless encodeSlash is set, as required for the canonical request of Signature Version 4.
+func s3Encode(s string, encodeSlash bool) string {
+	b := &strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3CanonicalQuery encodes the query string with its parameters sorted by name, as required for the
+// canonical request of Signature Version 4.
+func s3CanonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	params := []string{}
+	for _, name := range names {
+		values := append([]string{}, query[name]...)
+		sort.Strings(values)
+		for _, value := range values {
+			params = append(params, s3Encode(name, true)+"="+s3Encode(value, true))
+		}
+	}
+	return strings.Join(params, "&")
+}
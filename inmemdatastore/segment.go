@@ -0,0 +1,148 @@
+package inmemdatastore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// The suffix appended to the name of a data file while it is still being written.  It is
+	// removed, by renaming the file, once the file has been closed and synced to disk.
+	TmpFileSuffix = ".tmp"
+)
+
+// The extensions of the segments written to a DataDir by each of the Writers.
+var dataFileExtensions = []string{
+	AvroFileExtension,
+	TombstoneFileExtension,
+	RawFileExtension,
+	CSVFileExtension,
+	ParquetFileExtension,
+	JSONLinesFileExtension,
+	JSONLinesGzipFileExtension,
+}
+
+// RotationPolicy defines when a writer will close its current data file and start writing to a
+// new one.  A zero value for any of the limits disables that limit.
+type RotationPolicy struct {
+	// The maximum size, in bytes, to which a data file will grow before it is rotated.  The limit
+	// is checked after each write so a file will exceed it by at most the size of one write.
+	MaxBytes int64
+	// The maximum number of records written to a data file before it is rotated.
+	MaxRecords int64
+	// The maximum amount of time that a data file will be open for writing before it is rotated.
+	MaxAge time.Duration
+}
+
+func (r RotationPolicy) shouldRotate(numBytes, numRecords int64, opened time.Time) bool {
+	if r.MaxBytes > 0 && numBytes >= r.MaxBytes {
+		return true
+	}
+	if r.MaxRecords > 0 && numRecords >= r.MaxRecords {
+		return true
+	}
+	if r.MaxAge > 0 && time.Since(opened) >= r.MaxAge {
+		return true
+	}
+	return false
+}
+
+// SegmentFileName returns the name of the data file, or segment, with the given sequence number
+// for the writer with the given id, eg. "3-0000000012.avro".
+func SegmentFileName(writerId int, seq uint64, ext string) string {
+	return fmt.Sprintf("%d-%010d%s", writerId, seq, ext)
+}
+
+// ParseSegmentFileName is the inverse of SegmentFileName.  The TmpFileSuffix, if present, is
+// ignored.  Returns false if the name is not that of a segment with the given extension.
+func ParseSegmentFileName(name, ext string) (int, uint64, bool) {
+	name = strings.TrimSuffix(name, TmpFileSuffix)
+	if !strings.HasSuffix(name, ext) {
+		return 0, 0, false
+	}
+	tokens := strings.SplitN(strings.TrimSuffix(name, ext), "-", 2)
+	if len(tokens) != 2 {
+		return 0, 0, false
+	}
+	writerId, err := strconv.Atoi(tokens[0])
+	if err != nil {
+		return 0, 0, false
+	}
+	seq, err := strconv.ParseUint(tokens[1], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return writerId, seq, true
+}
+
+// Segment describes a data file, written by a writer, in an output directory.
+type Segment struct {
+	Path     string
+	WriterId int
+	Seq      uint64
+	// Whether the file still has the TmpFileSuffix and is either still being written or was left
+	// behind by a writer that did not shutdown cleanly.
+	Tmp bool
+}
+
+// ListSegments returns all of the segments with the given extension in the directory, ordered by
+// writer id and then sequence number.
+func ListSegments(dir, ext string) ([]Segment, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	retval := []Segment{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		writerId, seq, ok := ParseSegmentFileName(entry.Name(), ext)
+		if !ok {
+			continue
+		}
+		retval = append(retval, Segment{
+			Path:     filepath.Join(dir, entry.Name()),
+			WriterId: writerId,
+			Seq:      seq,
+			Tmp:      strings.HasSuffix(entry.Name(), TmpFileSuffix),
+		})
+	}
+	sort.Slice(retval, func(i, j int) bool {
+		if retval[i].WriterId != retval[j].WriterId {
+			return retval[i].WriterId < retval[j].WriterId
+		}
+		return retval[i].Seq < retval[j].Seq
+	})
+	return retval, nil
+}
+
+// closedSegments splits the segments with the given extension in the directory into those that
+// their writers have moved on from and the rest, which are the most recent segment of each writer
+// and any that still have the TmpFileSuffix.  The most recent segment of a writer is never closed,
+// even if the writer has been shutdown, so that its sequence numbers, and the markers of any
+// snapshots, remain valid.
+func closedSegments(dir, ext string) ([]Segment, []Segment, error) {
+	segments, err := ListSegments(dir, ext)
+	if err != nil {
+		return nil, nil, err
+	}
+	closed := []Segment{}
+	open := []Segment{}
+	for i, segment := range segments {
+		// The segments are ordered by writer id and then sequence number, so the last one for each
+		// writer is its most recent.
+		latest := i+1 == len(segments) || segments[i+1].WriterId != segment.WriterId
+		if latest || segment.Tmp {
+			open = append(open, segment)
+		} else {
+			closed = append(closed, segment)
+		}
+	}
+	return closed, open, nil
+}
@@ -0,0 +1,253 @@
+package inmemdatastore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/rchapin/rlog"
+)
+
+// segmentEncoder encodes the records written to a single segment to its file.
+type segmentEncoder interface {
+	io.Writer
+	// Flush writes any data buffered by the encoder to the file.
+	Flush() error
+	// Close writes any trailer required by the format and flushes the encoder, but does not close
+	// the file.
+	Close() error
+}
+
+// plainEncoder is a segmentEncoder for formats that write directly to the file.
+type plainEncoder struct {
+	io.Writer
+}
+
+func (p plainEncoder) Flush() error { return nil }
+func (p plainEncoder) Close() error { return nil }
+
+type segmentWriterConfig struct {
+	Id        int
+	OutputDir string
+	// The extension of the segments, eg. ".raw".
+	Ext      string
+	Rotation RotationPolicy
+	// Returns the encoder for a new segment, writing any header required by the format to w.
+	NewEncoder func(w io.Writer) (segmentEncoder, error)
+}
+
+// segmentWriter writes the sequence of segments, named with SegmentFileName, for a Writer of a
+// format that is not appended to once it has been closed.  As with the AvroFileWriter, each
+// segment is written with the TmpFileSuffix and is synced and renamed to its final name when it is
+// closed, and segments are rotated according to the RotationPolicy.  Any segments left open by a
+// previous writer with the same id are closed and a new segment is always started after them.
+type segmentWriter struct {
+	ctx        context.Context
+	wg         *sync.WaitGroup
+	id         int
+	outputDir  string
+	ext        string
+	rotation   RotationPolicy
+	newEncoder func(w io.Writer) (segmentEncoder, error)
+	seq        uint64
+	path       string
+	fh         *os.File
+	counter    *countingWriter
+	enc        segmentEncoder
+	opened     time.Time
+	numRecords int64
+	// Guards the current segment against concurrent writes and rotations triggered by the MaxAge
+	// ticker.
+	mux    *sync.Mutex
+	closed bool
+	stop   chan struct{}
+}
+
+func newSegmentWriter(ctx context.Context, wg *sync.WaitGroup, cfg segmentWriterConfig) (*segmentWriter, error) {
+	retval := &segmentWriter{
+		ctx:        ctx,
+		wg:         wg,
+		id:         cfg.Id,
+		outputDir:  cfg.OutputDir,
+		ext:        cfg.Ext,
+		rotation:   cfg.Rotation,
+		newEncoder: cfg.NewEncoder,
+		mux:        &sync.Mutex{},
+		stop:       make(chan struct{}),
+	}
+	segments, err := ListSegments(cfg.OutputDir, cfg.Ext)
+	if err != nil {
+		return nil, err
+	}
+	for _, segment := range segments {
+		if segment.WriterId != cfg.Id {
+			continue
+		}
+		if segment.Seq >= retval.seq {
+			retval.seq = segment.Seq + 1
+		}
+		if segment.Tmp {
+			log.Infof("Closing file left open by a previous writer; path=%s", segment.Path)
+			err := renameNoReplace(segment.Path, strings.TrimSuffix(segment.Path, TmpFileSuffix))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	err = retval.makeFile()
+	if err != nil {
+		return nil, err
+	}
+	if retval.rotation.MaxAge > 0 {
+		retval.runAgeRotation()
+	}
+	return retval, nil
+}
+
+// write calls fn to write numRecords records to the encoder of the current segment and then
+// rotates the segment if it has hit any of the limits of the RotationPolicy.
+func (s *segmentWriter) write(numRecords int, fn func(enc segmentEncoder) error) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.closed {
+		return fmt.Errorf("writer is shut down; id=%d, ext=%s", s.id, s.ext)
+	}
+	err := fn(s.enc)
+	if err != nil {
+		return err
+	}
+	s.numRecords += int64(numRecords)
+	if s.rotation.shouldRotate(s.counter.n, s.numRecords, s.opened) {
+		return s.rotate()
+	}
+	return nil
+}
+
+// sync flushes the encoder and then the current segment to disk.
+func (s *segmentWriter) sync() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.closed {
+		return nil
+	}
+	err := s.enc.Flush()
+	if err != nil {
+		return err
+	}
+	return s.fh.Sync()
+}
+
+func (s *segmentWriter) shutdown() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.stop)
+	return s.closeFile()
+}
+
+// runAgeRotation starts a go routine that rotates the current segment once it has been open for
+// longer than the MaxAge of the RotationPolicy.
+func (s *segmentWriter) runAgeRotation() {
+	s.wg.Add(1)
+	ticker := time.NewTicker(s.rotation.MaxAge / 4)
+	go func() {
+		defer s.wg.Done()
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.mux.Lock()
+				if !s.closed && s.numRecords > 0 && time.Since(s.opened) >= s.rotation.MaxAge {
+					err := s.rotate()
+					if err != nil {
+						log.Errorf("Unable to rotate file; id=%d, path=%s, err=%s", s.id, s.path, err)
+					}
+				}
+				s.mux.Unlock()
+			case <-s.stop:
+				return
+			case <-s.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// rotate closes the current segment and opens the next one.  The caller must hold the mux.
+func (s *segmentWriter) rotate() error {
+	log.Infof(
+		"Rotating file; id=%d, path=%s, records=%d, bytes=%d", s.id, s.path, s.numRecords, s.counter.n)
+	err := s.closeFile()
+	if err != nil {
+		return err
+	}
+	s.seq++
+	return s.makeFile()
+}
+
+// makeFile creates the next segment in the sequence and its encoder.  The caller must hold the
+// mux.
+func (s *segmentWriter) makeFile() error {
+	s.path = filepath.Join(s.outputDir, SegmentFileName(s.id, s.seq, s.ext))
+	fh, err := os.OpenFile(s.path+TmpFileSuffix, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	counter := &countingWriter{w: fh}
+	enc, err := s.newEncoder(counter)
+	if err != nil {
+		fh.Close()
+		return err
+	}
+	s.fh = fh
+	s.counter = counter
+	s.enc = enc
+	s.opened = time.Now()
+	s.numRecords = 0
+	return nil
+}
+
+// closeFile closes the encoder, syncs and closes the current segment and then atomically renames
+// it to its final name.  A segment to which no records were written is removed instead.  The
+// caller must hold the mux.
+func (s *segmentWriter) closeFile() error {
+	err := s.enc.Close()
+	if err != nil {
+		s.fh.Close()
+		return err
+	}
+	err = syncAndClose(s.fh)
+	if err != nil {
+		return err
+	}
+	if s.numRecords == 0 {
+		err = os.Remove(s.path + TmpFileSuffix)
+	} else {
+		err = renameNoReplace(s.path+TmpFileSuffix, s.path)
+	}
+	if err != nil {
+		return err
+	}
+	return syncDir(s.outputDir)
+}
+
+// countingWriter counts the bytes written through it to the file, after any compression done by
+// the encoder, which is what the MaxBytes of the RotationPolicy is measured against.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -1,38 +1,146 @@
 package inmemdatastore
 
-import "github.com/linkedin/goavro/v2"
+import (
+	"fmt"
 
+	"github.com/linkedin/goavro/v2"
+)
+
+// Encoding identifies the format of the Data of a SerializedRecord.
+type Encoding int
+
+const (
+	// The record has not been encoded and Data is empty.  The Writer encodes the Record itself.
+	EncodingNone Encoding = iota
+	// Data is the Avro binary encoding of the record, without any framing, as it is written to the
+	// blocks of an OCF.
+	EncodingAvroBinary
+	// Data is the record as a JSON object.
+	EncodingJSON
+	// Data is the record as a MessagePack map.
+	EncodingMsgPack
+	// Data is the record as the binary encoding of a Protobuf message.
+	EncodingProtobuf
+)
+
+func (e Encoding) String() string {
+	switch e {
+	case EncodingNone:
+		return "none"
+	case EncodingAvroBinary:
+		return "avro-binary"
+	case EncodingJSON:
+		return "json"
+	case EncodingMsgPack:
+		return "msgpack"
+	case EncodingProtobuf:
+		return "protobuf"
+	default:
+		return fmt.Sprintf("Encoding(%d)", int(e))
+	}
+}
+
+// SerializedRecord is the output of a Serializer and the input to a Writer.
+type SerializedRecord struct {
+	Key      string
+	Encoding Encoding
+	Data     []byte
+	// For EncodingAvroBinary, the CRC-64-AVRO Rabin fingerprint of the canonical form of the
+	// schema with which the Data was encoded, so that a Writer can verify that it matches its own.
+	// For EncodingProtobuf, the fingerprint of the descriptor of the message.
+	SchemaFingerprint uint64
+	// The record from which the Data was serialized, for Writers that encode records themselves.  It
+	// is shared with the datastore and must not be modified.
+	Record map[string]interface{}
+}
+
+// Serializer encodes records before they are passed to a Writer.  It is called on the go routine of
+// the Persister, so a Writer that accepts the output of a Serializer does not have to encode the
+// records itself while it holds the lock on its current file.
 type Serializer interface {
-	Serialize(map[string]interface{}) (interface{}, error)
+	Serialize(key string, record map[string]interface{}) (*SerializedRecord, error)
+}
+
+// Deserializer decodes the Data of SerializedRecords with a single Encoding back into records.  The
+// InMemDataStore uses the Deserializers in its Config to recover the records from the files written
+// by a RawFileWriter.
+type Deserializer interface {
+	Encoding() Encoding
+	Deserialize(record *SerializedRecord) (map[string]interface{}, error)
 }
 
+// NoopSerializer passes the records through without encoding them, with EncodingNone.
 type NoopSerializer struct{}
 
 func NewNoopSerializer() Serializer {
 	return &NoopSerializer{}
 }
 
-func (n *NoopSerializer) Serialize(record map[string]interface{}) (interface{}, error) {
-	return record, nil
+func (n *NoopSerializer) Serialize(key string, record map[string]interface{}) (*SerializedRecord, error) {
+	return &SerializedRecord{Key: key, Encoding: EncodingNone, Record: record}, nil
 }
 
+// AvroSerializer encodes the records with EncodingAvroBinary.
 type AvroSerializer struct {
 	avroSchema string
 	codec      *goavro.Codec
 }
 
-func NewAvroSerializer(avroSchema string) Serializer {
+func NewAvroSerializer(avroSchema string) (Serializer, error) {
 	codec, err := GetAvroCodec(avroSchema)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	retval := &AvroSerializer{
 		avroSchema: avroSchema,
 		codec:      codec,
 	}
-	return retval
+	return retval, nil
+}
+
+func (a *AvroSerializer) Serialize(key string, record map[string]interface{}) (*SerializedRecord, error) {
+	data, err := a.codec.BinaryFromNative(nil, record)
+	if err != nil {
+		return nil, err
+	}
+	return &SerializedRecord{
+		Key:               key,
+		Encoding:          EncodingAvroBinary,
+		Data:              data,
+		SchemaFingerprint: a.codec.Rabin,
+		Record:            record,
+	}, nil
 }
 
-func (a *AvroSerializer) Serialize(record map[string]interface{}) (interface{}, error) {
-	return a.codec.BinaryFromNative(nil, record)
+// AvroDeserializer decodes records with EncodingAvroBinary that were encoded with the same schema.
+type AvroDeserializer struct {
+	codec *goavro.Codec
+}
+
+func NewAvroDeserializer(avroSchema string) (Deserializer, error) {
+	codec, err := GetAvroCodec(avroSchema)
+	if err != nil {
+		return nil, err
+	}
+	return &AvroDeserializer{codec: codec}, nil
+}
+
+func (a *AvroDeserializer) Encoding() Encoding {
+	return EncodingAvroBinary
+}
+
+func (a *AvroDeserializer) Deserialize(record *SerializedRecord) (map[string]interface{}, error) {
+	if record.SchemaFingerprint != a.codec.Rabin {
+		return nil, fmt.Errorf(
+			"schema fingerprint mismatch; key=%s, fingerprint=%d, expected=%d", record.Key, record.SchemaFingerprint, a.codec.Rabin)
+	}
+	native, _, err := a.codec.NativeFromBinary(record.Data)
+	if err != nil {
+		return nil, err
+	}
+	retval, ok := native.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("avro datum is not a record; key=%s, type=%T", record.Key, native)
+	}
+	return retval, nil
 }
@@ -0,0 +1,537 @@
+package inmemdatastore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/rchapin/rlog"
+)
+
+const (
+	// The name of the file, in the DataDir, in which the shipper tracks its uploads if no
+	// ShipperManifestPath is set.
+	ShipperManifestFileName = "shipper-manifest.json"
+	// How often the closed data files are shipped if no ShipperInterval is set.
+	DefaultShipperInterval = 10 * time.Second
+	// The size of each part of a multipart upload if no ShipperPartSize is set.
+	DefaultShipperPartSize = 8 << 20
+	// The smallest ShipperPartSize that is accepted.  S3 requires every part other than the last to
+	// be at least 5 MiB.
+	MinShipperPartSize = 5 << 20
+)
+
+var (
+	// ErrUploadNotFound is returned by an ObjectStore for a multipart upload that does not exist,
+	// usually because it was aborted, or expired, since it was started.
+	ErrUploadNotFound = errors.New("multipart upload not found")
+)
+
+// ObjectStore is the subset of the multipart upload API of an S3-compatible object store that is
+// used to ship the data files.
+type ObjectStore interface {
+	// CreateMultipartUpload starts a multipart upload of the object with the key and returns the id
+	// of the upload.
+	CreateMultipartUpload(ctx context.Context, key string) (string, error)
+	// UploadPart uploads the data as the part, numbered from one, of the upload and returns its
+	// ETag.
+	UploadPart(ctx context.Context, key, uploadId string, partNumber int, data []byte) (string, error)
+	// CompleteMultipartUpload assembles the parts, in order, into the object.
+	CompleteMultipartUpload(ctx context.Context, key, uploadId string, parts []CompletedPart) error
+	// AbortMultipartUpload discards the upload and any of its parts.
+	AbortMultipartUpload(ctx context.Context, key, uploadId string) error
+}
+
+// CompletedPart is a part of a multipart upload that has been uploaded.
+type CompletedPart struct {
+	PartNumber int    `json:"part_number"`
+	ETag       string `json:"etag"`
+}
+
+// ShipPolicy determines what happens to a data file once it has been shipped.
+type ShipPolicy int
+
+const (
+	// The data file is left in the DataDir and recorded as shipped in the manifest.
+	ShipMark ShipPolicy = iota
+	// The data file is deleted from the DataDir.
+	ShipDelete
+)
+
+func (p ShipPolicy) String() string {
+	switch p {
+	case ShipMark:
+		return "mark"
+	case ShipDelete:
+		return "delete"
+	default:
+		return fmt.Sprintf("ShipPolicy(%d)", int(p))
+	}
+}
+
+// ShipperStats are the counters for the shipping of the data files.
+type ShipperStats struct {
+	Runs            int64
+	SegmentsShipped int64
+	BytesShipped    int64
+	PartsUploaded   int64
+	// The number of requests to the ObjectStore that were retried.
+	Retries int64
+	// The number of uploads that were continued from the manifest rather than being started again.
+	Resumed int64
+	// The number of times that a data file could not be shipped after all of the retries.  It is
+	// shipped again by the next run.
+	Failures int64
+	// The number of closed data files that had not been shipped as of the end of the most recent
+	// run.
+	Pending int
+}
+
+// shipperManifest is the state of the shipper that is kept in the manifest file, so that an upload
+// that is interrupted, by a failure or by a restart, can be resumed.
+type shipperManifest struct {
+	// The uploads in progress, by the name of the data file.
+	Uploads map[string]*shipperUpload `json:"uploads"`
+	// With ShipMark, the data files that have been shipped, by name.  Entries are removed once the
+	// data file is no longer in the DataDir.
+	Shipped map[string]shippedFile `json:"shipped"`
+}
+
+type shipperUpload struct {
+	Key      string `json:"key"`
+	UploadId string `json:"upload_id"`
+	// The size and modification time of the data file, and the part size, when the upload was
+	// started.  The upload is only resumed if none of them have changed.
+	Size     int64           `json:"size"`
+	ModTime  time.Time       `json:"mod_time"`
+	PartSize int64           `json:"part_size"`
+	Parts    []CompletedPart `json:"parts"`
+}
+
+type shippedFile struct {
+	Key  string    `json:"key"`
+	Time time.Time `json:"time"`
+}
+
+// shipper holds the configuration and state for the shipping of the closed data files in the
+// DataDir to an ObjectStore.
+type shipper struct {
+	store        ObjectStore
+	interval     time.Duration
+	partSize     int64
+	keyPrefix    string
+	policy       ShipPolicy
+	retry        RetryPolicy
+	manifestPath string
+	// Serializes the runs.
+	mux *sync.Mutex
+	// Guards the manifest and the stats, which are also read by compaction and retention and by
+	// ShipperStats.
+	stateMux *sync.Mutex
+	manifest *shipperManifest
+	stats    ShipperStats
+}
+
+// newShipper returns nil if there is no ShipperStore.
+func newShipper(cfg Config) *shipper {
+	if cfg.ShipperStore == nil {
+		return nil
+	}
+	interval := cfg.ShipperInterval
+	if interval == 0 {
+		interval = DefaultShipperInterval
+	}
+	partSize := cfg.ShipperPartSize
+	if partSize <= 0 {
+		partSize = DefaultShipperPartSize
+	}
+	manifestPath := cfg.ShipperManifestPath
+	if manifestPath == "" {
+		manifestPath = filepath.Join(cfg.DataDir, ShipperManifestFileName)
+	}
+	return &shipper{
+		store:        cfg.ShipperStore,
+		interval:     interval,
+		partSize:     partSize,
+		keyPrefix:    cfg.ShipperKeyPrefix,
+		policy:       cfg.ShipperPolicy,
+		retry:        cfg.ShipperRetry.withDefaults(),
+		manifestPath: manifestPath,
+		mux:          &sync.Mutex{},
+		stateMux:     &sync.Mutex{},
+		manifest:     &shipperManifest{Uploads: map[string]*shipperUpload{}, Shipped: map[string]shippedFile{}},
+	}
+}
+
+// loadManifest reads the manifest written before the last shutdown, if there is one.
+func (s *shipper) loadManifest() error {
+	data, err := os.ReadFile(s.manifestPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	manifest := &shipperManifest{}
+	err = json.Unmarshal(data, manifest)
+	if err != nil {
+		return fmt.Errorf("unable to parse shipper manifest; path=%s, err=%w", s.manifestPath, err)
+	}
+	if manifest.Uploads == nil {
+		manifest.Uploads = map[string]*shipperUpload{}
+	}
+	if manifest.Shipped == nil {
+		manifest.Shipped = map[string]shippedFile{}
+	}
+	s.stateMux.Lock()
+	s.manifest = manifest
+	s.stateMux.Unlock()
+	return nil
+}
+
+// writeManifest replaces the manifest file with the current state.  It is written to a temporary
+// file and renamed so that a crash never leaves a partially written manifest behind.
+func (s *shipper) writeManifest() error {
+	s.stateMux.Lock()
+	data, err := json.Marshal(s.manifest)
+	s.stateMux.Unlock()
+	if err != nil {
+		return err
+	}
+	tmpPath := s.manifestPath + TmpFileSuffix
+	fh, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = fh.Write(data)
+	if err != nil {
+		fh.Close()
+		return err
+	}
+	err = syncAndClose(fh)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpPath, s.manifestPath)
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(s.manifestPath))
+}
+
+// pending returns true if the closed data file at the path has not been shipped yet, in which case
+// it is not to be removed by compaction or retention.  It is safe to call on a nil shipper, for
+// which nothing is ever pending.
+func (s *shipper) pending(path string) bool {
+	if s == nil {
+		return false
+	}
+	s.stateMux.Lock()
+	defer s.stateMux.Unlock()
+	_, ok := s.manifest.Shipped[filepath.Base(path)]
+	return !ok
+}
+
+// ShipperStats returns a snapshot of the counters for the shipping of the data files.  They are all
+// zero if there is no ShipperStore.
+func (ds *InMemDataStore) ShipperStats() ShipperStats {
+	s := ds.shipper
+	if s == nil {
+		return ShipperStats{}
+	}
+	s.stateMux.Lock()
+	defer s.stateMux.Unlock()
+	return s.stats
+}
+
+// Ship uploads each of the closed data files in the DataDir, those that their writers have moved
+// on from, that has not already been shipped to the ShipperStore as an object named with the
+// ShipperKeyPrefix followed by the name of the file.  Each file is uploaded with a multipart
+// upload, with each part retried according to the ShipperRetry, and then marked as shipped or
+// deleted according to the ShipperPolicy.  The progress of each upload is recorded in the manifest
+// so that an upload that fails, or is interrupted by a Shutdown, is resumed by the next Ship from
+// the first part that was not uploaded.
+//
+// The data files that have not been shipped are neither compacted nor removed by retention, and
+// the files written by Compact are never shipped.  Returns the counters as of the end of the run
+// and the first error, if any data file could not be shipped.
+func (ds *InMemDataStore) Ship() (ShipperStats, error) {
+	s := ds.shipper
+	if ds.dataDir == "" || s == nil {
+		return ShipperStats{}, errors.New("a DataDir and a ShipperStore are required for shipping")
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	paths := []string{}
+	for _, ext := range dataFileExtensions {
+		closed, _, err := closedSegments(ds.dataDir, ext)
+		if err != nil {
+			return ds.ShipperStats(), err
+		}
+		for _, segment := range closed {
+			if s.pending(segment.Path) {
+				paths = append(paths, segment.Path)
+			}
+		}
+	}
+	err := ds.pruneManifest()
+	if err != nil {
+		return ds.ShipperStats(), err
+	}
+
+	var retval error
+	pending := len(paths)
+	for _, path := range paths {
+		if ds.bgCtx.Err() != nil {
+			break
+		}
+		err := ds.shipFile(path)
+		if err != nil {
+			log.Errorf("IMDS unable to ship data file; path=%s, err=%s", path, err)
+			s.stateMux.Lock()
+			s.stats.Failures++
+			s.stateMux.Unlock()
+			if retval == nil {
+				retval = fmt.Errorf("unable to ship data file; path=%s, err=%w", path, err)
+			}
+			continue
+		}
+		pending--
+	}
+	s.stateMux.Lock()
+	s.stats.Runs++
+	s.stats.Pending = pending
+	s.stateMux.Unlock()
+	return ds.ShipperStats(), retval
+}
+
+// pruneManifest removes the entries for the data files that are no longer in the DataDir, aborting
+// any of their uploads that are still in progress.
+func (ds *InMemDataStore) pruneManifest() error {
+	s := ds.shipper
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(ds.dataDir, name))
+		return err == nil
+	}
+	aborted := map[string]*shipperUpload{}
+	s.stateMux.Lock()
+	changed := false
+	for name, upload := range s.manifest.Uploads {
+		if !exists(name) {
+			aborted[name] = upload
+			delete(s.manifest.Uploads, name)
+			changed = true
+		}
+	}
+	for name := range s.manifest.Shipped {
+		if !exists(name) {
+			delete(s.manifest.Shipped, name)
+			changed = true
+		}
+	}
+	s.stateMux.Unlock()
+	for name, upload := range aborted {
+		err := s.store.AbortMultipartUpload(ds.bgCtx, upload.Key, upload.UploadId)
+		if err != nil {
+			log.Warnf("IMDS unable to abort upload of removed data file; name=%s, key=%s, err=%s", name, upload.Key, err)
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return s.writeManifest()
+}
+
+// shipFile uploads the data file, resuming its upload from the manifest if there is one, and then
+// marks it as shipped or deletes it.
+func (ds *InMemDataStore) shipFile(path string) error {
+	s := ds.shipper
+	ctx := ds.bgCtx
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	name := filepath.Base(path)
+	s.stateMux.Lock()
+	upload := s.manifest.Uploads[name]
+	s.stateMux.Unlock()
+	if upload != nil && (upload.Size != fi.Size() || !upload.ModTime.Equal(fi.ModTime()) || upload.PartSize != s.partSize) {
+		log.Infof("IMDS restarting upload of changed data file, path=%s, key=%s", path, upload.Key)
+		err := s.store.AbortMultipartUpload(ctx, upload.Key, upload.UploadId)
+		if err != nil {
+			log.Warnf("IMDS unable to abort upload; key=%s, uploadId=%s, err=%s", upload.Key, upload.UploadId, err)
+		}
+		upload = nil
+	}
+	if upload == nil {
+		upload = &shipperUpload{Key: s.keyPrefix + name, Size: fi.Size(), ModTime: fi.ModTime(), PartSize: s.partSize}
+		err := s.attemptWithRetry(ctx, name, func() error {
+			var err error
+			upload.UploadId, err = s.store.CreateMultipartUpload(ctx, upload.Key)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		s.stateMux.Lock()
+		s.manifest.Uploads[name] = upload
+		s.stateMux.Unlock()
+		err = s.writeManifest()
+		if err != nil {
+			return err
+		}
+	} else {
+		log.Infof("IMDS resuming upload of data file, path=%s, key=%s, partsUploaded=%d", path, upload.Key, len(upload.Parts))
+		s.stateMux.Lock()
+		s.stats.Resumed++
+		s.stateMux.Unlock()
+	}
+
+	err = ds.uploadParts(path, upload)
+	if errors.Is(err, ErrUploadNotFound) {
+		// The upload cannot be resumed, so it is started again by the next Ship.
+		s.stateMux.Lock()
+		delete(s.manifest.Uploads, name)
+		s.stateMux.Unlock()
+		if err := s.writeManifest(); err != nil {
+			log.Errorf("IMDS unable to write shipper manifest; path=%s, err=%s", s.manifestPath, err)
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	if s.policy == ShipDelete {
+		err := os.Remove(path)
+		if err != nil {
+			return err
+		}
+		err = syncDir(ds.dataDir)
+		if err != nil {
+			return err
+		}
+	}
+	s.stateMux.Lock()
+	delete(s.manifest.Uploads, name)
+	if s.policy == ShipMark {
+		s.manifest.Shipped[name] = shippedFile{Key: upload.Key, Time: time.Now().UTC()}
+	}
+	s.stats.SegmentsShipped++
+	s.stats.BytesShipped += upload.Size
+	s.stateMux.Unlock()
+	log.Infof(
+		"IMDS shipped data file, path=%s, key=%s, size=%d, parts=%d, policy=%s",
+		path, upload.Key, upload.Size, len(upload.Parts), s.policy)
+	return s.writeManifest()
+}
+
+// uploadParts uploads each of the parts of the data file that have not already been uploaded,
+// recording each one in the manifest, and then completes the upload.
+func (ds *InMemDataStore) uploadParts(path string, upload *shipperUpload) error {
+	s := ds.shipper
+	ctx := ds.bgCtx
+	fh, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	numParts := int((upload.Size + upload.PartSize - 1) / upload.PartSize)
+	if numParts == 0 {
+		// An empty file is uploaded as a single empty part.
+		numParts = 1
+	}
+	buf := make([]byte, upload.PartSize)
+	for partNumber := len(upload.Parts) + 1; partNumber <= numParts; partNumber++ {
+		offset := int64(partNumber-1) * upload.PartSize
+		length := upload.Size - offset
+		if length > upload.PartSize {
+			length = upload.PartSize
+		}
+		n, err := fh.ReadAt(buf[:length], offset)
+		if err != nil && !(errors.Is(err, io.EOF) && int64(n) == length) {
+			return err
+		}
+		var etag string
+		err = s.attemptWithRetry(ctx, filepath.Base(path), func() error {
+			var err error
+			etag, err = s.store.UploadPart(ctx, upload.Key, upload.UploadId, partNumber, buf[:length])
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		s.stateMux.Lock()
+		upload.Parts = append(upload.Parts, CompletedPart{PartNumber: partNumber, ETag: etag})
+		s.stats.PartsUploaded++
+		s.stateMux.Unlock()
+		err = s.writeManifest()
+		if err != nil {
+			return err
+		}
+	}
+	return s.attemptWithRetry(ctx, filepath.Base(path), func() error {
+		return s.store.CompleteMultipartUpload(ctx, upload.Key, upload.UploadId, upload.Parts)
+	})
+}
+
+// attemptWithRetry calls fn and retries it with an exponential backoff until it succeeds, the
+// ShipperRetry is exhausted, it fails with an ErrUploadNotFound, or the context is done.
+func (s *shipper) attemptWithRetry(ctx context.Context, name string, fn func() error) error {
+	err := fn()
+	attempts := 1
+	backoff := s.retry.InitialBackoff
+	for attempts < s.retry.MaxAttempts && err != nil && !errors.Is(err, ErrUploadNotFound) {
+		log.Warnf("IMDS shipper retrying request; name=%s, attempts=%d, err=%s", name, attempts, err)
+		s.stateMux.Lock()
+		s.stats.Retries++
+		s.stateMux.Unlock()
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+		backoff *= 2
+		if backoff > s.retry.MaxBackoff {
+			backoff = s.retry.MaxBackoff
+		}
+		err = fn()
+		attempts++
+	}
+	return err
+}
+
+// runShipper starts a go routine that ships the closed data files every ShipperInterval.
+func (ds *InMemDataStore) runShipper() {
+	log.Infof(
+		"IMDS starting shipper, interval=%s, partSize=%d, keyPrefix=%s, policy=%s, manifestPath=%s",
+		ds.shipper.interval, ds.shipper.partSize, ds.shipper.keyPrefix, ds.shipper.policy, ds.shipper.manifestPath)
+	ds.bgWg.Add(1)
+	ticker := time.NewTicker(ds.shipper.interval)
+	go func() {
+		defer ds.bgWg.Done()
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				_, err := ds.Ship()
+				if err != nil {
+					log.Errorf("IMDS unable to ship data files; dataDir=%s, err=%s", ds.dataDir, err)
+				}
+			case <-ds.bgCtx.Done():
+				log.Info("IMDS shipper exiting on context done")
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,396 @@
+package inmemdatastore
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/rchapin/rlog"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	SnapshotFileExtension = ".snapshot"
+	// The default amount of time between snapshots.
+	DefaultSnapshotInterval = 5 * time.Minute
+	// The default number of snapshot files that are kept.
+	DefaultSnapshotRetain = 2
+	// Written at the start of each snapshot file.
+	snapshotFileMagic = "IMDSSNAP\x01"
+	// The type of the last frame of a snapshot file, which holds the number of entries in it.
+	snapshotEntryEnd byte = 0xff
+)
+
+// SnapshotMarker records the position in the data files written by a Writer as of a snapshot.  All
+// of the records in the segments with the Ext written by the writer with the WriterId and a
+// sequence number lower than the Seq are reflected in the snapshot, so those segments are not read
+// when the datastore is re-populated from it.
+type SnapshotMarker struct {
+	Ext      string `msgpack:"ext"`
+	WriterId int    `msgpack:"writer_id"`
+	Seq      uint64 `msgpack:"seq"`
+}
+
+// snapshotHeader is the first frame of a snapshot file.
+type snapshotHeader struct {
+	// When the snapshot was started, in unix nanos.
+	Created int64            `msgpack:"created"`
+	Markers []SnapshotMarker `msgpack:"markers"`
+}
+
+// SnapshotInfo describes a snapshot file written by WriteSnapshot.
+type SnapshotInfo struct {
+	Path    string
+	Created time.Time
+	// The number of records and tombstones in the snapshot.
+	Records    int64
+	Tombstones int64
+	Markers    []SnapshotMarker
+}
+
+// snapshotter holds the state for writing the snapshots of the datastore.
+type snapshotter struct {
+	dir      string
+	interval time.Duration
+	retain   int
+	// Serializes the writing of the snapshots.
+	mux *sync.Mutex
+}
+
+func newSnapshotter(dir string, interval time.Duration, retain int) *snapshotter {
+	if dir == "" {
+		return nil
+	}
+	if interval == 0 {
+		interval = DefaultSnapshotInterval
+	}
+	if retain <= 0 {
+		retain = DefaultSnapshotRetain
+	}
+	return &snapshotter{dir: dir, interval: interval, retain: retain, mux: &sync.Mutex{}}
+}
+
+// WriteSnapshot writes all of the records and tombstones in the datastore to a new snapshot file
+// in the SnapshotDir, along with a SnapshotMarker for the current segment of each of the Writers in
+// the DataDir, and then removes all but the SnapshotRetain most recent snapshot files.  On the next
+// Start the datastore is re-populated from the most recent snapshot and only the segments written
+// from the markers onwards.
+//
+// The shards are copied one at a time under their read locks, so Puts are only blocked for as long
+// as it takes to copy the shard to which they are writing.  As with Snapshot(false), the records
+// from different shards may reflect different points in time, which is safe because the segments
+// from the markers onwards are read on top of the snapshot.
+func (ds *InMemDataStore) WriteSnapshot() (SnapshotInfo, error) {
+	if ds.snapshotter == nil {
+		return SnapshotInfo{}, errors.New("a SnapshotDir is required to write snapshots")
+	}
+	s := ds.snapshotter
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	err := os.MkdirAll(s.dir, 0o755)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	existing, err := ListSegments(s.dir, SnapshotFileExtension)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	seq := uint64(0)
+	for _, segment := range existing {
+		if segment.Seq >= seq {
+			seq = segment.Seq + 1
+		}
+	}
+
+	// The markers must be taken before any of the shards are copied.  A record is written to the
+	// datastore before it is handed off to the Persisters, so every record in a segment before a
+	// marker is then already in the datastore.
+	info := SnapshotInfo{Created: time.Now().UTC()}
+	info.Markers, err = ds.snapshotMarkers()
+	if err != nil {
+		return info, err
+	}
+	info.Path = filepath.Join(s.dir, SegmentFileName(0, seq, SnapshotFileExtension))
+	err = ds.writeSnapshotFile(&info)
+	if err != nil {
+		return info, err
+	}
+	log.Infof("IMDS wrote snapshot, path=%s, records=%d, tombstones=%d", info.Path, info.Records, info.Tombstones)
+
+	err = s.prune()
+	if err != nil {
+		log.Warnf("IMDS unable to remove old snapshots; snapshotDir=%s, err=%s", s.dir, err)
+	}
+	return info, nil
+}
+
+// snapshotMarkers returns a marker for the most recent segment of each writer of each of the types
+// of files read on start-up.
+func (ds *InMemDataStore) snapshotMarkers() ([]SnapshotMarker, error) {
+	retval := []SnapshotMarker{}
+	if ds.dataDir == "" {
+		return retval, nil
+	}
+	for _, ext := range []string{AvroFileExtension, RawFileExtension, TombstoneFileExtension} {
+		segments, err := ListSegments(ds.dataDir, ext)
+		if err != nil {
+			return nil, err
+		}
+		// The segments are ordered by writer id and then sequence number, so the last one for each
+		// writer is its most recent.
+		for i, segment := range segments {
+			if i+1 < len(segments) && segments[i+1].WriterId == segment.WriterId {
+				continue
+			}
+			retval = append(retval, SnapshotMarker{Ext: ext, WriterId: segment.WriterId, Seq: segment.Seq})
+		}
+	}
+	return retval, nil
+}
+
+// writeSnapshotFile writes the snapshot to a tmp file, which is only renamed to the path of the
+// snapshot once it has been synced, so that a snapshot file is never partially written.
+func (ds *InMemDataStore) writeSnapshotFile(info *SnapshotInfo) error {
+	tmpPath := info.Path + TmpFileSuffix
+	fh, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	err = ds.encodeSnapshot(bufio.NewWriter(fh), info)
+	if err == nil {
+		err = syncAndClose(fh)
+	} else {
+		fh.Close()
+	}
+	if err == nil {
+		err = renameNoReplace(tmpPath, info.Path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("unable to write snapshot; path=%s, err=%w", info.Path, err)
+	}
+	return syncDir(filepath.Dir(info.Path))
+}
+
+func (ds *InMemDataStore) encodeSnapshot(w *bufio.Writer, info *SnapshotInfo) error {
+	_, err := w.WriteString(snapshotFileMagic)
+	if err != nil {
+		return err
+	}
+	header, err := msgpack.Marshal(&snapshotHeader{Created: info.Created.UnixNano(), Markers: info.Markers})
+	if err != nil {
+		return err
+	}
+	buf := appendFrame(nil, header)
+	for i := uint64(0); i < uint64(ds.numShards); i++ {
+		entries := ds.snapshotShard(ds.datastores[i])
+		for _, e := range entries {
+			body, err := encodeWALEntry(e)
+			if err != nil {
+				return fmt.Errorf("unable to encode snapshot entry; key=%s, err=%w", e.Key, err)
+			}
+			buf = appendFrame(buf, body)
+			if e.Tombstone {
+				info.Tombstones++
+			} else {
+				info.Records++
+			}
+			if len(buf) >= 64<<10 {
+				_, err := w.Write(buf)
+				if err != nil {
+					return err
+				}
+				buf = buf[:0]
+			}
+		}
+	}
+	trailer := &bytes.Buffer{}
+	trailer.WriteByte(snapshotEntryEnd)
+	err = msgpack.NewEncoder(trailer).EncodeInt64(info.Records + info.Tombstones)
+	if err != nil {
+		return err
+	}
+	buf = appendFrame(buf, trailer.Bytes())
+	_, err = w.Write(buf)
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// snapshotShard returns a copy of the unexpired records, with their deadlines, and the tombstones
+// of the shard, taken under its read lock.
+func (ds *InMemDataStore) snapshotShard(datastore *Datastore) []*PersistenceEntry {
+	datastore.mux.RLock()
+	defer datastore.mux.RUnlock()
+	records := ds.copyShard(datastore)
+	retval := make([]*PersistenceEntry, 0, len(records)+len(datastore.Tombstones))
+	for key, record := range records {
+		retval = append(retval, &PersistenceEntry{Key: key, Record: record, deadline: datastore.Expiries[key]})
+	}
+	for key, timestamp := range datastore.Tombstones {
+		retval = append(retval, &PersistenceEntry{Key: key, Tombstone: true, Timestamp: timestamp})
+	}
+	return retval
+}
+
+// prune removes all but the most recent snapshot files, along with any tmp files left behind by a
+// snapshot that failed part way through.  The caller must hold the mux.
+func (s *snapshotter) prune() error {
+	segments, err := ListSegments(s.dir, SnapshotFileExtension)
+	if err != nil {
+		return err
+	}
+	complete := []Segment{}
+	for _, segment := range segments {
+		if segment.Tmp {
+			err := os.Remove(segment.Path)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		complete = append(complete, segment)
+	}
+	for i := 0; i < len(complete)-s.retain; i++ {
+		log.Infof("IMDS removing old snapshot, path=%s", complete[i].Path)
+		err := os.Remove(complete[i].Path)
+		if err != nil {
+			return err
+		}
+	}
+	return syncDir(s.dir)
+}
+
+// readSnapshotFile reads the header of the snapshot file and then passes each of its entries to
+// fn.  An error is returned if the file does not end with a trailer with the number of entries
+// read, in which case fn may have been called for some of them.  A nil fn only validates the file.
+func readSnapshotFile(path string, fn func(*PersistenceEntry)) (snapshotHeader, error) {
+	header := snapshotHeader{}
+	fh, err := os.Open(path)
+	if err != nil {
+		return header, err
+	}
+	defer fh.Close()
+	r := bufio.NewReader(fh)
+	magic := make([]byte, len(snapshotFileMagic))
+	_, err = io.ReadFull(r, magic)
+	if err != nil || !bytes.Equal(magic, []byte(snapshotFileMagic)) {
+		return header, fmt.Errorf("invalid snapshot file header; path=%s", path)
+	}
+	body, err := readFrame(r)
+	if err == nil {
+		err = msgpack.Unmarshal(body, &header)
+	}
+	if err != nil {
+		return header, fmt.Errorf("unable to read snapshot header; path=%s, err=%w", path, err)
+	}
+	var numEntries int64
+	for {
+		body, err := readFrame(r)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return header, fmt.Errorf("unable to read snapshot frame; path=%s, err=%w", path, err)
+		}
+		if len(body) > 0 && body[0] == snapshotEntryEnd {
+			expected, err := msgpack.NewDecoder(bytes.NewReader(body[1:])).DecodeInt64()
+			if err != nil || expected != numEntries {
+				return header, fmt.Errorf("invalid snapshot trailer; path=%s, entries=%d", path, numEntries)
+			}
+			return header, nil
+		}
+		entry, err := decodeWALEntry(body)
+		if err != nil {
+			return header, fmt.Errorf("unable to decode snapshot entry; path=%s, err=%w", path, err)
+		}
+		numEntries++
+		if fn != nil {
+			fn(entry)
+		}
+	}
+}
+
+// loadSnapshot loads the most recent valid snapshot in the SnapshotDir into the datastore and
+// returns its markers.  Each snapshot is validated before any of it is loaded, and one that is not
+// is skipped in favour of the one before it.  Returns nil markers if there is no snapshot to load.
+func (ds *InMemDataStore) loadSnapshot(stats *RecoveryStats) ([]SnapshotMarker, error) {
+	segments, err := ListSegments(ds.snapshotter.dir, SnapshotFileExtension)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i := len(segments) - 1; i >= 0; i-- {
+		segment := segments[i]
+		if segment.Tmp {
+			continue
+		}
+		_, err := readSnapshotFile(segment.Path, nil)
+		if err != nil {
+			log.Warnf("Skipping invalid snapshot during recovery; path=%s, err=%s", segment.Path, err)
+			continue
+		}
+		header, err := readSnapshotFile(segment.Path, func(entry *PersistenceEntry) {
+			if entry.Tombstone {
+				stats.SnapshotTombstones++
+			} else {
+				stats.SnapshotRecords++
+			}
+			ds.replayWALEntry(entry)
+		})
+		if err != nil {
+			return nil, err
+		}
+		stats.SnapshotPath = segment.Path
+		return header.Markers, nil
+	}
+	return nil, nil
+}
+
+// runSnapshotter starts a go routine that writes a snapshot every SnapshotInterval.
+func (ds *InMemDataStore) runSnapshotter() {
+	log.Infof("IMDS starting snapshotter, interval=%s", ds.snapshotter.interval)
+	ds.bgWg.Add(1)
+	ticker := time.NewTicker(ds.snapshotter.interval)
+	go func() {
+		defer ds.bgWg.Done()
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				_, err := ds.WriteSnapshot()
+				if err != nil {
+					log.Errorf("IMDS unable to write snapshot; snapshotDir=%s, err=%s", ds.snapshotter.dir, err)
+				}
+			case <-ds.bgCtx.Done():
+				log.Info("IMDS snapshotter exiting on context done")
+				return
+			}
+		}
+	}()
+}
+
+// coveredBySnapshot returns true if all of the records in the data file are reflected in the
+// snapshot with the given markers.
+func coveredBySnapshot(markers []SnapshotMarker, path, ext string) bool {
+	writerId, seq, ok := ParseSegmentFileName(filepath.Base(path), ext)
+	if !ok {
+		return false
+	}
+	for _, marker := range markers {
+		if marker.Ext == ext && marker.WriterId == writerId {
+			return seq < marker.Seq
+		}
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+package inmemdatastore
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// PutOutcome describes what a Put did with its record in the datastore.
+type PutOutcome int
+
+const (
+	// There was no record for the key, so the record was written.
+	PutInserted PutOutcome = iota
+	// The record was newer than the existing record for the key and replaced it.
+	PutReplaced
+	// The existing record for the key, or the delete of the key, was newer than, or as new as, the
+	// record, so it was not written.  It is still persisted.
+	PutStaleSkipped
+	// The existing record for the key could not be ordered against the record, usually because it
+	// does not have a timestamp, so the record replaced it without a comparison.
+	PutNoTimestampOverwrite
+)
+
+func (o PutOutcome) String() string {
+	switch o {
+	case PutInserted:
+		return "inserted"
+	case PutReplaced:
+		return "replaced"
+	case PutStaleSkipped:
+		return "stale-skipped"
+	case PutNoTimestampOverwrite:
+		return "no-timestamp-overwrite"
+	default:
+		return fmt.Sprintf("PutOutcome(%d)", int(o))
+	}
+}
+
+func putOutcome(resolution Resolution, existed bool) PutOutcome {
+	switch {
+	case !resolution.Applied():
+		return PutStaleSkipped
+	case resolution == ResolutionUnordered:
+		return PutNoTimestampOverwrite
+	case existed:
+		return PutReplaced
+	default:
+		return PutInserted
+	}
+}
+
+// countOutcome increments the counter for the outcome.  The caller must hold the write lock for the
+// shard.
+func (d *Datastore) countOutcome(outcome PutOutcome) {
+	switch outcome {
+	case PutInserted:
+		d.NumInserted++
+	case PutReplaced:
+		d.NumReplaced++
+	case PutStaleSkipped:
+		d.NumStaleSkipped++
+	case PutNoTimestampOverwrite:
+		d.NumNoTimestampOverwrites++
+	}
+}
+
+// ShardStats are the counters for a single Datastore shard.
+type ShardStats struct {
+	Id                       uint64
+	NumRecords               int
+	NumTombstones            int
+	NumReads                 int64
+	NumWrites                int64
+	NumDeletes               int64
+	NumExpired               int64
+	NumTombstonesEvicted     int64
+	NumInserted              int64
+	NumReplaced              int64
+	NumStaleSkipped          int64
+	NumNoTimestampOverwrites int64
+}
+
+func (s *ShardStats) add(o ShardStats) {
+	s.NumRecords += o.NumRecords
+	s.NumTombstones += o.NumTombstones
+	s.NumReads += o.NumReads
+	s.NumWrites += o.NumWrites
+	s.NumDeletes += o.NumDeletes
+	s.NumExpired += o.NumExpired
+	s.NumTombstonesEvicted += o.NumTombstonesEvicted
+	s.NumInserted += o.NumInserted
+	s.NumReplaced += o.NumReplaced
+	s.NumStaleSkipped += o.NumStaleSkipped
+	s.NumNoTimestampOverwrites += o.NumNoTimestampOverwrites
+}
+
+// Stats are the counters for the whole datastore.
+type Stats struct {
+	// The stats for each shard, indexed by shard id.
+	Shards []ShardStats
+	// The sum of the stats of all of the shards.  Its Id is not meaningful.
+	Totals      ShardStats
+	Persistence PersistenceStats
+}
+
+// Stats returns a snapshot of the counters for each of the shards, and their totals, and for the
+// handing off of entries to the Persisters.  Each shard is read under its own read lock, so the
+// counters of different shards may reflect different points in time.
+func (ds *InMemDataStore) Stats() Stats {
+	retval := Stats{
+		Shards:      make([]ShardStats, ds.numShards),
+		Persistence: ds.PersistenceStats(),
+	}
+	for i := uint64(0); i < uint64(ds.numShards); i++ {
+		datastore := ds.datastores[i]
+		datastore.mux.RLock()
+		shardStats := ShardStats{
+			Id:                       datastore.Id,
+			NumRecords:               len(datastore.Data),
+			NumTombstones:            len(datastore.Tombstones),
+			NumReads:                 atomic.LoadInt64(&datastore.NumReads),
+			NumWrites:                datastore.NumWrites,
+			NumDeletes:               datastore.NumDeletes,
+			NumExpired:               datastore.NumExpired,
+			NumTombstonesEvicted:     datastore.NumTombstonesEvicted,
+			NumInserted:              datastore.NumInserted,
+			NumReplaced:              datastore.NumReplaced,
+			NumStaleSkipped:          datastore.NumStaleSkipped,
+			NumNoTimestampOverwrites: datastore.NumNoTimestampOverwrites,
+		}
+		datastore.mux.RUnlock()
+		retval.Shards[i] = shardStats
+		retval.Totals.add(shardStats)
+	}
+	return retval
+}
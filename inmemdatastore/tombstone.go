@@ -0,0 +1,31 @@
+package inmemdatastore
+
+const (
+	// The extension of the Avro OCF files to which the AvroFileWriter persists tombstones.  Each
+	// tombstone file has the same sequence number as the data file that was being written at the
+	// same time.
+	TombstoneFileExtension  = ".tombstones"
+	TombstoneFieldKey       = "key"
+	TombstoneFieldTimestamp = "timestamp"
+	// The Avro schema of the records in the tombstone files.
+	TombstoneSchema = `{
+  "name": "tombstone",
+  "namespace": "com.ryanchapin.inmemdatastore",
+  "type": "record",
+  "fields": [
+    {
+      "name": "key",
+      "type": "string"
+    },
+    {
+      "name": "timestamp",
+      "type": "long"
+    }
+  ]
+}`
+)
+
+// TombstoneWriter is implemented by Writers that are able to persist the deletion of a key.
+type TombstoneWriter interface {
+	WriteTombstone(key string, timestamp int64) error
+}
@@ -0,0 +1,229 @@
+package inmemdatastore
+
+import (
+	"container/heap"
+	"time"
+
+	log "github.com/rchapin/rlog"
+)
+
+const (
+	// The default interval at which the sweeper checks the Datastore shards for expired records.
+	DefaultTTLSweepInterval = time.Second
+	// The maximum number of expired records that the sweeper will evict from a shard while holding
+	// its lock.  Limits how long Gets and Puts to the shard are blocked by the sweeper.
+	ttlSweepBatchSize = 256
+)
+
+// TTLMode determines what the TTL of a record is measured against.
+type TTLMode int
+
+const (
+	// The TTL is measured from the time at which the record was written to the datastore.
+	TTLModeWallClock TTLMode = iota
+	// The TTL is measured from the value of the RecordTimestampKey of the record.  Records without
+	// a timestamp fall back to TTLModeWallClock.
+	TTLModeRecordTimestamp
+)
+
+// ExpiryEvent describes a record that was evicted from the datastore because its TTL expired.
+type ExpiryEvent struct {
+	Key     string
+	Record  map[string]interface{}
+	ShardId uint64
+	// The time at which the record expired.
+	Expired time.Time
+	// The time at which the record was evicted by the sweeper.
+	Evicted time.Time
+}
+
+type ExpiryChan chan ExpiryEvent
+
+type expiry struct {
+	key      string
+	deadline int64
+}
+
+// expiryQueue is a min-heap of the expiry deadlines of the records in a Datastore shard.  Entries
+// are not removed when a record is overwritten or deleted, they are skipped when they no longer
+// match the deadline in the Expiries map of the shard.
+type expiryQueue []expiry
+
+func (q expiryQueue) Len() int            { return len(q) }
+func (q expiryQueue) Less(i, j int) bool  { return q[i].deadline < q[j].deadline }
+func (q expiryQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *expiryQueue) Push(x interface{}) { *q = append(*q, x.(expiry)) }
+func (q *expiryQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	retval := old[n-1]
+	*q = old[:n-1]
+	return retval
+}
+
+// expiryDeadline returns the deadline, in unix nanos, at which the record expires if it is written
+// now with the ttl.  A ttl of zero or less returns zero, the record does not expire.
+func (ds *InMemDataStore) expiryDeadline(val map[string]interface{}, ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	if ds.ttlMode == TTLModeRecordTimestamp {
+		if timestamp, ok := ds.recordTimestamp(val); ok {
+			return timestamp*int64(ds.recordTimestampUnit) + int64(ttl)
+		}
+	}
+	return time.Now().UnixNano() + int64(ttl)
+}
+
+// setExpiry records the deadline, in unix nanos, at which the record for the key expires.  A
+// deadline of zero clears any existing expiry for the key.  The caller must hold the write lock for
+// the shard.
+func (ds *InMemDataStore) setExpiry(datastore *Datastore, key string, deadline int64) {
+	if deadline == 0 {
+		delete(datastore.Expiries, key)
+		return
+	}
+	datastore.Expiries[key] = deadline
+	pushExpiry(&datastore.expiryQueue, expiry{key: key, deadline: deadline}, datastore.Expiries, func(d int64) int64 {
+		return d
+	})
+}
+
+// pushExpiry pushes the entry onto the queue.  The queue is rebuilt from the live map, whose values
+// are converted to deadlines with the deadline func, if it is mostly made up of entries for keys
+// that have since been overwritten, so that it does not grow without bound for frequently written
+// keys.
+func pushExpiry(queue *expiryQueue, next expiry, live map[string]int64, deadline func(int64) int64) {
+	heap.Push(queue, next)
+	if len(*queue) > 1024 && len(*queue) > 2*len(live) {
+		rebuilt := make(expiryQueue, 0, len(live))
+		for k, v := range live {
+			rebuilt = append(rebuilt, expiry{key: k, deadline: deadline(v)})
+		}
+		heap.Init(&rebuilt)
+		*queue = rebuilt
+	}
+}
+
+// tombstoneDeadline returns the deadline, in unix nanos, at which the tombstone for a delete with
+// the timestamp is evicted.
+func (ds *InMemDataStore) tombstoneDeadline(timestamp int64) int64 {
+	return timestamp*int64(ds.recordTimestampUnit) + int64(ds.tombstoneTTL)
+}
+
+// expired returns true if the record for the key has expired but has not yet been evicted.  The
+// caller must hold at least the read lock for the shard.
+func (ds *InMemDataStore) expired(datastore *Datastore, key string) bool {
+	deadline, ok := datastore.Expiries[key]
+	return ok && deadline <= time.Now().UnixNano()
+}
+
+// runSweeper starts a go routine that periodically evicts the expired records and tombstones from
+// each of the Datastore shards.
+func (ds *InMemDataStore) runSweeper() {
+	log.Infof("IMDS starting TTL sweeper, interval=%s", ds.ttlSweepInterval)
+	ds.bgWg.Add(1)
+	ticker := time.NewTicker(ds.ttlSweepInterval)
+	go func() {
+		defer ds.bgWg.Done()
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				for _, datastore := range ds.datastores {
+					ds.sweep(datastore)
+				}
+			case <-ds.bgCtx.Done():
+				log.Info("IMDS TTL sweeper exiting on context done")
+				return
+			}
+		}
+	}()
+}
+
+// sweep evicts all of the expired records and tombstones from the shard, only holding the lock for
+// the shard for up to ttlSweepBatchSize of them at a time.
+func (ds *InMemDataStore) sweep(datastore *Datastore) {
+	for {
+		events, more := ds.evictExpired(datastore, ttlSweepBatchSize)
+		for _, event := range events {
+			ds.emitExpiry(event)
+		}
+		if !more {
+			break
+		}
+	}
+	for ds.evictTombstones(datastore, ttlSweepBatchSize) {
+	}
+}
+
+func (ds *InMemDataStore) evictExpired(datastore *Datastore, limit int) ([]ExpiryEvent, bool) {
+	events := []ExpiryEvent{}
+	now := time.Now()
+	nowNanos := now.UnixNano()
+	datastore.mux.Lock()
+	defer datastore.mux.Unlock()
+	for i := 0; i < limit; i++ {
+		if len(datastore.expiryQueue) == 0 || datastore.expiryQueue[0].deadline > nowNanos {
+			return events, false
+		}
+		next := heap.Pop(&datastore.expiryQueue).(expiry)
+		deadline, ok := datastore.Expiries[next.key]
+		if !ok || deadline != next.deadline {
+			// The record was overwritten, with a different expiry, or deleted since this entry was
+			// queued.
+			continue
+		}
+		event := ExpiryEvent{
+			Key:     next.key,
+			ShardId: datastore.Id,
+			Expired: time.Unix(0, deadline),
+			Evicted: now,
+		}
+		if rec, ok := datastore.Data[next.key]; ok {
+			event.Record = rec.(map[string]interface{})
+		}
+		delete(datastore.Data, next.key)
+		delete(datastore.Expiries, next.key)
+		datastore.NumExpired++
+		events = append(events, event)
+	}
+	return events, true
+}
+
+// evictTombstones evicts up to limit of the tombstones whose TombstoneTTL has passed from the shard.
+// Returns true if there may be more to evict.
+func (ds *InMemDataStore) evictTombstones(datastore *Datastore, limit int) bool {
+	nowNanos := time.Now().UnixNano()
+	datastore.mux.Lock()
+	defer datastore.mux.Unlock()
+	for i := 0; i < limit; i++ {
+		if len(datastore.tombstoneQueue) == 0 || datastore.tombstoneQueue[0].deadline > nowNanos {
+			return false
+		}
+		next := heap.Pop(&datastore.tombstoneQueue).(expiry)
+		timestamp, ok := datastore.Tombstones[next.key]
+		if !ok || ds.tombstoneDeadline(timestamp) != next.deadline {
+			// The key was written, or deleted again, since this entry was queued.
+			continue
+		}
+		delete(datastore.Tombstones, next.key)
+		datastore.NumTombstonesEvicted++
+		log.Debugf("IMDS tombstone evicted, key=%s, shardId=%d", next.key, datastore.Id)
+	}
+	return true
+}
+
+// emitExpiry sends the event on the ExpiryChan, if one was configured.  The sweeper never blocks
+// on the channel, if it is full the event is dropped.
+func (ds *InMemDataStore) emitExpiry(event ExpiryEvent) {
+	log.Debugf("IMDS record expired, key=%s, shardId=%d", event.Key, event.ShardId)
+	if ds.expiryChan == nil {
+		return
+	}
+	select {
+	case ds.expiryChan <- event:
+	default:
+		log.Warnf("IMDS ExpiryChan is full, dropping expiry event, key=%s", event.Key)
+	}
+}
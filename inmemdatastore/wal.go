@@ -0,0 +1,667 @@
+package inmemdatastore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/rchapin/rlog"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	WALFileExtension = ".wal"
+	// The default amount of time between the syncs of the write-ahead log with WALSyncInterval.
+	DefaultWALSyncInterval = 10 * time.Millisecond
+	// The default size at which a write-ahead log segment is rotated.
+	DefaultWALSegmentMaxBytes = 64 << 20
+	// The default amount of time between the checkpoints of the write-ahead log.
+	DefaultWALCheckpointInterval = time.Second
+)
+
+// WALSyncPolicy determines when the write-ahead log is synced to disk, and so how much of it can be
+// lost if the machine, rather than just the process, crashes.
+type WALSyncPolicy int
+
+const (
+	// Put does not return until its entry has been synced.  Concurrent Puts are synced together,
+	// with a single fsync for all of the entries written while the previous one was in progress.
+	WALSyncAlways WALSyncPolicy = iota
+	// The log is synced every WALSyncInterval, and Put returns as soon as its entry is written.
+	WALSyncInterval
+	// The log is never explicitly synced, other than when a segment is rotated, and it is left to
+	// the OS to write it to disk.
+	WALSyncOS
+)
+
+func (w WALSyncPolicy) String() string {
+	switch w {
+	case WALSyncAlways:
+		return "always"
+	case WALSyncInterval:
+		return "interval"
+	case WALSyncOS:
+		return "os"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(w))
+	}
+}
+
+// The types of the entries in the write-ahead log.
+const (
+	walEntryPut    byte = 1
+	walEntryDelete byte = 2
+	walEntryBatch  byte = 3
+)
+
+// walSegment is a single file of the write-ahead log.  It can be removed once all of the entries
+// written to it have been released by the Persisters and the Writers have been synced.  It is also
+// used to track the entries drained from an overflow file.
+type walSegment struct {
+	path string
+	seq  uint64
+	// The number of entries written to the segment that have not yet been released.  Updated
+	// atomically.
+	outstanding int64
+}
+
+// release records that the Persisters are done with an entry in the segment, regardless of
+// whether they managed to persist it.  It is a no-op for a nil segment, which is what the entries
+// have when there is no write-ahead log.
+func (s *walSegment) release() {
+	if s != nil {
+		atomic.AddInt64(&s.outstanding, -1)
+	}
+}
+
+func (s *walSegment) done() bool {
+	return atomic.LoadInt64(&s.outstanding) <= 0
+}
+
+// writeAheadLog is the append-only log, in the WALDir, to which each Put, PutBatch and Delete is
+// written before it returns.  It is a sequence of segments named "0-<seq>.wal", each of which is a
+// sequence of frames in the same format as those of the RawFileWriter.  The body of each frame is
+// the type of the entry followed by its fields encoded with MessagePack.
+//
+// All of its methods are no-ops for a nil writeAheadLog.
+type writeAheadLog struct {
+	dir      string
+	policy   WALSyncPolicy
+	maxBytes int64
+	mux      *sync.Mutex
+	// Signalled whenever a sync completes.
+	cond    *sync.Cond
+	fh      *os.File
+	current *walSegment
+	size    int64
+	nextSeq uint64
+	// The segments that have been rotated and not yet removed, oldest first.
+	sealed []*walSegment
+	// The number of frames that have been written, and of those the number that are known to have
+	// been synced.  They count across all of the segments, and rotating a segment syncs it.
+	written uint64
+	synced  uint64
+	// Whether a sync is in progress, outside of the mux.
+	syncing bool
+	closed  bool
+}
+
+func newWriteAheadLog(dir string, policy WALSyncPolicy, maxBytes int64) *writeAheadLog {
+	if dir == "" {
+		return nil
+	}
+	if maxBytes <= 0 {
+		maxBytes = DefaultWALSegmentMaxBytes
+	}
+	mux := &sync.Mutex{}
+	return &writeAheadLog{
+		dir:      dir,
+		policy:   policy,
+		maxBytes: maxBytes,
+		mux:      mux,
+		cond:     sync.NewCond(mux),
+	}
+}
+
+// appendEntry writes the entry to the log and, with WALSyncAlways, waits for it to be synced.  On
+// success the entry holds a reference to the segment to which it was written, which the Persisters
+// release once they are done with it.
+func (w *writeAheadLog) appendEntry(entry *PersistenceEntry) error {
+	if w == nil {
+		return nil
+	}
+	body, err := encodeWALEntry(entry)
+	if err != nil {
+		return fmt.Errorf("unable to encode write-ahead log entry; key=%s, err=%w", entry.Key, err)
+	}
+	frame := appendFrame(nil, body)
+
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if w.closed {
+		return errors.New("write-ahead log is closed")
+	}
+	if w.current != nil && w.size+int64(len(frame)) > w.maxBytes {
+		err := w.seal()
+		if err != nil {
+			return err
+		}
+	}
+	if w.current == nil {
+		err := w.open()
+		if err != nil {
+			return err
+		}
+	}
+	_, err = w.fh.Write(frame)
+	if err != nil {
+		// The segment may now end with a partial frame, after which nothing could be read back,
+		// so the next entry is written to a new segment.
+		w.abandon()
+		return fmt.Errorf("unable to write to write-ahead log; key=%s, err=%w", entry.Key, err)
+	}
+	w.size += int64(len(frame))
+	w.written++
+	segment := w.current
+	atomic.AddInt64(&segment.outstanding, 1)
+
+	if w.policy == WALSyncAlways {
+		err := w.waitForSync(w.written)
+		if err != nil {
+			segment.release()
+			return fmt.Errorf("unable to sync write-ahead log; key=%s, err=%w", entry.Key, err)
+		}
+	}
+	entry.walSegment = segment
+	return nil
+}
+
+// waitForSync blocks until the frame with the given sequence number has been synced.  If no sync
+// is in progress this caller becomes the leader and syncs everything written so far, otherwise it
+// waits for the sync in progress and then checks again, so that all of the frames written while a
+// sync is in progress are covered by the next one.  The caller must hold the mux.
+func (w *writeAheadLog) waitForSync(seq uint64) error {
+	for w.synced < seq {
+		if w.syncing {
+			w.cond.Wait()
+			continue
+		}
+		err := w.syncLocked()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncLocked syncs the current segment, releasing the mux for the duration of the fsync.  The
+// caller must hold the mux and no other sync may be in progress.
+func (w *writeAheadLog) syncLocked() error {
+	if w.fh == nil {
+		w.synced = w.written
+		return nil
+	}
+	w.syncing = true
+	fh := w.fh
+	target := w.written
+	w.mux.Unlock()
+	err := fh.Sync()
+	w.mux.Lock()
+	w.syncing = false
+	if err == nil {
+		w.synced = target
+	}
+	w.cond.Broadcast()
+	return err
+}
+
+// sync syncs everything written so far.  It is used by the syncer with WALSyncInterval.
+func (w *writeAheadLog) sync() error {
+	if w == nil {
+		return nil
+	}
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	for w.syncing {
+		w.cond.Wait()
+	}
+	if w.synced == w.written {
+		return nil
+	}
+	return w.syncLocked()
+}
+
+// open creates the next segment.  The caller must hold the mux.
+func (w *writeAheadLog) open() error {
+	segment := &walSegment{path: filepath.Join(w.dir, SegmentFileName(0, w.nextSeq, WALFileExtension)), seq: w.nextSeq}
+	fh, err := os.OpenFile(segment.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return fmt.Errorf("unable to create write-ahead log segment; path=%s, err=%w", segment.path, err)
+	}
+	err = syncDir(w.dir)
+	if err != nil {
+		fh.Close()
+		os.Remove(segment.path)
+		return fmt.Errorf("unable to sync write-ahead log dir; dir=%s, err=%w", w.dir, err)
+	}
+	w.nextSeq++
+	w.fh = fh
+	w.current = segment
+	w.size = 0
+	return nil
+}
+
+// seal syncs and closes the current segment and adds it to the sealed segments.  The next entry is
+// written to a new segment.  The caller must hold the mux.
+func (w *writeAheadLog) seal() error {
+	for w.syncing {
+		w.cond.Wait()
+	}
+	if w.current == nil {
+		return nil
+	}
+	err := syncAndClose(w.fh)
+	w.fh = nil
+	w.sealed = append(w.sealed, w.current)
+	w.current = nil
+	if err != nil {
+		return fmt.Errorf("unable to close write-ahead log segment; err=%w", err)
+	}
+	w.synced = w.written
+	w.cond.Broadcast()
+	return nil
+}
+
+// abandon seals the current segment after a failed write.  The frames before the failed one are
+// still read back on replay.  The caller must hold the mux.
+func (w *writeAheadLog) abandon() {
+	for w.syncing {
+		w.cond.Wait()
+	}
+	err := syncAndClose(w.fh)
+	if err != nil {
+		log.Errorf("IMDS unable to close abandoned write-ahead log segment; path=%s, err=%s", w.current.path, err)
+	}
+	w.fh = nil
+	w.sealed = append(w.sealed, w.current)
+	w.current = nil
+	w.synced = w.written
+	w.cond.Broadcast()
+}
+
+// adopt adds a segment left behind by a previous run to the sealed segments, so that it is removed
+// once the entries replayed from it have been persisted.  New segments are numbered after it.
+func (w *writeAheadLog) adopt(segment *walSegment) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	w.sealed = append(w.sealed, segment)
+	if segment.seq >= w.nextSeq {
+		w.nextSeq = segment.seq + 1
+	}
+}
+
+// checkpoint seals the current segment, if anything has been written to it, and returns the
+// sealed segments whose entries have all been released.
+func (w *writeAheadLog) checkpoint() ([]*walSegment, error) {
+	if w == nil {
+		return nil, nil
+	}
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if w.current != nil && w.size > 0 {
+		err := w.seal()
+		if err != nil {
+			return nil, err
+		}
+	}
+	retval := []*walSegment{}
+	for _, segment := range w.sealed {
+		if segment.done() {
+			retval = append(retval, segment)
+		}
+	}
+	return retval, nil
+}
+
+// remove deletes the segments, which must have been returned by checkpoint.
+func (w *writeAheadLog) remove(segments []*walSegment) error {
+	if w == nil || len(segments) == 0 {
+		return nil
+	}
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	removed := make(map[*walSegment]bool, len(segments))
+	for _, segment := range segments {
+		err := os.Remove(segment.path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("unable to remove write-ahead log segment; path=%s, err=%w", segment.path, err)
+		}
+		removed[segment] = true
+	}
+	sealed := w.sealed[:0]
+	for _, segment := range w.sealed {
+		if !removed[segment] {
+			sealed = append(sealed, segment)
+		}
+	}
+	w.sealed = sealed
+	return syncDir(w.dir)
+}
+
+// close seals the current segment.  Any later appends fail.
+func (w *writeAheadLog) close() error {
+	if w == nil {
+		return nil
+	}
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	w.closed = true
+	return w.seal()
+}
+
+// numSegments returns the number of segments that have not yet been removed.
+func (w *writeAheadLog) numSegments() int {
+	if w == nil {
+		return 0
+	}
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	retval := len(w.sealed)
+	if w.current != nil {
+		retval++
+	}
+	return retval
+}
+
+// encodeWALEntry encodes the entry, along with the deadline of each of its records, into the body
+// of a frame.
+func encodeWALEntry(entry *PersistenceEntry) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	enc := msgpack.NewEncoder(buf)
+	var err error
+	switch {
+	case entry.Batch != nil:
+		buf.WriteByte(walEntryBatch)
+		err = enc.EncodeArrayLen(len(entry.Batch))
+		for _, e := range entry.Batch {
+			if err == nil {
+				err = encodeWALRecord(enc, e)
+			}
+		}
+	case entry.Tombstone:
+		buf.WriteByte(walEntryDelete)
+		err = enc.EncodeString(entry.Key)
+		if err == nil {
+			err = enc.EncodeInt64(entry.Timestamp)
+		}
+	default:
+		buf.WriteByte(walEntryPut)
+		err = encodeWALRecord(enc, entry)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeWALEntry decodes the body of a frame written by encodeWALEntry into the PersistenceEntry.
+func decodeWALEntry(body []byte) (*PersistenceEntry, error) {
+	if len(body) == 0 {
+		return nil, errors.New("empty write-ahead log entry")
+	}
+	dec := msgpack.NewDecoder(bytes.NewReader(body[1:]))
+	switch body[0] {
+	case walEntryBatch:
+		n, err := dec.DecodeArrayLen()
+		if err != nil {
+			return nil, err
+		}
+		retval := &PersistenceEntry{Batch: make([]*PersistenceEntry, 0, n)}
+		for i := 0; i < n; i++ {
+			e, err := decodeWALRecord(dec)
+			if err != nil {
+				return nil, err
+			}
+			retval.Batch = append(retval.Batch, e)
+		}
+		return retval, nil
+	case walEntryDelete:
+		key, err := dec.DecodeString()
+		if err != nil {
+			return nil, err
+		}
+		timestamp, err := dec.DecodeInt64()
+		if err != nil {
+			return nil, err
+		}
+		return &PersistenceEntry{Key: key, Tombstone: true, Timestamp: timestamp}, nil
+	case walEntryPut:
+		return decodeWALRecord(dec)
+	default:
+		return nil, fmt.Errorf("unknown write-ahead log entry type; type=%d", body[0])
+	}
+}
+
+// encodeWALRecord encodes the key, deadline and record of a single record.
+func encodeWALRecord(enc *msgpack.Encoder, entry *PersistenceEntry) error {
+	err := enc.EncodeString(entry.Key)
+	if err != nil {
+		return err
+	}
+	err = enc.EncodeInt64(entry.deadline)
+	if err != nil {
+		return err
+	}
+	return enc.Encode(entry.Record)
+}
+
+func decodeWALRecord(dec *msgpack.Decoder) (*PersistenceEntry, error) {
+	key, err := dec.DecodeString()
+	if err != nil {
+		return nil, err
+	}
+	deadline, err := dec.DecodeInt64()
+	if err != nil {
+		return nil, err
+	}
+	record, err := dec.DecodeMap()
+	if err != nil {
+		return nil, err
+	}
+	return &PersistenceEntry{Key: key, Record: record, deadline: deadline}, nil
+}
+
+// readWALSegment reads each of the entries from the segment and passes them to fn.  A segment that
+// ends with a partially written frame returns an error wrapping io.ErrUnexpectedEOF after all of
+// the complete frames have been read.
+func readWALSegment(path string, fn func(*PersistenceEntry)) error {
+	fh, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	r := bufio.NewReader(fh)
+	for {
+		body, err := readFrame(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("unable to read write-ahead log frame; path=%s, err=%w", path, err)
+		}
+		entry, err := decodeWALEntry(body)
+		if err != nil {
+			return fmt.Errorf("unable to decode write-ahead log entry; path=%s, err=%w", path, err)
+		}
+		fn(entry)
+	}
+}
+
+// replayWAL loads each of the entries in the segments in the WALDir into the datastore, in the
+// order in which they were written, and keeps them to be handed off to the Persisters once they
+// are running.  Those entries may already have been persisted before the last shutdown, in which
+// case they are persisted again, but it is only the entries that had not been that are otherwise
+// lost.  Reading a segment stops at the first frame that cannot be read, as would be left by a
+// crash part way through a write.
+func (ds *InMemDataStore) replayWAL(stats *RecoveryStats) error {
+	err := os.MkdirAll(ds.wal.dir, 0o755)
+	if err != nil {
+		return err
+	}
+	segments, err := ListSegments(ds.wal.dir, WALFileExtension)
+	if err != nil {
+		return err
+	}
+	for _, s := range segments {
+		segment := &walSegment{path: s.Path, seq: s.Seq}
+		stats.WALSegmentsRead++
+		err := readWALSegment(segment.path, func(entry *PersistenceEntry) {
+			stats.WALEntriesReplayed++
+			ds.replayWALEntry(entry)
+			segment.outstanding++
+			entry.walSegment = segment
+			ds.walReplayed = append(ds.walReplayed, entry)
+		})
+		if err != nil {
+			log.Warnf("Unable to read all of the write-ahead log segment during recovery; path=%s, err=%s", segment.path, err)
+		}
+		ds.wal.adopt(segment)
+	}
+	return nil
+}
+
+// replayWALEntry applies the entry to the datastore.  Its records expire at the deadlines at which
+// they were written, so any that have passed are evicted by the next sweep.
+func (ds *InMemDataStore) replayWALEntry(entry *PersistenceEntry) {
+	if entry.Tombstone {
+		datastore, err := ds.getDatastoreShard(entry.Key)
+		if err != nil {
+			return
+		}
+		datastore.mux.Lock()
+		ds.tombstone(datastore, entry.Key, entry.Timestamp)
+		datastore.mux.Unlock()
+		return
+	}
+	entries := entry.Batch
+	if entries == nil {
+		entries = []*PersistenceEntry{entry}
+	}
+	for _, e := range entries {
+		_, err := ds.load(e.Key, e.Record, e.deadline)
+		if err != nil {
+			log.Debugf("IMDS unable to replay write-ahead log entry; key=%s, err=%s", e.Key, err)
+		}
+	}
+}
+
+// handOffReplayed hands the entries replayed from the write-ahead log off to the Persisters.
+func (ds *InMemDataStore) handOffReplayed() {
+	for _, entry := range ds.walReplayed {
+		err := ds.enqueue(context.Background(), entry)
+		if err != nil {
+			entry.walSegment.release()
+			log.Errorf("IMDS unable to hand off replayed write-ahead log entry; key=%s, err=%s", entry.Key, err)
+		}
+	}
+	ds.walReplayed = nil
+}
+
+// runWALSyncer starts a go routine that syncs the write-ahead log every WALSyncInterval.
+func (ds *InMemDataStore) runWALSyncer() {
+	log.Infof("IMDS starting write-ahead log syncer, interval=%s", ds.walSyncInterval)
+	ds.bgWg.Add(1)
+	ticker := time.NewTicker(ds.walSyncInterval)
+	go func() {
+		defer ds.bgWg.Done()
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				err := ds.wal.sync()
+				if err != nil {
+					log.Errorf("IMDS unable to sync write-ahead log; walDir=%s, err=%s", ds.wal.dir, err)
+				}
+			case <-ds.bgCtx.Done():
+				log.Info("IMDS write-ahead log syncer exiting on context done")
+				return
+			}
+		}
+	}()
+}
+
+// runWALCheckpointer starts a go routine that removes the write-ahead log segments whose entries
+// are durable in the files of the Writers every WALCheckpointInterval.
+func (ds *InMemDataStore) runWALCheckpointer() {
+	log.Infof("IMDS starting write-ahead log checkpointer, interval=%s", ds.walCheckpointInterval)
+	ds.bgWg.Add(1)
+	ticker := time.NewTicker(ds.walCheckpointInterval)
+	go func() {
+		defer ds.bgWg.Done()
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				err := ds.checkpointWAL(true)
+				if err != nil {
+					log.Errorf("IMDS unable to checkpoint write-ahead log; walDir=%s, err=%s", ds.wal.dir, err)
+				}
+			case <-ds.bgCtx.Done():
+				log.Info("IMDS write-ahead log checkpointer exiting on context done")
+				return
+			}
+		}
+	}()
+}
+
+// checkpointWAL removes the sealed segments all of whose entries have been released by the
+// Persisters.  If syncWriters is true the Writers, and the overflow file, are first synced so that
+// the entries that were written to them are durable, and nothing is removed if any of them cannot
+// be synced.  Otherwise the caller must ensure that they already are.
+func (ds *InMemDataStore) checkpointWAL(syncWriters bool) error {
+	segments, err := ds.wal.checkpoint()
+	if err != nil || len(segments) == 0 {
+		return err
+	}
+	if syncWriters {
+		for _, persister := range ds.persisters {
+			err := persister.sync()
+			if err != nil {
+				return err
+			}
+		}
+		err := ds.overflow.sync()
+		if err != nil {
+			return err
+		}
+	}
+	return ds.wal.remove(segments)
+}
+
+// closeWAL closes the write-ahead log once the Persisters have shutdown and, unless any of their
+// Writers failed to shutdown, removes all of the segments whose entries have been persisted.
+func (ds *InMemDataStore) closeWAL() {
+	err := ds.wal.close()
+	if err != nil {
+		log.Errorf("IMDS unable to close write-ahead log; walDir=%s, err=%s", ds.wal.dir, err)
+		return
+	}
+	for _, persister := range ds.persisters {
+		if persister.shutdownErr != nil {
+			log.Warnf("IMDS not truncating write-ahead log, a Writer failed to shutdown; persisterId=%d", persister.id)
+			return
+		}
+	}
+	err = ds.checkpointWAL(false)
+	if err != nil {
+		log.Errorf("IMDS unable to truncate write-ahead log; walDir=%s, err=%s", ds.wal.dir, err)
+	}
+}
@@ -1,19 +1,57 @@
 package inmemdatastore
 
 import (
+	"bufio"
+	"compress/flate"
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/linkedin/goavro/v2"
 	log "github.com/rchapin/rlog"
 )
 
+var (
+	// ErrIncompatibleSchema is returned when creating a writer for an output dir that already
+	// contains data files written with a different schema.
+	ErrIncompatibleSchema = errors.New("data file was written with an incompatible schema")
+	// errUnreadableHeader is returned by readAvroFileSchema for a file whose header cannot be read.
+	errUnreadableHeader = errors.New("unable to read avro data file header")
+)
+
+// FileMode determines what a writer does with the data files left in its output dir by a previous
+// writer with the same id.  Existing data files are never truncated or overwritten.
+type FileMode int
+
+const (
+	// Start a new segment, numbered after the last existing segment for the writer.  Any segment
+	// left open by a previous writer, which still has the TmpFileSuffix, is closed by renaming it to
+	// its final name.
+	FileModeNewSegment FileMode = iota
+	// Continue appending to the segment left open by a previous writer, if there is one.
+	// Otherwise, start a new segment.  Segments that have already been closed are never appended
+	// to.
+	FileModeAppend
+)
+
+// Writer writes the records output by a Serializer.  A Writer returns an error wrapping
+// ErrInvalidRecord for a record with an Encoding that it does not support.
 type Writer interface {
-	Write(interface{}) error
-	Shutdown()
+	Write(*SerializedRecord) error
+	Shutdown() error
+}
+
+// BatchWriter is implemented by Writers that are able to write a batch of serialized records as a
+// single unit.  Either all of the records are written or none of them are.
+type BatchWriter interface {
+	WriteBatch([]*SerializedRecord) error
 }
 
 type AvroFileWriter struct {
@@ -25,71 +63,582 @@ type AvroFileWriter struct {
 	outputFilePath string
 	avroSchema     string
 	codec          *goavro.Codec
+	compression    Compression
+	level          int
 	fh             *os.File
-	ocfw           *goavro.OCFWriter
+	ocfw           *ocfWriter
+	rotation       RotationPolicy
+	seq            uint64
+	fileOpened     time.Time
+	fileBytes      int64
+	fileRecords    int64
+	// The tombstone file for the current sequence number is only created when the first tombstone
+	// is written to it.
+	tombstoneCodec *goavro.Codec
+	tombstoneFh    *os.File
+	tombstoneOcfw  *ocfWriter
+	tombstoneBytes int64
+	fileTombstones int64
+	// The concatenated encodings of the records buffered for the next block.
+	block          BlockPolicy
+	pending        []byte
+	pendingRecords int
+	// Reused for encoding records that are not buffered.
+	scratch []byte
+	// Guards the current file against concurrent writes and rotations triggered by the MaxAge
+	// ticker.
+	mux    *sync.Mutex
+	closed bool
+	stop   chan struct{}
 }
 
 type AvroFileWriterConfig struct {
 	Id         int
 	AvroSchema string
 	OutputDir  string
+	// Defines when the writer closes the file to which it is currently writing and opens a new
+	// one.  By default files are never rotated.
+	Rotation RotationPolicy
+	// How to handle data files left in the OutputDir by a previous writer with the same Id.
+	// Defaults to FileModeNewSegment.
+	Mode FileMode
+	// Defines how many records are buffered and appended to the data file as a single block.  By
+	// default records are not buffered.
+	Block BlockPolicy
+	// The codec with which the blocks of the data and tombstone files are compressed.  Defaults to
+	// CompressionNull.  A file left open by a previous writer that is appended to keeps the codec
+	// with which it was created.
+	Compression Compression
+	// The compress/flate level used with CompressionDeflate, from flate.HuffmanOnly to
+	// flate.BestCompression.  Zero selects flate.DefaultCompression; use CompressionNull rather than
+	// flate.NoCompression to write uncompressed blocks.
+	CompressionLevel int
 }
 
-func NewAvroFileWriter(ctx context.Context, wg *sync.WaitGroup, cfg AvroFileWriterConfig) *AvroFileWriter {
-	fileName := fmt.Sprintf("%d.avro", cfg.Id)
+func NewAvroFileWriter(ctx context.Context, wg *sync.WaitGroup, cfg AvroFileWriterConfig) (*AvroFileWriter, error) {
 	retval := &AvroFileWriter{
-		ctx:            ctx,
-		wg:             wg,
-		id:             cfg.Id,
-		outputDir:      cfg.OutputDir,
-		outputFileName: fileName,
-		outputFilePath: filepath.Join(cfg.OutputDir, fileName),
-		avroSchema:     cfg.AvroSchema,
+		ctx:         ctx,
+		wg:          wg,
+		id:          cfg.Id,
+		outputDir:   cfg.OutputDir,
+		avroSchema:  cfg.AvroSchema,
+		rotation:    cfg.Rotation,
+		block:       cfg.Block.withDefaults(),
+		compression: cfg.Compression,
+		level:       cfg.CompressionLevel,
+		mux:         &sync.Mutex{},
+		stop:        make(chan struct{}),
+	}
+
+	if cfg.Compression < CompressionNull || cfg.Compression > CompressionSnappy {
+		return nil, fmt.Errorf("unsupported compression codec; codec=%s", cfg.Compression)
+	}
+	if retval.level == 0 {
+		retval.level = flate.DefaultCompression
+	}
+	if retval.level < flate.HuffmanOnly || retval.level > flate.BestCompression {
+		return nil, fmt.Errorf("invalid compression level; level=%d", retval.level)
 	}
 
 	codec, err := GetAvroCodec(cfg.AvroSchema)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	retval.codec = codec
+	tombstoneCodec, err := GetAvroCodec(TombstoneSchema)
+	if err != nil {
+		return nil, err
+	}
+	retval.tombstoneCodec = tombstoneCodec
+
+	err = retval.checkSchemas()
+	if err != nil {
+		return nil, err
+	}
+	err = retval.openInitialFile(cfg.Mode)
+	if err != nil {
+		return nil, err
+	}
+
+	if retval.rotation.MaxAge > 0 {
+		retval.runAgeRotation()
+	}
+	if retval.block.enabled() {
+		retval.runFlusher()
+	}
+
+	return retval, nil
+}
+
+// Write appends the record to the current data file as its own OCF block, or adds it to the
+// current block if a BlockPolicy is set.
+func (a *AvroFileWriter) Write(record *SerializedRecord) error {
+	return a.WriteBatch([]*SerializedRecord{record})
+}
+
+// WriteBatch appends all of the records to the current data file as a single OCF block, or adds
+// them to the current block if a BlockPolicy is set.  The file is only rotated after the whole
+// batch has been written, so a batch is never split across files.
+func (a *AvroFileWriter) WriteBatch(records []*SerializedRecord) error {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	if a.block.enabled() {
+		return a.buffer(records)
+	}
+	var err error
+	a.scratch, err = a.encode(a.scratch[:0], records)
+	if err != nil {
+		return err
+	}
+	err = a.ocfw.appendEncoded(int64(len(records)), a.scratch)
+	if err != nil {
+		return err
+	}
+	a.fileRecords += int64(len(records))
+	a.fileBytes, err = a.fh.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	return a.rotateIfNeeded()
+}
 
-	// For the time being we will just initialize our output file on instantiation and ignore that
-	// there might be any existing files in the output dir.
-	retval.makeFile()
+// encode appends the Avro binary encoding of each of the records to buf.  Records with
+// EncodingAvroBinary are appended as-is, once their schema has been checked against that of the
+// writer, and records with EncodingNone are encoded with the codec of the writer.
+func (a *AvroFileWriter) encode(buf []byte, records []*SerializedRecord) ([]byte, error) {
+	for i, record := range records {
+		switch record.Encoding {
+		case EncodingNone:
+			var err error
+			buf, err = a.codec.BinaryFromNative(buf, record.Record)
+			if err != nil {
+				return buf, fmt.Errorf("%w: %s; index=%d, key=%s", ErrInvalidRecord, err, i, record.Key)
+			}
+		case EncodingAvroBinary:
+			if record.SchemaFingerprint != a.codec.Rabin {
+				return buf, fmt.Errorf(
+					"%w: encoded with a different schema; index=%d, key=%s, fingerprint=%016x",
+					ErrInvalidRecord, i, record.Key, record.SchemaFingerprint)
+			}
+			buf = append(buf, record.Data...)
+		default:
+			return buf, fmt.Errorf(
+				"%w: unsupported encoding; index=%d, key=%s, encoding=%s", ErrInvalidRecord, i, record.Key, record.Encoding)
+		}
+	}
+	return buf, nil
+}
 
-	return retval
+// WriteTombstone persists the deletion of the key to the tombstone file that accompanies the
+// current data file.
+func (a *AvroFileWriter) WriteTombstone(key string, timestamp int64) error {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	if a.tombstoneOcfw == nil {
+		err := a.openTombstoneFile()
+		if err != nil {
+			return err
+		}
+	}
+	values := []map[string]interface{}{
+		{TombstoneFieldKey: key, TombstoneFieldTimestamp: timestamp},
+	}
+	err := a.tombstoneOcfw.Append(values)
+	if err != nil {
+		return appendError(err)
+	}
+	a.fileTombstones++
+	a.tombstoneBytes, err = a.tombstoneFh.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	return a.rotateIfNeeded()
 }
 
-func (a *AvroFileWriter) Write(data interface{}) error {
-	record := data.(map[string]interface{})
-	values := []map[string]interface{}{record}
-	return a.ocfw.Append(values)
+// Sync flushes any buffered records, and then the current data file and its tombstone file if
+// there is one, to disk.
+func (a *AvroFileWriter) Sync() error {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	if a.closed {
+		return nil
+	}
+	err := a.flush()
+	if err != nil {
+		return err
+	}
+	if a.tombstoneFh != nil {
+		err := a.tombstoneFh.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	return a.fh.Sync()
 }
 
-func (a *AvroFileWriter) Shutdown() {
+func (a *AvroFileWriter) Shutdown() error {
 	log.Infof("Serializer shutting down; id=%d", a.id)
-	err := a.fh.Close()
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	if a.closed {
+		return nil
+	}
+	a.closed = true
+	close(a.stop)
+	return a.closeFile()
+}
+
+// runAgeRotation starts a go routine that rotates the current file once it has been open for
+// longer than the MaxAge of the RotationPolicy, regardless of whether any records are being
+// written to it.
+func (a *AvroFileWriter) runAgeRotation() {
+	a.wg.Add(1)
+	// Check at a fraction of the MaxAge so that files are not held open much longer than it.
+	ticker := time.NewTicker(a.rotation.MaxAge / 4)
+	go func() {
+		defer a.wg.Done()
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				a.mux.Lock()
+				numRecords := a.fileRecords + int64(a.pendingRecords) + a.fileTombstones
+				if !a.closed && numRecords > 0 && time.Since(a.fileOpened) >= a.rotation.MaxAge {
+					err := a.rotate()
+					if err != nil {
+						log.Errorf("Unable to rotate file; id=%d, err=%s", a.id, err)
+					}
+				}
+				a.mux.Unlock()
+			case <-a.stop:
+				return
+			case <-a.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// rotateIfNeeded rotates the current file if it has hit any of the limits of the RotationPolicy.
+// Tombstones count towards the limits along with the records.  The caller must hold the mux.
+func (a *AvroFileWriter) rotateIfNeeded() error {
+	numBytes := a.fileBytes + a.tombstoneBytes
+	numRecords := a.fileRecords + a.fileTombstones
+	if a.rotation.shouldRotate(numBytes, numRecords, a.fileOpened) {
+		return a.rotate()
+	}
+	return nil
+}
+
+// rotate closes the current file and opens the next one.  The caller must hold the mux.
+func (a *AvroFileWriter) rotate() error {
+	log.Infof(
+		"Rotating file; id=%d, file=%s, records=%d, bytes=%d",
+		a.id, a.outputFileName, a.fileRecords, a.fileBytes)
+	err := a.closeFile()
 	if err != nil {
-		// FIXME: Refactor this so that we can pass back these errors on a channel.
-		log.Error(err)
+		return err
 	}
+	a.seq++
+	return a.makeFile()
 }
 
-func (a *AvroFileWriter) makeFile() {
-	fh, err := os.Create(a.outputFilePath)
+// checkSchemas verifies that all of the data files in the output dir were written with the same
+// schema as that of this writer.  A file that still has the TmpFileSuffix and whose header cannot
+// be read was left by a previous writer that crashed while writing the header, so it cannot
+// contain any records and is removed.
+func (a *AvroFileWriter) checkSchemas() error {
+	files, err := filepath.Glob(filepath.Join(a.outputDir, "*"+AvroFileExtension))
+	if err != nil {
+		return err
+	}
+	tmpFiles, err := filepath.Glob(filepath.Join(a.outputDir, "*"+AvroFileExtension+TmpFileSuffix))
 	if err != nil {
-		// Not sure if there is any other better way to handle this.  If, given the configs provide
-		// to generate output file paths, we cannot a file and get a file handle, what else is there
-		// that we can do here?
-		panic(err)
+		return err
+	}
+	expected := a.codec.CanonicalSchema()
+	for _, file := range append(files, tmpFiles...) {
+		actual, err := readAvroFileSchema(file)
+		if errors.Is(err, errUnreadableHeader) && strings.HasSuffix(file, TmpFileSuffix) {
+			log.Warnf("Removing file left with a partial header by a previous writer; path=%s, err=%s", file, err)
+			err = os.Remove(file)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if actual != "" && actual != expected {
+			return fmt.Errorf("%w; path=%s", ErrIncompatibleSchema, file)
+		}
+	}
+	return nil
+}
+
+// openInitialFile opens the file to which the writer will write when it is created, continuing
+// the sequence of segments written by any previous writer with the same id.
+func (a *AvroFileWriter) openInitialFile(mode FileMode) error {
+	ours := []Segment{}
+	for _, ext := range []string{AvroFileExtension, TombstoneFileExtension} {
+		segments, err := ListSegments(a.outputDir, ext)
+		if err != nil {
+			return err
+		}
+		for _, segment := range segments {
+			if segment.WriterId == a.id {
+				ours = append(ours, segment)
+			}
+		}
+	}
+	if len(ours) == 0 {
+		return a.makeFile()
+	}
+
+	for _, segment := range ours {
+		if segment.Seq > a.seq {
+			a.seq = segment.Seq
+		}
+	}
+	appending := false
+	tmpPath := filepath.Join(a.outputDir, SegmentFileName(a.id, a.seq, AvroFileExtension)) + TmpFileSuffix
+	if _, err := os.Stat(tmpPath); err == nil && mode == FileModeAppend {
+		err := a.reopenFile()
+		if err == nil {
+			appending = true
+		} else {
+			log.Warnf("Unable to append to existing file, starting a new one; path=%s, err=%s", tmpPath, err)
+		}
+	}
+
+	// Close out any of the remaining segments left open by a previous writer.  If we are appending
+	// to the current data file, we will also continue appending to its tombstone file.
+	for _, segment := range ours {
+		if !segment.Tmp || (appending && segment.Seq == a.seq) {
+			continue
+		}
+		log.Infof("Closing file left open by a previous writer; path=%s", segment.Path)
+		err := renameNoReplace(segment.Path, strings.TrimSuffix(segment.Path, TmpFileSuffix))
+		if err != nil {
+			return err
+		}
+	}
+
+	if appending {
+		return nil
+	}
+	a.seq++
+	return a.makeFile()
+}
+
+// reopenFile opens the existing tmp file for the current sequence number and positions the writer
+// to append to it.
+func (a *AvroFileWriter) reopenFile() error {
+	a.outputFileName = SegmentFileName(a.id, a.seq, AvroFileExtension)
+	a.outputFilePath = filepath.Join(a.outputDir, a.outputFileName)
+	tmpPath := a.outputFilePath + TmpFileSuffix
+	numRecords, err := countAvroRecords(tmpPath)
+	if err != nil {
+		return err
+	}
+	fh, err := os.OpenFile(tmpPath, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	// Given an *os.File with existing data, the ocfWriter reads the existing header and then
+	// advances to the end of the file.
+	ocfw, err := newOCFWriter(fh, a.codec, a.compression, a.level)
+	if err != nil {
+		fh.Close()
+		return err
+	}
+	fileBytes, err := fh.Seek(0, io.SeekCurrent)
+	if err != nil {
+		fh.Close()
+		return err
+	}
+	log.Infof("Appending to existing file; path=%s, records=%d, bytes=%d", tmpPath, numRecords, fileBytes)
+	a.fh = fh
+	a.ocfw = ocfw
+	a.fileOpened = time.Now()
+	a.fileRecords = numRecords
+	a.fileBytes = fileBytes
+	a.resetTombstoneFile()
+	return nil
+}
+
+// makeFile creates the next file in the sequence for this writer.  The file is written with the
+// TmpFileSuffix and is only renamed to its final name when it is closed.
+func (a *AvroFileWriter) makeFile() error {
+	a.outputFileName = SegmentFileName(a.id, a.seq, AvroFileExtension)
+	a.outputFilePath = filepath.Join(a.outputDir, a.outputFileName)
+	// Never truncate an existing file.
+	fh, err := os.OpenFile(a.outputFilePath+TmpFileSuffix, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
 	}
 	a.fh = fh
-	ocfw, err := goavro.NewOCFWriter(goavro.OCFConfig{
-		W:     fh,
-		Codec: a.codec,
-	})
+	ocfw, err := newOCFWriter(fh, a.codec, a.compression, a.level)
 	if err != nil {
-		panic(err)
+		fh.Close()
+		return err
 	}
 	a.ocfw = ocfw
+	a.fileOpened = time.Now()
+	a.fileRecords = 0
+	a.fileBytes = 0
+	a.resetTombstoneFile()
+	return nil
+}
+
+// openTombstoneFile opens the tombstone file for the current sequence number.  If a previous
+// writer left one behind that we are to append to, the ocfWriter will append to it.
+func (a *AvroFileWriter) openTombstoneFile() error {
+	path := filepath.Join(a.outputDir, SegmentFileName(a.id, a.seq, TombstoneFileExtension)) + TmpFileSuffix
+	fh, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	ocfw, err := newOCFWriter(fh, a.tombstoneCodec, a.compression, a.level)
+	if err != nil {
+		fh.Close()
+		return err
+	}
+	tombstoneBytes, err := fh.Seek(0, io.SeekCurrent)
+	if err != nil {
+		fh.Close()
+		return err
+	}
+	a.tombstoneFh = fh
+	a.tombstoneOcfw = ocfw
+	a.tombstoneBytes = tombstoneBytes
+	return nil
+}
+
+func (a *AvroFileWriter) resetTombstoneFile() {
+	a.tombstoneFh = nil
+	a.tombstoneOcfw = nil
+	a.tombstoneBytes = 0
+	a.fileTombstones = 0
+}
+
+// closeFile flushes any buffered records, syncs and closes the current file, and its tombstone file
+// if there is one, and then atomically renames them to their final names.  A data file to which no
+// records were written is removed instead.
+func (a *AvroFileWriter) closeFile() error {
+	err := a.flush()
+	if err != nil {
+		return err
+	}
+	if a.tombstoneFh != nil {
+		tombstonePath := strings.TrimSuffix(a.tombstoneFh.Name(), TmpFileSuffix)
+		err := syncAndClose(a.tombstoneFh)
+		if err != nil {
+			return err
+		}
+		err = renameNoReplace(a.tombstoneFh.Name(), tombstonePath)
+		if err != nil {
+			return err
+		}
+	}
+	tmpPath := a.outputFilePath + TmpFileSuffix
+	err = syncAndClose(a.fh)
+	if err != nil {
+		return err
+	}
+	if a.fileRecords == 0 {
+		err = os.Remove(tmpPath)
+	} else {
+		err = renameNoReplace(tmpPath, a.outputFilePath)
+	}
+	if err != nil {
+		return err
+	}
+	return syncDir(a.outputDir)
+}
+
+func syncAndClose(fh *os.File) error {
+	err := fh.Sync()
+	if err != nil {
+		fh.Close()
+		return err
+	}
+	return fh.Close()
+}
+
+// appendError distinguishes between the errors returned by ocfWriter.Append for records that could
+// not be encoded and for failures to write to the file.  The ocfWriter encodes all of the records
+// before writing anything, and passes back the errors from the file as-is, so anything that is not
+// an error from the file is due to the records.
+func appendError(err error) error {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return err
+	}
+	return fmt.Errorf("%w: %s", ErrInvalidRecord, err)
+}
+
+// readAvroFileSchema returns the canonical form of the schema in the header of the Avro OCF file,
+// or an empty string if the file is empty.
+func readAvroFileSchema(path string) (string, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fh.Close()
+	fi, err := fh.Stat()
+	if err != nil {
+		return "", err
+	}
+	if fi.Size() == 0 {
+		return "", nil
+	}
+	ocfr, err := goavro.NewOCFReader(bufio.NewReader(fh))
+	if err != nil {
+		return "", fmt.Errorf("%w; path=%s, err=%s", errUnreadableHeader, path, err)
+	}
+	return ocfr.Codec().CanonicalSchema(), nil
+}
+
+// countAvroRecords returns the number of records in the Avro OCF file without decoding them.
+func countAvroRecords(path string) (int64, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer fh.Close()
+	ocfr, err := goavro.NewOCFReader(bufio.NewReader(fh))
+	if err != nil {
+		return 0, err
+	}
+	var retval int64
+	for ocfr.Scan() {
+		retval += ocfr.RemainingBlockItems()
+		ocfr.SkipThisBlockAndReset()
+	}
+	return retval, ocfr.Err()
+}
+
+// renameNoReplace renames the file, returning an error rather than replacing the destination if
+// it already exists.
+func renameNoReplace(src, dst string) error {
+	_, err := os.Stat(dst)
+	if err == nil {
+		return fmt.Errorf("unable to rename file, destination already exists; src=%s, dst=%s", src, dst)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return os.Rename(src, dst)
+}
+
+// syncDir fsyncs the directory so that renames of, and new entries in, it are durable.
+func syncDir(dir string) error {
+	dh, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer dh.Close()
+	return dh.Sync()
 }
@@ -11,6 +11,15 @@ const (
 	recordIdKey             = "id"
 	recordTimestampKey      = "collection_time"
 	dirData                 = "data"
+	dirDeadLetters          = "deadletters"
+	dirOverflow             = "overflow"
+	dirJSONLines            = "jsonlines"
+	dirParquet              = "parquet"
+	dirCSV                  = "csv"
+	dirWAL                  = "wal"
+	dirSnapshots            = "snapshots"
+	dirArchive              = "archive"
+	shipperKeyPrefix        = "device-1/"
 	// How many times are we going to concatenate the hex value that we generate from a random
 	// number in our integration_test.getRandomString() function
 	randomStringGenIterations = 16
@@ -0,0 +1,194 @@
+package inttest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	fakeS3Bucket    = "imds-test"
+	fakeS3AccessKey = "test-access-key"
+	fakeS3SecretKey = "test-secret-key"
+)
+
+// fakeS3 is an in-process stand-in for an S3-compatible object store that implements just the
+// multipart upload API used by the shipper.  It checks that each request is signed with the test
+// access key and that the payload hash matches the body, but not the signature itself.
+type fakeS3 struct {
+	server *httptest.Server
+	mux    sync.Mutex
+	// The completed objects, by key.
+	objects map[string][]byte
+	uploads map[string]*fakeS3Upload
+	nextId  int
+	// The number of UploadPart requests that succeeded, by key.
+	partsUploaded map[string]int
+	// If non-negative, every UploadPart request after this many have succeeded fails.
+	failPartsAfter int
+}
+
+type fakeS3Upload struct {
+	key   string
+	parts map[int][]byte
+}
+
+func newFakeS3() *fakeS3 {
+	retval := &fakeS3{
+		objects:        map[string][]byte{},
+		uploads:        map[string]*fakeS3Upload{},
+		partsUploaded:  map[string]int{},
+		failPartsAfter: -1,
+	}
+	retval.server = httptest.NewServer(http.HandlerFunc(retval.handle))
+	return retval
+}
+
+func (f *fakeS3) url() string {
+	return f.server.URL
+}
+
+func (f *fakeS3) close() {
+	f.server.Close()
+}
+
+func (f *fakeS3) setFailPartsAfter(n int) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.failPartsAfter = n
+}
+
+func (f *fakeS3) getObject(key string) ([]byte, bool) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	data, ok := f.objects[key]
+	return data, ok
+}
+
+func (f *fakeS3) numObjects() int {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return len(f.objects)
+}
+
+func (f *fakeS3) getPartsUploaded(key string) int {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.partsUploaded[key]
+}
+
+func (f *fakeS3) handle(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		fakeS3Error(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential="+fakeS3AccessKey+"/") {
+		fakeS3Error(w, http.StatusForbidden, "InvalidAccessKeyId", "unexpected authorization")
+		return
+	}
+	hash := sha256.Sum256(body)
+	if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(hash[:]) {
+		fakeS3Error(w, http.StatusBadRequest, "XAmzContentSHA256Mismatch", "payload hash mismatch")
+		return
+	}
+	prefix := "/" + fakeS3Bucket + "/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		fakeS3Error(w, http.StatusNotFound, "NoSuchBucket", r.URL.Path)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, prefix)
+	query := r.URL.Query()
+
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	_, initiate := query["uploads"]
+	uploadId := query.Get("uploadId")
+	switch {
+	case r.Method == http.MethodPost && initiate:
+		f.nextId++
+		uploadId := fmt.Sprintf("upload-%d", f.nextId)
+		f.uploads[uploadId] = &fakeS3Upload{key: key, parts: map[int][]byte{}}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><UploadId>%s</UploadId>"+
+			"</InitiateMultipartUploadResult>", fakeS3Bucket, key, uploadId)
+	case r.Method == http.MethodPut && uploadId != "":
+		upload, ok := f.uploads[uploadId]
+		if !ok || upload.key != key {
+			fakeS3Error(w, http.StatusNotFound, "NoSuchUpload", uploadId)
+			return
+		}
+		total := 0
+		for _, n := range f.partsUploaded {
+			total += n
+		}
+		if f.failPartsAfter >= 0 && total >= f.failPartsAfter {
+			fakeS3Error(w, http.StatusInternalServerError, "InternalError", "injected failure")
+			return
+		}
+		partNumber, err := strconv.Atoi(query.Get("partNumber"))
+		if err != nil {
+			fakeS3Error(w, http.StatusBadRequest, "InvalidArgument", err.Error())
+			return
+		}
+		upload.parts[partNumber] = body
+		f.partsUploaded[key]++
+		w.Header().Set("ETag", fmt.Sprintf("\"%s-%d\"", uploadId, partNumber))
+	case r.Method == http.MethodPost && uploadId != "":
+		upload, ok := f.uploads[uploadId]
+		if !ok || upload.key != key {
+			fakeS3Error(w, http.StatusNotFound, "NoSuchUpload", uploadId)
+			return
+		}
+		complete := struct {
+			Parts []struct {
+				PartNumber int
+				ETag       string
+			} `xml:"Part"`
+		}{}
+		if err := xml.Unmarshal(body, &complete); err != nil {
+			fakeS3Error(w, http.StatusBadRequest, "MalformedXML", err.Error())
+			return
+		}
+		numbers := []int{}
+		for _, part := range complete.Parts {
+			if part.ETag != fmt.Sprintf("\"%s-%d\"", uploadId, part.PartNumber) {
+				fakeS3Error(w, http.StatusBadRequest, "InvalidPart", part.ETag)
+				return
+			}
+			numbers = append(numbers, part.PartNumber)
+		}
+		if !sort.IntsAreSorted(numbers) || len(numbers) != len(upload.parts) {
+			fakeS3Error(w, http.StatusBadRequest, "InvalidPartOrder", fmt.Sprint(numbers))
+			return
+		}
+		data := []byte{}
+		for _, number := range numbers {
+			data = append(data, upload.parts[number]...)
+		}
+		f.objects[key] = data
+		delete(f.uploads, uploadId)
+		fmt.Fprintf(w, "<CompleteMultipartUploadResult><Key>%s</Key></CompleteMultipartUploadResult>", key)
+	case r.Method == http.MethodDelete && uploadId != "":
+		if _, ok := f.uploads[uploadId]; !ok {
+			fakeS3Error(w, http.StatusNotFound, "NoSuchUpload", uploadId)
+			return
+		}
+		delete(f.uploads, uploadId)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		fakeS3Error(w, http.StatusNotImplemented, "NotImplemented", r.Method+" "+r.URL.String())
+	}
+}
+
+func fakeS3Error(w http.ResponseWriter, status int, code, message string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message><RequestId>fake</RequestId></Error>", code, message)
+}
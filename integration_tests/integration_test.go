@@ -1,13 +1,25 @@
 package inttest
 
 import (
+	"bufio"
+	"compress/flate"
 	"context"
+	"encoding/csv"
 	"fmt"
+	"math"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
+	"time"
 
+	"github.com/linkedin/goavro/v2"
 	"github.com/rchapin/go-in-mem-datastore/inmemdatastore"
 	"github.com/rchapin/go-in-mem-datastore/utils"
 	log "github.com/rchapin/rlog"
@@ -19,7 +31,7 @@ var rm *ResourceManager
 // Setup and Teardown functions ------------------------------------------------
 
 func setupSignalHandler(cancel context.CancelFunc) {
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		signal := <-c
@@ -143,6 +155,2825 @@ func TestWriteRecords(t *testing.T) {
 	printStats(tr)
 }
 
+// TestRecovery tests that a newly started IMDS is pre-populated with the most recent record for
+// each key from the data files persisted by a previous IMDS instance.
+func TestRecovery(t *testing.T) {
+	utils.SetupLogging("debug")
+	setUpSubTest()
+	startTimestamp := int64(1647106627392928613)
+	writerRecSpecs := []RecordSpec{
+		{Id: "sensor101", CollectionTime: startTimestamp},
+		{Id: "sensor101", CollectionTime: startTimestamp + 100},
+		{Id: "sensor101", CollectionTime: startTimestamp + 50},
+		{Id: "sensor201", CollectionTime: startTimestamp + 10},
+	}
+	testRecords := map[int][]map[string]interface{}{
+		0: generateRecordsFromRecordSpecs(writerRecSpecs, rm.avroNumMetricDblFields, rm.avroNumMetricStrFields),
+	}
+	expectedCachedRecSpecs := []RecordSpec{writerRecSpecs[1], writerRecSpecs[3]}
+
+	trCfg := TRConfig{
+		mode:                    SpecificRecords,
+		specificRecords:         testRecords,
+		persistenceChanBuffSize: 1024,
+		testWriterSleepTime:     2,
+		numPersisters:           2,
+		numDatastoreShards:      2,
+		testReaderSleepTime:     5,
+		schema:                  rm.avroSchemaString,
+		outputDirPath:           rm.testDirs[dirData],
+		keySpace:                []string{"sensor101", "sensor201"},
+		numDblFields:            rm.avroNumMetricDblFields,
+		numStrFields:            rm.avroNumMetricStrFields,
+	}
+	tr := NewTestRunner(rm.testRunnerCtx, rm.testRunnerCancel, rm.testRunnerWg, trCfg)
+	tr.RunTest()
+
+	// Start up a new IMDS, without any Persisters, that reads the data written by the first.
+	rm.refreshContextsWg()
+	imds := inmemdatastore.NewInMemDatastore(
+		rm.testRunnerCtx,
+		rm.testRunnerCancel,
+		&sync.WaitGroup{},
+		inmemdatastore.Config{
+			NumDatastoreShards: 4,
+			PersistenceChan:    make(inmemdatastore.PersistenceChan, 1),
+			RecordTimestampKey: recordTimestampKey,
+			RecordIdKey:        recordIdKey,
+			DataDir:            rm.testDirs[dirData],
+			Persisters:         inmemdatastore.Persisters{},
+		},
+	)
+	err := imds.Start()
+	assert.NoError(t, err)
+	defer imds.Shutdown()
+
+	stats := imds.GetRecoveryStats()
+	assert.Equal(t, int64(len(writerRecSpecs)), stats.RecordsRead)
+	assert.Equal(t, int64(0), stats.RecordsInvalid)
+	validateCachedData(t, imds, expectedCachedRecSpecs)
+	validateShardKeys(t, imds)
+}
+
+// TestRotation tests that the IMDS writers rotate their data files based on the configured
+// RotationPolicy and that all of the records are persisted across the rotated files.
+func TestRotation(t *testing.T) {
+	utils.SetupLogging("debug")
+	setUpSubTest()
+	startTimestamp := int64(1647106627392928613)
+	writerRecSpecs := []RecordSpec{}
+	for i := 0; i < 5; i++ {
+		writerRecSpecs = append(writerRecSpecs, RecordSpec{Id: "sensor101", CollectionTime: startTimestamp + int64(i)})
+	}
+	testRecords := map[int][]map[string]interface{}{
+		0: generateRecordsFromRecordSpecs(writerRecSpecs, rm.avroNumMetricDblFields, rm.avroNumMetricStrFields),
+	}
+
+	trCfg := TRConfig{
+		mode:                    SpecificRecords,
+		specificRecords:         testRecords,
+		persistenceChanBuffSize: 1024,
+		testWriterSleepTime:     2,
+		numPersisters:           1,
+		numDatastoreShards:      2,
+		testReaderSleepTime:     5,
+		schema:                  rm.avroSchemaString,
+		outputDirPath:           rm.testDirs[dirData],
+		rotation:                inmemdatastore.RotationPolicy{MaxRecords: 2},
+		keySpace:                []string{"sensor101"},
+		numDblFields:            rm.avroNumMetricDblFields,
+		numStrFields:            rm.avroNumMetricStrFields,
+	}
+	tr := NewTestRunner(rm.testRunnerCtx, rm.testRunnerCancel, rm.testRunnerWg, trCfg)
+	tr.RunTest()
+
+	// We expect two full files, one with the remaining record and none left with the tmp suffix.
+	files, err := filepath.Glob(filepath.Join(rm.testDirs[dirData], "*"))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(files))
+	for _, file := range files {
+		assert.False(t, strings.HasSuffix(file, inmemdatastore.TmpFileSuffix))
+	}
+	validatePersistedData(t, tr.imds, writerRecSpecs)
+}
+
+// TestRestart tests that starting a new IMDS on the output dir of a previous one does not truncate
+// or overwrite any of the data that it persisted.
+func TestRestart(t *testing.T) {
+	utils.SetupLogging("debug")
+	setUpSubTest()
+	startTimestamp := int64(1647106627392928613)
+	firstRecSpecs := []RecordSpec{
+		{Id: "sensor101", CollectionTime: startTimestamp},
+		{Id: "sensor201", CollectionTime: startTimestamp},
+	}
+	secondRecSpecs := []RecordSpec{
+		{Id: "sensor101", CollectionTime: startTimestamp + 100},
+		{Id: "sensor201", CollectionTime: startTimestamp - 100},
+	}
+
+	for _, recSpecs := range [][]RecordSpec{firstRecSpecs, secondRecSpecs} {
+		rm.refreshContextsWg()
+		trCfg := TRConfig{
+			mode: SpecificRecords,
+			specificRecords: map[int][]map[string]interface{}{
+				0: generateRecordsFromRecordSpecs(recSpecs, rm.avroNumMetricDblFields, rm.avroNumMetricStrFields),
+			},
+			persistenceChanBuffSize: 1024,
+			testWriterSleepTime:     2,
+			numPersisters:           2,
+			numDatastoreShards:      2,
+			testReaderSleepTime:     5,
+			schema:                  rm.avroSchemaString,
+			outputDirPath:           rm.testDirs[dirData],
+			keySpace:                []string{"sensor101", "sensor201"},
+			numDblFields:            rm.avroNumMetricDblFields,
+			numStrFields:            rm.avroNumMetricStrFields,
+		}
+		tr := NewTestRunner(rm.testRunnerCtx, rm.testRunnerCancel, rm.testRunnerWg, trCfg)
+		tr.RunTest()
+		if t.Failed() {
+			return
+		}
+		// The second IMDS should have recovered the records from the first and only replaced the
+		// ones for which it was given newer records.
+		if recSpecs[0] == secondRecSpecs[0] {
+			validateCachedData(t, tr.imds, []RecordSpec{secondRecSpecs[0], firstRecSpecs[1]})
+		}
+	}
+
+	validatePersistedData(t, nil, append(firstRecSpecs, secondRecSpecs...))
+}
+
+// TestIncompatibleSchema tests that a writer cannot be created for an output dir that contains
+// data files written with a different schema.
+func TestIncompatibleSchema(t *testing.T) {
+	utils.SetupLogging("debug")
+	setUpSubTest()
+	otherSchema := `{"type": "record", "name": "other", "fields": [{"name": "id", "type": "string"}]}`
+	writer, err := inmemdatastore.NewAvroFileWriter(
+		rm.testRunnerCtx,
+		rm.testRunnerWg,
+		inmemdatastore.AvroFileWriterConfig{Id: 0, AvroSchema: otherSchema, OutputDir: rm.testDirs[dirData]},
+	)
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Write(&inmemdatastore.SerializedRecord{
+		Key:    "sensor101",
+		Record: map[string]interface{}{"id": "sensor101"},
+	}))
+	writer.Shutdown()
+
+	_, err = inmemdatastore.NewAvroFileWriter(
+		rm.testRunnerCtx,
+		rm.testRunnerWg,
+		inmemdatastore.AvroFileWriterConfig{Id: 1, AvroSchema: rm.avroSchemaString, OutputDir: rm.testDirs[dirData]},
+	)
+	assert.ErrorIs(t, err, inmemdatastore.ErrIncompatibleSchema)
+}
+
+// TestPartialHeader tests that a data file left with a partially written header by a writer that
+// crashed does not prevent a new writer from being created, and that it is removed.
+func TestPartialHeader(t *testing.T) {
+	utils.SetupLogging("debug")
+	setUpSubTest()
+	writer, err := inmemdatastore.NewAvroFileWriter(
+		rm.testRunnerCtx,
+		rm.testRunnerWg,
+		inmemdatastore.AvroFileWriterConfig{Id: 0, AvroSchema: rm.avroSchemaString, OutputDir: rm.testDirs[dirData]},
+	)
+	assert.NoError(t, err)
+	recSpec := RecordSpec{Id: "sensor101", CollectionTime: 1647106627392928613}
+	record := generateRecordsFromRecordSpecs([]RecordSpec{recSpec}, rm.avroNumMetricDblFields, rm.avroNumMetricStrFields)[0]
+	assert.NoError(t, writer.Write(&inmemdatastore.SerializedRecord{Key: recSpec.Id, Record: record}))
+	assert.NoError(t, writer.Shutdown())
+	segments, err := inmemdatastore.ListSegments(rm.testDirs[dirData], inmemdatastore.AvroFileExtension)
+	assert.NoError(t, err)
+	assert.Len(t, segments, 1)
+	data, err := os.ReadFile(segments[0].Path)
+	assert.NoError(t, err)
+
+	// Truncate a copy of the file part way through the schema in its header, as if the writer
+	// crashed while writing it.
+	partialPath := filepath.Join(
+		rm.testDirs[dirData],
+		inmemdatastore.SegmentFileName(0, segments[0].Seq+1, inmemdatastore.AvroFileExtension)+inmemdatastore.TmpFileSuffix,
+	)
+	assert.NoError(t, os.WriteFile(partialPath, data[:len(rm.avroSchemaString)/2], 0o644))
+	writer, err = inmemdatastore.NewAvroFileWriter(
+		rm.testRunnerCtx,
+		rm.testRunnerWg,
+		inmemdatastore.AvroFileWriterConfig{
+			Id:         0,
+			AvroSchema: rm.avroSchemaString,
+			OutputDir:  rm.testDirs[dirData],
+			Mode:       inmemdatastore.FileModeAppend,
+		},
+	)
+	assert.NoError(t, err)
+	// The new writer starts its own file in place of the partial one.
+	assert.NoError(t, writer.Shutdown())
+	assert.NoFileExists(t, partialPath)
+	validatePersistedData(t, nil, []RecordSpec{recSpec})
+}
+
+// TestDelete tests that a deleted key is removed from the IMDS, that a record older than the delete
+// does not resurrect it, and that the delete is persisted and applied on recovery.
+func TestDelete(t *testing.T) {
+	utils.SetupLogging("debug")
+	setUpSubTest()
+	startTimestamp := int64(1647106627392928613)
+	recSpecs := []RecordSpec{
+		{Id: "sensor101", CollectionTime: startTimestamp},
+		{Id: "sensor101", CollectionTime: startTimestamp + 50},
+		{Id: "sensor201", CollectionTime: startTimestamp},
+	}
+	records := generateRecordsFromRecordSpecs(recSpecs, rm.avroNumMetricDblFields, rm.avroNumMetricStrFields)
+
+	trCfg := TRConfig{
+		numPersisters:      2,
+		numDatastoreShards: 2,
+		schema:             rm.avroSchemaString,
+		outputDirPath:      rm.testDirs[dirData],
+	}
+	for i := 0; i < 2; i++ {
+		rm.refreshContextsWg()
+		imdsWg := &sync.WaitGroup{}
+		imds := initTestOut(rm.testRunnerCtx, rm.testRunnerCancel, trCfg, imdsWg)
+		assert.NoError(t, imds.Start())
+		if i == 0 {
+			_, err := imds.Put(recSpecs[0].Id, records[0])
+			assert.NoError(t, err)
+			assert.NoError(t, imds.Delete(recSpecs[0].Id, startTimestamp+100))
+			// This record is older than the delete and should not be written to the cache.
+			_, err = imds.Put(recSpecs[1].Id, records[1])
+			assert.NoError(t, err)
+			_, err = imds.Put(recSpecs[2].Id, records[2])
+			assert.NoError(t, err)
+		} else {
+			// The second IMDS should have recovered the same state as the first.
+			stats := imds.GetRecoveryStats()
+			assert.Equal(t, int64(3), stats.RecordsRead)
+			assert.Equal(t, int64(1), stats.TombstonesRead)
+		}
+		rec, err := imds.Get(recSpecs[0].Id)
+		assert.NoError(t, err)
+		assert.Nil(t, rec)
+		validateCachedData(t, imds, []RecordSpec{recSpecs[2]})
+		rm.testRunnerCancel()
+		imds.Shutdown()
+		imdsWg.Wait()
+	}
+	validatePersistedData(t, nil, recSpecs)
+}
+
+// TestDeleteWithoutTimestamp tests that a record without a timestamp, which cannot be ordered against
+// a delete, is not written over the tombstone for its key, and that the same holds after a restart
+// and after the data files are compacted.
+func TestDeleteWithoutTimestamp(t *testing.T) {
+	utils.SetupLogging("debug")
+	setUpSubTest()
+	startTimestamp := int64(1647106627392928613)
+	recSpecs := []RecordSpec{
+		{Id: "sensor101", CollectionTime: startTimestamp},
+		{Id: "sensor101", CollectionTime: startTimestamp + 50},
+		{Id: "sensor201", CollectionTime: startTimestamp},
+	}
+	records := generateRecordsFromRecordSpecs(recSpecs, rm.avroNumMetricDblFields, rm.avroNumMetricStrFields)
+
+	trCfg := TRConfig{
+		numPersisters:      2,
+		numDatastoreShards: 2,
+		schema:             rm.avroSchemaString,
+		outputDirPath:      rm.testDirs[dirData],
+		rotation:           inmemdatastore.RotationPolicy{MaxRecords: 1},
+		// None of the records have this key, so none of them have a timestamp, and are instead
+		// ordered by when they are Put.
+		recordTimestampKey: "event_time",
+		resolver: inmemdatastore.ResolverFunc(func(existing, incoming map[string]interface{}) (inmemdatastore.Resolution, error) {
+			return inmemdatastore.ResolutionApplied, nil
+		}),
+	}
+	for i := 0; i < 3; i++ {
+		rm.refreshContextsWg()
+		imdsWg := &sync.WaitGroup{}
+		imds := initTestOut(rm.testRunnerCtx, rm.testRunnerCancel, trCfg, imdsWg)
+		assert.NoError(t, imds.Start())
+		switch i {
+		case 0:
+			_, err := imds.PutSync(context.Background(), recSpecs[0].Id, records[0])
+			assert.NoError(t, err)
+			assert.NoError(t, imds.Delete(recSpecs[0].Id, startTimestamp+100))
+			result, err := imds.PutSync(context.Background(), recSpecs[1].Id, records[1])
+			assert.NoError(t, err)
+			assert.Equal(t, inmemdatastore.PutStaleSkipped, result.Outcome)
+			_, err = imds.PutSync(context.Background(), recSpecs[2].Id, records[2])
+			assert.NoError(t, err)
+		case 1:
+			// Both of the records for the deleted key were persisted and are removed by the tombstone
+			// on recovery, as they are by compaction.
+			assert.Equal(t, int64(3), imds.GetRecoveryStats().RecordsRead)
+			stats, err := imds.Compact()
+			assert.NoError(t, err)
+			compacted, _ := loadAvroRecords(stats.Path, false)
+			assert.Equal(t, 1, len(compacted))
+			assert.Equal(t, recSpecs[2].Id, compacted[0][avroFieldId])
+		}
+		rec, err := imds.Get(recSpecs[0].Id)
+		assert.NoError(t, err)
+		assert.Nil(t, rec)
+		validateCachedData(t, imds, []RecordSpec{recSpecs[2]})
+		rm.testRunnerCancel()
+		imds.Shutdown()
+		imdsWg.Wait()
+	}
+}
+
+// TestTombstoneTTL tests that tombstones are evicted from the IMDS once their TombstoneTTL has
+// passed, after which a record older than the delete is written again.
+func TestTombstoneTTL(t *testing.T) {
+	utils.SetupLogging("debug")
+	setUpSubTest()
+	now := time.Now().UTC().UnixNano()
+	recSpecs := []RecordSpec{
+		{Id: "sensor101", CollectionTime: now - int64(2*time.Hour)},
+		{Id: "sensor201", CollectionTime: now - int64(2*time.Hour)},
+	}
+	records := generateRecordsFromRecordSpecs(recSpecs, rm.avroNumMetricDblFields, rm.avroNumMetricStrFields)
+
+	imds := inmemdatastore.NewInMemDatastore(
+		rm.testRunnerCtx,
+		rm.testRunnerCancel,
+		&sync.WaitGroup{},
+		inmemdatastore.Config{
+			NumDatastoreShards: 2,
+			PersistenceChan:    make(inmemdatastore.PersistenceChan, 8),
+			RecordTimestampKey: recordTimestampKey,
+			Persisters:         inmemdatastore.Persisters{},
+			TombstoneTTL:       time.Hour,
+			TTLSweepInterval:   10 * time.Millisecond,
+		},
+	)
+	assert.NoError(t, imds.Start())
+	defer imds.Shutdown()
+	// The first delete is already older than the TombstoneTTL, the second is not.
+	assert.NoError(t, imds.Delete(recSpecs[0].Id, now-int64(90*time.Minute)))
+	assert.NoError(t, imds.Delete(recSpecs[1].Id, now))
+	assert.Eventually(t, func() bool {
+		return imds.Stats().Totals.NumTombstonesEvicted == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1, imds.Stats().Totals.NumTombstones)
+
+	result, err := imds.Put(recSpecs[0].Id, records[0])
+	assert.NoError(t, err)
+	assert.Equal(t, inmemdatastore.PutInserted, result.Outcome)
+	result, err = imds.Put(recSpecs[1].Id, records[1])
+	assert.NoError(t, err)
+	assert.Equal(t, inmemdatastore.PutStaleSkipped, result.Outcome)
+	validateCachedData(t, imds, []RecordSpec{recSpecs[0]})
+}
+
+// TestTTL tests that records are evicted from the IMDS once their TTL expires, measured against both
+// the wall clock and the timestamp of the record, and that an expiry event is emitted for each.
+func TestTTL(t *testing.T) {
+	utils.SetupLogging("debug")
+	setUpSubTest()
+	now := time.Now().UTC().UnixNano()
+	recSpecs := []RecordSpec{
+		{Id: "sensor101", CollectionTime: now},
+		{Id: "sensor201", CollectionTime: now},
+		{Id: "sensor301", CollectionTime: now - int64(2*time.Hour)},
+	}
+	records := generateRecordsFromRecordSpecs(recSpecs, rm.avroNumMetricDblFields, rm.avroNumMetricStrFields)
+
+	for _, ttlMode := range []inmemdatastore.TTLMode{inmemdatastore.TTLModeWallClock, inmemdatastore.TTLModeRecordTimestamp} {
+		expiryChan := make(inmemdatastore.ExpiryChan, 8)
+		ttl := 50 * time.Millisecond
+		if ttlMode == inmemdatastore.TTLModeRecordTimestamp {
+			ttl = time.Hour
+		}
+		imds := inmemdatastore.NewInMemDatastore(
+			rm.testRunnerCtx,
+			rm.testRunnerCancel,
+			&sync.WaitGroup{},
+			inmemdatastore.Config{
+				NumDatastoreShards: 2,
+				PersistenceChan:    make(inmemdatastore.PersistenceChan, 8),
+				RecordTimestampKey: recordTimestampKey,
+				Persisters:         inmemdatastore.Persisters{},
+				TTL:                ttl,
+				TTLMode:            ttlMode,
+				TTLSweepInterval:   10 * time.Millisecond,
+				ExpiryChan:         expiryChan,
+			},
+		)
+		assert.NoError(t, imds.Start())
+		// Overrides the TTL so that it never expires.
+		_, err := imds.PutWithTTL(recSpecs[1].Id, records[1], 0)
+		assert.NoError(t, err)
+		var expectedKey string
+		if ttlMode == inmemdatastore.TTLModeWallClock {
+			_, err = imds.Put(recSpecs[0].Id, records[0])
+			assert.NoError(t, err)
+			expectedKey = recSpecs[0].Id
+		} else {
+			// Already older than the TTL when measured against the timestamp of the record.
+			_, err = imds.Put(recSpecs[2].Id, records[2])
+			assert.NoError(t, err)
+			expectedKey = recSpecs[2].Id
+		}
+		select {
+		case event := <-expiryChan:
+			assert.Equal(t, expectedKey, event.Key)
+			assert.NotNil(t, event.Record)
+		case <-time.After(5 * time.Second):
+			assert.Fail(t, "timed out waiting for expiry event")
+		}
+		rec, err := imds.Get(expectedKey)
+		assert.NoError(t, err)
+		assert.Nil(t, rec)
+		validateCachedData(t, imds, []RecordSpec{recSpecs[1]})
+		imds.Shutdown()
+	}
+}
+
+// TestTTLRecovery tests that a record replayed from the write-ahead log, or loaded from a snapshot,
+// expires at the deadline with which it was written, rather than its TTL starting again.
+func TestTTLRecovery(t *testing.T) {
+	utils.SetupLogging("debug")
+	now := time.Now().UTC().UnixNano()
+	recSpecs := []RecordSpec{
+		{Id: "sensor101", CollectionTime: now},
+		{Id: "sensor201", CollectionTime: now},
+	}
+	records := generateRecordsFromRecordSpecs(recSpecs, rm.avroNumMetricDblFields, rm.avroNumMetricStrFields)
+
+	for _, source := range []string{"WAL", "Snapshot"} {
+		t.Run(source, func(t *testing.T) {
+			setUpSubTest()
+			cfg := inmemdatastore.Config{
+				NumDatastoreShards: 2,
+				RecordTimestampKey: recordTimestampKey,
+				Persisters:         inmemdatastore.Persisters{},
+				TTLSweepInterval:   10 * time.Millisecond,
+				SnapshotInterval:   time.Hour,
+			}
+			if source == "WAL" {
+				cfg.WALDir = rm.testDirs[dirWAL]
+			} else {
+				cfg.SnapshotDir = rm.testDirs[dirSnapshots]
+			}
+			newIMDS := func() *inmemdatastore.InMemDataStore {
+				cfg.PersistenceChan = make(inmemdatastore.PersistenceChan, 8)
+				return inmemdatastore.NewInMemDatastore(rm.testRunnerCtx, rm.testRunnerCancel, &sync.WaitGroup{}, cfg)
+			}
+			imds := newIMDS()
+			assert.NoError(t, imds.Start())
+			ttl := time.Second
+			_, err := imds.PutWithTTL(recSpecs[0].Id, records[0], ttl)
+			assert.NoError(t, err)
+			_, err = imds.Put(recSpecs[1].Id, records[1])
+			assert.NoError(t, err)
+			expires := time.Now().Add(ttl)
+			if source == "Snapshot" {
+				_, err := imds.WriteSnapshot()
+				assert.NoError(t, err)
+			}
+			imds.Shutdown()
+
+			// Restart most of the way through the TTL, had it started again the record would be
+			// kept for another whole TTL.
+			time.Sleep(time.Until(expires) - 200*time.Millisecond)
+			imds = newIMDS()
+			assert.NoError(t, imds.Start())
+			defer imds.Shutdown()
+			validateCachedData(t, imds, recSpecs)
+			assert.Eventually(t, func() bool {
+				rec, err := imds.Get(recSpecs[0].Id)
+				return err == nil && rec == nil
+			}, 700*time.Millisecond, 10*time.Millisecond)
+			validateCachedData(t, imds, []RecordSpec{recSpecs[1]})
+		})
+	}
+}
+
+// TestPutSync tests that PutSync only returns once the record has been persisted and that it
+// returns any error encountered while persisting it.
+func TestPutSync(t *testing.T) {
+	utils.SetupLogging("debug")
+	setUpSubTest()
+	startTimestamp := int64(1647106627392928613)
+	recSpecs := []RecordSpec{{Id: "sensor101", CollectionTime: startTimestamp}}
+	records := generateRecordsFromRecordSpecs(recSpecs, rm.avroNumMetricDblFields, rm.avroNumMetricStrFields)
+
+	trCfg := TRConfig{
+		numPersisters:      2,
+		numDatastoreShards: 2,
+		schema:             rm.avroSchemaString,
+		outputDirPath:      rm.testDirs[dirData],
+	}
+	imdsWg := &sync.WaitGroup{}
+	imds := initTestOut(rm.testRunnerCtx, rm.testRunnerCancel, trCfg, imdsWg)
+	assert.NoError(t, imds.Start())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := imds.PutSync(ctx, recSpecs[0].Id, records[0])
+	assert.NoError(t, err)
+
+	// A record that does not match the schema cannot be persisted.
+	invalidRecord := map[string]interface{}{avroFieldId: "sensor201", avroFieldCollectionTime: startTimestamp}
+	_, err = imds.PutSync(ctx, "sensor201", invalidRecord)
+	assert.Error(t, err)
+
+	rm.testRunnerCancel()
+	imds.Shutdown()
+	imdsWg.Wait()
+	validatePersistedData(t, nil, recSpecs)
+}
+
+// TestPersisterErrors tests that a record that cannot be persisted is reported on the error channel
+// of the IMDS, rather than causing a panic, and that once it has been dropped it is released from
+// the write-ahead log.
+func TestPersisterErrors(t *testing.T) {
+	utils.SetupLogging("debug")
+	setUpSubTest()
+	startTimestamp := int64(1647106627392928613)
+	errorChan := make(inmemdatastore.PersisterErrorChan, 8)
+	trCfg := TRConfig{
+		numPersisters:         1,
+		numDatastoreShards:    2,
+		schema:                rm.avroSchemaString,
+		outputDirPath:         rm.testDirs[dirData],
+		walDirPath:            rm.testDirs[dirWAL],
+		walCheckpointInterval: 10 * time.Millisecond,
+		failurePolicy:         inmemdatastore.FailurePolicyRetry,
+		retry:                 inmemdatastore.RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond},
+		errorChan:             errorChan,
+	}
+	imdsWg := &sync.WaitGroup{}
+	imds := initTestOut(rm.testRunnerCtx, rm.testRunnerCancel, trCfg, imdsWg)
+	assert.NoError(t, imds.Start())
+
+	// A record that does not match the schema cannot be persisted.
+	invalidRecord := map[string]interface{}{avroFieldId: "sensor201", avroFieldCollectionTime: startTimestamp}
+	_, err := imds.Put("sensor201", invalidRecord)
+	assert.NoError(t, err)
+	select {
+	case perr := <-imds.Errors():
+		assert.Equal(t, "sensor201", perr.Key)
+		assert.Equal(t, 0, perr.PersisterId)
+		// Records that do not match the schema are never retried.
+		assert.Equal(t, 1, perr.Attempts)
+		assert.ErrorIs(t, perr.Err, inmemdatastore.ErrInvalidRecord)
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "timed out waiting for persister error")
+	}
+	// Without a DeadLetterWriter the record is dropped, which releases it from the write-ahead log,
+	// so the checkpointer removes its segment.
+	assert.Eventually(t, func() bool {
+		return imds.PersistenceStats().Dropped == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		segments, err := inmemdatastore.ListSegments(rm.testDirs[dirWAL], inmemdatastore.WALFileExtension)
+		return err == nil && len(segments) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	rm.testRunnerCancel()
+	imds.Shutdown()
+	imdsWg.Wait()
+	validatePersistedData(t, nil, []RecordSpec{})
+}
+
+// TestDeadLetters tests that a record that does not match the schema is written to the dead letter
+// file and that it can be read back and replayed.
+func TestDeadLetters(t *testing.T) {
+	utils.SetupLogging("debug")
+	setUpSubTest()
+	startTimestamp := int64(1647106627392928613)
+	trCfg := TRConfig{
+		numPersisters:      1,
+		numDatastoreShards: 2,
+		schema:             rm.avroSchemaString,
+		outputDirPath:      rm.testDirs[dirData],
+		walDirPath:         rm.testDirs[dirWAL],
+		failurePolicy:      inmemdatastore.FailurePolicyRetry,
+		deadLetterDirPath:  rm.testDirs[dirDeadLetters],
+	}
+	imdsWg := &sync.WaitGroup{}
+	imds := initTestOut(rm.testRunnerCtx, rm.testRunnerCancel, trCfg, imdsWg)
+	assert.NoError(t, imds.Start())
+	invalidRecord := map[string]interface{}{avroFieldId: "sensor201", avroFieldCollectionTime: startTimestamp}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// The record is invalid, so it should not have been retried before being routed to the dead
+	// letter file.
+	_, err := imds.PutSync(ctx, "sensor201", invalidRecord)
+	assert.ErrorIs(t, err, inmemdatastore.ErrInvalidRecord)
+	rm.testRunnerCancel()
+	imds.Shutdown()
+	imdsWg.Wait()
+	// The record was written to the dead letter file, so it was released from the write-ahead log.
+	segments, err := inmemdatastore.ListSegments(rm.testDirs[dirWAL], inmemdatastore.WALFileExtension)
+	assert.NoError(t, err)
+	assert.Empty(t, segments)
+
+	path := filepath.Join(rm.testDirs[dirDeadLetters], "0"+inmemdatastore.DeadLetterFileExtension)
+	deadLetters := []*inmemdatastore.DeadLetter{}
+	err = inmemdatastore.ReadDeadLetters(path, func(deadLetter *inmemdatastore.DeadLetter) error {
+		deadLetters = append(deadLetters, deadLetter)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(deadLetters))
+	assert.Equal(t, "sensor201", deadLetters[0].Key)
+	assert.Equal(t, 0, deadLetters[0].PersisterId)
+	assert.NotEmpty(t, deadLetters[0].Error)
+	assert.Equal(t, invalidRecord, deadLetters[0].Record)
+
+	// Replay the dead letters into a new IMDS.
+	rm.refreshContextsWg()
+	imds = inmemdatastore.NewInMemDatastore(
+		rm.testRunnerCtx,
+		rm.testRunnerCancel,
+		&sync.WaitGroup{},
+		inmemdatastore.Config{
+			NumDatastoreShards: 2,
+			PersistenceChan:    make(inmemdatastore.PersistenceChan, 8),
+			RecordTimestampKey: recordTimestampKey,
+			Persisters:         inmemdatastore.Persisters{},
+		},
+	)
+	assert.NoError(t, imds.Start())
+	count, err := imds.ReplayDeadLetters(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	validateCachedData(t, imds, []RecordSpec{{Id: "sensor201", CollectionTime: startTimestamp}})
+	imds.Shutdown()
+}
+
+// TestBackpressure tests each of the BackpressurePolicies with a PersistenceChan that is not being
+// drained by any Persisters.
+func TestBackpressure(t *testing.T) {
+	utils.SetupLogging("debug")
+	startTimestamp := int64(1647106627392928613)
+	newIMDS := func(policy inmemdatastore.BackpressurePolicy, persistenceChan inmemdatastore.PersistenceChan) *inmemdatastore.InMemDataStore {
+		rm.refreshContextsWg()
+		return inmemdatastore.NewInMemDatastore(
+			rm.testRunnerCtx,
+			rm.testRunnerCancel,
+			&sync.WaitGroup{},
+			inmemdatastore.Config{
+				NumDatastoreShards:  2,
+				PersistenceChan:     persistenceChan,
+				RecordTimestampKey:  recordTimestampKey,
+				Persisters:          inmemdatastore.Persisters{},
+				BackpressurePolicy:  policy,
+				BackpressureTimeout: 10 * time.Millisecond,
+				OverflowDir:         rm.testDirs[dirOverflow],
+			},
+		)
+	}
+	// The records include values of types that the overflow file must keep as they are.
+	record := func(i int) (string, map[string]interface{}) {
+		key := fmt.Sprintf("sensor%d", i)
+		return key, map[string]interface{}{
+			avroFieldId:             key,
+			avroFieldCollectionTime: startTimestamp + int64(i),
+			"received":              time.Unix(0, startTimestamp+int64(i)),
+			"sequence":              int32(i),
+		}
+	}
+
+	t.Run("BlockWithTimeout", func(t *testing.T) {
+		setUpSubTest()
+		persistenceChan := make(inmemdatastore.PersistenceChan, 2)
+		imds := newIMDS(inmemdatastore.BackpressureBlockWithTimeout, persistenceChan)
+		assert.NoError(t, imds.Start())
+		for i := 0; i < 2; i++ {
+			_, err := imds.Put(record(i))
+			assert.NoError(t, err)
+		}
+		key, rec := record(2)
+		_, err := imds.Put(key, rec)
+		assert.ErrorIs(t, err, inmemdatastore.ErrPersistenceBackpressure)
+		// The record is still written to the datastore.
+		cached, err := imds.Get(key)
+		assert.NoError(t, err)
+		assert.Equal(t, rec, cached)
+		stats := imds.PersistenceStats()
+		assert.Equal(t, 2, stats.QueueDepth)
+		assert.Equal(t, int64(2), stats.Enqueued)
+		assert.Equal(t, int64(1), stats.QueueFull)
+		assert.Equal(t, int64(1), stats.TimedOut)
+		imds.Shutdown()
+	})
+
+	t.Run("DropOldest", func(t *testing.T) {
+		setUpSubTest()
+		persistenceChan := make(inmemdatastore.PersistenceChan, 2)
+		imds := newIMDS(inmemdatastore.BackpressureDropOldest, persistenceChan)
+		assert.NoError(t, imds.Start())
+		for i := 0; i < 3; i++ {
+			_, err := imds.Put(record(i))
+			assert.NoError(t, err)
+		}
+		stats := imds.PersistenceStats()
+		assert.Equal(t, 2, stats.QueueDepth)
+		assert.Equal(t, int64(1), stats.DroppedOldest)
+		assert.Equal(t, "sensor1", (<-persistenceChan).Key)
+		assert.Equal(t, "sensor2", (<-persistenceChan).Key)
+		imds.Shutdown()
+	})
+
+	t.Run("Spill", func(t *testing.T) {
+		setUpSubTest()
+		persistenceChan := make(inmemdatastore.PersistenceChan, 2)
+		imds := newIMDS(inmemdatastore.BackpressureSpill, persistenceChan)
+		assert.NoError(t, imds.Start())
+		for i := 0; i < 4; i++ {
+			_, err := imds.Put(record(i))
+			assert.NoError(t, err)
+		}
+		stats := imds.PersistenceStats()
+		assert.Equal(t, int64(2), stats.Spilled)
+		assert.FileExists(t, filepath.Join(rm.testDirs[dirOverflow], inmemdatastore.OverflowFileName))
+
+		// Once there is space on the channel the spilled entries are drained back onto it.
+		keys := []string{}
+		for len(keys) < 4 {
+			select {
+			case entry := <-persistenceChan:
+				keys = append(keys, entry.Key)
+				_, rec := record(len(keys) - 1)
+				assert.Equal(t, rec, entry.Record)
+			case <-time.After(5 * time.Second):
+				assert.FailNow(t, "timed out waiting for spilled entries to be drained")
+			}
+		}
+		assert.Equal(t, []string{"sensor0", "sensor1", "sensor2", "sensor3"}, keys)
+		assert.Equal(t, int64(2), imds.PersistenceStats().Drained)
+		// Nothing has persisted the drained entries, so the file from which they were drained is
+		// kept.
+		assert.FileExists(t, filepath.Join(rm.testDirs[dirOverflow], inmemdatastore.OverflowDrainingFileName))
+		imds.Shutdown()
+	})
+
+	t.Run("SpillRecovery", func(t *testing.T) {
+		setUpSubTest()
+		imds := newIMDS(inmemdatastore.BackpressureSpill, make(inmemdatastore.PersistenceChan, 2))
+		assert.NoError(t, imds.Start())
+		for i := 0; i < 3; i++ {
+			_, err := imds.Put(record(i))
+			assert.NoError(t, err)
+		}
+		// Shutdown while the channel is still full, so the spilled entry is never drained.
+		imds.Shutdown()
+
+		// The spilled entry is written back to the datastore, and then drained, after a restart.
+		persistenceChan := make(inmemdatastore.PersistenceChan, 2)
+		imds = newIMDS(inmemdatastore.BackpressureSpill, persistenceChan)
+		assert.NoError(t, imds.Start())
+		key, rec := record(2)
+		cached, err := imds.Get(key)
+		assert.NoError(t, err)
+		assert.Equal(t, rec, cached)
+		select {
+		case entry := <-persistenceChan:
+			assert.Equal(t, key, entry.Key)
+			assert.Equal(t, rec, entry.Record)
+		case <-time.After(5 * time.Second):
+			assert.Fail(t, "timed out waiting for spilled entry to be drained")
+		}
+		imds.Shutdown()
+	})
+
+	t.Run("SpillRemovedOncePersisted", func(t *testing.T) {
+		setUpSubTest()
+		imds := newIMDS(inmemdatastore.BackpressureSpill, make(inmemdatastore.PersistenceChan, 2))
+		assert.NoError(t, imds.Start())
+		for i := 0; i < 3; i++ {
+			_, err := imds.Put(record(i))
+			assert.NoError(t, err)
+		}
+		imds.Shutdown()
+
+		// After a restart with a Persister the spilled entry is drained, and the file from which it
+		// was drained is removed once it has been persisted.
+		rm.refreshContextsWg()
+		imdsWg := &sync.WaitGroup{}
+		persistenceChan := make(inmemdatastore.PersistenceChan, 2)
+		writer, err := inmemdatastore.NewJSONLinesFileWriter(
+			rm.testRunnerCtx,
+			imdsWg,
+			inmemdatastore.JSONLinesFileWriterConfig{Id: 0, OutputDir: rm.testDirs[dirJSONLines]},
+		)
+		assert.NoError(t, err)
+		persister, err := inmemdatastore.NewPersister(
+			rm.testRunnerCtx,
+			imdsWg,
+			inmemdatastore.PersisterConfig{
+				Id:         0,
+				Serializer: inmemdatastore.NewJSONSerializer(),
+				Writer:     writer,
+				InputChan:  persistenceChan,
+			},
+		)
+		assert.NoError(t, err)
+		imds = inmemdatastore.NewInMemDatastore(
+			rm.testRunnerCtx,
+			rm.testRunnerCancel,
+			imdsWg,
+			inmemdatastore.Config{
+				NumDatastoreShards: 2,
+				PersistenceChan:    persistenceChan,
+				RecordTimestampKey: recordTimestampKey,
+				Persisters:         inmemdatastore.Persisters{0: persister},
+				BackpressurePolicy: inmemdatastore.BackpressureSpill,
+				OverflowDir:        rm.testDirs[dirOverflow],
+			},
+		)
+		assert.NoError(t, imds.Start())
+		assert.Eventually(t, func() bool {
+			entries, err := os.ReadDir(rm.testDirs[dirOverflow])
+			return err == nil && len(entries) == 0
+		}, 5*time.Second, 10*time.Millisecond)
+		assert.Equal(t, int64(1), imds.PersistenceStats().Drained)
+		rm.testRunnerCancel()
+		imds.Shutdown()
+		imdsWg.Wait()
+		assert.Equal(
+			t,
+			[]RecordSpec{{Id: "sensor2", CollectionTime: startTimestamp + 2}},
+			loadJSONLinesRecordSpecs(t, rm.testDirs[dirJSONLines], inmemdatastore.JSONLinesFileExtension),
+		)
+	})
+}
+
+// TestSnapshot tests that Range and Snapshot return copies of the records and that they can be
+// safely called concurrently with Puts.
+func TestSnapshot(t *testing.T) {
+	utils.SetupLogging("debug")
+	setUpSubTest()
+	startTimestamp := int64(1647106627392928613)
+	imds := inmemdatastore.NewInMemDatastore(
+		rm.testRunnerCtx,
+		rm.testRunnerCancel,
+		&sync.WaitGroup{},
+		inmemdatastore.Config{
+			NumDatastoreShards: 4,
+			PersistenceChan:    make(inmemdatastore.PersistenceChan, 1024),
+			RecordTimestampKey: recordTimestampKey,
+			Persisters:         inmemdatastore.Persisters{},
+			BackpressurePolicy: inmemdatastore.BackpressureDropOldest,
+		},
+	)
+	assert.NoError(t, imds.Start())
+	for i := 0; i < 8; i++ {
+		key := fmt.Sprintf("sensor%d", i)
+		_, err := imds.Put(key, map[string]interface{}{
+			avroFieldId:             key,
+			avroFieldCollectionTime: startTimestamp,
+			"tags":                  []interface{}{"a", "b"},
+		})
+		assert.NoError(t, err)
+	}
+
+	// Modifying the snapshot must not modify the datastore.
+	snapshot := imds.Snapshot(true)
+	assert.Equal(t, 8, len(snapshot))
+	snapshot["sensor0"][avroFieldCollectionTime] = int64(0)
+	snapshot["sensor0"]["tags"].([]interface{})[0] = "z"
+	rec, err := imds.Get("sensor0")
+	assert.NoError(t, err)
+	assert.Equal(t, startTimestamp, rec.(map[string]interface{})[avroFieldCollectionTime])
+	assert.Equal(t, "a", rec.(map[string]interface{})["tags"].([]interface{})[0])
+
+	count := 0
+	imds.Range(func(key string, record map[string]interface{}) bool {
+		count++
+		return count < 3
+	})
+	assert.Equal(t, 3, count)
+
+	// Take snapshots while the records are being overwritten.
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= 1000; i++ {
+			key := fmt.Sprintf("sensor%d", i%8)
+			imds.Put(key, map[string]interface{}{avroFieldId: key, avroFieldCollectionTime: startTimestamp + int64(i)})
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		assert.Equal(t, 8, len(imds.Snapshot(i%2 == 0)))
+	}
+	wg.Wait()
+	imds.Shutdown()
+}
+
+// TestConflictResolution tests each of the built-in ConflictResolvers and that Put reports how the
+// conflict for each record was resolved.
+func TestConflictResolution(t *testing.T) {
+	utils.SetupLogging("debug")
+	newIMDS := func(resolver inmemdatastore.ConflictResolver) *inmemdatastore.InMemDataStore {
+		setUpSubTest()
+		return inmemdatastore.NewInMemDatastore(
+			rm.testRunnerCtx,
+			rm.testRunnerCancel,
+			&sync.WaitGroup{},
+			inmemdatastore.Config{
+				NumDatastoreShards: 2,
+				PersistenceChan:    make(inmemdatastore.PersistenceChan, 1024),
+				RecordTimestampKey: recordTimestampKey,
+				Persisters:         inmemdatastore.Persisters{},
+				ConflictResolver:   resolver,
+			},
+		)
+	}
+	type put struct {
+		record   map[string]interface{}
+		expected inmemdatastore.Resolution
+		err      error
+	}
+	now := time.Now()
+	hlc := inmemdatastore.NewHLClock()
+	hlc1, hlc2 := hlc.Now(), hlc.Now()
+	testCases := []struct {
+		name     string
+		resolver inmemdatastore.ConflictResolver
+		puts     []put
+	}{
+		{
+			name: "LWWMixedNumericTypes",
+			puts: []put{
+				{record: map[string]interface{}{recordTimestampKey: int64(10)}, expected: inmemdatastore.ResolutionApplied},
+				{record: map[string]interface{}{recordTimestampKey: 11}, expected: inmemdatastore.ResolutionApplied},
+				{record: map[string]interface{}{recordTimestampKey: 10.5}, expected: inmemdatastore.ResolutionStale},
+				{record: map[string]interface{}{recordTimestampKey: uint32(11)}, expected: inmemdatastore.ResolutionTie},
+				{record: map[string]interface{}{}, err: inmemdatastore.ErrConflictField},
+				{record: map[string]interface{}{recordTimestampKey: "11"}, err: inmemdatastore.ErrConflictField},
+			},
+		},
+		{
+			name:     "LWWTime",
+			resolver: inmemdatastore.NewLWWResolver("updated"),
+			puts: []put{
+				{record: map[string]interface{}{"updated": now}, expected: inmemdatastore.ResolutionApplied},
+				{record: map[string]interface{}{"updated": now.Add(-time.Second)}, expected: inmemdatastore.ResolutionStale},
+				{record: map[string]interface{}{"updated": now.Add(time.Second)}, expected: inmemdatastore.ResolutionApplied},
+			},
+		},
+		{
+			name:     "Version",
+			resolver: inmemdatastore.NewVersionResolver("version"),
+			puts: []put{
+				{record: map[string]interface{}{"version": int32(1)}, expected: inmemdatastore.ResolutionApplied},
+				{record: map[string]interface{}{"version": int64(2)}, expected: inmemdatastore.ResolutionApplied},
+				{record: map[string]interface{}{"version": 2}, expected: inmemdatastore.ResolutionTie},
+				{record: map[string]interface{}{"version": 2.5}, err: inmemdatastore.ErrConflictField},
+			},
+		},
+		{
+			name:     "HLC",
+			resolver: inmemdatastore.NewHLCResolver("hlc"),
+			puts: []put{
+				{record: map[string]interface{}{"hlc": hlc2}, expected: inmemdatastore.ResolutionApplied},
+				{record: map[string]interface{}{"hlc": hlc1.Map()}, expected: inmemdatastore.ResolutionStale},
+				{record: map[string]interface{}{"hlc": hlc.Update(hlc2)}, expected: inmemdatastore.ResolutionApplied},
+			},
+		},
+		{
+			name: "Func",
+			resolver: inmemdatastore.ResolverFunc(func(existing, incoming map[string]interface{}) (inmemdatastore.Resolution, error) {
+				// Only the first record is ever kept.
+				if existing == nil {
+					return inmemdatastore.ResolutionApplied, nil
+				}
+				return inmemdatastore.ResolutionStale, nil
+			}),
+			puts: []put{
+				{record: map[string]interface{}{"value": 1}, expected: inmemdatastore.ResolutionApplied},
+				{record: map[string]interface{}{"value": 2}, expected: inmemdatastore.ResolutionStale},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			imds := newIMDS(tc.resolver)
+			assert.NoError(t, imds.Start())
+			var latest map[string]interface{}
+			for i, p := range tc.puts {
+				result, err := imds.Put("sensor101", p.record)
+				if p.err != nil {
+					assert.ErrorIs(t, err, p.err, "put %d", i)
+					continue
+				}
+				assert.NoError(t, err, "put %d", i)
+				assert.Equal(t, p.expected, result.Resolution, "put %d", i)
+				if result.Applied() {
+					latest = p.record
+				}
+			}
+			rec, err := imds.Get("sensor101")
+			assert.NoError(t, err)
+			assert.Equal(t, latest, rec)
+			imds.Shutdown()
+		})
+	}
+}
+
+// TestPutOutcomes tests that Put reports the outcome of each record and that they are counted in
+// the Stats for each shard.
+func TestPutOutcomes(t *testing.T) {
+	utils.SetupLogging("debug")
+	setUpSubTest()
+	imds := inmemdatastore.NewInMemDatastore(
+		rm.testRunnerCtx,
+		rm.testRunnerCancel,
+		&sync.WaitGroup{},
+		inmemdatastore.Config{
+			NumDatastoreShards: 2,
+			PersistenceChan:    make(inmemdatastore.PersistenceChan, 1024),
+			RecordTimestampKey: recordTimestampKey,
+			Persisters:         inmemdatastore.Persisters{},
+		},
+	)
+	assert.NoError(t, imds.Start())
+	assert.NoError(t, imds.Delete("sensor301", 100))
+	puts := []struct {
+		key       string
+		timestamp interface{}
+		expected  inmemdatastore.PutOutcome
+	}{
+		{key: "sensor101", timestamp: int64(10), expected: inmemdatastore.PutInserted},
+		{key: "sensor101", timestamp: int64(20), expected: inmemdatastore.PutReplaced},
+		{key: "sensor101", timestamp: int64(15), expected: inmemdatastore.PutStaleSkipped},
+		{key: "sensor101", timestamp: int64(20), expected: inmemdatastore.PutStaleSkipped},
+		// A time.Time cannot be ordered against an int64.
+		{key: "sensor201", timestamp: time.Now(), expected: inmemdatastore.PutInserted},
+		{key: "sensor201", timestamp: int64(10), expected: inmemdatastore.PutNoTimestampOverwrite},
+		// Older than the delete.
+		{key: "sensor301", timestamp: int64(50), expected: inmemdatastore.PutStaleSkipped},
+		{key: "sensor301", timestamp: int64(150), expected: inmemdatastore.PutInserted},
+	}
+	for i, p := range puts {
+		result, err := imds.Put(p.key, map[string]interface{}{avroFieldId: p.key, recordTimestampKey: p.timestamp})
+		assert.NoError(t, err, "put %d", i)
+		assert.Equal(t, p.expected, result.Outcome, "put %d", i)
+	}
+
+	stats := imds.Stats()
+	assert.Equal(t, 2, len(stats.Shards))
+	assert.Equal(t, 3, stats.Totals.NumRecords)
+	assert.Equal(t, int64(8), stats.Totals.NumWrites)
+	assert.Equal(t, int64(1), stats.Totals.NumDeletes)
+	assert.Equal(t, int64(3), stats.Totals.NumInserted)
+	assert.Equal(t, int64(1), stats.Totals.NumReplaced)
+	assert.Equal(t, int64(3), stats.Totals.NumStaleSkipped)
+	assert.Equal(t, int64(1), stats.Totals.NumNoTimestampOverwrites)
+	assert.Equal(t, 9, stats.Persistence.QueueDepth)
+	imds.Shutdown()
+}
+
+// TestBatch tests that PutBatch writes and persists all of the valid records in the batch, that an
+// invalid record in the batch does not prevent the others from being persisted, and that GetMany
+// returns the records for the keys that are in the datastore.
+func TestBatch(t *testing.T) {
+	utils.SetupLogging("debug")
+	setUpSubTest()
+	startTimestamp := int64(1647106627392928613)
+	recSpecs := []RecordSpec{
+		{Id: "sensor101", CollectionTime: startTimestamp},
+		{Id: "sensor102", CollectionTime: startTimestamp},
+		{Id: "sensor103", CollectionTime: startTimestamp},
+		{Id: "sensor101", CollectionTime: startTimestamp - 1},
+	}
+	records := generateRecordsFromRecordSpecs(recSpecs, rm.avroNumMetricDblFields, rm.avroNumMetricStrFields)
+	batch := []inmemdatastore.KeyedRecord{}
+	for i, recSpec := range recSpecs {
+		batch = append(batch, inmemdatastore.KeyedRecord{Key: recSpec.Id, Record: records[i]})
+	}
+	errorChan := make(inmemdatastore.PersisterErrorChan, 8)
+	trCfg := TRConfig{
+		numPersisters:      2,
+		numDatastoreShards: 2,
+		schema:             rm.avroSchemaString,
+		outputDirPath:      rm.testDirs[dirData],
+		errorChan:          errorChan,
+	}
+	imdsWg := &sync.WaitGroup{}
+	imds := initTestOut(rm.testRunnerCtx, rm.testRunnerCancel, trCfg, imdsWg)
+	assert.NoError(t, imds.Start())
+
+	results, err := imds.PutBatch(batch)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(results))
+	for i, expected := range []inmemdatastore.PutOutcome{
+		inmemdatastore.PutInserted,
+		inmemdatastore.PutInserted,
+		inmemdatastore.PutInserted,
+		inmemdatastore.PutStaleSkipped,
+	} {
+		assert.Equal(t, recSpecs[i].Id, results[i].Key)
+		assert.NoError(t, results[i].Err)
+		assert.Equal(t, expected, results[i].Result.Outcome)
+	}
+
+	// A batch with a record without a timestamp and one that does not match the schema.
+	invalidRecord := map[string]interface{}{avroFieldId: "sensor201", avroFieldCollectionTime: startTimestamp}
+	validRecSpec := RecordSpec{Id: "sensor202", CollectionTime: startTimestamp}
+	results, err = imds.PutBatch([]inmemdatastore.KeyedRecord{
+		{Key: "sensor200", Record: map[string]interface{}{avroFieldId: "sensor200"}},
+		{Key: "sensor201", Record: invalidRecord},
+		{Key: "sensor202", Record: generateAvroRecord(validRecSpec, rm.avroNumMetricDblFields, rm.avroNumMetricStrFields)},
+	})
+	assert.NoError(t, err)
+	assert.ErrorIs(t, results[0].Err, inmemdatastore.ErrConflictField)
+	assert.NoError(t, results[1].Err)
+	assert.NoError(t, results[2].Err)
+	select {
+	case perr := <-imds.Errors():
+		assert.Equal(t, "sensor201", perr.Key)
+		assert.ErrorIs(t, perr.Err, inmemdatastore.ErrInvalidRecord)
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "timed out waiting for persister error")
+	}
+
+	recs, err := imds.GetMany([]string{"sensor101", "sensor103", "sensor200", "sensor999"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(recs))
+	assert.Equal(t, records[0], recs["sensor101"])
+	assert.Equal(t, records[2], recs["sensor103"])
+
+	rm.testRunnerCancel()
+	imds.Shutdown()
+	imdsWg.Wait()
+	validatePersistedData(t, nil, append(recSpecs, validRecSpec))
+}
+
+// TestBlockBuffering tests that buffered records are flushed on the FlushInterval and on Shutdown,
+// and that an invalid record is rejected without failing the rest of the records in its block.
+func TestBlockBuffering(t *testing.T) {
+	utils.SetupLogging("debug")
+	setUpSubTest()
+	startTimestamp := int64(1647106627392928613)
+	recSpecs := []RecordSpec{
+		{Id: "sensor101", CollectionTime: startTimestamp},
+		{Id: "sensor102", CollectionTime: startTimestamp},
+		{Id: "sensor103", CollectionTime: startTimestamp},
+	}
+	records := generateRecordsFromRecordSpecs(recSpecs, rm.avroNumMetricDblFields, rm.avroNumMetricStrFields)
+	errorChan := make(inmemdatastore.PersisterErrorChan, 8)
+	trCfg := TRConfig{
+		numPersisters:      1,
+		numDatastoreShards: 2,
+		schema:             rm.avroSchemaString,
+		outputDirPath:      rm.testDirs[dirData],
+		block:              inmemdatastore.BlockPolicy{MaxRecords: 100, FlushInterval: 50 * time.Millisecond},
+		errorChan:          errorChan,
+	}
+	imdsWg := &sync.WaitGroup{}
+	imds := initTestOut(rm.testRunnerCtx, rm.testRunnerCancel, trCfg, imdsWg)
+	assert.NoError(t, imds.Start())
+	for i, recSpec := range recSpecs[:2] {
+		_, err := imds.Put(recSpec.Id, records[i])
+		assert.NoError(t, err)
+	}
+	invalidRecord := map[string]interface{}{avroFieldId: "sensor201", avroFieldCollectionTime: startTimestamp}
+	_, err := imds.Put("sensor201", invalidRecord)
+	assert.NoError(t, err)
+	select {
+	case perr := <-imds.Errors():
+		assert.Equal(t, "sensor201", perr.Key)
+		assert.ErrorIs(t, perr.Err, inmemdatastore.ErrInvalidRecord)
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "timed out waiting for persister error")
+	}
+
+	// The valid records are flushed to the file that is still being written, without a Sync.
+	tmpPath := filepath.Join(
+		rm.testDirs[dirData],
+		inmemdatastore.SegmentFileName(0, 0, inmemdatastore.AvroFileExtension)+inmemdatastore.TmpFileSuffix)
+	assert.Eventually(t, func() bool {
+		_, count := loadAvroRecords(tmpPath, true)
+		return count == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The last record is only buffered, and is flushed on Shutdown.
+	_, err = imds.Put(recSpecs[2].Id, records[2])
+	assert.NoError(t, err)
+	rm.testRunnerCancel()
+	imds.Shutdown()
+	imdsWg.Wait()
+	validatePersistedData(t, nil, recSpecs)
+}
+
+// TestCompression tests that the data and tombstone files are written with each of the compression
+// codecs and that they are recovered on restart.
+func TestCompression(t *testing.T) {
+	utils.SetupLogging("debug")
+	startTimestamp := int64(1647106627392928613)
+	recSpecs := []RecordSpec{
+		{Id: "sensor101", CollectionTime: startTimestamp},
+		{Id: "sensor201", CollectionTime: startTimestamp},
+		{Id: "sensor301", CollectionTime: startTimestamp},
+	}
+	records := generateRecordsFromRecordSpecs(recSpecs, rm.avroNumMetricDblFields, rm.avroNumMetricStrFields)
+	testCases := []struct {
+		compression inmemdatastore.Compression
+		level       int
+	}{
+		{compression: inmemdatastore.CompressionNull},
+		{compression: inmemdatastore.CompressionDeflate},
+		{compression: inmemdatastore.CompressionDeflate, level: flate.BestSpeed},
+		{compression: inmemdatastore.CompressionSnappy},
+	}
+	dataBytes := map[inmemdatastore.Compression]int64{}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%s-%d", tc.compression, tc.level), func(t *testing.T) {
+			setUpSubTest()
+			trCfg := TRConfig{
+				numPersisters:      1,
+				numDatastoreShards: 2,
+				schema:             rm.avroSchemaString,
+				outputDirPath:      rm.testDirs[dirData],
+				compression:        tc.compression,
+				compressionLevel:   tc.level,
+			}
+			for i := 0; i < 2; i++ {
+				rm.refreshContextsWg()
+				imdsWg := &sync.WaitGroup{}
+				imds := initTestOut(rm.testRunnerCtx, rm.testRunnerCancel, trCfg, imdsWg)
+				assert.NoError(t, imds.Start())
+				if i == 0 {
+					for j, recSpec := range recSpecs {
+						_, err := imds.Put(recSpec.Id, records[j])
+						assert.NoError(t, err)
+					}
+					assert.NoError(t, imds.Delete(recSpecs[2].Id, startTimestamp+100))
+				} else {
+					stats := imds.GetRecoveryStats()
+					assert.Equal(t, int64(3), stats.RecordsRead)
+					assert.Equal(t, int64(1), stats.TombstonesRead)
+				}
+				validateCachedData(t, imds, recSpecs[:2])
+				rm.testRunnerCancel()
+				imds.Shutdown()
+				imdsWg.Wait()
+			}
+			validatePersistedData(t, nil, recSpecs)
+
+			segments, err := inmemdatastore.ListSegments(rm.testDirs[dirData], inmemdatastore.AvroFileExtension)
+			assert.NoError(t, err)
+			tombstoneSegments, err := inmemdatastore.ListSegments(
+				rm.testDirs[dirData], inmemdatastore.TombstoneFileExtension)
+			assert.NoError(t, err)
+			assert.Len(t, tombstoneSegments, 1)
+			for _, segment := range append(segments, tombstoneSegments...) {
+				fh, err := os.Open(segment.Path)
+				assert.NoError(t, err)
+				ocfr, err := goavro.NewOCFReader(bufio.NewReader(fh))
+				assert.NoError(t, err)
+				assert.Equal(t, tc.compression.String(), ocfr.CompressionName())
+				fh.Close()
+				if filepath.Ext(segment.Path) == inmemdatastore.AvroFileExtension {
+					fi, err := os.Stat(segment.Path)
+					assert.NoError(t, err)
+					dataBytes[tc.compression] += fi.Size()
+				}
+			}
+		})
+	}
+	// The test records are highly repetitive and compress well.
+	assert.Less(t, dataBytes[inmemdatastore.CompressionDeflate], dataBytes[inmemdatastore.CompressionNull])
+	assert.Less(t, dataBytes[inmemdatastore.CompressionSnappy], dataBytes[inmemdatastore.CompressionNull])
+}
+
+// TestSerializers tests that records encoded by the AvroSerializer on the persister go routines are
+// written as-is by the AvroFileWriter, with and without buffering, and by the RawFileWriter.
+func TestSerializers(t *testing.T) {
+	utils.SetupLogging("debug")
+	startTimestamp := int64(1647106627392928613)
+	recSpecs := []RecordSpec{
+		{Id: "sensor101", CollectionTime: startTimestamp},
+		{Id: "sensor201", CollectionTime: startTimestamp},
+		{Id: "sensor101", CollectionTime: startTimestamp + 100},
+	}
+	records := generateRecordsFromRecordSpecs(recSpecs, rm.avroNumMetricDblFields, rm.avroNumMetricStrFields)
+
+	for _, block := range []inmemdatastore.BlockPolicy{{}, {MaxRecords: 2}} {
+		t.Run(fmt.Sprintf("Avro-MaxRecords=%d", block.MaxRecords), func(t *testing.T) {
+			setUpSubTest()
+			errorChan := make(inmemdatastore.PersisterErrorChan, 8)
+			trCfg := TRConfig{
+				numPersisters:      2,
+				numDatastoreShards: 2,
+				schema:             rm.avroSchemaString,
+				outputDirPath:      rm.testDirs[dirData],
+				block:              block,
+				avroSerializer:     true,
+				errorChan:          errorChan,
+			}
+			imdsWg := &sync.WaitGroup{}
+			imds := initTestOut(rm.testRunnerCtx, rm.testRunnerCancel, trCfg, imdsWg)
+			assert.NoError(t, imds.Start())
+			for i, recSpec := range recSpecs {
+				_, err := imds.Put(recSpec.Id, records[i])
+				assert.NoError(t, err)
+			}
+			invalidRecord := map[string]interface{}{avroFieldId: "sensor301", avroFieldCollectionTime: startTimestamp}
+			_, err := imds.Put("sensor301", invalidRecord)
+			assert.NoError(t, err)
+			select {
+			case perr := <-imds.Errors():
+				assert.Equal(t, "sensor301", perr.Key)
+				assert.ErrorIs(t, perr.Err, inmemdatastore.ErrInvalidRecord)
+			case <-time.After(5 * time.Second):
+				assert.Fail(t, "timed out waiting for persister error")
+			}
+			rm.testRunnerCancel()
+			imds.Shutdown()
+			imdsWg.Wait()
+			validatePersistedData(t, nil, recSpecs)
+		})
+	}
+
+	t.Run("Raw", func(t *testing.T) {
+		setUpSubTest()
+		serializer, err := inmemdatastore.NewAvroSerializer(rm.avroSchemaString)
+		assert.NoError(t, err)
+		writer, err := inmemdatastore.NewRawFileWriter(rm.testRunnerCtx, rm.testRunnerWg, inmemdatastore.RawFileWriterConfig{
+			Id:        0,
+			OutputDir: rm.testDirs[dirData],
+			Rotation:  inmemdatastore.RotationPolicy{MaxRecords: 2},
+		})
+		assert.NoError(t, err)
+		for i, recSpec := range recSpecs {
+			serialized, err := serializer.Serialize(recSpec.Id, records[i])
+			assert.NoError(t, err)
+			assert.NoError(t, writer.Write(serialized))
+		}
+		// The RawFileWriter does not encode records itself.
+		err = writer.Write(&inmemdatastore.SerializedRecord{Key: "sensor301", Record: records[0]})
+		assert.ErrorIs(t, err, inmemdatastore.ErrInvalidRecord)
+		assert.NoError(t, writer.Shutdown())
+
+		segments, err := inmemdatastore.ListSegments(rm.testDirs[dirData], inmemdatastore.RawFileExtension)
+		assert.NoError(t, err)
+		assert.Len(t, segments, 2)
+		codec, err := inmemdatastore.GetAvroCodec(rm.avroSchemaString)
+		assert.NoError(t, err)
+		actual := []RecordSpec{}
+		for _, segment := range segments {
+			assert.False(t, segment.Tmp)
+			err := inmemdatastore.ReadRawFile(segment.Path, func(record *inmemdatastore.SerializedRecord) error {
+				assert.Equal(t, inmemdatastore.EncodingAvroBinary, record.Encoding)
+				assert.Equal(t, codec.Rabin, record.SchemaFingerprint)
+				native, _, err := codec.NativeFromBinary(record.Data)
+				if err != nil {
+					return err
+				}
+				m := native.(map[string]interface{})
+				assert.Equal(t, record.Key, m[avroFieldId])
+				actual = append(actual, RecordSpec{Id: record.Key, CollectionTime: m[avroFieldCollectionTime].(int64)})
+				return nil
+			})
+			assert.NoError(t, err)
+		}
+		assert.Equal(t, recSpecs, actual)
+
+		// A record encoded with a different schema is rejected by the AvroFileWriter.
+		avroWriter, err := inmemdatastore.NewAvroFileWriter(
+			rm.testRunnerCtx,
+			rm.testRunnerWg,
+			inmemdatastore.AvroFileWriterConfig{Id: 0, AvroSchema: rm.avroSchemaString, OutputDir: rm.testDirs[dirData]},
+		)
+		assert.NoError(t, err)
+		err = avroWriter.Write(&inmemdatastore.SerializedRecord{
+			Key:               "sensor101",
+			Encoding:          inmemdatastore.EncodingAvroBinary,
+			Data:              []byte{0},
+			SchemaFingerprint: codec.Rabin + 1,
+		})
+		assert.ErrorIs(t, err, inmemdatastore.ErrInvalidRecord)
+		assert.NoError(t, avroWriter.Shutdown())
+	})
+}
+
+// TestDeserializers tests that the records written by RawFileWriters, with each of the Serializers,
+// are recovered with the matching Deserializers when the IMDS starts, and that the MessagePack and
+// Protobuf encodings round-trip all of the types that they support.
+func TestDeserializers(t *testing.T) {
+	utils.SetupLogging("debug")
+	startTimestamp := int64(1647106627392928613)
+	recSpecs := []RecordSpec{
+		{Id: "sensor101", CollectionTime: startTimestamp},
+		{Id: "sensor201", CollectionTime: startTimestamp},
+		{Id: "sensor101", CollectionTime: startTimestamp + 100},
+	}
+	records := generateRecordsFromRecordSpecs(recSpecs, rm.avroNumMetricDblFields, rm.avroNumMetricStrFields)
+	expectedCachedRecSpecs := []RecordSpec{recSpecs[1], recSpecs[2]}
+	protobufDescriptorSet := "testdata/metrics.pb"
+
+	avroSerializer, err := inmemdatastore.NewAvroSerializer(rm.avroSchemaString)
+	assert.NoError(t, err)
+	avroDeserializer, err := inmemdatastore.NewAvroDeserializer(rm.avroSchemaString)
+	assert.NoError(t, err)
+	protobufSerializer, err := inmemdatastore.NewProtobufSerializer(protobufDescriptorSet, "inmemdatastore.test.Metrics")
+	assert.NoError(t, err)
+	protobufDeserializer, err := inmemdatastore.NewProtobufDeserializer(protobufDescriptorSet, "inmemdatastore.test.Metrics")
+	assert.NoError(t, err)
+	deserializers := []inmemdatastore.Deserializer{
+		avroDeserializer,
+		inmemdatastore.NewJSONDeserializer(),
+		inmemdatastore.NewMsgPackDeserializer(),
+		protobufDeserializer,
+	}
+
+	testCases := []struct {
+		encoding   inmemdatastore.Encoding
+		serializer inmemdatastore.Serializer
+	}{
+		{encoding: inmemdatastore.EncodingAvroBinary, serializer: avroSerializer},
+		{encoding: inmemdatastore.EncodingJSON, serializer: inmemdatastore.NewJSONSerializer()},
+		{encoding: inmemdatastore.EncodingMsgPack, serializer: inmemdatastore.NewMsgPackSerializer()},
+		{encoding: inmemdatastore.EncodingProtobuf, serializer: protobufSerializer},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Recovery-%s", tc.encoding), func(t *testing.T) {
+			setUpSubTest()
+			trCfg := TRConfig{
+				numPersisters:      2,
+				numDatastoreShards: 2,
+				schema:             rm.avroSchemaString,
+				outputDirPath:      rm.testDirs[dirData],
+				rawSerializer:      tc.serializer,
+			}
+			imdsWg := &sync.WaitGroup{}
+			imds := initTestOut(rm.testRunnerCtx, rm.testRunnerCancel, trCfg, imdsWg)
+			assert.NoError(t, imds.Start())
+			for i, recSpec := range recSpecs {
+				_, err := imds.PutSync(context.Background(), recSpec.Id, records[i])
+				assert.NoError(t, err)
+			}
+			rm.testRunnerCancel()
+			imds.Shutdown()
+			imdsWg.Wait()
+
+			// Without a Deserializer for the encoding none of the records can be recovered.
+			rm.refreshContextsWg()
+			trCfg.numPersisters = 0
+			imds = initTestOut(rm.testRunnerCtx, rm.testRunnerCancel, trCfg, &sync.WaitGroup{})
+			assert.NoError(t, imds.Start())
+			stats := imds.GetRecoveryStats()
+			assert.Equal(t, int64(len(recSpecs)), stats.RecordsRead)
+			assert.Equal(t, int64(len(recSpecs)), stats.RecordsInvalid)
+			imds.Shutdown()
+
+			rm.refreshContextsWg()
+			trCfg.deserializers = deserializers
+			imds = initTestOut(rm.testRunnerCtx, rm.testRunnerCancel, trCfg, &sync.WaitGroup{})
+			assert.NoError(t, imds.Start())
+			defer imds.Shutdown()
+			stats = imds.GetRecoveryStats()
+			assert.Equal(t, int64(len(recSpecs)), stats.RecordsRead)
+			assert.Equal(t, int64(0), stats.RecordsInvalid)
+			validateCachedData(t, imds, expectedCachedRecSpecs)
+			if tc.encoding != inmemdatastore.EncodingJSON {
+				// The other encodings preserve the types of all of the values.
+				for _, i := range []int{1, 2} {
+					record, err := imds.Get(recSpecs[i].Id)
+					assert.NoError(t, err)
+					assert.Equal(t, records[i], record)
+				}
+			}
+		})
+	}
+
+	t.Run("MsgPack-Types", func(t *testing.T) {
+		record := map[string]interface{}{
+			"int32":   int32(-7),
+			"int64":   int64(1647106627392928613),
+			"uint64":  uint64(18446744073709551615),
+			"float32": float32(1.5),
+			"float64": 2.25,
+			"bool":    true,
+			"bytes":   []byte{0, 1, 2},
+			"null":    nil,
+			"time":    time.Unix(1647106627, 392928613).UTC(),
+			"array":   []interface{}{"a", int64(1)},
+			"map":     map[string]interface{}{"nested": "value"},
+		}
+		serialized, err := inmemdatastore.NewMsgPackSerializer().Serialize("key", record)
+		assert.NoError(t, err)
+		assert.Equal(t, inmemdatastore.EncodingMsgPack, serialized.Encoding)
+		actual, err := inmemdatastore.NewMsgPackDeserializer().Deserialize(serialized)
+		assert.NoError(t, err)
+		// Times are decoded in the local time zone.
+		assert.True(t, record["time"].(time.Time).Equal(actual["time"].(time.Time)))
+		delete(record, "time")
+		delete(actual, "time")
+		assert.Equal(t, record, actual)
+	})
+
+	t.Run("Protobuf-Types", func(t *testing.T) {
+		serializer, err := inmemdatastore.NewProtobufSerializer(protobufDescriptorSet, "inmemdatastore.test.Event")
+		assert.NoError(t, err)
+		deserializer, err := inmemdatastore.NewProtobufDeserializer(protobufDescriptorSet, "inmemdatastore.test.Event")
+		assert.NoError(t, err)
+		record := map[string]interface{}{
+			"id":       "event1",
+			"time":     int64(1647106627392),
+			"location": map[string]interface{}{"lat": 1.5, "valid": true},
+			"tags":     []interface{}{"x", "y"},
+			"counts":   map[string]interface{}{"a": int64(1), "b": int64(2)},
+			"level":    "WARN",
+			"payload":  []byte{0, 1, 2},
+			"count":    uint32(3),
+			"ratio":    float32(0.5),
+			"delta":    int32(-4),
+		}
+		serialized, err := serializer.Serialize("event1", record)
+		assert.NoError(t, err)
+		assert.Equal(t, inmemdatastore.EncodingProtobuf, serialized.Encoding)
+		actual, err := deserializer.Deserialize(serialized)
+		assert.NoError(t, err)
+		assert.Equal(t, record, actual)
+
+		// Unset scalars are decoded with their zero values and unset messages are omitted.
+		serialized, err = serializer.Serialize("event2", map[string]interface{}{"id": "event2", "location": nil})
+		assert.NoError(t, err)
+		actual, err = deserializer.Deserialize(serialized)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]interface{}{
+			"id":      "event2",
+			"time":    int64(0),
+			"tags":    []interface{}{},
+			"counts":  map[string]interface{}{},
+			"level":   "LEVEL_UNSPECIFIED",
+			"payload": []byte{},
+			"count":   uint32(0),
+			"ratio":   float32(0),
+			"delta":   int32(0),
+		}, actual)
+
+		for _, invalid := range []map[string]interface{}{
+			{"id": "event3", "unknown": "field"},
+			{"id": int64(3)},
+			{"id": "event3", "level": "ERROR"},
+			{"id": "event3", "count": int64(-1)},
+			{"id": "event3", "delta": int64(math.MaxInt64)},
+		} {
+			_, err = serializer.Serialize("event3", invalid)
+			assert.ErrorIs(t, err, inmemdatastore.ErrInvalidRecord)
+		}
+
+		// A record encoded as a different message is rejected.
+		_, err = protobufDeserializer.Deserialize(serialized)
+		assert.Error(t, err)
+	})
+}
+
+// TestJSONLines tests that a MultiWriter persists the same records to Avro and to JSON Lines side
+// by side, and that the JSONSerializer can be paired with a rotating JSONLinesFileWriter.
+func TestJSONLines(t *testing.T) {
+	utils.SetupLogging("debug")
+	startTimestamp := int64(1647106627392928613)
+	recSpecs := []RecordSpec{
+		{Id: "sensor101", CollectionTime: startTimestamp},
+		{Id: "sensor201", CollectionTime: startTimestamp},
+		{Id: "sensor101", CollectionTime: startTimestamp + 100},
+	}
+	records := generateRecordsFromRecordSpecs(recSpecs, rm.avroNumMetricDblFields, rm.avroNumMetricStrFields)
+
+	for _, gzip := range []bool{false, true} {
+		t.Run(fmt.Sprintf("MultiWriter-Gzip=%t", gzip), func(t *testing.T) {
+			setUpSubTest()
+			trCfg := TRConfig{
+				numPersisters:      2,
+				numDatastoreShards: 2,
+				schema:             rm.avroSchemaString,
+				outputDirPath:      rm.testDirs[dirData],
+				jsonLinesDirPath:   rm.testDirs[dirJSONLines],
+				jsonLinesGzip:      gzip,
+			}
+			imdsWg := &sync.WaitGroup{}
+			imds := initTestOut(rm.testRunnerCtx, rm.testRunnerCancel, trCfg, imdsWg)
+			assert.NoError(t, imds.Start())
+			for i, recSpec := range recSpecs {
+				_, err := imds.PutSync(context.Background(), recSpec.Id, records[i])
+				assert.NoError(t, err)
+			}
+			// Tombstones are only written to the AvroFileWriter.
+			assert.NoError(t, imds.Delete(recSpecs[1].Id, startTimestamp+100))
+			rm.testRunnerCancel()
+			imds.Shutdown()
+			imdsWg.Wait()
+			validatePersistedData(t, nil, recSpecs)
+
+			ext := inmemdatastore.JSONLinesFileExtension
+			if gzip {
+				ext = inmemdatastore.JSONLinesGzipFileExtension
+			}
+			assert.ElementsMatch(t, recSpecs, loadJSONLinesRecordSpecs(t, rm.testDirs[dirJSONLines], ext))
+		})
+	}
+
+	t.Run("JSONSerializer", func(t *testing.T) {
+		setUpSubTest()
+		serializer := inmemdatastore.NewJSONSerializer()
+		writer, err := inmemdatastore.NewJSONLinesFileWriter(
+			rm.testRunnerCtx,
+			rm.testRunnerWg,
+			inmemdatastore.JSONLinesFileWriterConfig{
+				Id:        0,
+				OutputDir: rm.testDirs[dirJSONLines],
+				Rotation:  inmemdatastore.RotationPolicy{MaxRecords: 2},
+			},
+		)
+		assert.NoError(t, err)
+		for i, recSpec := range recSpecs {
+			serialized, err := serializer.Serialize(recSpec.Id, records[i])
+			assert.NoError(t, err)
+			assert.Equal(t, inmemdatastore.EncodingJSON, serialized.Encoding)
+			assert.NoError(t, writer.Write(serialized))
+		}
+		assert.NoError(t, writer.Shutdown())
+		segments, err := inmemdatastore.ListSegments(rm.testDirs[dirJSONLines], inmemdatastore.JSONLinesFileExtension)
+		assert.NoError(t, err)
+		assert.Len(t, segments, 2)
+		assert.Equal(t, recSpecs, loadJSONLinesRecordSpecs(t, rm.testDirs[dirJSONLines], inmemdatastore.JSONLinesFileExtension))
+	})
+}
+
+// loadJSONLinesRecordSpecs reads the RecordSpecs of all of the records in the JSON Lines files in
+// the dir, in the order of the segments.
+func loadJSONLinesRecordSpecs(t *testing.T, dir, ext string) []RecordSpec {
+	segments, err := inmemdatastore.ListSegments(dir, ext)
+	assert.NoError(t, err)
+	retval := []RecordSpec{}
+	for _, segment := range segments {
+		assert.False(t, segment.Tmp)
+		err := inmemdatastore.ReadJSONLinesFile(segment.Path, func(record map[string]interface{}) error {
+			retval = append(retval, RecordSpec{
+				Id:             record[avroFieldId].(string),
+				CollectionTime: record[avroFieldCollectionTime].(int64),
+			})
+			return nil
+		})
+		assert.NoError(t, err)
+	}
+	return retval
+}
+
+// nestedTestSchema is a schema with a nested record, nullable unions, a logical type and an array,
+// for testing the writers that derive their schema from the Avro schema.
+var nestedTestSchema = `{
+	"type": "record",
+	"name": "event",
+	"fields": [
+		{"name": "id", "type": "string"},
+		{"name": "time", "type": {"type": "long", "logicalType": "timestamp-millis"}},
+		{"name": "note", "type": ["null", "string"]},
+		{"name": "location", "type": ["null", {
+			"type": "record",
+			"name": "location",
+			"fields": [
+				{"name": "lat", "type": "double"},
+				{"name": "valid", "type": "boolean"}
+			]
+		}]},
+		{"name": "tags", "type": {"type": "array", "items": "string"}}
+	]
+}`
+
+// TestParquet tests that the ParquetFileWriter writes the records, in row groups and rotated
+// files, with a schema derived from the Avro schema, and reads the files back with the column
+// reader of parquet-go.
+func TestParquet(t *testing.T) {
+	utils.SetupLogging("debug")
+	startTimestamp := int64(1647106627392928613)
+	recSpecs := []RecordSpec{}
+	for i := 0; i < 5; i++ {
+		recSpecs = append(recSpecs, RecordSpec{Id: fmt.Sprintf("%s%d", idPrefix, i), CollectionTime: startTimestamp + int64(i)})
+	}
+	records := generateRecordsFromRecordSpecs(recSpecs, rm.avroNumMetricDblFields, rm.avroNumMetricStrFields)
+
+	for _, compression := range []inmemdatastore.Compression{
+		inmemdatastore.CompressionNull,
+		inmemdatastore.CompressionDeflate,
+		inmemdatastore.CompressionSnappy,
+	} {
+		t.Run(fmt.Sprintf("Compression=%s", compression), func(t *testing.T) {
+			setUpSubTest()
+			writer, err := inmemdatastore.NewParquetFileWriter(
+				rm.testRunnerCtx,
+				rm.testRunnerWg,
+				inmemdatastore.ParquetFileWriterConfig{
+					Id:          0,
+					AvroSchema:  rm.avroSchemaString,
+					OutputDir:   rm.testDirs[dirParquet],
+					Rotation:    inmemdatastore.RotationPolicy{MaxRecords: 4},
+					RowGroup:    inmemdatastore.RowGroupPolicy{MaxRows: 2},
+					Compression: compression,
+				},
+			)
+			assert.NoError(t, err)
+			// The records are written with both of the encodings to show that the writer only uses
+			// the Record.
+			avroSerializer, err := inmemdatastore.NewAvroSerializer(rm.avroSchemaString)
+			assert.NoError(t, err)
+			serializers := []inmemdatastore.Serializer{inmemdatastore.NewNoopSerializer(), avroSerializer}
+			for i, recSpec := range recSpecs {
+				serialized, err := serializers[i%2].Serialize(recSpec.Id, records[i])
+				assert.NoError(t, err)
+				assert.NoError(t, writer.Write(serialized))
+			}
+			assert.NoError(t, writer.Shutdown())
+
+			segments, err := inmemdatastore.ListSegments(rm.testDirs[dirParquet], inmemdatastore.ParquetFileExtension)
+			assert.NoError(t, err)
+			assert.Len(t, segments, 2)
+			expectedRowGroups := [][]int64{{2, 2}, {1}}
+			actual := []RecordSpec{}
+			for i, segment := range segments {
+				assert.False(t, segment.Tmp)
+				file, err := readParquetFile(segment.Path)
+				assert.NoError(t, err)
+				assert.Equal(t, expectedRowGroups[i], file.rowGroups)
+				assert.Equal(t, rm.avroSchemaString, file.keyValues["parquet.avro.schema"])
+				assert.Len(t, file.columns, rm.avroNumMetricDblFields+rm.avroNumMetricStrFields+2)
+				for j := int64(0); j < file.numRows; j++ {
+					actual = append(actual, RecordSpec{
+						Id:             file.values[avroFieldId][j].(string),
+						CollectionTime: file.values[avroFieldCollectionTime][j].(int64),
+					})
+				}
+				for j, val := range file.values[metricDblPrefix+"1"] {
+					assert.Equal(t, records[i*4+j][metricDblPrefix+"1"], val)
+				}
+			}
+			assert.Equal(t, recSpecs, actual)
+		})
+	}
+
+	t.Run("NestedAndOptional", func(t *testing.T) {
+		setUpSubTest()
+		writer, err := inmemdatastore.NewParquetFileWriter(
+			rm.testRunnerCtx,
+			rm.testRunnerWg,
+			inmemdatastore.ParquetFileWriterConfig{Id: 0, AvroSchema: nestedTestSchema, OutputDir: rm.testDirs[dirParquet]},
+		)
+		assert.NoError(t, err)
+		ts := time.Unix(1647106627, 392000000).UTC()
+		events := []map[string]interface{}{
+			{
+				"id":       "a",
+				"time":     ts,
+				"note":     map[string]interface{}{"string": "first"},
+				"location": map[string]interface{}{"location": map[string]interface{}{"lat": 1.5, "valid": true}},
+				"tags":     []interface{}{"x", "y"},
+			},
+			{"id": "b", "time": ts, "note": nil, "location": nil, "tags": []interface{}{}},
+		}
+		for _, event := range events {
+			assert.NoError(t, writer.Write(&inmemdatastore.SerializedRecord{Key: event["id"].(string), Record: event}))
+		}
+		// A record that is missing a required field is rejected without affecting the others in the
+		// row group.
+		err = writer.WriteBatch([]*inmemdatastore.SerializedRecord{
+			{Key: "c", Record: map[string]interface{}{"id": "c", "time": ts, "tags": []interface{}{}}},
+			{Key: "d", Record: map[string]interface{}{"id": "d", "tags": []interface{}{}}},
+		})
+		assert.ErrorIs(t, err, inmemdatastore.ErrInvalidRecord)
+		assert.NoError(t, writer.Shutdown())
+
+		segments, err := inmemdatastore.ListSegments(rm.testDirs[dirParquet], inmemdatastore.ParquetFileExtension)
+		assert.NoError(t, err)
+		assert.Len(t, segments, 1)
+		file, err := readParquetFile(segments[0].Path)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), file.numRows)
+		assert.Equal(t, []string{"id", "time", "note", "location.lat", "location.valid", "tags"}, file.columns)
+		assert.Equal(t, []interface{}{"a", "b"}, file.values["id"])
+		assert.Equal(t, []interface{}{ts.UnixNano() / int64(time.Millisecond), ts.UnixNano() / int64(time.Millisecond)}, file.values["time"])
+		assert.Equal(t, []interface{}{"first", nil}, file.values["note"])
+		assert.Equal(t, []interface{}{1.5, nil}, file.values["location.lat"])
+		assert.Equal(t, []interface{}{true, nil}, file.values["location.valid"])
+		assert.Equal(t, []interface{}{`["x","y"]`, `[]`}, file.values["tags"])
+	})
+}
+
+// TestCSV tests the CSVFileWriter as the writer of the persisters and as the writer of a one-shot
+// export of the contents of the data store.
+func TestCSV(t *testing.T) {
+	utils.SetupLogging("debug")
+	startTimestamp := int64(1647106627392928613)
+	recSpecs := []RecordSpec{}
+	for i := 0; i < 5; i++ {
+		recSpecs = append(recSpecs, RecordSpec{Id: fmt.Sprintf("%s%d", idPrefix, i), CollectionTime: startTimestamp + int64(i)})
+	}
+	records := generateRecordsFromRecordSpecs(recSpecs, rm.avroNumMetricDblFields, rm.avroNumMetricStrFields)
+
+	t.Run("Persister", func(t *testing.T) {
+		setUpSubTest()
+		trCfg := TRConfig{
+			numPersisters:      2,
+			numDatastoreShards: 2,
+			schema:             rm.avroSchemaString,
+			outputDirPath:      rm.testDirs[dirData],
+			csvDirPath:         rm.testDirs[dirCSV],
+		}
+		imdsWg := &sync.WaitGroup{}
+		imds := initTestOut(rm.testRunnerCtx, rm.testRunnerCancel, trCfg, imdsWg)
+		assert.NoError(t, imds.Start())
+		for i, recSpec := range recSpecs {
+			_, err := imds.PutSync(context.Background(), recSpec.Id, records[i])
+			assert.NoError(t, err)
+		}
+		rm.testRunnerCancel()
+		imds.Shutdown()
+		imdsWg.Wait()
+		validatePersistedData(t, nil, recSpecs)
+
+		header, rows := loadCSVRows(t, rm.testDirs[dirCSV], ',')
+		assert.Len(t, header, rm.avroNumMetricDblFields+rm.avroNumMetricStrFields+2)
+		assert.Equal(t, []string{avroFieldId, avroFieldCollectionTime}, header[:2])
+		assert.ElementsMatch(t, recSpecs, csvRecordSpecs(t, rows))
+	})
+
+	t.Run("Export", func(t *testing.T) {
+		setUpSubTest()
+		trCfg := TRConfig{
+			numPersisters:      2,
+			numDatastoreShards: 2,
+			schema:             rm.avroSchemaString,
+			outputDirPath:      rm.testDirs[dirData],
+		}
+		imdsWg := &sync.WaitGroup{}
+		imds := initTestOut(rm.testRunnerCtx, rm.testRunnerCancel, trCfg, imdsWg)
+		assert.NoError(t, imds.Start())
+		// Put the records in reverse order to show that they are exported ordered by key.
+		for i := len(recSpecs) - 1; i >= 0; i-- {
+			_, err := imds.PutSync(context.Background(), recSpecs[i].Id, records[i])
+			assert.NoError(t, err)
+		}
+
+		writer, err := inmemdatastore.NewCSVFileWriter(
+			context.Background(),
+			&sync.WaitGroup{},
+			inmemdatastore.CSVFileWriterConfig{
+				Id:         0,
+				AvroSchema: rm.avroSchemaString,
+				OutputDir:  rm.testDirs[dirCSV],
+				Delimiter:  '\t',
+				Rotation:   inmemdatastore.RotationPolicy{MaxRecords: 3},
+			},
+		)
+		assert.NoError(t, err)
+		n, err := imds.Export(writer, true)
+		assert.NoError(t, err)
+		assert.Equal(t, len(recSpecs), n)
+		assert.NoError(t, writer.Shutdown())
+		rm.testRunnerCancel()
+		imds.Shutdown()
+		imdsWg.Wait()
+
+		segments, err := inmemdatastore.ListSegments(rm.testDirs[dirCSV], inmemdatastore.CSVFileExtension)
+		assert.NoError(t, err)
+		assert.Len(t, segments, 2)
+		_, rows := loadCSVRows(t, rm.testDirs[dirCSV], '\t')
+		assert.Equal(t, recSpecs, csvRecordSpecs(t, rows))
+	})
+
+	for _, nested := range []inmemdatastore.CSVNestedMode{inmemdatastore.CSVNestedFlatten, inmemdatastore.CSVNestedJSON} {
+		t.Run(fmt.Sprintf("Nested=%s", nested), func(t *testing.T) {
+			setUpSubTest()
+			writer, err := inmemdatastore.NewCSVFileWriter(
+				rm.testRunnerCtx,
+				rm.testRunnerWg,
+				inmemdatastore.CSVFileWriterConfig{
+					Id:         0,
+					AvroSchema: nestedTestSchema,
+					OutputDir:  rm.testDirs[dirCSV],
+					Nested:     nested,
+					NullValue:  "NULL",
+				},
+			)
+			assert.NoError(t, err)
+			ts := time.Unix(1647106627, 392000000).UTC()
+			events := []map[string]interface{}{
+				{
+					"id":       "a",
+					"time":     ts,
+					"note":     map[string]interface{}{"string": "first, with a delimiter"},
+					"location": map[string]interface{}{"location": map[string]interface{}{"lat": 1.5, "valid": true}},
+					"tags":     []interface{}{"x", "y"},
+				},
+				{"id": "b", "time": ts, "tags": []interface{}{}},
+			}
+			for _, event := range events {
+				assert.NoError(t, writer.Write(&inmemdatastore.SerializedRecord{Key: event["id"].(string), Record: event}))
+			}
+			assert.NoError(t, writer.Shutdown())
+
+			header, rows := loadCSVRows(t, rm.testDirs[dirCSV], ',')
+			if nested == inmemdatastore.CSVNestedFlatten {
+				assert.Equal(t, []string{"id", "time", "note", "location.lat", "location.valid", "tags"}, header)
+				assert.Equal(t, [][]string{
+					{"a", "2022-03-12T17:37:07.392Z", "first, with a delimiter", "1.5", "true", `["x","y"]`},
+					{"b", "2022-03-12T17:37:07.392Z", "NULL", "NULL", "NULL", "[]"},
+				}, rows)
+			} else {
+				assert.Equal(t, []string{"id", "time", "note", "location", "tags"}, header)
+				assert.Equal(t, [][]string{
+					{"a", "2022-03-12T17:37:07.392Z", "first, with a delimiter", `{"lat":1.5,"valid":true}`, `["x","y"]`},
+					{"b", "2022-03-12T17:37:07.392Z", "NULL", "NULL", "[]"},
+				}, rows)
+			}
+		})
+	}
+}
+
+// loadCSVRows reads all of the CSV files in the dir, in the order of the segments, and returns the
+// header, which must be the same for all of them, and all of the other rows.
+func loadCSVRows(t *testing.T, dir string, delimiter rune) ([]string, [][]string) {
+	segments, err := inmemdatastore.ListSegments(dir, inmemdatastore.CSVFileExtension)
+	assert.NoError(t, err)
+	var header []string
+	rows := [][]string{}
+	for _, segment := range segments {
+		assert.False(t, segment.Tmp)
+		fh, err := os.Open(segment.Path)
+		assert.NoError(t, err)
+		r := csv.NewReader(fh)
+		r.Comma = delimiter
+		segmentRows, err := r.ReadAll()
+		fh.Close()
+		assert.NoError(t, err)
+		if header != nil {
+			assert.Equal(t, header, segmentRows[0])
+		}
+		header = segmentRows[0]
+		rows = append(rows, segmentRows[1:]...)
+	}
+	return header, rows
+}
+
+func csvRecordSpecs(t *testing.T, rows [][]string) []RecordSpec {
+	retval := []RecordSpec{}
+	for _, row := range rows {
+		collectionTime, err := strconv.ParseInt(row[1], 10, 64)
+		assert.NoError(t, err)
+		retval = append(retval, RecordSpec{Id: row[0], CollectionTime: collectionTime})
+	}
+	return retval
+}
+
+// TestWAL tests that the entries in the write-ahead log that were never persisted, as if the process
+// had crashed, are replayed and persisted on the next start, and that the log is truncated once its
+// entries have been persisted.
+func TestWAL(t *testing.T) {
+	utils.SetupLogging("debug")
+	startTimestamp := int64(1647106627392928613)
+	recSpecs := []RecordSpec{
+		{Id: "sensor101", CollectionTime: startTimestamp},
+		{Id: "sensor102", CollectionTime: startTimestamp},
+		{Id: "sensor101", CollectionTime: startTimestamp + 100},
+		{Id: "sensor103", CollectionTime: startTimestamp},
+		{Id: "sensor104", CollectionTime: startTimestamp},
+	}
+	records := generateRecordsFromRecordSpecs(recSpecs, rm.avroNumMetricDblFields, rm.avroNumMetricStrFields)
+	expectedCachedRecSpecs := []RecordSpec{recSpecs[1], recSpecs[2], recSpecs[3]}
+	walSegments := func() []inmemdatastore.Segment {
+		segments, err := inmemdatastore.ListSegments(rm.testDirs[dirWAL], inmemdatastore.WALFileExtension)
+		assert.NoError(t, err)
+		return segments
+	}
+
+	for _, policy := range []inmemdatastore.WALSyncPolicy{
+		inmemdatastore.WALSyncAlways,
+		inmemdatastore.WALSyncInterval,
+		inmemdatastore.WALSyncOS,
+	} {
+		t.Run(fmt.Sprintf("Replay-%s", policy), func(t *testing.T) {
+			setUpSubTest()
+			// Without any Persisters nothing is written to the DataDir, as if the process had crashed
+			// before any of the records were persisted.
+			trCfg := TRConfig{
+				numPersisters:      0,
+				numDatastoreShards: 2,
+				schema:             rm.avroSchemaString,
+				outputDirPath:      rm.testDirs[dirData],
+				walDirPath:         rm.testDirs[dirWAL],
+				walSyncPolicy:      policy,
+			}
+			imdsWg := &sync.WaitGroup{}
+			imds := initTestOut(rm.testRunnerCtx, rm.testRunnerCancel, trCfg, imdsWg)
+			assert.NoError(t, imds.Start())
+			for i := 0; i < 3; i++ {
+				_, err := imds.Put(recSpecs[i].Id, records[i])
+				assert.NoError(t, err)
+			}
+			_, err := imds.PutBatch([]inmemdatastore.KeyedRecord{
+				{Key: recSpecs[3].Id, Record: records[3]},
+				{Key: recSpecs[4].Id, Record: records[4]},
+			})
+			assert.NoError(t, err)
+			assert.NoError(t, imds.Delete(recSpecs[4].Id, startTimestamp+1))
+			rm.testRunnerCancel()
+			imds.Shutdown()
+			imdsWg.Wait()
+
+			// None of the entries were persisted, so none of the segments were removed.
+			segments := walSegments()
+			assert.Equal(t, 1, len(segments))
+			// Append a partial frame, as is left by a crash part way through a write.
+			fh, err := os.OpenFile(segments[0].Path, os.O_WRONLY|os.O_APPEND, 0o644)
+			assert.NoError(t, err)
+			_, err = fh.Write([]byte{0x7f, 0x01, 0x02})
+			assert.NoError(t, err)
+			assert.NoError(t, fh.Close())
+
+			rm.refreshContextsWg()
+			trCfg.numPersisters = 2
+			imdsWg = &sync.WaitGroup{}
+			imds = initTestOut(rm.testRunnerCtx, rm.testRunnerCancel, trCfg, imdsWg)
+			assert.NoError(t, imds.Start())
+			stats := imds.GetRecoveryStats()
+			assert.Equal(t, 1, stats.WALSegmentsRead)
+			assert.Equal(t, int64(5), stats.WALEntriesReplayed)
+			assert.Equal(t, int64(0), stats.RecordsRead)
+			validateCachedData(t, imds, expectedCachedRecSpecs)
+			record, err := imds.Get(recSpecs[2].Id)
+			assert.NoError(t, err)
+			assert.Equal(t, records[2], record)
+			rm.testRunnerCancel()
+			imds.Shutdown()
+			imdsWg.Wait()
+
+			// The replayed entries have been persisted, so the log has been truncated.
+			assert.Empty(t, walSegments())
+			validatePersistedData(t, nil, recSpecs)
+
+			rm.refreshContextsWg()
+			trCfg.numPersisters = 0
+			imds = initTestOut(rm.testRunnerCtx, rm.testRunnerCancel, trCfg, &sync.WaitGroup{})
+			assert.NoError(t, imds.Start())
+			defer imds.Shutdown()
+			stats = imds.GetRecoveryStats()
+			assert.Equal(t, 0, stats.WALSegmentsRead)
+			assert.Equal(t, int64(len(recSpecs)), stats.RecordsRead)
+			assert.Equal(t, int64(1), stats.TombstonesRead)
+			validateCachedData(t, imds, expectedCachedRecSpecs)
+		})
+	}
+
+	t.Run("Checkpoint", func(t *testing.T) {
+		setUpSubTest()
+		trCfg := TRConfig{
+			numPersisters:         2,
+			numDatastoreShards:    2,
+			schema:                rm.avroSchemaString,
+			outputDirPath:         rm.testDirs[dirData],
+			walDirPath:            rm.testDirs[dirWAL],
+			walCheckpointInterval: 100 * time.Millisecond,
+		}
+		imdsWg := &sync.WaitGroup{}
+		imds := initTestOut(rm.testRunnerCtx, rm.testRunnerCancel, trCfg, imdsWg)
+		assert.NoError(t, imds.Start())
+		waitForTruncation := func() {
+			deadline := time.Now().Add(5 * time.Second)
+			for len(walSegments()) > 0 {
+				if time.Now().After(deadline) {
+					assert.FailNow(t, "timed out waiting for the write-ahead log to be truncated")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+
+		_, err := imds.Put(recSpecs[0].Id, records[0])
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(walSegments()))
+		waitForTruncation()
+		// The next entry is written to a new segment.
+		_, err = imds.Put(recSpecs[1].Id, records[1])
+		assert.NoError(t, err)
+		segments := walSegments()
+		assert.Equal(t, 1, len(segments))
+		assert.Equal(t, uint64(1), segments[0].Seq)
+		waitForTruncation()
+
+		rm.testRunnerCancel()
+		imds.Shutdown()
+		imdsWg.Wait()
+		validatePersistedData(t, nil, recSpecs[:2])
+	})
+
+	t.Run("GroupCommit", func(t *testing.T) {
+		setUpSubTest()
+		trCfg := TRConfig{
+			numPersisters:      0,
+			numDatastoreShards: 4,
+			schema:             rm.avroSchemaString,
+			outputDirPath:      rm.testDirs[dirData],
+			walDirPath:         rm.testDirs[dirWAL],
+			walSyncPolicy:      inmemdatastore.WALSyncAlways,
+		}
+		imds := initTestOut(rm.testRunnerCtx, rm.testRunnerCancel, trCfg, &sync.WaitGroup{})
+		assert.NoError(t, imds.Start())
+		numWriters, numWrites := 8, 25
+		expected := []RecordSpec{}
+		wg := &sync.WaitGroup{}
+		for w := 0; w < numWriters; w++ {
+			recSpecs := []RecordSpec{}
+			for i := 0; i < numWrites; i++ {
+				recSpecs = append(recSpecs, RecordSpec{Id: fmt.Sprintf("sensor%d-%d", w, i), CollectionTime: startTimestamp})
+			}
+			expected = append(expected, recSpecs...)
+			records := generateRecordsFromRecordSpecs(recSpecs, rm.avroNumMetricDblFields, rm.avroNumMetricStrFields)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i, recSpec := range recSpecs {
+					_, err := imds.Put(recSpec.Id, records[i])
+					assert.NoError(t, err)
+				}
+			}()
+		}
+		wg.Wait()
+		imds.Shutdown()
+
+		rm.refreshContextsWg()
+		imds = initTestOut(rm.testRunnerCtx, rm.testRunnerCancel, trCfg, &sync.WaitGroup{})
+		assert.NoError(t, imds.Start())
+		defer imds.Shutdown()
+		assert.Equal(t, int64(numWriters*numWrites), imds.GetRecoveryStats().WALEntriesReplayed)
+		validateCachedData(t, imds, expected)
+	})
+
+	// The write-ahead log is only truncated once the Writers have been synced, so Start rejects a
+	// Writer that cannot be synced, whether on its own or as one of the Writers of a MultiWriter.
+	t.Run("RequiresSyncer", func(t *testing.T) {
+		newWriters := map[string]func() inmemdatastore.Writer{
+			"Parquet": func() inmemdatastore.Writer {
+				writer, err := inmemdatastore.NewParquetFileWriter(
+					rm.testRunnerCtx,
+					rm.testRunnerWg,
+					inmemdatastore.ParquetFileWriterConfig{Id: 0, AvroSchema: rm.avroSchemaString, OutputDir: rm.testDirs[dirParquet]},
+				)
+				assert.NoError(t, err)
+				return writer
+			},
+			"MultiWriter": func() inmemdatastore.Writer {
+				avroWriter, err := inmemdatastore.NewAvroFileWriter(
+					rm.testRunnerCtx,
+					rm.testRunnerWg,
+					inmemdatastore.AvroFileWriterConfig{Id: 0, AvroSchema: rm.avroSchemaString, OutputDir: rm.testDirs[dirData]},
+				)
+				assert.NoError(t, err)
+				parquetWriter, err := inmemdatastore.NewParquetFileWriter(
+					rm.testRunnerCtx,
+					rm.testRunnerWg,
+					inmemdatastore.ParquetFileWriterConfig{Id: 0, AvroSchema: rm.avroSchemaString, OutputDir: rm.testDirs[dirParquet]},
+				)
+				assert.NoError(t, err)
+				return inmemdatastore.NewMultiWriter(avroWriter, parquetWriter)
+			},
+		}
+		for _, name := range []string{"Parquet", "MultiWriter"} {
+			t.Run(name, func(t *testing.T) {
+				setUpSubTest()
+				writer := newWriters[name]()
+				persistenceChan := make(inmemdatastore.PersistenceChan, 8)
+				persister, err := inmemdatastore.NewPersister(
+					rm.testRunnerCtx,
+					rm.testRunnerWg,
+					inmemdatastore.PersisterConfig{
+						Id:         0,
+						Serializer: inmemdatastore.NewNoopSerializer(),
+						Writer:     writer,
+						InputChan:  persistenceChan,
+					},
+				)
+				assert.NoError(t, err)
+				imds := inmemdatastore.NewInMemDatastore(
+					rm.testRunnerCtx,
+					rm.testRunnerCancel,
+					&sync.WaitGroup{},
+					inmemdatastore.Config{
+						NumDatastoreShards: 2,
+						PersistenceChan:    persistenceChan,
+						RecordTimestampKey: recordTimestampKey,
+						Persisters:         inmemdatastore.Persisters{0: persister},
+						WALDir:             rm.testDirs[dirWAL],
+					},
+				)
+				assert.ErrorIs(t, imds.Start(), inmemdatastore.ErrSyncNotSupported)
+				assert.NoError(t, writer.Shutdown())
+				assert.Empty(t, walSegments())
+			})
+		}
+	})
+}
+
+// TestSnapshotFiles tests that the IMDS is re-populated from the most recent snapshot and only the
+// data files written after it, that snapshots can be written while records are being Put, and
+// that an invalid snapshot is skipped in favour of the one before it.
+func TestSnapshotFiles(t *testing.T) {
+	utils.SetupLogging("debug")
+	setUpSubTest()
+	startTimestamp := int64(1647106627392928613)
+	recSpecs := []RecordSpec{}
+	for i := 0; i < 12; i++ {
+		recSpecs = append(recSpecs, RecordSpec{Id: fmt.Sprintf("sensor%d", i%8), CollectionTime: startTimestamp + int64(i)})
+	}
+	records := generateRecordsFromRecordSpecs(recSpecs, rm.avroNumMetricDblFields, rm.avroNumMetricStrFields)
+	trCfg := TRConfig{
+		numPersisters:      2,
+		numDatastoreShards: 4,
+		schema:             rm.avroSchemaString,
+		outputDirPath:      rm.testDirs[dirData],
+		rotation:           inmemdatastore.RotationPolicy{MaxRecords: 2},
+		snapshotDirPath:    rm.testDirs[dirSnapshots],
+		snapshotRetain:     2,
+	}
+	imdsWg := &sync.WaitGroup{}
+	imds := initTestOut(rm.testRunnerCtx, rm.testRunnerCancel, trCfg, imdsWg)
+	assert.NoError(t, imds.Start())
+	for i := 0; i < 8; i++ {
+		_, err := imds.PutSync(context.Background(), recSpecs[i].Id, records[i])
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, imds.Delete("sensor7", startTimestamp+100))
+	first, err := imds.WriteSnapshot()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(7), first.Records)
+	assert.Equal(t, int64(1), first.Tombstones)
+	assert.NotEmpty(t, first.Markers)
+
+	// Records Put while the snapshot is being written are either in it or in the data files
+	// written after it.
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 8; i < 12; i++ {
+			_, err := imds.PutSync(context.Background(), recSpecs[i].Id, records[i])
+			assert.NoError(t, err)
+		}
+	}()
+	second, err := imds.WriteSnapshot()
+	assert.NoError(t, err)
+	wg.Wait()
+	rm.testRunnerCancel()
+	imds.Shutdown()
+	imdsWg.Wait()
+
+	expectedCachedRecSpecs := []RecordSpec{}
+	for _, recSpec := range recSpecs[4:] {
+		if recSpec.Id != "sensor7" {
+			expectedCachedRecSpecs = append(expectedCachedRecSpecs, recSpec)
+		}
+	}
+	restart := func() inmemdatastore.RecoveryStats {
+		rm.refreshContextsWg()
+		trCfg.numPersisters = 0
+		imds := initTestOut(rm.testRunnerCtx, rm.testRunnerCancel, trCfg, &sync.WaitGroup{})
+		assert.NoError(t, imds.Start())
+		defer imds.Shutdown()
+		validateCachedData(t, imds, expectedCachedRecSpecs)
+		rec, err := imds.Get("sensor7")
+		assert.NoError(t, err)
+		assert.Nil(t, rec)
+		return imds.GetRecoveryStats()
+	}
+
+	stats := restart()
+	assert.Equal(t, second.Path, stats.SnapshotPath)
+	assert.Less(t, int64(0), stats.SnapshotRecords)
+	assert.Less(t, 0, stats.FilesSkipped)
+	assert.Less(t, stats.RecordsRead, int64(len(recSpecs)))
+
+	// Only the most recent snapshots are kept.
+	third, err := func() (inmemdatastore.SnapshotInfo, error) {
+		rm.refreshContextsWg()
+		imds := initTestOut(rm.testRunnerCtx, rm.testRunnerCancel, trCfg, &sync.WaitGroup{})
+		assert.NoError(t, imds.Start())
+		defer imds.Shutdown()
+		return imds.WriteSnapshot()
+	}()
+	assert.NoError(t, err)
+	snapshots, err := inmemdatastore.ListSegments(rm.testDirs[dirSnapshots], inmemdatastore.SnapshotFileExtension)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(snapshots))
+	assert.NoFileExists(t, first.Path)
+
+	// A truncated snapshot is skipped in favour of the one before it.
+	assert.NoError(t, os.Truncate(third.Path, 32))
+	stats = restart()
+	assert.Equal(t, second.Path, stats.SnapshotPath)
+
+	// Without any valid snapshots all of the data files are read.
+	assert.NoError(t, os.Truncate(second.Path, 32))
+	stats = restart()
+	assert.Equal(t, "", stats.SnapshotPath)
+	assert.Equal(t, 0, stats.FilesSkipped)
+	assert.Equal(t, int64(len(recSpecs)), stats.RecordsRead)
+}
+
+// TestCompaction tests that the closed data files are compacted down to the records that are to be
+// retained for each key while records are being Put, and that the IMDS recovers the same state from
+// the compacted files.
+func TestCompaction(t *testing.T) {
+	utils.SetupLogging("debug")
+	now := time.Now().UnixNano()
+	numKeys, numVersions := 4, 4
+	recSpecs := []RecordSpec{}
+	for v := 0; v < numVersions; v++ {
+		for k := 0; k < numKeys; k++ {
+			recSpecs = append(recSpecs, RecordSpec{
+				Id:             fmt.Sprintf("sensor%d", k),
+				CollectionTime: now - int64(numVersions-v)*int64(time.Hour),
+			})
+		}
+	}
+	records := generateRecordsFromRecordSpecs(recSpecs, rm.avroNumMetricDblFields, rm.avroNumMetricStrFields)
+	deletedKey := fmt.Sprintf("sensor%d", numKeys-1)
+	liveRecSpecs := []RecordSpec{}
+	for i := 10; i < 20; i++ {
+		liveRecSpecs = append(liveRecSpecs, RecordSpec{Id: fmt.Sprintf("sensor%d", i), CollectionTime: now})
+	}
+	liveRecords := generateRecordsFromRecordSpecs(liveRecSpecs, rm.avroNumMetricDblFields, rm.avroNumMetricStrFields)
+
+	testCases := []struct {
+		name           string
+		retainVersions int
+		retainDuration time.Duration
+		expectedPerKey int
+	}{
+		{name: "Latest", expectedPerKey: 1},
+		{name: "RetainVersions", retainVersions: 2, expectedPerKey: 2},
+		{name: "RetainDuration", retainDuration: 150 * time.Minute, expectedPerKey: 2},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			setUpSubTest()
+			trCfg := TRConfig{
+				numPersisters:            2,
+				numDatastoreShards:       2,
+				schema:                   rm.avroSchemaString,
+				outputDirPath:            rm.testDirs[dirData],
+				rotation:                 inmemdatastore.RotationPolicy{MaxRecords: 2},
+				compactionRetainVersions: tc.retainVersions,
+				compactionRetainDuration: tc.retainDuration,
+			}
+			imdsWg := &sync.WaitGroup{}
+			imds := initTestOut(rm.testRunnerCtx, rm.testRunnerCancel, trCfg, imdsWg)
+			assert.NoError(t, imds.Start())
+			for i, recSpec := range recSpecs {
+				_, err := imds.PutSync(context.Background(), recSpec.Id, records[i])
+				assert.NoError(t, err)
+			}
+			assert.NoError(t, imds.Delete(deletedKey, now))
+			rm.testRunnerCancel()
+			imds.Shutdown()
+			imdsWg.Wait()
+
+			// After a restart the writers move on to new files, so all of those written so far are
+			// closed and can be compacted, while more records are Put.
+			rm.refreshContextsWg()
+			imdsWg = &sync.WaitGroup{}
+			imds = initTestOut(rm.testRunnerCtx, rm.testRunnerCancel, trCfg, imdsWg)
+			assert.NoError(t, imds.Start())
+			wg := &sync.WaitGroup{}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i, recSpec := range liveRecSpecs {
+					_, err := imds.PutSync(context.Background(), recSpec.Id, liveRecords[i])
+					assert.NoError(t, err)
+				}
+			}()
+			stats, err := imds.Compact()
+			assert.NoError(t, err)
+			wg.Wait()
+			assert.Less(t, 2, stats.FilesCompacted)
+
+			// Any files that the concurrent Puts have already closed are compacted too, and all of
+			// their records are kept since each has a key of its own.
+			liveKeys := map[string]bool{}
+			for _, recSpec := range liveRecSpecs {
+				liveKeys[recSpec.Id] = true
+			}
+			compacted, _ := loadAvroRecords(stats.Path, false)
+			perKey := map[string][]int64{}
+			numLive := 0
+			for _, record := range compacted {
+				id := record[avroFieldId].(string)
+				if liveKeys[id] {
+					numLive++
+					continue
+				}
+				perKey[id] = append(perKey[id], record[avroFieldCollectionTime].(int64))
+			}
+			assert.Equal(t, int64(len(recSpecs)+numLive), stats.RecordsRead)
+			assert.Equal(t, int64((numKeys-1)*tc.expectedPerKey+numLive), stats.RecordsWritten)
+			assert.Equal(t, numKeys-1, len(perKey))
+			assert.NotContains(t, perKey, deletedKey)
+			for _, timestamps := range perKey {
+				// The most recent versions are kept, in the order in which they were read.
+				expected := []int64{}
+				for v := numVersions - tc.expectedPerKey; v < numVersions; v++ {
+					expected = append(expected, now-int64(numVersions-v)*int64(time.Hour))
+				}
+				sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+				assert.Equal(t, expected, timestamps)
+			}
+
+			// The files closed by the concurrent Puts are compacted along with the previously
+			// compacted file, which is replaced.
+			second, err := imds.Compact()
+			assert.NoError(t, err)
+			assert.NotEqual(t, stats.Path, second.Path)
+			_, err = os.Stat(stats.Path)
+			assert.True(t, os.IsNotExist(err))
+			rm.testRunnerCancel()
+			imds.Shutdown()
+			imdsWg.Wait()
+
+			rm.refreshContextsWg()
+			trCfg.numPersisters = 0
+			imds = initTestOut(rm.testRunnerCtx, rm.testRunnerCancel, trCfg, &sync.WaitGroup{})
+			assert.NoError(t, imds.Start())
+			defer imds.Shutdown()
+			expectedCachedRecSpecs := append([]RecordSpec{}, recSpecs[len(recSpecs)-numKeys:len(recSpecs)-1]...)
+			validateCachedData(t, imds, append(expectedCachedRecSpecs, liveRecSpecs...))
+		})
+	}
+
+	// Only the Avro data files are compacted, so a CompactionInterval is rejected with any other
+	// Writer.
+	t.Run("RequiresAvroFileWriters", func(t *testing.T) {
+		setUpSubTest()
+		writer, err := inmemdatastore.NewJSONLinesFileWriter(
+			rm.testRunnerCtx,
+			rm.testRunnerWg,
+			inmemdatastore.JSONLinesFileWriterConfig{
+				Id:        0,
+				OutputDir: rm.testDirs[dirData],
+			},
+		)
+		assert.NoError(t, err)
+		persistenceChan := make(inmemdatastore.PersistenceChan, 8)
+		persister, err := inmemdatastore.NewPersister(
+			rm.testRunnerCtx,
+			rm.testRunnerWg,
+			inmemdatastore.PersisterConfig{
+				Id:         0,
+				Serializer: inmemdatastore.NewJSONSerializer(),
+				Writer:     writer,
+				InputChan:  persistenceChan,
+			},
+		)
+		assert.NoError(t, err)
+		imds := inmemdatastore.NewInMemDatastore(
+			rm.testRunnerCtx,
+			rm.testRunnerCancel,
+			&sync.WaitGroup{},
+			inmemdatastore.Config{
+				NumDatastoreShards: 2,
+				PersistenceChan:    persistenceChan,
+				RecordTimestampKey: recordTimestampKey,
+				Persisters:         inmemdatastore.Persisters{0: persister},
+				DataDir:            rm.testDirs[dirData],
+				CompactionInterval: time.Hour,
+			},
+		)
+		err = imds.Start()
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "AvroFileWriters")
+		assert.NoError(t, writer.Shutdown())
+	})
+}
+
+// TestRetention tests that the oldest closed data files are removed, or archived, to enforce each
+// of the retention limits, that the most recent file of each writer is kept, and that the IMDS
+// rejects entries for the Persisters when the free space watermark cannot be met.
+func TestRetention(t *testing.T) {
+	utils.SetupLogging("debug")
+	startTimestamp := int64(1647106627392928613)
+	recSpecs := []RecordSpec{}
+	for i := 0; i < 4; i++ {
+		recSpecs = append(recSpecs, RecordSpec{Id: fmt.Sprintf("sensor%d", i), CollectionTime: startTimestamp})
+	}
+	records := generateRecordsFromRecordSpecs(recSpecs, rm.avroNumMetricDblFields, rm.avroNumMetricStrFields)
+	listSegments := func() []inmemdatastore.Segment {
+		segments, err := inmemdatastore.ListSegments(rm.testDirs[dirData], inmemdatastore.AvroFileExtension)
+		assert.NoError(t, err)
+		return segments
+	}
+	// Each record is written to its own data file, the last of which is the most recent file of the
+	// writer, and the IMDS is then restarted without any Persisters so that no more files are
+	// created.
+	writeRecords := func(t *testing.T, trCfg TRConfig) *inmemdatastore.InMemDataStore {
+		imdsWg := &sync.WaitGroup{}
+		imds := initTestOut(rm.testRunnerCtx, rm.testRunnerCancel, trCfg, imdsWg)
+		assert.NoError(t, imds.Start())
+		for i, recSpec := range recSpecs {
+			_, err := imds.PutSync(context.Background(), recSpec.Id, records[i])
+			assert.NoError(t, err)
+		}
+		rm.testRunnerCancel()
+		imds.Shutdown()
+		imdsWg.Wait()
+		assert.Equal(t, len(recSpecs), len(listSegments()))
+
+		rm.refreshContextsWg()
+		trCfg.numPersisters = 0
+		imds = initTestOut(rm.testRunnerCtx, rm.testRunnerCancel, trCfg, &sync.WaitGroup{})
+		assert.NoError(t, imds.Start())
+		return imds
+	}
+	baseCfg := TRConfig{
+		numPersisters:      1,
+		numDatastoreShards: 2,
+		schema:             rm.avroSchemaString,
+		outputDirPath:      rm.testDirs[dirData],
+		rotation:           inmemdatastore.RotationPolicy{MaxRecords: 1},
+	}
+
+	t.Run("MaxAge", func(t *testing.T) {
+		setUpSubTest()
+		trCfg := baseCfg
+		trCfg.retentionMaxAge = time.Hour
+		trCfg.retentionArchiveDirPath = rm.testDirs[dirArchive]
+		// Nothing is old enough to be removed.
+		imds := writeRecords(t, trCfg)
+		defer imds.Shutdown()
+		stats, err := imds.EnforceRetention()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(0), stats.FilesArchived)
+
+		segments := listSegments()
+		old := time.Now().Add(-2 * time.Hour)
+		for _, segment := range segments[:2] {
+			assert.NoError(t, os.Chtimes(segment.Path, old, old))
+		}
+		stats, err = imds.EnforceRetention()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), stats.Runs)
+		assert.Equal(t, int64(2), stats.FilesArchived)
+		assert.Equal(t, int64(0), stats.FilesDeleted)
+		assert.Equal(t, int64(2), stats.RemovedMaxAge)
+		assert.Equal(t, segments[2:], listSegments())
+		for _, segment := range segments[:2] {
+			_, err := os.Stat(filepath.Join(rm.testDirs[dirArchive], filepath.Base(segment.Path)))
+			assert.NoError(t, err)
+		}
+	})
+
+	t.Run("MaxBytes", func(t *testing.T) {
+		setUpSubTest()
+		trCfg := baseCfg
+		// Determine the size of the files that are written, to set the limit one byte below it.
+		imds := writeRecords(t, trCfg)
+		imds.Shutdown()
+		segments := listSegments()
+		var used int64
+		for _, segment := range segments {
+			fi, err := os.Stat(segment.Path)
+			assert.NoError(t, err)
+			used += fi.Size()
+		}
+		first, err := os.Stat(segments[0].Path)
+		assert.NoError(t, err)
+
+		setUpSubTest()
+		trCfg.retentionMaxBytes = used - 1
+		imds = writeRecords(t, trCfg)
+		defer imds.Shutdown()
+		stats, err := imds.EnforceRetention()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), stats.FilesDeleted)
+		assert.Equal(t, int64(1), stats.RemovedMaxBytes)
+		assert.Equal(t, first.Size(), stats.BytesRemoved)
+		assert.Equal(t, used-first.Size(), stats.BytesUsed)
+		assert.Equal(t, segments[1:], listSegments())
+		assert.False(t, stats.Degraded)
+	})
+
+	t.Run("MinFreeBytes", func(t *testing.T) {
+		setUpSubTest()
+		trCfg := baseCfg
+		// A watermark that can never be met.
+		trCfg.retentionMinFreeBytes = math.MaxInt64
+		imds := writeRecords(t, trCfg)
+		defer imds.Shutdown()
+		segments := listSegments()
+		stats, err := imds.EnforceRetention()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(segments)-1), stats.RemovedMinFreeBytes)
+		assert.Less(t, int64(0), stats.FreeBytes)
+		assert.True(t, stats.Degraded)
+		// The most recent file of the writer is kept.
+		assert.Equal(t, segments[len(segments)-1:], listSegments())
+
+		// The writes are rejected without being applied to the datastore.
+		recSpec := RecordSpec{Id: "sensor100", CollectionTime: startTimestamp}
+		record := generateRecordsFromRecordSpecs([]RecordSpec{recSpec}, rm.avroNumMetricDblFields, rm.avroNumMetricStrFields)[0]
+		_, err = imds.Put(recSpec.Id, record)
+		assert.ErrorIs(t, err, inmemdatastore.ErrInsufficientDiskSpace)
+		_, err = imds.PutBatch([]inmemdatastore.KeyedRecord{{Key: recSpec.Id, Record: record}})
+		assert.ErrorIs(t, err, inmemdatastore.ErrInsufficientDiskSpace)
+		assert.ErrorIs(t, imds.Delete(recSpecs[0].Id, startTimestamp+1), inmemdatastore.ErrInsufficientDiskSpace)
+		cached, err := imds.Get(recSpec.Id)
+		assert.NoError(t, err)
+		assert.Nil(t, cached)
+		cached, err = imds.Get(recSpecs[0].Id)
+		assert.NoError(t, err)
+		assert.NotNil(t, cached)
+		assert.Equal(t, int64(3), imds.RetentionStats().Rejected)
+		assert.Equal(t, 0, imds.PersistenceStats().QueueDepth)
+	})
+}
+
+// TestShipper tests that the closed data files are shipped to an S3-compatible object store with
+// multipart uploads, that an upload that fails part way through is resumed, after a restart, from
+// where it left off, and that the data files are kept until they have been shipped.
+func TestShipper(t *testing.T) {
+	utils.SetupLogging("debug")
+	newStore := func(t *testing.T) (*fakeS3, inmemdatastore.ObjectStore) {
+		fake := newFakeS3()
+		store, err := inmemdatastore.NewS3ObjectStore(inmemdatastore.S3Config{
+			Endpoint:        fake.url(),
+			Bucket:          fakeS3Bucket,
+			AccessKeyId:     fakeS3AccessKey,
+			SecretAccessKey: fakeS3SecretKey,
+		})
+		assert.NoError(t, err)
+		return fake, store
+	}
+	startTimestamp := int64(1647106627392928613)
+	recSpecs := []RecordSpec{}
+	for i := 0; i < 200; i++ {
+		recSpecs = append(recSpecs, RecordSpec{Id: fmt.Sprintf("sensor%d", i), CollectionTime: startTimestamp})
+	}
+	records := generateRecordsFromRecordSpecs(recSpecs, rm.avroNumMetricDblFields, rm.avroNumMetricStrFields)
+	partSize := int64(inmemdatastore.MinShipperPartSize)
+	listSegments := func() []inmemdatastore.Segment {
+		segments, err := inmemdatastore.ListSegments(rm.testDirs[dirData], inmemdatastore.AvroFileExtension)
+		assert.NoError(t, err)
+		return segments
+	}
+	// The records are written to data files that are rotated once they are a little larger than
+	// one part, and the IMDS is then restarted without any Persisters, so that all but the last of
+	// the files are closed.
+	writeRecords := func(t *testing.T, trCfg TRConfig) *inmemdatastore.InMemDataStore {
+		imdsWg := &sync.WaitGroup{}
+		imds := initTestOut(rm.testRunnerCtx, rm.testRunnerCancel, trCfg, imdsWg)
+		assert.NoError(t, imds.Start())
+		for i, recSpec := range recSpecs {
+			_, err := imds.PutSync(context.Background(), recSpec.Id, records[i])
+			assert.NoError(t, err)
+		}
+		rm.testRunnerCancel()
+		imds.Shutdown()
+		imdsWg.Wait()
+
+		rm.refreshContextsWg()
+		trCfg.numPersisters = 0
+		imds = initTestOut(rm.testRunnerCtx, rm.testRunnerCancel, trCfg, &sync.WaitGroup{})
+		assert.NoError(t, imds.Start())
+		return imds
+	}
+	readFiles := func(segments []inmemdatastore.Segment) ([][]byte, int64) {
+		retval := [][]byte{}
+		var numParts int64
+		for _, segment := range segments {
+			data, err := os.ReadFile(segment.Path)
+			assert.NoError(t, err)
+			retval = append(retval, data)
+			numParts += (int64(len(data)) + partSize - 1) / partSize
+		}
+		return retval, numParts
+	}
+	baseCfg := TRConfig{
+		numPersisters:      1,
+		numDatastoreShards: 2,
+		schema:             rm.avroSchemaString,
+		outputDirPath:      rm.testDirs[dirData],
+		rotation:           inmemdatastore.RotationPolicy{MaxBytes: partSize + 1<<20},
+		shipperPartSize:    partSize,
+		shipperRetry:       inmemdatastore.RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond},
+	}
+
+	t.Run("MinPartSize", func(t *testing.T) {
+		setUpSubTest()
+		fake, store := newStore(t)
+		defer fake.close()
+		trCfg := baseCfg
+		trCfg.shipperStore = store
+		trCfg.shipperPartSize = partSize - 1
+		imds := initTestOut(rm.testRunnerCtx, rm.testRunnerCancel, trCfg, &sync.WaitGroup{})
+		assert.Error(t, imds.Start())
+		imds.Shutdown()
+	})
+
+	t.Run("Mark", func(t *testing.T) {
+		setUpSubTest()
+		fake, store := newStore(t)
+		defer fake.close()
+		trCfg := baseCfg
+		trCfg.shipperStore = store
+		imds := writeRecords(t, trCfg)
+		defer imds.Shutdown()
+		segments := listSegments()
+		closed := segments[:len(segments)-1]
+		contents, numParts := readFiles(closed)
+		assert.Less(t, 1, len(closed))
+		assert.Less(t, int64(len(closed)), numParts)
+
+		// Nothing is compacted until it has been shipped.
+		compactionStats, err := imds.Compact()
+		assert.NoError(t, err)
+		assert.Equal(t, 0, compactionStats.FilesCompacted)
+
+		stats, err := imds.Ship()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(closed)), stats.SegmentsShipped)
+		assert.Equal(t, numParts, stats.PartsUploaded)
+		assert.Equal(t, 0, stats.Pending)
+		for i, segment := range closed {
+			data, ok := fake.getObject(shipperKeyPrefix + filepath.Base(segment.Path))
+			assert.True(t, ok)
+			assert.Equal(t, contents[i], data)
+		}
+		// The files are marked as shipped, so they are kept but not shipped again.
+		assert.Equal(t, segments, listSegments())
+		stats, err = imds.Ship()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), stats.Runs)
+		assert.Equal(t, int64(len(closed)), stats.SegmentsShipped)
+
+		compactionStats, err = imds.Compact()
+		assert.NoError(t, err)
+		assert.Equal(t, len(closed), compactionStats.FilesCompacted)
+		// The compacted file is not shipped.
+		stats, err = imds.Ship()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(closed)), stats.SegmentsShipped)
+		assert.Equal(t, len(closed), fake.numObjects())
+	})
+
+	t.Run("ResumeAndDelete", func(t *testing.T) {
+		setUpSubTest()
+		fake, store := newStore(t)
+		defer fake.close()
+		trCfg := baseCfg
+		trCfg.shipperStore = store
+		trCfg.shipperPolicy = inmemdatastore.ShipDelete
+		imds := writeRecords(t, trCfg)
+		segments := listSegments()
+		closed := segments[:len(segments)-1]
+		contents, _ := readFiles(closed)
+
+		// Only the first part of the first file is uploaded.
+		fake.setFailPartsAfter(1)
+		stats, err := imds.Ship()
+		assert.Error(t, err)
+		assert.Equal(t, int64(0), stats.SegmentsShipped)
+		assert.Equal(t, int64(1), stats.PartsUploaded)
+		assert.Equal(t, int64(len(closed)), stats.Failures)
+		assert.Equal(t, int64(len(closed)), stats.Retries)
+		assert.Equal(t, len(closed), stats.Pending)
+		assert.Equal(t, segments, listSegments())
+		imds.Shutdown()
+
+		fake.setFailPartsAfter(-1)
+		rm.refreshContextsWg()
+		trCfg.numPersisters = 0
+		imds = initTestOut(rm.testRunnerCtx, rm.testRunnerCancel, trCfg, &sync.WaitGroup{})
+		assert.NoError(t, imds.Start())
+		defer imds.Shutdown()
+		stats, err = imds.Ship()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(closed)), stats.Resumed)
+		assert.Equal(t, int64(len(closed)), stats.SegmentsShipped)
+		for i, segment := range closed {
+			key := shipperKeyPrefix + filepath.Base(segment.Path)
+			data, ok := fake.getObject(key)
+			assert.True(t, ok)
+			assert.Equal(t, contents[i], data)
+			// None of the parts were uploaded twice.
+			assert.Equal(t, int((int64(len(data))+partSize-1)/partSize), fake.getPartsUploaded(key))
+		}
+		// The shipped files have been deleted.
+		assert.Equal(t, segments[len(segments)-1:], listSegments())
+	})
+}
+
 func TestPerformance(t *testing.T) {
 	utils.SetupLogging("info")
 	setUpSubTest()
@@ -187,7 +3018,7 @@ func printStats(tr *TestRunner) {
 	var totalReads int64
 	var totalWrites int64
 	for _, datastore := range tr.imds.GetDatastores() {
-		totalReads += datastore.NumReads
+		totalReads += atomic.LoadInt64(&datastore.NumReads)
 		totalWrites += datastore.NumWrites
 	}
 
@@ -275,3 +3106,53 @@ func checkForKey(t *testing.T, keySet map[string]bool, actualKey string) {
 		delete(keySet, actualKey)
 	}
 }
+
+// BenchmarkAvroFileWriter compares appending each record as its own block to buffering records
+// into larger blocks.
+func BenchmarkAvroFileWriter(b *testing.B) {
+	utils.SetupLogging("warn")
+	recSpec := RecordSpec{Id: "sensor101", CollectionTime: time.Now().UnixNano()}
+	record := &inmemdatastore.SerializedRecord{
+		Key:    recSpec.Id,
+		Record: generateAvroRecord(recSpec, rm.avroNumMetricDblFields, rm.avroNumMetricStrFields),
+	}
+	benchmarks := []struct {
+		name  string
+		block inmemdatastore.BlockPolicy
+	}{
+		{name: "Unbuffered"},
+		{name: "MaxRecords=16", block: inmemdatastore.BlockPolicy{MaxRecords: 16}},
+		{name: "MaxRecords=128", block: inmemdatastore.BlockPolicy{MaxRecords: 128}},
+		{name: "MaxBytes=4MB", block: inmemdatastore.BlockPolicy{MaxBytes: 4 << 20}},
+	}
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			wg := &sync.WaitGroup{}
+			writer, err := inmemdatastore.NewAvroFileWriter(ctx, wg, inmemdatastore.AvroFileWriterConfig{
+				Id:         0,
+				AvroSchema: rm.avroSchemaString,
+				OutputDir:  b.TempDir(),
+				Block:      bm.block,
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				err := writer.Write(record)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			err = writer.Shutdown()
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.StopTimer()
+			cancel()
+			wg.Wait()
+		})
+	}
+}
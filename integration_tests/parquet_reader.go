@@ -0,0 +1,62 @@
+package inttest
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/common"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+// parquetFile is the contents of a Parquet file, read with the column reader of parquet-go.
+type parquetFile struct {
+	// The paths of the leaf columns, joined with ".".
+	columns []string
+	// The values of each column, in the order of the rows, with nil for null values.
+	values    map[string][]interface{}
+	numRows   int64
+	rowGroups []int64
+	keyValues map[string]string
+}
+
+func readParquetFile(path string) (*parquetFile, error) {
+	fh, err := local.NewLocalFileReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	pr, err := reader.NewParquetColumnReader(fh, 1)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read footer; path=%s, err=%w", path, err)
+	}
+	defer pr.ReadStop()
+
+	retval := &parquetFile{
+		values:    map[string][]interface{}{},
+		numRows:   pr.GetNumRows(),
+		keyValues: map[string]string{},
+	}
+	for _, kv := range pr.Footer.KeyValueMetadata {
+		retval.keyValues[kv.Key] = kv.GetValue()
+	}
+	for _, rowGroup := range pr.Footer.RowGroups {
+		retval.rowGroups = append(retval.rowGroups, rowGroup.NumRows)
+	}
+	for _, inPath := range pr.SchemaHandler.ValueColumns {
+		// The reader uses the names of the columns as Go identifiers, so the columns are named with
+		// the names from the file, without the root.
+		exPath := common.StrToPath(pr.SchemaHandler.InPathToExPath[inPath])[1:]
+		name := strings.Join(exPath, ".")
+		retval.columns = append(retval.columns, name)
+		if retval.numRows == 0 {
+			continue
+		}
+		values, _, _, err := pr.ReadColumnByPath(inPath, retval.numRows)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read column; path=%s, column=%s, err=%w", path, name, err)
+		}
+		retval.values[name] = values
+	}
+	return retval, nil
+}
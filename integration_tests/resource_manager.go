@@ -64,6 +64,14 @@ func NewResourceManager(testParentDir string) *ResourceManager {
 	// directory.
 	testDirs := map[string]string{}
 	testDirs[dirData] = filepath.Join(testParentDir, dirData)
+	testDirs[dirDeadLetters] = filepath.Join(testParentDir, dirDeadLetters)
+	testDirs[dirOverflow] = filepath.Join(testParentDir, dirOverflow)
+	testDirs[dirJSONLines] = filepath.Join(testParentDir, dirJSONLines)
+	testDirs[dirParquet] = filepath.Join(testParentDir, dirParquet)
+	testDirs[dirCSV] = filepath.Join(testParentDir, dirCSV)
+	testDirs[dirWAL] = filepath.Join(testParentDir, dirWAL)
+	testDirs[dirSnapshots] = filepath.Join(testParentDir, dirSnapshots)
+	testDirs[dirArchive] = filepath.Join(testParentDir, dirArchive)
 	retval.testDataDirPath = testDirs[dirData]
 	retval.testDirs = testDirs
 
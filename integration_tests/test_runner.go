@@ -42,10 +42,63 @@ type TRConfig struct {
 	numTestReaders int
 	// The amount of time in milliseconds that the Readers will sleep between reads.
 	testReaderSleepTime int64
+	// Whether the IMDS persisters encode the records with an AvroSerializer, rather than passing
+	// them to the writers to be encoded.
+	avroSerializer bool
+	// If set, the IMDS persisters encode the records with this Serializer and write them with a
+	// RawFileWriter, instead of an AvroFileWriter.
+	rawSerializer inmemdatastore.Serializer
+	// Passed to the IMDS to decode the records in the raw files when it starts.
+	deserializers []inmemdatastore.Deserializer
+	// If set, the key from which the IMDS reads the timestamps of the records, instead of
+	// recordTimestampKey, and the ConflictResolver that it uses instead of the default.
+	recordTimestampKey string
+	resolver           inmemdatastore.ConflictResolver
 	// The avro schema, in "raw" string form that we will pass to the IMDS.
 	schema string
 	// The directory into which we will tell the IMDS to write its data files
 	outputDirPath string
+	// The policy that the IMDS writers will use to rotate their data files.
+	rotation inmemdatastore.RotationPolicy
+	// How many records the IMDS writers buffer into each block.
+	block inmemdatastore.BlockPolicy
+	// The codec, and for deflate the level, with which the IMDS writers compress their data files.
+	compression      inmemdatastore.Compression
+	compressionLevel int
+	// What the IMDS persisters do with records that they fail to persist.
+	failurePolicy inmemdatastore.FailurePolicy
+	retry         inmemdatastore.RetryPolicy
+	// The channel on which the IMDS reports persister failures.
+	errorChan inmemdatastore.PersisterErrorChan
+	// If set, the IMDS persisters also write the records, as JSON Lines, to this directory.
+	jsonLinesDirPath string
+	jsonLinesGzip    bool
+	// If set, the IMDS persisters also write the records, as CSV, to this directory.
+	csvDirPath string
+	// If set, the directory into which the IMDS persisters write their dead letters.
+	deadLetterDirPath string
+	// If set, the directory in which the IMDS keeps its write-ahead log, and how it is synced and
+	// checkpointed.
+	walDirPath            string
+	walSyncPolicy         inmemdatastore.WALSyncPolicy
+	walCheckpointInterval time.Duration
+	// If set, the directory into which the IMDS writes its snapshots, and how many it keeps.
+	snapshotDirPath string
+	snapshotRetain  int
+	// What the IMDS keeps when it compacts its data files.
+	compactionRetainVersions int
+	compactionRetainDuration time.Duration
+	// The retention limits on the data dir, and the directory to which the removed files are
+	// archived.
+	retentionMaxBytes       int64
+	retentionMaxAge         time.Duration
+	retentionMinFreeBytes   int64
+	retentionArchiveDirPath string
+	// If set, the object store to which the IMDS ships its data files, and how.
+	shipperStore    inmemdatastore.ObjectStore
+	shipperPartSize int64
+	shipperPolicy   inmemdatastore.ShipPolicy
+	shipperRetry    inmemdatastore.RetryPolicy
 	// The keys that we expect to be written to the datastore.  We will provide these to all of the
 	// readers so that they can randomly query the datastore for records.
 	keySpace []string
@@ -87,7 +140,10 @@ func NewTestRunner(ctx context.Context, cancel context.CancelFunc, wg *sync.Wait
 
 func (tr *TestRunner) RunTest() {
 	tr.StartTime = time.Now().UTC().Unix()
-	tr.imds.Start()
+	err := tr.imds.Start()
+	if err != nil {
+		panic(err)
+	}
 	tr.startReaders()
 	switch tr.cfg.mode {
 	case SpecificRecords:
@@ -172,27 +228,130 @@ func initTestOut(ctx context.Context, cancel context.CancelFunc, cfg TRConfig, i
 
 	for i := 0; i < cfg.numPersisters; i++ {
 		serializer := inmemdatastore.NewNoopSerializer()
-		avroWriterCfg := inmemdatastore.AvroFileWriterConfig{
-			Id:         i,
-			AvroSchema: cfg.schema,
-			OutputDir:  cfg.outputDirPath,
+		if cfg.avroSerializer {
+			var err error
+			serializer, err = inmemdatastore.NewAvroSerializer(cfg.schema)
+			if err != nil {
+				panic(err)
+			}
+		}
+		var primaryWriter inmemdatastore.Writer
+		if cfg.rawSerializer != nil {
+			serializer = cfg.rawSerializer
+			rawFileWriter, err := inmemdatastore.NewRawFileWriter(
+				ctx,
+				imdsWg,
+				inmemdatastore.RawFileWriterConfig{Id: i, OutputDir: cfg.outputDirPath, Rotation: cfg.rotation},
+			)
+			if err != nil {
+				panic(err)
+			}
+			primaryWriter = rawFileWriter
+		} else {
+			avroWriterCfg := inmemdatastore.AvroFileWriterConfig{
+				Id:               i,
+				AvroSchema:       cfg.schema,
+				OutputDir:        cfg.outputDirPath,
+				Rotation:         cfg.rotation,
+				Block:            cfg.block,
+				Compression:      cfg.compression,
+				CompressionLevel: cfg.compressionLevel,
+			}
+			avroFileWriter, err := inmemdatastore.NewAvroFileWriter(ctx, imdsWg, avroWriterCfg)
+			if err != nil {
+				panic(err)
+			}
+			primaryWriter = avroFileWriter
+		}
+		writers := []inmemdatastore.Writer{primaryWriter}
+		if cfg.jsonLinesDirPath != "" {
+			jsonLinesWriter, err := inmemdatastore.NewJSONLinesFileWriter(
+				ctx,
+				imdsWg,
+				inmemdatastore.JSONLinesFileWriterConfig{Id: i, OutputDir: cfg.jsonLinesDirPath, Gzip: cfg.jsonLinesGzip},
+			)
+			if err != nil {
+				panic(err)
+			}
+			writers = append(writers, jsonLinesWriter)
+		}
+		if cfg.csvDirPath != "" {
+			csvWriter, err := inmemdatastore.NewCSVFileWriter(
+				ctx,
+				imdsWg,
+				inmemdatastore.CSVFileWriterConfig{Id: i, AvroSchema: cfg.schema, OutputDir: cfg.csvDirPath},
+			)
+			if err != nil {
+				panic(err)
+			}
+			writers = append(writers, csvWriter)
+		}
+		writer := primaryWriter
+		if len(writers) > 1 {
+			writer = inmemdatastore.NewMultiWriter(writers...)
+		}
+		var deadLetterWriter inmemdatastore.DeadLetterWriter
+		if cfg.deadLetterDirPath != "" {
+			var err error
+			deadLetterWriter, err = inmemdatastore.NewJSONLinesDeadLetterWriter(
+				inmemdatastore.JSONLinesDeadLetterWriterConfig{Id: i, OutputDir: cfg.deadLetterDirPath},
+			)
+			if err != nil {
+				panic(err)
+			}
 		}
-		avroFileWriter := inmemdatastore.NewAvroFileWriter(ctx, imdsWg, avroWriterCfg)
 		persisterConfig := inmemdatastore.PersisterConfig{
-			Id:         i,
-			Serializer: serializer,
-			Writer:     avroFileWriter,
-			InputChan:  persistenceChan,
+			Id:               i,
+			Serializer:       serializer,
+			Writer:           writer,
+			InputChan:        persistenceChan,
+			FailurePolicy:    cfg.failurePolicy,
+			Retry:            cfg.retry,
+			DeadLetterWriter: deadLetterWriter,
+		}
+		persister, err := inmemdatastore.NewPersister(ctx, imdsWg, persisterConfig)
+		if err != nil {
+			panic(err)
 		}
-		persister := inmemdatastore.NewPersister(ctx, imdsWg, persisterConfig)
 		persisters[i] = persister
 	}
 
+	timestampKey := recordTimestampKey
+	if cfg.recordTimestampKey != "" {
+		timestampKey = cfg.recordTimestampKey
+	}
 	imdsCfg := inmemdatastore.Config{
-		NumDatastoreShards: cfg.numDatastoreShards,
-		PersistenceChan:    persistenceChan,
-		RecordTimestampKey: recordTimestampKey,
-		Persisters:         persisters,
+		NumDatastoreShards:    cfg.numDatastoreShards,
+		PersistenceChan:       persistenceChan,
+		RecordTimestampKey:    timestampKey,
+		ConflictResolver:      cfg.resolver,
+		RecordIdKey:           recordIdKey,
+		DataDir:               cfg.outputDirPath,
+		Deserializers:         cfg.deserializers,
+		Persisters:            persisters,
+		ErrorChan:             cfg.errorChan,
+		WALDir:                cfg.walDirPath,
+		WALSyncPolicy:         cfg.walSyncPolicy,
+		WALCheckpointInterval: cfg.walCheckpointInterval,
+		SnapshotDir:           cfg.snapshotDirPath,
+		// The tests write the snapshots that they need with WriteSnapshot.
+		SnapshotInterval:         time.Hour,
+		SnapshotRetain:           cfg.snapshotRetain,
+		CompactionRetainVersions: cfg.compactionRetainVersions,
+		CompactionRetainDuration: cfg.compactionRetainDuration,
+		// The tests enforce the retention limits with EnforceRetention.
+		RetentionInterval:     time.Hour,
+		RetentionMaxBytes:     cfg.retentionMaxBytes,
+		RetentionMaxAge:       cfg.retentionMaxAge,
+		RetentionMinFreeBytes: cfg.retentionMinFreeBytes,
+		RetentionArchiveDir:   cfg.retentionArchiveDirPath,
+		ShipperStore:          cfg.shipperStore,
+		// The tests ship the data files with Ship.
+		ShipperInterval:  time.Hour,
+		ShipperKeyPrefix: shipperKeyPrefix,
+		ShipperPartSize:  cfg.shipperPartSize,
+		ShipperPolicy:    cfg.shipperPolicy,
+		ShipperRetry:     cfg.shipperRetry,
 	}
 	log.Info(imdsCfg)
 	return inmemdatastore.NewInMemDatastore(ctx, cancel, imdsWg, imdsCfg)
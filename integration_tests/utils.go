@@ -11,7 +11,7 @@ import (
 	"strconv"
 	"strings"
 
-	"github.com/linkedin/goavro"
+	"github.com/linkedin/goavro/v2"
 	log "github.com/rchapin/rlog"
 )
 
@@ -116,6 +116,10 @@ func loadAllAvroRecords(path string, justCounts bool) ([]map[string]interface{},
 	data := []map[string]interface{}{}
 	var count int64
 	for _, file := range files {
+		// Only load the data files and not any of the tombstone files.
+		if filepath.Ext(file.Name()) != ".avro" {
+			continue
+		}
 		recs, curCount := loadAvroRecords(filepath.Join(path, file.Name()), justCounts)
 		count += curCount
 		if !justCounts {